@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"os"
+	"strings"
+)
+
+// passphraseEnv is the environment variable for the backup passphrase.
+// If not set, the passphrase is read from stdin.
+const passphraseEnv = "COCONUT_BACKUP_PASSPHRASE"
+
+// backup handles "backup <file>" command
+func backup(cli *client.Client, confPath string, args []string) (err error) {
+	if len(args) != 1 {
+		return errors.New("usage: backup <file>")
+	}
+	passphrase, err := readPassphrase(true)
+	if err != nil {
+		return err
+	}
+	if err = cli.CreateBackup(args[0], confPath, passphrase); err != nil {
+		return err
+	}
+	fmt.Println("Backup written to", args[0])
+	return nil
+}
+
+// restore handles "restore [-force] <file>" command
+func restore(conf *configFile, args []string) (err error) {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := flags.Bool("force", false, "Replace existing identity. Existing keys are archived.")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [-force] <file>")
+	}
+	passphrase, err := readPassphrase(false)
+	if err != nil {
+		return err
+	}
+	cli, err := client.RestoreBackup(flags.Arg(0), conf.path, conf.defaults, passphrase, *force)
+	if err == client.IdentityExistsError {
+		return errors.New("identity already exists, use -force to replace it")
+	} else if err != nil {
+		return err
+	}
+	fmt.Println("Restored identity:", cli.Fingerprint())
+	return nil
+}
+
+// readPassphrase returns the passphrase from passphraseEnv, or reads it from stdin.
+// If confirm is true, the passphrase is read twice.
+func readPassphrase(confirm bool) (passphrase []byte, err error) {
+	if env, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(env), nil
+	}
+	reader := bufio.NewReader(os.Stdin)
+	readLine := func(prompt string) ([]byte, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	if passphrase, err = readLine("Passphrase: "); err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := readLine("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"gopkg.in/yaml.v3"
+)
+
+// configCommand handles "config check" and "config show [--effective]" commands for conf
+func configCommand(conf *configFile, out *output, args []string) (err error) {
+	const usage = "config check | config show [--effective]"
+	if len(args) == 0 {
+		return usageError(usage)
+	}
+	switch args[0] {
+	case "check":
+		if len(args) != 1 {
+			return usageError(usage)
+		}
+		return configCheck(conf, out)
+	case "show":
+		flags := flag.NewFlagSet("config show", flag.ContinueOnError)
+		effective := flags.Bool("effective", false, "Apply environment variables and flags, and show sources")
+		if err = flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+			return usageError(usage)
+		}
+		return configShow(conf, *effective, out)
+	default:
+		return usageError(usage)
+	}
+}
+
+// configCheck validates the config with environment variables and flags, and prints every problem
+func configCheck(conf *configFile, out *output) (err error) {
+	_, _, err = conf.load(true)
+	var configErr *client.ConfigError
+	if err != nil && !errors.As(err, &configErr) {
+		return err
+	}
+	problems := make([]string, 0)
+	if configErr != nil {
+		problems = configErr.Problems
+	}
+	out.print(&struct {
+		File     string   `json:"file"`
+		Valid    bool     `json:"valid"`
+		Problems []string `json:"problems"`
+	}{conf.path, err == nil, problems}, func() {
+		if err == nil {
+			fmt.Println(conf.path + ": config is valid")
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+	})
+	if err != nil {
+		return &commandError{code: exitConfig, err: errors.New("config is invalid")}
+	}
+	return nil
+}
+
+// configShow prints settings from defaults and the config file. With effective, environment
+// variables and flags are applied, and the source of each setting is printed.
+func configShow(conf *configFile, effective bool, out *output) (err error) {
+	config, sources, err := conf.load(effective)
+	if err != nil {
+		return err
+	}
+	settings := config.EffectiveSettings(sources)
+	if !effective {
+		out.print(settings, func() {
+			b, err := yaml.Marshal(config)
+			if err != nil {
+				log.Debug(err)
+				log.Error("Error while encoding config")
+				return
+			}
+			fmt.Print(string(b))
+		})
+		return nil
+	}
+	out.print(settings, func() {
+		for _, setting := range settings {
+			fmt.Printf("%s=%s\t# %s\n", setting.Key, setting.Value, setting.Source)
+		}
+	})
+	return nil
+}
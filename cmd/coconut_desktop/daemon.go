@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runDaemon keeps cli connected to the relay server and serves API on cli.SocketPath until
+// the process is interrupted or terminated. Changes of conf are applied.
+func runDaemon(cli *client.Client, conf *configFile) (err error) {
+	if err = loadClient(cli); err != nil {
+		return err
+	}
+	listener, err := daemon.Listen(cli.SocketPath)
+	if err != nil {
+		return err
+	}
+	local := daemon.NewLocal(cli)
+	server, err := daemon.NewServer(local)
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	if err = local.Connect(); err != nil {
+		log.Warning("Could not connect to the server, retrying on next request: ", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("Stopping daemon")
+		if err := server.Close(); err != nil {
+			log.Debug(err)
+		}
+	}()
+
+	watcher := watchConfig(local, conf, cli.Log, cli.DataPath)
+	defer watcher.Close()
+
+	log.Info("Daemon listening on ", cli.SocketPath)
+	if err = server.Serve(listener); err != nil {
+		return err
+	}
+	return local.Close()
+}
+
+// runCommand runs the headless command with name using the daemon if it is running, or cli
+// otherwise
+func runCommand(cli *client.Client, out *output, name string, args []string) (err error) {
+	command, ok := headlessCommands[name]
+	if !ok {
+		return usageError("unknown command " + name)
+	}
+	api, err := openAPI(cli)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := api.Close(); err != nil {
+			log.Debug(err)
+			log.Warning("Error while closing connection")
+		}
+	}()
+	return command(api, out, args)
+}
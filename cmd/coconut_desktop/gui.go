@@ -0,0 +1,43 @@
+//go:build !nogui
+// +build !nogui
+
+package main
+
+import (
+	"flag"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/app"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/gui"
+	"os"
+	"os/exec"
+)
+
+// startGUI starts the GTK interface for profile. Blocks until the interface is closed.
+func startGUI(api daemon.API, profile string) (err error) {
+	names, err := client.ListProfiles()
+	if err != nil {
+		return err
+	}
+	gui.Start("./data/ui/UI.glade", api, app.Profiles{Current: profile, Names: names, Switch: startProfile})
+	//gui.Start(string(uiString))
+	return nil
+}
+
+// startProfile starts this program with the GUI of the profile with name. Flags other than
+// -profile and -config-path are passed on.
+func startProfile(name string) (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"-profile", name}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "profile" && f.Name != "config-path" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Start()
+}
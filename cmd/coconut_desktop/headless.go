@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of headless commands
+const (
+	exitOK = iota
+	// exitError indicates a general error
+	exitError
+	// exitUsage indicates invalid arguments
+	exitUsage
+	// exitConnection indicates that the relay server could not be reached
+	exitConnection
+	// exitNotFound indicates that a contact could not be found
+	exitNotFound
+	// exitPartial indicates that some, but not all, operations failed
+	exitPartial
+	// exitTimeout indicates that the command timed out
+	exitTimeout
+	// exitConfig indicates that the config is invalid
+	exitConfig
+)
+
+// commandError is an error with the exit code of the command
+type commandError struct {
+	code int
+	err  error
+}
+
+func (e *commandError) Error() string { return e.err.Error() }
+
+func (e *commandError) Unwrap() error { return e.err }
+
+// usageError returns an error with exitUsage
+func usageError(usage string) error {
+	return &commandError{code: exitUsage, err: errors.New("usage: " + usage)}
+}
+
+// exitCode returns the exit code for err
+func exitCode(err error) int {
+	var cmdErr *commandError
+	var configErr *client.ConfigError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &cmdErr):
+		return cmdErr.code
+	case errors.As(err, &configErr):
+		return exitConfig
+	case errors.Is(err, daemon.ConnectError):
+		return exitConnection
+	case errors.Is(err, client.ContactNotFoundError), errors.Is(err, client.TransferNotFoundError):
+		return exitNotFound
+	default:
+		return exitError
+	}
+}
+
+// output writes command results to stdout as text or JSON
+type output struct {
+	json bool
+}
+
+// print writes v as a single line of JSON, or calls text if JSON output is not enabled
+func (o *output) print(v interface{}, text func()) {
+	if !o.json {
+		text()
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while encoding output")
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// errorString returns the message of err, or an empty string if err is nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// headlessCommands maps subcommands to handlers. Handlers do not use the GUI.
+var headlessCommands = map[string]func(api daemon.API, out *output, args []string) error{
+	"send":     send,
+	"receive":  receive,
+	"contacts": contacts,
+	"addcode":  addCode,
+	"status":   status,
+	"history":  history,
+}
+
+// loadClient reads keys, contacts, groups, key handovers and transfer history of cli
+func loadClient(cli *client.Client) (err error) {
+	if err = cli.LoadKeys(); err != nil {
+		return err
+	}
+	if err = cli.ReadContactsFile(); err != nil {
+		return err
+	}
+	if err = cli.ReadGroupsFile(); err != nil {
+		return err
+	}
+	if err = cli.ReadHandoversFile(); err != nil {
+		return err
+	}
+	return cli.ReadHistoryFile()
+}
+
+// openAPI returns API of the daemon if it is running, otherwise API that uses cli directly.
+// Returns an error if the daemon at cli.SocketPath belongs to another profile.
+func openAPI(cli *client.Client) (api daemon.API, err error) {
+	if conn, err := daemon.Dial(cli.SocketPath); err == nil {
+		// Daemon of another profile is never used, so that profiles do not share keys or contacts
+		status, err := conn.Status()
+		if err == nil && status.Profile == cli.Profile {
+			log.Debug("Using daemon at ", cli.SocketPath)
+			return conn, nil
+		}
+		_ = conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("daemon at %s belongs to profile %q", cli.SocketPath, status.Profile)
+	}
+	if err = loadClient(cli); err != nil {
+		return nil, err
+	}
+	return daemon.NewLocal(cli), nil
+}
+
+// waitContext returns a context that is done after timeout, or when the process is interrupted.
+// If timeout is 0, the context is done only when the process is interrupted.
+func waitContext(timeout time.Duration) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	if timeout == 0 {
+		return ctx, stop
+	}
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancelTimeout()
+		stop()
+	}
+}
+
+// sendOutput is the result of sending a file
+type sendOutput struct {
+	File    string          `json:"file"`
+	Contact *daemon.Contact `json:"contact"`
+	Sent    bool            `json:"sent"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// findContact returns the contact with fingerprint
+// Returns client.ContactNotFoundError if the contact does not exist
+func findContact(api daemon.API, fingerprint string) (contact *daemon.Contact, err error) {
+	contacts, err := api.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	for _, contact := range contacts {
+		if strings.EqualFold(contact.Fingerprint, fingerprint) {
+			return contact, nil
+		}
+	}
+	return nil, client.ContactNotFoundError
+}
+
+// send handles "send <fingerprint> <file>..." command
+func send(api daemon.API, out *output, args []string) (err error) {
+	if len(args) < 2 {
+		return usageError("send <fingerprint> <file>...")
+	}
+	contact, err := findContact(api, args[0])
+	if err != nil {
+		return err
+	}
+	if err = api.Connect(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, fileName := range args[1:] {
+		err := api.SendFile(contact.Fingerprint, fileName)
+		if errors.Is(err, daemon.ConnectError) {
+			return err
+		} else if err != nil {
+			failed++
+		}
+		out.print(&sendOutput{File: fileName, Contact: contact, Sent: err == nil, Error: errorString(err)},
+			func() {
+				if err != nil {
+					fmt.Printf("failed\t%s\t%v\n", fileName, err)
+				} else {
+					fmt.Printf("sent\t%s\n", fileName)
+				}
+			})
+	}
+	switch failed {
+	case 0:
+		return nil
+	case len(args) - 1:
+		return errors.New("no file was sent")
+	default:
+		return &commandError{code: exitPartial, err: fmt.Errorf("%d file(s) not sent", failed)}
+	}
+}
+
+// receive handles "receive [-count n] [-timeout duration]" command
+func receive(api daemon.API, out *output, args []string) (err error) {
+	flags := flag.NewFlagSet("receive", flag.ContinueOnError)
+	count := flags.Int("count", 1, "Number of files to receive before exiting. 0 to receive until interrupted.")
+	timeout := flags.Duration("timeout", 0, "Maximum time to wait. 0 to wait until interrupted.")
+	if err = flags.Parse(args); err != nil || flags.NArg() != 0 || *count < 0 {
+		return usageError("receive [-count n] [-timeout duration]")
+	}
+	// Files received by the daemon before this command started are not reported
+	stat, err := api.Status()
+	if err != nil {
+		return err
+	}
+	if err = api.Connect(); err != nil {
+		return err
+	}
+
+	ctx, cancel := waitContext(*timeout)
+	defer cancel()
+	after := stat.LastReceivedID
+	received, failed := 0, 0
+	for *count == 0 || received+failed < *count {
+		type result struct {
+			files []*daemon.ReceivedFile
+			err   error
+		}
+		results := make(chan result, 1)
+		go func() {
+			files, err := api.Receive(after, time.Second)
+			results <- result{files: files, err: err}
+		}()
+
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			if *count != 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return &commandError{code: exitTimeout, err: errors.New("timed out while waiting for files")}
+			}
+			return nil
+		}
+		if res.err != nil {
+			return res.err
+		}
+		for _, file := range res.files {
+			after = file.ID
+			if file.Error != "" {
+				failed++
+			} else {
+				received++
+			}
+			out.print(file, func() {
+				if file.Error != "" {
+					fmt.Printf("failed\t%s\n", file.Error)
+				} else {
+					fmt.Printf("received\t%s\t%s\n", file.FileName, file.Sender.Fingerprint)
+				}
+			})
+			if *count != 0 && received+failed == *count {
+				break
+			}
+		}
+	}
+	if failed != 0 {
+		return &commandError{code: exitPartial, err: fmt.Errorf("%d file(s) not received", failed)}
+	}
+	return nil
+}
+
+// contacts handles "contacts list|add|remove" commands
+func contacts(api daemon.API, out *output, args []string) (err error) {
+	const usage = "contacts list | contacts add <add-code> <first-name> [last-name] | contacts remove <fingerprint>"
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		list, err := api.Contacts()
+		if err != nil {
+			return err
+		}
+		out.print(list, func() {
+			for _, contact := range list {
+				fmt.Printf("%s\t%s\t%s\t%t\n", contact.Fingerprint, contact.FirstName, contact.LastName,
+					contact.Verified)
+			}
+		})
+		return nil
+	case (len(args) == 3 || len(args) == 4) && args[0] == "add":
+		lastName := ""
+		if len(args) == 4 {
+			lastName = args[3]
+		}
+		contact, added, err := api.AddContact(strings.ToUpper(args[1]), args[2], lastName)
+		if err != nil {
+			return err
+		}
+		out.print(&struct {
+			*daemon.Contact
+			Added bool `json:"added"`
+		}{contact, added}, func() {
+			fmt.Println(contact.Fingerprint)
+		})
+		return nil
+	case len(args) == 2 && args[0] == "remove":
+		contact, err := api.RemoveContact(args[1])
+		if err != nil {
+			return err
+		}
+		out.print(contact, func() {
+			fmt.Println(contact.Fingerprint)
+		})
+		return nil
+	default:
+		return usageError(usage)
+	}
+}
+
+// addCode handles "addcode get [-wait duration]" and "addcode remove <add-code>" commands.
+// Without the daemon, the Add Code is only valid while this process is connected, so
+// "addcode get" stays connected until wait elapses or the process is interrupted, then
+// removes the Add Code.
+func addCode(api daemon.API, out *output, args []string) (err error) {
+	const usage = "addcode get [-wait duration] | addcode remove <add-code>"
+	if len(args) == 2 && args[0] == "remove" {
+		return api.RemoveAddCode(strings.ToUpper(args[1]))
+	}
+	if len(args) == 0 || args[0] != "get" {
+		return usageError(usage)
+	}
+	flags := flag.NewFlagSet("addcode get", flag.ContinueOnError)
+	wait := flags.Duration("wait", 0, "Time to keep the Add Code. 0 to keep it until interrupted.")
+	if err = flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+		return usageError(usage)
+	}
+
+	code, err := api.GetAddCode()
+	if err != nil {
+		return err
+	}
+	out.print(&struct {
+		AddCode string `json:"add_code"`
+	}{code}, func() {
+		fmt.Println(code)
+	})
+
+	ctx, cancel := waitContext(*wait)
+	defer cancel()
+	<-ctx.Done()
+	return api.RemoveAddCode(code)
+}
+
+// status handles "status" command. Exits with exitConnection if the server is not reachable.
+func status(api daemon.API, out *output, args []string) (err error) {
+	if len(args) != 0 {
+		return usageError("status")
+	}
+	connErr := api.Connect()
+	stat, err := api.Status()
+	if err != nil {
+		return err
+	}
+	out.print(&struct {
+		*daemon.Status
+		Error string `json:"error,omitempty"`
+	}{stat, errorString(connErr)}, func() {
+		fmt.Println("Profile:", stat.Profile)
+		fmt.Println("Fingerprint:", stat.Fingerprint)
+		fmt.Println("Server:", stat.Server)
+		fmt.Println("Daemon:", stat.Daemon)
+		fmt.Println("Connected:", stat.Connected)
+		if stat.Connected {
+			fmt.Println("Protocol version:", stat.ProtocolVersion)
+			fmt.Println("Features:", stat.Features)
+		}
+		fmt.Println("Contacts:", stat.Contacts)
+		fmt.Println("Pending key handover:", stat.PendingHandover)
+	})
+	return connErr
+}
+
+// history handles "history [list] [-n count] [-peer fingerprint]" and "history resend <id>" commands
+func history(api daemon.API, out *output, args []string) (err error) {
+	const usage = "history [list] [-n count] [-peer fingerprint] | history resend <id>"
+	if len(args) == 2 && args[0] == "resend" {
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return usageError(usage)
+		}
+		return api.Resend(id)
+	}
+	if len(args) != 0 && args[0] == "list" {
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	count := flags.Int("n", 0, "Number of transfers to show, newest first. 0 to show every transfer.")
+	peer := flags.String("peer", "", "Show only transfers with the contact with fingerprint")
+	if err = flags.Parse(args); err != nil || flags.NArg() != 0 || *count < 0 {
+		return usageError(usage)
+	}
+
+	limit := *count
+	if *peer != "" {
+		// Transfers are filtered after they are returned
+		limit = 0
+	}
+	transfers, err := api.History(limit)
+	if err != nil {
+		return err
+	}
+	list := make([]*daemon.Transfer, 0, len(transfers))
+	for _, transfer := range transfers {
+		if *count != 0 && len(list) == *count {
+			break
+		}
+		if *peer == "" || strings.EqualFold(transfer.Peer, *peer) {
+			list = append(list, transfer)
+		}
+	}
+	out.print(list, func() {
+		for _, transfer := range list {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", transfer.ID,
+				transfer.Time.Format(time.RFC3339), transfer.Direction, transfer.Result, transfer.Peer,
+				transfer.Size, transfer.Duration.Round(time.Millisecond), transfer.FileName, transfer.Error)
+		}
+	})
+	return nil
+}
@@ -3,84 +3,248 @@ package main
 import (
 	//_ "embed"
 	"flag"
+	"fmt"
 	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
-	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
 )
 
 //var uiString []byte
 
 func main() {
-	// Command line arguments (flags) overrides configuration file, if exist
+	// Command line arguments (flags) override environment variables and configuration file, if exist
 
 	// Double dash arguments (e.g. --config-path) is not possible with "flag" package it seems like. Consider
 	// Using "getopt" package.
-	confPath := flag.String("config-path", "./config/config.yml", "Configuration file path")
-	logLevelArg := flag.String("log-level", "warning", "Logging level")
-
-	serverHostFlag := flag.String("host", "", "Server address")
-	serverPortFlag := flag.Int("port", 0, "Server port")
-	localPortFlag := flag.Int("local-port", 0, "Local port")
-	keyPathFlag := flag.String("cert-path", "", "Key pair path")
-	dataPathFlag := flag.String("data-path", "", "Data path")
+	confPath := flag.String("config-path", "", "Configuration file path (default: config.yml in the config directory of the profile)")
+	profile := flag.String("profile", "", "Profile with its own keys, contacts, config and downloads (default \"default\")")
+	rotateKeysFlag := flag.Bool("rotate-keys", false, "Replace key pair and announce new public key to contacts")
+	jsonFlag := flag.Bool("json", false, "Print command output as JSON")
+	migrateFrom := flag.String("migrate-from", "", "Directory with config, keys and contacts of an earlier version to move to default locations (default: directory of the executable)")
+	// Flags for each setting, such as -host and -log-level
+	settingFlags := client.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	// Setup logger
-	var logLevel log.LoggingMode
-	switch *logLevelArg {
-	case "debug":
-		logLevel = log.DEBUG
-	case "info":
-		logLevel = log.INFO
-	case "warning":
-		logLevel = log.WARNING
-	case "error":
-		logLevel = log.ERROR
-	case "fatal":
-		logLevel = log.FATAL
-	default:
-		logLevel = log.WARNING
+	// Standard output is reserved for command output. Logger is set up again after reading config.
+	log.Init(os.Stderr, log.WARNING)
+	out := &output{json: *jsonFlag}
+
+	paths, err := client.ProfilePaths(*profile)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(exitUsage)
+	}
+	defaults, _ := client.ProfileConfig(*profile)
+	conf := &configFile{path: *confPath, defaults: defaults, flagValues: settingFlags}
+	if conf.path == "" {
+		conf.path = paths.Config
+		// Identity created next to the executable by earlier versions is moved once to default
+		// locations. Other directories are only used if set explicitly.
+		legacyDir := *migrateFrom
+		if legacyDir == "" {
+			legacyDir = executableDir()
+		}
+		if defaults.Profile == client.DefaultProfile && flag.Arg(0) != "restore" && legacyDir != "" {
+			if migrated, err := client.MigrateLegacyPaths(legacyDir, conf.path); err != nil {
+				log.Warning("Could not migrate files of earlier version: ", err)
+			} else if migrated {
+				log.Warning("Moved config, keys and contacts to default locations. Config: ", conf.path)
+			}
+		}
 	}
-	log.Init(os.Stdout, logLevel)
 
-	var cli *client.Client
-	var err error
+	switch flag.Arg(0) {
+	case "restore":
+		// Restore does not require existing config
+		if err := restore(conf, flag.Args()[1:]); err != nil {
+			log.Fatal("Could not restore backup: ", err)
+			os.Exit(1)
+		}
+		return
+	case "config":
+		// Invalid config is reported by the command
+		if err := configCommand(conf, out, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
 
 	// Read configurations
-	if cli, err = client.ReadConfig(*confPath); err != nil {
-		log.Warning("Could not read config, trying default config")
-		cli = client.InitConfig()
-		if err := util.WriteConfig(*confPath, cli); err != nil {
-			log.Debug(err)
-			log.Warning("Could not save config")
+	config, _, err := conf.load(true)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(exitCode(err))
+	}
+	if _, err = os.Stat(conf.path); os.IsNotExist(err) {
+		log.Warning("Could not find config, writing default config")
+		// Existing files are never overwritten
+		if err := client.WriteDefaultConfig(conf.path, conf.defaults); err != nil {
+			log.Warning("Could not save config: ", err)
 		}
 	}
-
-	// Override configurations if arguments are provided
-	if *serverHostFlag != "" {
-		cli.ServerHost = *serverHostFlag
+	if err = initLog(config.Log, config.DataPath); err != nil {
+		log.Fatal("Could not open log file: ", err)
+		os.Exit(1)
 	}
-	if *keyPathFlag != "" {
-		cli.KeyPath = *keyPathFlag
+	cli := client.NewClient(*config)
+
+	switch flag.Arg(0) {
+	case "":
+	case "backup":
+		if err = backup(cli, conf.path, flag.Args()[1:]); err != nil {
+			log.Fatal("Could not create backup: ", err)
+			os.Exit(1)
+		}
+		return
+	case "daemon":
+		if err = runDaemon(cli, conf); err != nil {
+			log.Fatal("Daemon stopped: ", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		if err = runCommand(cli, out, flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+			os.Exit(exitCode(err))
+		}
+		return
 	}
-	if *dataPathFlag != "" {
-		cli.DataPath = *dataPathFlag
+
+	if *rotateKeysFlag {
+		if err = rotateKeys(cli); err != nil {
+			log.Fatal("Could not rotate keys: ", err)
+			os.Exit(1)
+		}
+		return
 	}
-	if 0 < *serverPortFlag && *serverPortFlag < 65536 {
-		cli.ServerPort = uint16(*serverPortFlag)
-	} else if *serverPortFlag != 0 {
-		log.Fatal("Provided port out of range")
+
+	api, err := openAPI(cli)
+	if err != nil {
+		log.Fatal(err)
 		os.Exit(1)
 	}
-	if 0 < *localPortFlag && *localPortFlag < 65536 {
-		cli.LocalPort = uint16(*localPortFlag)
-	} else if *localPortFlag != 0 {
-		log.Fatal("Provided port out of range")
+	if local, ok := api.(*daemon.Local); ok {
+		// Settings are reloaded by the daemon if it is running
+		defer watchConfig(local, conf, config.Log, config.DataPath).Close()
+	}
+	// api is closed by the GUI when it shuts down
+	if err = startGUI(api, defaults.Profile); err != nil {
+		_ = api.Close()
+		log.Fatal(err)
 		os.Exit(1)
 	}
+}
+
+// configFile is the config file of a profile, and settings layered on it
+type configFile struct {
+	path string
+	// defaults are default settings of the profile
+	defaults client.Config
+	// flagValues are values of setting flags returned by client.RegisterFlags
+	flagValues map[string]string
+}
+
+// load returns settings from defaults and the config file, and the source of each setting. With
+// overrides, environment variables and flags are applied, and settings are checked for conflicts
+// with other profiles.
+func (conf *configFile) load(overrides bool) (config *client.Config, sources map[string]client.Source, err error) {
+	if !overrides {
+		return client.LoadConfigWithDefaults(conf.defaults, conf.path, nil, nil)
+	}
+	config, sources, err = client.LoadConfigWithDefaults(conf.defaults, conf.path, os.Environ(), conf.flagValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = client.CheckProfileIsolation(config); err != nil {
+		return nil, nil, err
+	}
+	return config, sources, nil
+}
+
+// logFile is the log file opened by initLog
+var logFile *log.RotatingFile
+
+// initLog sets up the logger with settings in config. Logs are written to stderr, and to the log
+// file in dataPath if set. The log file opened by the previous call is closed.
+func initLog(config client.LogConfig, dataPath string) (err error) {
+	newHandler := log.NewJSONHandler
+	if config.Format != client.LogFormatJSON {
+		newHandler = func(w io.Writer) slog.Handler { return log.NewTextHandler(w) }
+	}
+	handlers := []slog.Handler{log.NewRedactHandler(newHandler(os.Stderr), config.StderrRedaction())}
+	var file *log.RotatingFile
+	if fileName := config.FilePath(dataPath); fileName != "" {
+		file, err = log.OpenRotatingFile(fileName, int64(config.MaxSize), config.MaxAge, client.MaxLogBackups)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, log.NewRedactHandler(newHandler(file), config.FileRedaction()))
+	}
+	log.InitHandler(log.NewMultiHandler(handlers...), config.Mode())
+	log.SetSubsystemModes(config.SubsystemModes())
+	if logFile != nil {
+		if err := logFile.Close(); err != nil {
+			log.Debug(err)
+		}
+	}
+	logFile = file
+	return nil
+}
 
-	client.Start("./data/ui/UI.glade", cli)
-	//client.Start(string(uiString))
+// rotateKeys replaces the key pair of cli, then tries to announce the new public key to contacts.
+// Contacts that could not be reached receive the new key when the client connects next time.
+func rotateKeys(cli *client.Client) (err error) {
+	if err = cli.ReadContactsFile(); err != nil {
+		return err
+	}
+	if err = cli.ReadGroupsFile(); err != nil {
+		return err
+	}
+	if err = cli.ReadHandoversFile(); err != nil {
+		return err
+	}
+	if err = cli.LoadKeys(); err != nil {
+		return err
+	}
+	if err = cli.RotateKeys(); err != nil {
+		return err
+	}
+	fmt.Println("New fingerprint:", cli.Fingerprint())
+
+	if err = cli.Connect(); err != nil {
+		log.Warning("Could not connect to the server, new key will be announced on next connection")
+		return nil
+	}
+	defer func() {
+		if err := cli.Disconnect(); err != nil {
+			log.Debug(err)
+		}
+	}()
+	results, err := cli.DoAnnounceKey()
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Println("Not announced:", result.Contact.FirstName, result.Contact.LastName)
+		}
+	}
+	return err
+}
+
+// executableDir returns the directory of this executable, or an empty string if it is unknown
+func executableDir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Debug(err)
+		return ""
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		log.Debug(err)
+		return ""
+	}
+	return filepath.Dir(exe)
 }
@@ -0,0 +1,14 @@
+//go:build nogui
+// +build nogui
+
+package main
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+)
+
+// startGUI returns an error, as this binary was built with "nogui" tag
+func startGUI(api daemon.API, profile string) (err error) {
+	return errors.New("built without GUI support, use one of the commands instead")
+}
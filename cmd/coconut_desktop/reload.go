@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// watchConfig applies changes of conf to local until the watcher is closed. Environment variables
+// and flags still override the file. logConfig is the current log setting, and dataPath is the
+// data directory in use.
+func watchConfig(local *daemon.Local, conf *configFile, logConfig client.LogConfig, dataPath string) *client.ConfigWatcher {
+	return client.WatchConfig(conf.path, conf.defaults, os.Environ(), conf.flagValues, configPollInterval,
+		func(config *client.Config) {
+			if !config.Log.Equal(logConfig) {
+				if err := initLog(config.Log, dataPath); err != nil {
+					log.Error("Could not open log file: ", err)
+				} else {
+					logConfig = config.Log
+				}
+			}
+			changes, err := local.Reload(*config)
+			if err != nil {
+				log.Warning("Could not reconnect with new settings: ", err)
+			}
+			for _, change := range changes {
+				if change.Reload == client.ReloadRestart {
+					log.Warning("Restart to apply ", change.Key)
+				} else {
+					log.Info("Applied ", change.Key)
+				}
+			}
+		})
+}
@@ -1,6 +1,6 @@
 module github.com/jaeha-choi/Proj_Coconut_Desktop
 
-go 1.16
+go 1.21
 
 require (
 	github.com/gotk3/gotk3 v0.6.1
@@ -8,4 +8,9 @@ require (
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
+require (
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+)
+
 replace github.com/jaeha-choi/Proj_Coconut_Utility => ./pkg
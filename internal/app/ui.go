@@ -0,0 +1,376 @@
+// Package app contains the logic of the graphical interface without depending on a toolkit.
+// A View receives commands from Controller, and the toolkit forwards user events to Controller.
+package app
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+	"sync"
+)
+
+// ConnStatus is the connection status shown by View
+type ConnStatus int
+
+const (
+	Offline ConnStatus = iota
+	Connecting
+	Online
+	Disconnecting
+	// ConnFailed indicates that the last connect or disconnect attempt failed
+	ConnFailed
+)
+
+// String returns the label of status
+func (status ConnStatus) String() string {
+	switch status {
+	case Offline:
+		return "Offline"
+	case Connecting:
+		return "Connecting..."
+	case Online:
+		return "Online"
+	case Disconnecting:
+		return "Disconnecting..."
+	default:
+		return "ERROR"
+	}
+}
+
+// FileStatus is the status of a file to send
+type FileStatus int
+
+const (
+	Pending FileStatus = iota
+	Sending
+	Sent
+	Failed
+)
+
+// String returns the label of status
+func (status FileStatus) String() string {
+	switch status {
+	case Pending:
+		return "Pending"
+	case Sending:
+		return "Sending"
+	case Sent:
+		return "Sent"
+	default:
+		return "Failed"
+	}
+}
+
+// File is a file in the list of files to send
+type File struct {
+	// Name is the full path of the file
+	Name   string
+	Size   int64
+	Status FileStatus
+}
+
+// NotOnlineError is passed to View.SetAddCode when the Add Code is requested while offline
+var NotOnlineError = errors.New("not online")
+
+// NoContactError is returned by SendFiles when no contact is selected
+var NoContactError = errors.New("no contact selected")
+
+// UnknownProfileError is returned by SwitchProfile when the profile is not in Profiles.Names
+var UnknownProfileError = errors.New("unknown profile")
+
+// Profiles are identities the user can switch between
+type Profiles struct {
+	// Current is the name of the profile in use
+	Current string
+	// Names lists every profile, including Current
+	Names []string
+	// Switch starts this program with the profile with name. If it succeeds, the toolkit quits.
+	Switch func(name string) error
+}
+
+// View displays the state of Controller. Methods are called from the goroutine that called
+// Controller, so implementations must hand them over to the UI thread if required.
+type View interface {
+	// SetStatus shows the connection status
+	SetStatus(status ConnStatus)
+	// SetAddCode shows addCode, or clears the Add Code if addCode is empty.
+	// err is not nil if the last Add Code operation failed.
+	SetAddCode(addCode string, err error)
+	// SetFiles shows files to send, in the order they were added
+	SetFiles(files []File)
+	// SetContacts shows contacts
+	SetContacts(contacts []*daemon.Contact)
+	// SetProfiles shows profiles that can be selected, and selects current
+	SetProfiles(current string, names []string)
+	// SetHistory shows recorded transfers, newest first
+	SetHistory(transfers []*daemon.Transfer)
+}
+
+// Controller handles user events and updates View. Methods block while calling the API,
+// so the toolkit should call them outside of its main loop. Events are handled one at a time.
+type Controller struct {
+	mutex   sync.Mutex
+	api     daemon.API
+	view    View
+	online  bool
+	addCode string
+	// files are files to send, in the order they were added
+	files    []File
+	profiles Profiles
+}
+
+// NewController returns Controller that uses api of the current profile in profiles, and updates view
+func NewController(api daemon.API, view View, profiles Profiles) (controller *Controller) {
+	return &Controller{
+		api:      api,
+		view:     view,
+		online:   false,
+		addCode:  "",
+		files:    nil,
+		profiles: profiles,
+	}
+}
+
+// Start shows profiles, the current connection status and contacts
+func (controller *Controller) Start() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.view.SetProfiles(controller.profiles.Current, controller.profiles.Names)
+	status, err := controller.api.Status()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting status")
+		controller.view.SetStatus(ConnFailed)
+		return
+	}
+	controller.online = status.Connected
+	if controller.online {
+		controller.view.SetStatus(Online)
+	} else {
+		controller.view.SetStatus(Offline)
+	}
+	controller.refreshContacts()
+	controller.refreshHistory()
+}
+
+// refreshContacts shows contacts. Must be called with mutex locked.
+func (controller *Controller) refreshContacts() {
+	contacts, err := controller.api.Contacts()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting contacts")
+		return
+	}
+	controller.view.SetContacts(contacts)
+}
+
+// RefreshHistory shows recorded transfers, including files received since the last refresh
+func (controller *Controller) RefreshHistory() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.refreshHistory()
+}
+
+// refreshHistory shows recorded transfers. Must be called with mutex locked.
+func (controller *Controller) refreshHistory() {
+	transfers, err := controller.api.History(0)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting history")
+		return
+	}
+	controller.view.SetHistory(transfers)
+}
+
+// Resend sends the file of the sent transfer with id to its receiver again, then shows the
+// updated history
+func (controller *Controller) Resend(id uint64) (err error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	defer controller.refreshHistory()
+	if err = controller.api.Resend(id); err != nil {
+		log.Debug(err)
+		log.Error("Error while sending file again")
+		return err
+	}
+	return nil
+}
+
+// ToggleOnline connects to the relay server if offline, or disconnects if online.
+// Disconnecting removes the Add Code.
+func (controller *Controller) ToggleOnline() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if controller.online {
+		controller.view.SetStatus(Disconnecting)
+		if err := controller.api.Disconnect(); err != nil {
+			log.Debug(err)
+			log.Error("Error while disconnecting from the server")
+			controller.view.SetStatus(ConnFailed)
+			return
+		}
+		controller.online = false
+		if controller.addCode != "" {
+			// Add Code is removed by the server when the client disconnects
+			controller.addCode = ""
+			controller.view.SetAddCode("", nil)
+		}
+		controller.view.SetStatus(Offline)
+		return
+	}
+
+	controller.view.SetStatus(Connecting)
+	// Rotated key is announced to contacts that did not receive it yet
+	if err := controller.api.Connect(); err != nil {
+		log.Debug(err)
+		log.Error("Error while connecting to the server")
+		controller.view.SetStatus(ConnFailed)
+		return
+	}
+	controller.online = true
+	controller.view.SetStatus(Online)
+}
+
+// ToggleAddCode gets a new Add Code if there is none, or removes the current Add Code
+func (controller *Controller) ToggleAddCode() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if !controller.online {
+		controller.view.SetAddCode(controller.addCode, NotOnlineError)
+		return
+	}
+
+	if controller.addCode != "" {
+		log.Debugf("Removing Add Code: %s", controller.addCode)
+		if err := controller.api.RemoveAddCode(controller.addCode); err != nil {
+			log.Debug(err)
+			log.Error("Error while removing Add Code from the server")
+			controller.view.SetAddCode(controller.addCode, err)
+			return
+		}
+		controller.addCode = ""
+		controller.view.SetAddCode("", nil)
+		return
+	}
+
+	addCode, err := controller.api.GetAddCode()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting Add Code from the server")
+		controller.view.SetAddCode("", err)
+		return
+	}
+	log.Debugf("Received Add Code: %s", addCode)
+	controller.addCode = addCode
+	controller.view.SetAddCode(addCode, nil)
+}
+
+// AddFiles adds fileNames to the list of files to send. Files already in the list, and files
+// that cannot be read are skipped.
+func (controller *Controller) AddFiles(fileNames []string) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for _, fileName := range fileNames {
+		if controller.findFile(fileName) != -1 {
+			log.Debug("File is already added; Skipping...")
+			continue
+		}
+		stat, err := os.Stat(fileName)
+		if err != nil {
+			log.Debug(err)
+			log.Error("Error while getting stats; Skipping...")
+			continue
+		}
+		controller.files = append(controller.files, File{Name: fileName, Size: stat.Size(), Status: Pending})
+	}
+	controller.view.SetFiles(controller.filesCopy())
+}
+
+// RemoveFiles removes fileNames from the list of files to send
+func (controller *Controller) RemoveFiles(fileNames []string) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	for _, fileName := range fileNames {
+		if i := controller.findFile(fileName); i != -1 {
+			controller.files = append(controller.files[:i], controller.files[i+1:]...)
+		}
+	}
+	controller.view.SetFiles(controller.filesCopy())
+}
+
+// SendFiles sends files that are not sent yet to the contact with fingerprint. Sending stops
+// if the relay server cannot be reached.
+// Returns NoContactError if fingerprint is empty.
+func (controller *Controller) SendFiles(fingerprint string) (err error) {
+	if fingerprint == "" {
+		return NoContactError
+	}
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	defer controller.refreshHistory()
+	for i := range controller.files {
+		if controller.files[i].Status == Sent {
+			continue
+		}
+		controller.files[i].Status = Sending
+		controller.view.SetFiles(controller.filesCopy())
+
+		err = controller.api.SendFile(fingerprint, controller.files[i].Name)
+		if err != nil {
+			log.Debug(err)
+			log.Error("Error while sending ", controller.files[i].Name)
+			controller.files[i].Status = Failed
+		} else {
+			controller.files[i].Status = Sent
+		}
+		controller.view.SetFiles(controller.filesCopy())
+		if errors.Is(err, daemon.ConnectError) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SwitchProfile starts this program with the profile with name. Returns true if the toolkit should
+// quit, or false if name is the current profile. Returns UnknownProfileError if name is not a profile.
+func (controller *Controller) SwitchProfile(name string) (switched bool, err error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if name == controller.profiles.Current {
+		return false, nil
+	}
+	found := false
+	for _, profile := range controller.profiles.Names {
+		found = found || profile == name
+	}
+	if !found {
+		return false, UnknownProfileError
+	}
+	if err = controller.profiles.Switch(name); err != nil {
+		log.Debug(err)
+		log.Error("Error while switching to profile ", name)
+		// Selection is restored
+		controller.view.SetProfiles(controller.profiles.Current, controller.profiles.Names)
+		return false, err
+	}
+	log.Info("Switched to profile ", name)
+	return true, nil
+}
+
+// findFile returns the index of fileName in files, or -1 if it is not in files.
+// Must be called with mutex locked.
+func (controller *Controller) findFile(fileName string) int {
+	for i, file := range controller.files {
+		if file.Name == fileName {
+			return i
+		}
+	}
+	return -1
+}
+
+// filesCopy returns a copy of files, so that View does not share it with Controller.
+// Must be called with mutex locked.
+func (controller *Controller) filesCopy() []File {
+	return append([]File(nil), controller.files...)
+}
@@ -0,0 +1,347 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
+	"testing"
+	"time"
+)
+
+// fakeView records commands from Controller
+type fakeView struct {
+	statuses    []ConnStatus
+	addCode     string
+	addCodeErr  error
+	fileUpdates [][]File
+	contacts    []*daemon.Contact
+	profile     string
+	history     []*daemon.Transfer
+}
+
+func (view *fakeView) SetStatus(status ConnStatus) {
+	view.statuses = append(view.statuses, status)
+}
+
+func (view *fakeView) SetAddCode(addCode string, err error) {
+	view.addCode, view.addCodeErr = addCode, err
+}
+
+func (view *fakeView) SetFiles(files []File) {
+	view.fileUpdates = append(view.fileUpdates, files)
+}
+
+func (view *fakeView) SetContacts(contacts []*daemon.Contact) {
+	view.contacts = contacts
+}
+
+func (view *fakeView) SetProfiles(current string, _ []string) {
+	view.profile = current
+}
+
+func (view *fakeView) SetHistory(transfers []*daemon.Transfer) {
+	view.history = transfers
+}
+
+// files returns files of the last update
+func (view *fakeView) files() []File {
+	if len(view.fileUpdates) == 0 {
+		return nil
+	}
+	return view.fileUpdates[len(view.fileUpdates)-1]
+}
+
+// fakeAPI implements daemon.API without a relay server. Errors are returned by the
+// corresponding methods if set.
+type fakeAPI struct {
+	connected  bool
+	connectErr error
+	addCodes   map[string]struct{}
+	lastCode   int
+	// sendErrs maps file names to errors returned by SendFile
+	sendErrs map[string]error
+	sent     []string
+	// history records sent files, oldest first
+	history []*daemon.Transfer
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{addCodes: make(map[string]struct{}), sendErrs: make(map[string]error)}
+}
+
+func (api *fakeAPI) Status() (*daemon.Status, error) {
+	return &daemon.Status{Connected: api.connected}, nil
+}
+
+func (api *fakeAPI) Connect() error {
+	if api.connectErr != nil {
+		return api.connectErr
+	}
+	api.connected = true
+	return nil
+}
+
+func (api *fakeAPI) Disconnect() error {
+	api.connected = false
+	api.addCodes = make(map[string]struct{})
+	return nil
+}
+
+func (api *fakeAPI) Contacts() ([]*daemon.Contact, error) {
+	return []*daemon.Contact{{Fingerprint: "aa", FirstName: "Build", LastName: "Server"}}, nil
+}
+
+func (api *fakeAPI) AddContact(string, string, string) (*daemon.Contact, bool, error) {
+	return nil, false, errors.New("not implemented")
+}
+
+func (api *fakeAPI) RemoveContact(string) (*daemon.Contact, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (api *fakeAPI) SendFile(fingerprint string, fileName string) error {
+	if !api.connected {
+		return daemon.ConnectError
+	}
+	err := api.sendErrs[fileName]
+	transfer := &daemon.Transfer{ID: uint64(len(api.history) + 1), Direction: client.DirectionSent,
+		Peer: fingerprint, FileName: fileName, Result: client.ResultOK}
+	if err != nil {
+		transfer.Result, transfer.Error = client.ResultFailed, err.Error()
+	}
+	api.history = append(api.history, transfer)
+	if err != nil {
+		return err
+	}
+	api.sent = append(api.sent, fingerprint+":"+fileName)
+	return nil
+}
+
+func (api *fakeAPI) GetAddCode() (string, error) {
+	if !api.connected {
+		return "", daemon.ConnectError
+	}
+	api.lastCode++
+	addCode := fmt.Sprintf("%06d", api.lastCode)
+	api.addCodes[addCode] = struct{}{}
+	return addCode, nil
+}
+
+func (api *fakeAPI) RemoveAddCode(addCode string) error {
+	if _, ok := api.addCodes[addCode]; !ok {
+		return errors.New("unknown Add Code")
+	}
+	delete(api.addCodes, addCode)
+	return nil
+}
+
+func (api *fakeAPI) Receive(uint64, time.Duration) ([]*daemon.ReceivedFile, error) {
+	return make([]*daemon.ReceivedFile, 0), nil
+}
+
+func (api *fakeAPI) History(limit int) ([]*daemon.Transfer, error) {
+	transfers := make([]*daemon.Transfer, 0)
+	for i := len(api.history) - 1; i >= 0 && (limit == 0 || len(transfers) < limit); i-- {
+		transfers = append(transfers, api.history[i])
+	}
+	return transfers, nil
+}
+
+func (api *fakeAPI) Resend(id uint64) error {
+	if id == 0 || id > uint64(len(api.history)) {
+		return client.TransferNotFoundError
+	}
+	transfer := api.history[id-1]
+	return api.SendFile(transfer.Peer, transfer.FileName)
+}
+
+func (api *fakeAPI) Close() error {
+	return api.Disconnect()
+}
+
+// defaultProfiles has only the default profile
+var defaultProfiles = Profiles{Current: "default", Names: []string{"default"}, Switch: nil}
+
+func TestStart(t *testing.T) {
+	api := newFakeAPI()
+	api.connected = true
+	view := &fakeView{}
+	NewController(api, view, defaultProfiles).Start()
+	if len(view.statuses) != 1 || view.statuses[0] != Online {
+		t.Error("Unexpected statuses: ", view.statuses)
+	}
+	if len(view.contacts) != 1 || view.contacts[0].Fingerprint != "aa" {
+		t.Error("Contacts were not shown: ", view.contacts)
+	}
+	if view.profile != "default" {
+		t.Error("Profile was not shown: ", view.profile)
+	}
+}
+
+func TestToggleOnline(t *testing.T) {
+	api := newFakeAPI()
+	api.connectErr = daemon.ConnectError
+	view := &fakeView{}
+	controller := NewController(api, view, defaultProfiles)
+
+	controller.ToggleOnline()
+	if len(view.statuses) != 2 || view.statuses[0] != Connecting || view.statuses[1] != ConnFailed {
+		t.Error("Unexpected statuses: ", view.statuses)
+	}
+
+	api.connectErr = nil
+	view.statuses = nil
+	controller.ToggleOnline()
+	if len(view.statuses) != 2 || view.statuses[1] != Online || !api.connected {
+		t.Error("Unexpected statuses: ", view.statuses)
+	}
+
+	view.statuses = nil
+	controller.ToggleOnline()
+	if len(view.statuses) != 2 || view.statuses[0] != Disconnecting || view.statuses[1] != Offline || api.connected {
+		t.Error("Unexpected statuses: ", view.statuses)
+	}
+}
+
+func TestToggleAddCode(t *testing.T) {
+	api := newFakeAPI()
+	view := &fakeView{}
+	controller := NewController(api, view, defaultProfiles)
+
+	controller.ToggleAddCode()
+	if view.addCode != "" || view.addCodeErr != NotOnlineError {
+		t.Error("Add Code should not be requested while offline: ", view.addCode, view.addCodeErr)
+	}
+
+	controller.ToggleOnline()
+	controller.ToggleAddCode()
+	if view.addCode != "000001" || view.addCodeErr != nil {
+		t.Fatal("Unexpected Add Code: ", view.addCode, view.addCodeErr)
+	}
+	controller.ToggleAddCode()
+	if view.addCode != "" || view.addCodeErr != nil || len(api.addCodes) != 0 {
+		t.Error("Add Code was not removed: ", view.addCode, view.addCodeErr)
+	}
+
+	// Disconnecting clears the Add Code
+	controller.ToggleAddCode()
+	controller.ToggleOnline()
+	if view.addCode != "" || controller.addCode != "" {
+		t.Error("Add Code was not cleared when disconnected: ", view.addCode)
+	}
+}
+
+func TestSendFiles(t *testing.T) {
+	const file1, file2 = "../../pkg/testdata/simple.txt", "../../pkg/testdata/checksum.txt"
+	api := newFakeAPI()
+	view := &fakeView{}
+	controller := NewController(api, view, defaultProfiles)
+
+	controller.AddFiles([]string{file1, file2, file1, "../../pkg/testdata/does_not_exist"})
+	if files := view.files(); len(files) != 2 || files[0].Name != file1 || files[1].Name != file2 ||
+		files[0].Status != Pending || files[0].Size == 0 {
+		t.Fatal("Unexpected files: ", files)
+	}
+
+	if err := controller.SendFiles(""); err != NoContactError {
+		t.Error("Expected NoContactError, got: ", err)
+	}
+
+	// Sending stops when the relay server cannot be reached
+	view.fileUpdates = nil
+	if err := controller.SendFiles("aa"); !errors.Is(err, daemon.ConnectError) {
+		t.Error("Expected ConnectError, got: ", err)
+	}
+	if len(view.fileUpdates) != 2 || view.fileUpdates[0][0].Status != Sending {
+		t.Error("Unexpected file updates: ", view.fileUpdates)
+	}
+	if files := view.files(); files[0].Status != Failed || files[1].Status != Pending {
+		t.Error("Unexpected files: ", files)
+	}
+
+	api.connected = true
+	api.sendErrs[file2] = errors.New("file too large")
+	if err := controller.SendFiles("aa"); err != nil {
+		t.Error(err)
+	}
+	if files := view.files(); files[0].Status != Sent || files[1].Status != Failed {
+		t.Error("Unexpected files: ", files)
+	}
+
+	// Sent files are not sent again
+	delete(api.sendErrs, file2)
+	if err := controller.SendFiles("aa"); err != nil {
+		t.Error(err)
+	}
+	if len(api.sent) != 2 || api.sent[0] != "aa:"+file1 || api.sent[1] != "aa:"+file2 {
+		t.Error("Unexpected sent files: ", api.sent)
+	}
+
+	controller.RemoveFiles([]string{file1})
+	if files := view.files(); len(files) != 1 || files[0].Name != file2 {
+		t.Error("Unexpected files: ", files)
+	}
+}
+
+func TestResend(t *testing.T) {
+	const file1 = "../../pkg/testdata/simple.txt"
+	api := newFakeAPI()
+	api.connected = true
+	view := &fakeView{}
+	controller := NewController(api, view, defaultProfiles)
+	controller.Start()
+	if view.history == nil || len(view.history) != 0 {
+		t.Error("Expected empty history, got: ", view.history)
+	}
+
+	api.sendErrs[file1] = errors.New("file too large")
+	controller.AddFiles([]string{file1})
+	if err := controller.SendFiles("aa"); err != nil {
+		t.Error(err)
+	}
+	if len(view.history) != 1 || view.history[0].Result != client.ResultFailed {
+		t.Fatal("Unexpected history: ", view.history)
+	}
+
+	delete(api.sendErrs, file1)
+	if err := controller.Resend(view.history[0].ID); err != nil {
+		t.Error(err)
+	}
+	if len(view.history) != 2 || view.history[0].Result != client.ResultOK || view.history[0].FileName != file1 {
+		t.Error("Unexpected history: ", view.history)
+	}
+	if err := controller.Resend(10); !errors.Is(err, client.TransferNotFoundError) {
+		t.Error("Expected TransferNotFoundError, got: ", err)
+	}
+}
+
+func TestSwitchProfile(t *testing.T) {
+	view := &fakeView{}
+	var switchedTo []string
+	switchErr := errors.New("could not start")
+	profiles := Profiles{Current: "default", Names: []string{"default", "work"}, Switch: func(name string) error {
+		switchedTo = append(switchedTo, name)
+		return switchErr
+	}}
+	controller := NewController(newFakeAPI(), view, profiles)
+
+	if switched, err := controller.SwitchProfile("default"); switched || err != nil {
+		t.Error("Current profile should not be switched to: ", switched, err)
+	}
+	if _, err := controller.SwitchProfile("personal"); err != UnknownProfileError {
+		t.Error("Expected UnknownProfileError, got: ", err)
+	}
+	// Selection is restored if switching fails
+	view.profile = "work"
+	if switched, err := controller.SwitchProfile("work"); switched || err != switchErr || view.profile != "default" {
+		t.Error("Unexpected result of failed switch: ", switched, err, view.profile)
+	}
+	switchErr = nil
+	if switched, err := controller.SwitchProfile("work"); !switched || err != nil {
+		t.Error("Expected switch, got: ", switched, err)
+	}
+	if len(switchedTo) != 2 || switchedTo[1] != "work" {
+		t.Error("Unexpected switches: ", switchedTo)
+	}
+}
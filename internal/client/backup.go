@@ -0,0 +1,364 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// backupVersion is the version of the backup archive format.
+	// Increase this value when the content of the archive changes in an incompatible way.
+	backupVersion = 1
+	// backupManifestName is the name of the manifest in the backup archive
+	backupManifestName = "manifest.json"
+	// backupConfigName is the name of the config file in the backup archive
+	backupConfigName = "config.yml"
+	// backupMaxFileSize is the maximum size of a single file in the backup archive
+	backupMaxFileSize = 64 << 20
+)
+
+// backupDataFiles are files in DataPath included in the backup archive, if they exist
+var backupDataFiles = []string{"contacts.gob", "groups.gob", "handovers.gob"}
+
+// IdentityExistsError is returned when restoring a backup would replace an existing identity
+var IdentityExistsError = errors.New("identity already exists")
+
+// InvalidBackupError is returned when the backup archive is malformed or its content was modified
+var InvalidBackupError = errors.New("invalid backup")
+
+// backupManifest describes the content of the backup archive
+type backupManifest struct {
+	// Version is the version of the backup archive format
+	Version int `json:"version"`
+	// Created is the time the backup was created
+	Created time.Time `json:"created"`
+	// Fingerprint is the fingerprint of the backed up identity
+	Fingerprint string `json:"fingerprint"`
+	// Files maps the name of every other file in the archive to its hex encoded SHA256 hash
+	Files map[string]string `json:"files"`
+}
+
+// CreateBackup writes identity keys, contacts, groups and config of this client to fileName
+// as an archive encrypted with passphrase. Config is read from configPath if it exists.
+// Existing fileName is never overwritten.
+func (client *Client) CreateBackup(fileName string, configPath string, passphrase []byte) (err error) {
+	ks, err := client.keyStore()
+	if err != nil {
+		return err
+	}
+	pubBlock, privBlock, err := ks.Load()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Keys could not be loaded")
+		return err
+	}
+
+	files := map[string][]byte{
+		"key.pub":  pem.EncodeToMemory(pubBlock),
+		"key.priv": pem.EncodeToMemory(privBlock),
+	}
+	if files[backupConfigName], err = ioutil.ReadFile(configPath); os.IsNotExist(err) {
+		if files[backupConfigName], err = yaml.Marshal(client); err != nil {
+			return err
+		}
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading config")
+		return err
+	}
+	if err = readBackupFiles(files, client.DataPath, "data/", backupDataFiles); err != nil {
+		return err
+	}
+
+	archive, err := writeBackupArchive(files, hex.EncodeToString(cryptography.PemToSha256(pubBlock)))
+	if err != nil {
+		return err
+	}
+	data, err := cryptography.EncryptWithPassphrase(archive, passphrase)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while creating backup file")
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		log.Debug(err)
+		log.Error("Error while writing backup file")
+		return err
+	}
+	return file.Close()
+}
+
+// RestoreBackup restores backup created by CreateBackup. If configPath does not exist,
+// config in the backup is restored to configPath. Otherwise, existing config is kept and used
+// to locate keys and data. Settings missing in either config are taken from defaults.
+// Returns IdentityExistsError if keys or contacts already exist, unless force is true. With force,
+// existing keys are archived in KeyPath and existing data files are renamed with ".bak" suffix.
+// Returns the client with restored config and keys.
+func RestoreBackup(fileName string, configPath string, defaults Config, passphrase []byte, force bool) (
+	client *Client, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading backup file")
+		return nil, err
+	}
+	archive, err := cryptography.DecryptWithPassphrase(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	files, manifest, err := readBackupArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	// Existing config describes where keys and data are stored on this device
+	restoreConfig := false
+	if _, err = os.Stat(configPath); os.IsNotExist(err) {
+		restoreConfig = true
+	}
+	if restoreConfig {
+		client = NewClient(defaults)
+		if err = yaml.Unmarshal(files[backupConfigName], client); err != nil {
+			log.Debug(err)
+			log.Error("Error while parsing config in backup")
+			return nil, InvalidBackupError
+		}
+	} else {
+		config, _, err := LoadConfigWithDefaults(defaults, configPath, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		client = NewClient(*config)
+	}
+
+	ks, err := client.keyStore()
+	if err != nil {
+		return nil, err
+	}
+	if !force && client.hasIdentity() {
+		log.Error("Existing identity found in ", client.KeyPath, " or ", client.DataPath)
+		return nil, IdentityExistsError
+	}
+
+	pubBlock, _ := pem.Decode(files["key.pub"])
+	privBlock, _ := pem.Decode(files["key.priv"])
+	if pubBlock == nil || privBlock == nil {
+		return nil, InvalidBackupError
+	}
+	if err = os.MkdirAll(client.KeyPath, 0700); err != nil {
+		return nil, err
+	}
+	if err = ks.Replace(pubBlock, privBlock); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(client.DataPath, 0700); err != nil {
+		return nil, err
+	}
+	if err = writeBackupFiles(files, client.DataPath, "data/", backupDataFiles); err != nil {
+		return nil, err
+	}
+	if restoreConfig {
+		if err = replaceFile(configPath, files[backupConfigName], 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = client.LoadKeys(); err != nil {
+		return nil, err
+	}
+	log.Info("Restored identity ", manifest.Fingerprint, " created at ", manifest.Created)
+	return client, nil
+}
+
+// hasIdentity returns true if keys or contacts of this client exist
+func (client *Client) hasIdentity() bool {
+	for _, fileN := range []string{
+		filepath.Join(client.KeyPath, "key.pub"),
+		filepath.Join(client.DataPath, "contacts.gob"),
+	} {
+		if info, err := os.Stat(fileN); err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+	if ks, err := client.keyStore(); err == nil {
+		if _, _, err = ks.Load(); !errors.Is(err, cryptography.KeyMissing) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBackupFiles reads names in dir into files with prefix. Missing files are skipped.
+func readBackupFiles(files map[string][]byte, dir string, prefix string, names []string) (err error) {
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Debug(err)
+			log.Error("Error while reading ", name)
+			return err
+		}
+		files[prefix+name] = data
+	}
+	return nil
+}
+
+// writeBackupFiles writes names with prefix in files to dir. Names not in files are skipped.
+func writeBackupFiles(files map[string][]byte, dir string, prefix string, names []string) (err error) {
+	for _, name := range names {
+		data, ok := files[prefix+name]
+		if !ok {
+			continue
+		}
+		var perm os.FileMode = 0644
+		if filepath.Ext(name) == ".priv" {
+			perm = 0600
+		}
+		if err = replaceFile(filepath.Join(dir, name), data, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceFile writes data to fileName. Existing file is renamed with ".bak" suffix.
+func replaceFile(fileName string, data []byte, perm os.FileMode) (err error) {
+	if _, err = os.Stat(fileName); err == nil {
+		if err = os.Rename(fileName, fileName+".bak"); err != nil {
+			log.Debug(err)
+			log.Error("Error while renaming existing file")
+			return err
+		}
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while creating file")
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeBackupArchive creates tar archive with manifest followed by files sorted by name
+func writeBackupArchive(files map[string][]byte, fingerprint string) (archive []byte, err error) {
+	manifest := backupManifest{
+		Version:     backupVersion,
+		Created:     time.Now().UTC().Truncate(time.Second),
+		Fingerprint: fingerprint,
+		Files:       make(map[string]string, len(files)),
+	}
+	names := make([]string, 0, len(files))
+	for name, data := range files {
+		hash := sha256.Sum256(data)
+		manifest.Files[name] = hex.EncodeToString(hash[:])
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	writeEntry := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := writer.Write(data)
+		return err
+	}
+	if err = writeEntry(backupManifestName, manifestBytes); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err = writeEntry(name, files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// readBackupArchive reads tar archive created by writeBackupArchive and verifies every file
+// against the manifest.
+// Returns InvalidBackupError if the archive is malformed or files do not match the manifest,
+// UnsupportedVersionError if the archive was created with a newer format version.
+func readBackupArchive(archive []byte) (files map[string][]byte, manifest *backupManifest, err error) {
+	files = make(map[string][]byte)
+	reader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Debug(err)
+			return nil, nil, InvalidBackupError
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > backupMaxFileSize {
+			return nil, nil, InvalidBackupError
+		}
+		if _, exist := files[header.Name]; exist {
+			return nil, nil, InvalidBackupError
+		}
+		if files[header.Name], err = ioutil.ReadAll(reader); err != nil {
+			log.Debug(err)
+			return nil, nil, InvalidBackupError
+		}
+	}
+
+	manifest = &backupManifest{}
+	if err = json.Unmarshal(files[backupManifestName], manifest); err != nil {
+		log.Debug(err)
+		log.Error("Backup does not contain valid manifest")
+		return nil, nil, InvalidBackupError
+	}
+	if manifest.Version > backupVersion {
+		return nil, nil, UnsupportedVersionError
+	}
+	delete(files, backupManifestName)
+	if len(files) != len(manifest.Files) {
+		return nil, nil, InvalidBackupError
+	}
+	for name, data := range files {
+		hash := sha256.Sum256(data)
+		if manifest.Files[name] != hex.EncodeToString(hash[:]) {
+			log.Error("Backup file ", name, " does not match manifest")
+			return nil, nil, InvalidBackupError
+		}
+	}
+	for _, name := range []string{"key.pub", "key.priv", backupConfigName} {
+		if _, ok := files[name]; !ok {
+			return nil, nil, InvalidBackupError
+		}
+	}
+	return files, manifest, nil
+}
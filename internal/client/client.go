@@ -4,27 +4,25 @@ import (
 	"crypto/rsa"
 	"crypto/tls"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
-	"gopkg.in/yaml.v3"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
 const (
-	// keyPath is a default path for asymmetric keys
-	keyPath = "./"
-	// dataPath is a default path for various data,
-	// including UI interface, gob file that contains contact list, etc.
-	dataPath = "./data/"
 	//// contactsCapacity is the maximum number of contacts that a client can hold
 	//contactsCapacity = 200
 	// defaultServerPort is a default port number for central relay server
@@ -35,28 +33,35 @@ const (
 	bufferSize = 10
 )
 
+// RequestTimeoutError is returned when the relay server did not respond within RequestTimeout
+var RequestTimeoutError = errors.New("timed out while waiting for the relay server")
+
+// NotConnectedError is returned if the connection to the relay server was lost or closed
+var NotConnectedError = errors.New("not connected to the relay server")
+
 // Client structure stores all necessary user data
 type Client struct {
-	// ServerHost is the central relay server's ip address
-	ServerHost string `yaml:"server_host"`
-	// ServerPort is the central relay server's port
-	ServerPort uint16 `yaml:"server_port"`
-	// LocalPort is a client port that will be opened for P2P connection,
-	// in case hole punching fails
-	LocalPort uint16 `yaml:"local_port"`
-	// KeyPath is a path for asymmetric keys
-	KeyPath string `yaml:"key_path"`
-	// DataPath is a path for various data,
-	// including UI interface, gob file that contains contact list, etc.
-	DataPath string `yaml:"data_path"`
+	Config `yaml:",inline"`
+	// configMutex protects Config from ApplyConfig (see currentConfig)
+	configMutex sync.RWMutex
 	// tlsConfig stores TLS configuration for connections between the central relay server
 	tlsConfig *tls.Config
 	// privKey stores the RSA private and public key of this client
 	privKey *rsa.PrivateKey
 	// pubKeyBlock stores the RSA public key of this client in PEM block format
 	pubKeyBlock *pem.Block
-	// conn is a connection to the central relay server
+	// conn is a connection to the central relay server, or nil if this client is not connected
 	conn net.Conn
+	// session multiplexes conn if common.FeatureMux was negotiated, nil otherwise
+	session *util.MuxSession
+	// connMutex protects conn, session, protocolVersion and features, as they are cleared by
+	// commandHandler when the connection is lost
+	connMutex sync.RWMutex
+	// commandMutex serializes commands sent on the control connection, as replies are matched
+	// by command. Relays hold it only if conn is not multiplexed.
+	commandMutex sync.Mutex
+	// versionDone receives true from doVersion if conn is multiplexed after the reply to Version
+	versionDone chan bool
 	// peerConn is a p2p connection between other peer
 	peerConn net.Conn
 	// localAddr is a local address of this client
@@ -65,8 +70,27 @@ type Client struct {
 	addCode string
 	// contactMap stores the map of Contact structures. Uses public key hash string as a key
 	contactMap map[string]*Contact
+	// groupMap stores the map of Group structures. Uses group name as a key
+	groupMap map[string]*Group
+	// handovers stores key handovers created by RotateKeys, oldest first
+	handovers []*cryptography.KeyHandover
 	// chanMap stores the map of channels. Uses command string as a key
 	chanMap map[string]chan *util.Message
+	// mapMutex protects contactMap, groupMap, chanMap and the contacts and groups in them,
+	// as they are used by commandHandler while other methods are called
+	mapMutex sync.RWMutex
+	// received stores the outcome of files relayed to this client
+	received chan *ReceiveResult
+	// historyMutex protects history and historyLoaded, as files are received in commandHandler
+	historyMutex sync.Mutex
+	// history stores finished transfers
+	history history
+	// historyLoaded is true if history.gob was read by ReadHistoryFile
+	historyLoaded bool
+	// protocolVersion is the protocol version negotiated with the relay server
+	protocolVersion uint16
+	// features are protocol features supported by both this client and the relay server
+	features common.Feature
 }
 
 // Contact stores information about added contacts
@@ -78,52 +102,85 @@ type Contact struct {
 	PubKeyHash []byte
 	// PubKey stores the PEM formatted public key of added device's public key
 	PubKey *pem.Block
+	// Verified indicates whether the fingerprint of PubKey was confirmed by the user
+	Verified bool
+	// PreviousKeys stores public keys of added device that were replaced by key handovers
+	PreviousKeys []*pem.Block
+	// HandoverPending indicates whether this client's rotated key was not announced to the contact yet
+	HandoverPending bool
 }
 
 // InitConfig initializes a default Client struct.
 func InitConfig() (client *Client) {
+	return NewClient(DefaultConfig())
+}
+
+// NewClient initializes a Client struct with config
+func NewClient(config Config) (client *Client) {
 	client = &Client{
-		ServerHost:  "127.0.0.1", // TODO: update this value after deploying the relay server
-		ServerPort:  defaultServerPort,
-		LocalPort:   defaultLocalPort,
-		KeyPath:     keyPath,
-		DataPath:    dataPath,
-		tlsConfig:   &tls.Config{InsecureSkipVerify: true}, // TODO: Update after using trusted cert
-		privKey:     nil,
-		pubKeyBlock: nil,
-		conn:        nil,
-		peerConn:    nil,
-		localAddr:   nil,
-		addCode:     "",
-		contactMap:  make(map[string]*Contact),
-		chanMap:     make(map[string]chan *util.Message),
+		Config:          config,
+		tlsConfig:       &tls.Config{InsecureSkipVerify: true}, // TODO: Update after using trusted cert
+		privKey:         nil,
+		pubKeyBlock:     nil,
+		conn:            nil,
+		session:         nil,
+		versionDone:     nil,
+		peerConn:        nil,
+		localAddr:       nil,
+		addCode:         "",
+		contactMap:      make(map[string]*Contact),
+		groupMap:        make(map[string]*Group),
+		handovers:       nil,
+		chanMap:         make(map[string]chan *util.Message),
+		received:        make(chan *ReceiveResult, bufferSize),
+		history:         history{LastID: 0, Transfers: nil},
+		historyLoaded:   false,
+		protocolVersion: 0,
+		features:        0,
 	}
 	return client
 }
 
 // ReadConfig reads a config from a yaml file and override default settings
+// Returns *ConfigError if the config is invalid
 func ReadConfig(fileName string) (client *Client, err error) {
-	file, err := ioutil.ReadFile(fileName)
-	if err != nil {
+	if _, err = os.Stat(fileName); err != nil {
 		log.Debug(err)
 		return nil, err
 	}
-
-	client = InitConfig()
-
-	err = yaml.Unmarshal(file, &client)
+	config, _, err := LoadConfig(fileName, nil, nil)
 	if err != nil {
 		log.Debug(err)
 		log.Error("Error while parsing config.yml")
 		return nil, err
 	}
-	return client, nil
+	return NewClient(*config), nil
+}
+
+// Fingerprint returns hex encoded SHA256 hash of this client's public key
+func (client *Client) Fingerprint() string {
+	return hex.EncodeToString(cryptography.PemToSha256(client.pubKeyBlock))
+}
+
+// IsConnected returns true if this client is connected to the relay server
+func (client *Client) IsConnected() bool {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	return client.conn != nil
+}
+
+// AddCode returns the Add Code received by DoGetAddCode, or an empty string if there is none
+func (client *Client) AddCode() string {
+	return client.addCode
 }
 
 // getResult is called at the end of each operation to check potential error
 func (client *Client) getResult(command *common.Command) (err error) {
-	msg := <-client.chanMap[command.String]
-	delete(client.chanMap, command.String)
+	msg, err := client.getReply(command)
+	client.removeChan(command)
+	if err != nil {
+		return err
+	}
 	errCode := common.ErrorCodes[msg.ErrorCode]
 	if errCode != nil {
 		return errCode
@@ -131,9 +188,68 @@ func (client *Client) getResult(command *common.Command) (err error) {
 	return nil
 }
 
+// getReply waits for a reply of command, so that a lost connection does not block the caller
+// Returns RequestTimeoutError if the relay server does not reply within RequestTimeout
+func (client *Client) getReply(command *common.Command) (msg *util.Message, err error) {
+	select {
+	case msg = <-client.replyChan(command):
+		return msg, nil
+	case <-time.After(client.currentConfig().RequestTimeout):
+		log.Error("Timed out while waiting for the result of ", command.String)
+		return nil, RequestTimeoutError
+	}
+}
+
+// newChan creates the channel that receives replies of command from commandHandler
+func (client *Client) newChan(command *common.Command) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
+}
+
+// removeChan removes the channel created by newChan
+func (client *Client) removeChan(command *common.Command) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	delete(client.chanMap, command.String)
+}
+
+// replyChan returns the channel that receives replies of command, or nil if there is none
+func (client *Client) replyChan(command *common.Command) chan *util.Message {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	return client.chanMap[command.String]
+}
+
+// RLockContacts locks contacts and groups for reading. Contacts and groups returned by Client
+// are changed when a contact rotates its key, so their fields should be read with the lock held.
+// Other methods of Client must not be called until RUnlockContacts is called.
+func (client *Client) RLockContacts() {
+	client.mapMutex.RLock()
+}
+
+// RUnlockContacts unlocks contacts and groups locked by RLockContacts
+func (client *Client) RUnlockContacts() {
+	client.mapMutex.RUnlock()
+}
+
+// lookupContact returns the contact with public key hash pkHash
+func (client *Client) lookupContact(pkHash string) (contact *Contact, ok bool) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	contact, ok = client.contactMap[pkHash]
+	return contact, ok
+}
+
+// commandHandler reads commands from the relay server until the connection is closed.
+// The connection is cleared when commandHandler returns, so the client can connect again.
 func (client *Client) commandHandler() {
+	client.connMutex.RLock()
+	owner := client.conn
+	client.connMutex.RUnlock()
+	conn := client.controlConn()
 	for {
-		msg, err := util.ReadMessage(client.conn)
+		msg, err := util.ReadMessage(conn)
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -141,65 +257,136 @@ func (client *Client) commandHandler() {
 			break
 		}
 		command := common.CommandCodes[msg.CommandCode]
-		if c, ok := client.chanMap[command.String]; ok {
+		if command == nil {
+			log.Warning("Unknown command code ", msg.CommandCode, " received")
+			continue
+		}
+		if command == common.RequestRelay && len(msg.Data) != 0 {
+			// Results of doRelay have no data, so this is a relay to this client
+			err = client.handleConnRelay(msg, conn)
+		} else if c := client.replyChan(command); c != nil {
 			c <- msg
+			if command == common.Version && <-client.versionDone {
+				// conn is read by the session from now on
+				return
+			}
 		} else if command == common.GetPubKey {
 			err = client.handleGetPubKey()
+		} else if command == common.KeyHandover {
+			err = client.handleKeyHandover(msg)
 		}
 	}
+	if err := client.closeConn(owner); err != NotConnectedError {
+		log.Warning("Connection to the relay server was lost")
+	}
 }
 
-// Connect connects this client to the relay server and initializes the connection by calling doInit
-// Returns common.ExistingConnError if client is already connected
+// closeConn closes conn and clears the connection state if conn is the connection of this
+// client. Returns NotConnectedError if conn was already closed.
+func (client *Client) closeConn(conn net.Conn) (err error) {
+	client.connMutex.Lock()
+	session := client.session
+	if conn == nil || client.conn != conn {
+		client.connMutex.Unlock()
+		return NotConnectedError
+	}
+	client.conn = nil
+	client.session = nil
+	client.protocolVersion = 0
+	client.features = 0
+	client.connMutex.Unlock()
+	if session != nil {
+		// Closing the session closes conn
+		return session.Close()
+	}
+	return conn.Close()
+}
+
+// Connect connects this client to the relay server, negotiates the protocol version by calling
+// doVersion and initializes the connection by calling doInit
+// Returns common.ExistingConnError if client is already connected,
+// common.IncompatibleVersionError if the server protocol version is not supported
 func (client *Client) Connect() (err error) {
-	if client.conn != nil {
+	if client.IsConnected() {
 		// Client already established active connection
 		return common.ExistingConnError
 	}
 	log.Debug("Connecting...")
-	client.conn, err = tls.Dial("tcp", client.ServerHost+":"+strconv.Itoa(int(client.ServerPort)), client.tlsConfig)
-	if err != nil {
+	dialer := &net.Dialer{Timeout: client.ConnectTimeout}
+	var conn *tls.Conn
+	// Fallback servers are tried in order if the server cannot be reached
+	servers := append([]string{net.JoinHostPort(client.ServerHost, strconv.Itoa(int(client.ServerPort)))},
+		client.FallbackServers...)
+	for _, server := range servers {
+		if conn, err = tls.DialWithDialer(dialer, "tcp", server, client.tlsConfig); err == nil {
+			log.Debug("Connected to ", server)
+			break
+		}
 		log.Debug(err)
+		log.Warning("Could not connect to ", server)
+	}
+	if err != nil {
 		log.Error("Error while connecting to the server")
 		return err
 	}
+	client.connMutex.Lock()
+	client.conn = conn
+	client.connMutex.Unlock()
 	log.Debug("Connected")
 
 	go client.commandHandler()
 
+	// Connection is closed if it could not be initialized, so the client can connect again
+	defer func() {
+		if err != nil {
+			_ = client.closeConn(conn)
+		}
+	}()
+	if err = client.doVersion(); err != nil {
+		return err
+	}
+	if client.HasFeature(common.FeatureMux) {
+		client.startSession()
+	}
 	return client.doInit()
 }
 
-// Disconnect disconnects this client from the server
+// Disconnect disconnects this client from the server. The connection is closed even if the
+// server did not complete Quit, in which case common.TaskNotCompleteError is returned.
 func (client *Client) Disconnect() (err error) {
-	if client.conn == nil {
+	client.connMutex.RLock()
+	conn := client.conn
+	client.connMutex.RUnlock()
+	if conn == nil {
 		return nil
 	}
 	log.Debug("Disconnecting...")
-	if err = client.doQuit(); err != nil {
-		log.Debug(err)
+	quitErr := client.doQuit()
+	if quitErr != nil {
+		log.Debug(quitErr)
 		log.Error("Task is not complete")
-		return common.TaskNotCompleteError
+	} else {
+		// Timer allows graceful shutdown for client.conn
+		time.Sleep(1 * time.Second)
 	}
-	// Timer allows graceful shutdown for client.conn
-	time.Sleep(1 * time.Second)
-	if err = client.conn.Close(); err != nil {
+	if err = client.closeConn(conn); err != nil && err != NotConnectedError {
 		log.Debug(err)
 		log.Error("Error while disconnecting from the server")
-		return err
 	}
-	client.conn = nil
 	log.Debug("Disconnected")
+	if quitErr != nil {
+		return common.TaskNotCompleteError
+	}
 	return nil
 }
 
 // handleGetPubKey is called when the relay server requests this client's public key
 func (client *Client) handleGetPubKey() (err error) {
 	var command = common.GetAddCode
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
-	if _, err = util.WriteMessage(client.conn, client.pubKeyBlock.Bytes, nil, command); err != nil {
+	if _, err = util.WriteMessage(client.controlConn(), client.pubKeyBlock.Bytes, nil, command); err != nil {
 		log.Debug(err)
 		log.Error("Error while sending public key")
 		return err
@@ -210,17 +397,25 @@ func (client *Client) handleGetPubKey() (err error) {
 // doInit initializes the connection by sending this client's public key hash (SHA256) and
 // private IP address to the relay server
 func (client *Client) doInit() (err error) {
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
 	var command = common.Init
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
 	pubKeyHash := cryptography.PemToSha256(client.pubKeyBlock)
-	if _, err = util.WriteMessage(client.conn, pubKeyHash, nil, command); err != nil {
+	if _, err = util.WriteMessage(client.controlConn(), pubKeyHash, nil, command); err != nil {
 		log.Debug(err)
 		log.Error("Error while sending public key hash")
 		return err
 	}
-	if _, err = util.WriteMessage(client.conn, []byte(client.conn.LocalAddr().String()), nil, command); err != nil {
+	client.connMutex.RLock()
+	conn := client.conn
+	client.connMutex.RUnlock()
+	if conn == nil {
+		return NotConnectedError
+	}
+	if _, err = util.WriteMessage(client.controlConn(), []byte(conn.LocalAddr().String()), nil, command); err != nil {
 		log.Debug(err)
 		log.Error("Error while sending local ip address")
 		return err
@@ -231,11 +426,13 @@ func (client *Client) doInit() (err error) {
 
 // doQuit signals the relay server to unregister this client
 func (client *Client) doQuit() (err error) {
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
 	var command = common.Quit
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
-	if _, err = util.WriteMessage(client.conn, nil, nil, command); err != nil {
+	if _, err = util.WriteMessage(client.controlConn(), nil, nil, command); err != nil {
 		log.Debug(err)
 		log.Error("Error while quit command")
 		return err
@@ -247,14 +444,19 @@ func (client *Client) doQuit() (err error) {
 // DoGetAddCode signals the relay server to send the Add Code
 // Returns common.NoAvailableAddCodeError if no Add Code is available
 func (client *Client) DoGetAddCode() (err error) {
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
 	var command = common.GetAddCode
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
-	if _, err = util.WriteMessage(client.conn, nil, nil, command); err != nil {
+	if _, err = util.WriteMessage(client.controlConn(), nil, nil, command); err != nil {
+		return err
+	}
+	msg, err := client.getReply(command)
+	if err != nil {
 		return err
 	}
-	msg := <-client.chanMap[command.String]
 	client.addCode = string(msg.Data)
 
 	return client.getResult(command)
@@ -262,61 +464,146 @@ func (client *Client) DoGetAddCode() (err error) {
 
 // DoRemoveAddCode signals the relay server to dissociate the Add Code from this client
 func (client *Client) DoRemoveAddCode() (err error) {
+	return client.DoRemoveAddCodeStr(client.addCode)
+}
+
+// DoRemoveAddCodeStr signals the relay server to dissociate addCodeStr from this client
+func (client *Client) DoRemoveAddCodeStr(addCodeStr string) (err error) {
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
 	var command = common.RemoveAddCode
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
-	if _, err = util.WriteMessage(client.conn, nil, nil, command); err != nil {
+	if _, err = util.WriteMessage(client.controlConn(), nil, nil, command); err != nil {
 		return err
 	}
-	if _, err = util.WriteMessage(client.conn, []byte(client.addCode), nil, command); err != nil {
+	if _, err = util.WriteMessage(client.controlConn(), []byte(addCodeStr), nil, command); err != nil {
 		return err
 	}
-
-	return client.getResult(command)
+	if err = client.getResult(command); err != nil {
+		return err
+	}
+	if addCodeStr == client.addCode {
+		client.addCode = ""
+	}
+	return nil
 }
 
 // DoRequestRelay signals the relay server to relay files between this client and
 // the client with matching rxPubKeyHash
 // TODO: WIP
 func (client *Client) DoRequestRelay(rxPubKeyHash string) (err error) {
+	return client.doRelay(rxPubKeyHash, nil)
+}
+
+// doRelay signals the relay server to relay data written by writeData to the client with
+// matching rxPubKeyHash. If writeData is nil, only the relay is requested.
+// Returns UnsupportedFeatureError if the server does not support relay
+func (client *Client) doRelay(rxPubKeyHash string, writeData func(writer io.Writer) error) (err error) {
+	if !client.HasFeature(common.FeatureRelay) {
+		log.Error("Relay is not supported by the server")
+		return UnsupportedFeatureError
+	}
+	client.connMutex.RLock()
+	session := client.session
+	client.connMutex.RUnlock()
+	if session != nil {
+		return client.relayStream(session, rxPubKeyHash, writeData)
+	}
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
 	var command = common.RequestRelay
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
-	if _, err = util.WriteMessage(client.conn, nil, nil, command); err != nil {
+	conn := client.controlConn()
+	if _, err = util.WriteMessage(conn, nil, nil, command); err != nil {
 		return err
 	}
-	if _, err = util.WriteMessage(client.conn, []byte(rxPubKeyHash), nil, command); err != nil {
+	if _, err = util.WriteMessage(conn, []byte(rxPubKeyHash), nil, command); err != nil {
 		return err
 	}
-	// Add file relay here
+	if writeData != nil {
+		if err = writeData(limitWriter(conn, client.currentConfig().Bandwidth.Upload)); err != nil {
+			log.Debug(err)
+			log.Error("Error while relaying data")
+			return err
+		}
+	}
 
 	return client.getResult(command)
 }
 
+// DoSendFile encrypts fileName and sends it to the contact with matching rxPubKeyHash
+func (client *Client) DoSendFile(rxPubKeyHash string, fileName string) (err error) {
+	contact, ok := client.lookupContact(rxPubKeyHash)
+	if !ok {
+		return ContactNotFoundError
+	}
+	results, err := client.sendToContacts([]*Contact{contact}, fileName, client.doRelay)
+	if err != nil {
+		return err
+	}
+	return results[0].Err
+}
+
 // DoRequestPubKey signals the relay server to send public key associated with provided Add Code (rxAddCodeStr),
 // then save it as fileName
 // Returns common.ClientNotFoundError if no client is found
 func (client *Client) DoRequestPubKey(rxAddCodeStr string, fileName string) (err error) {
+	pubKeyBytes, err := client.requestPubKey(rxAddCodeStr)
+	if err != nil {
+		return err
+	}
+	return cryptography.BytesToPemFile(pubKeyBytes, fileName)
+}
+
+// DoAddContact requests the public key associated with rxAddCodeStr and adds it to contacts
+// with firstName and lastName, then saves contacts.gob
+// Returns the contact and true if it was newly added.
+// Returns common.ClientNotFoundError if no client is found
+func (client *Client) DoAddContact(rxAddCodeStr string, firstName string, lastName string) (
+	contact *Contact, added bool, err error) {
+	pubKeyBytes, err := client.requestPubKey(rxAddCodeStr)
+	if err != nil {
+		return nil, false, err
+	}
+	if contact, err = newContact(firstName, lastName, pubKeyBytes, "", false); err != nil {
+		return nil, false, err
+	}
+	added = client.mergeContact(contact)
+	if err = client.WriteContactsFile(); err != nil {
+		return nil, false, err
+	}
+	contact, _ = client.lookupContact(string(contact.PubKeyHash))
+	return contact, added, nil
+}
+
+// requestPubKey signals the relay server to send public key associated with rxAddCodeStr
+func (client *Client) requestPubKey(rxAddCodeStr string) (pubKeyBytes []byte, err error) {
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
 	var command = common.RequestPubKey
-	client.chanMap[command.String] = make(chan *util.Message, bufferSize)
-	defer delete(client.chanMap, command.String)
+	client.newChan(command)
+	defer client.removeChan(command)
 
-	if _, err = util.WriteMessage(client.conn, nil, nil, command); err != nil {
-		return err
+	if _, err = util.WriteMessage(client.controlConn(), nil, nil, command); err != nil {
+		return nil, err
 	}
-	if _, err = util.WriteMessage(client.conn, []byte(rxAddCodeStr), nil, command); err != nil {
-		return err
+	if _, err = util.WriteMessage(client.controlConn(), []byte(rxAddCodeStr), nil, command); err != nil {
+		return nil, err
 	}
 
 	// Get rxPubKeyBytes
-	msg := <-client.chanMap[command.String]
-	if err = cryptography.BytesToPemFile(msg.Data, fileName); err != nil {
-		return err
+	msg, err := client.getReply(command)
+	if err != nil {
+		return nil, err
 	}
-
-	return client.getResult(command)
+	if err = client.getResult(command); err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
 }
 
 //// DoRequestP2P signals the relay server to ...
@@ -329,17 +616,17 @@ func (client *Client) DoRequestPubKey(rxAddCodeStr string, fileName string) (err
 //		log.Error("Error writing to server")
 //		return err
 //	}
-//	command, err := util.ReadString(client.conn)
-//	if command != "GKEY" || err != nil {
+//	msg, err := util.ReadMessage(client.conn)
+//	if err != nil || msg.CommandCode != common.GetP2PKey.Code {
 //		return common.UnknownCommandError
 //	}
 //
-//	_, err = util.WriteBytes(client.conn, pkHash)
+//	_, err = util.WriteMessage(client.conn, pkHash, nil, common.GetP2PKey)
 //	if err != nil {
 //		return err
 //	}
-//	peerLocalAddr, err := util.ReadString(client.conn)
-//	peerPublicAddr, err := util.ReadString(client.conn)
+//	peerLocalAddr, err := util.ReadMessageData(client.conn, common.RequestP2P)
+//	peerPublicAddr, err := util.ReadMessageData(client.conn, common.RequestP2P)
 //	err = client.DoOpenHolePunch(peerLocalAddr, peerPublicAddr)
 //	return err
 //}
@@ -419,7 +706,12 @@ func (client *Client) DoRequestPubKey(rxAddCodeStr string, fileName string) (err
 
 // ReadContactsFile read the contents of contacts.gob into client.contactMap
 func (client *Client) ReadContactsFile() (err error) {
-	file, err := os.OpenFile(filepath.Join(client.DataPath, "contacts.gob"), os.O_RDONLY|os.O_CREATE, 0666)
+	if err = os.MkdirAll(client.DataPath, 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating data directory")
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(client.DataPath, "contacts.gob"), os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		log.Error("Error opening file: ", err)
 		return err
@@ -432,7 +724,9 @@ func (client *Client) ReadContactsFile() (err error) {
 		}
 	}()
 
+	client.mapMutex.Lock()
 	err = gob.NewDecoder(file).Decode(&client.contactMap)
+	client.mapMutex.Unlock()
 	if err == io.EOF {
 		//client.contactMap = nil
 		return nil
@@ -444,28 +738,53 @@ func (client *Client) ReadContactsFile() (err error) {
 	return err
 }
 
-// WriteContactsFile write contents of contacts map into contacts.gob file
-func (client *Client) WriteContactsFile() (err error) {
-	file, err := os.OpenFile(filepath.Join(client.DataPath, "contacts.gob"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+// writeDataFile encodes data into fileName in DataPath. data is written to a temp file that
+// replaces fileName, so that the file is not lost if writing fails midway.
+func (client *Client) writeDataFile(fileName string, data interface{}) (err error) {
+	if err = os.MkdirAll(client.DataPath, 0700); err != nil {
+		log.Debug(err)
+		return err
+	}
+	// Temp file is created with 0600
+	file, err := ioutil.TempFile(client.DataPath, fileName+".tmp_")
 	if err != nil {
 		log.Debug(err)
-		log.Error("Error opening file: ", err)
+		log.Error("Error while creating temp file for ", fileName)
 		return err
 	}
-
 	defer func() {
-		err = file.Close()
 		if err != nil {
-			log.Error("Error closing file: ", err)
+			if err := os.Remove(file.Name()); err != nil {
+				log.Debug(err)
+			}
 		}
 	}()
+	if err = gob.NewEncoder(file).Encode(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(client.DataPath, fileName))
+}
 
-	return gob.NewEncoder(file).Encode(client.contactMap)
+// WriteContactsFile write contents of contacts map into contacts.gob file
+func (client *Client) WriteContactsFile() (err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	return client.writeDataFile("contacts.gob", client.contactMap)
 }
 
 // addContact initializes new contact struct
 // Returns true if contact is added or already in list, false otherwise
 func (client *Client) addContact(firstName string, lastName string, pkHash []byte, pubKey *pem.Block) (inserted bool) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
 	pkHashStr := string(pkHash)
 	// check if contact already in list
 	if _, isFound := client.contactMap[pkHashStr]; isFound {
@@ -473,18 +792,55 @@ func (client *Client) addContact(firstName string, lastName string, pkHash []byt
 	}
 	// create contact if not in map
 	contact := Contact{
-		firstName,
-		lastName,
-		pkHash,
-		pubKey,
+		FirstName:  firstName,
+		LastName:   lastName,
+		PubKeyHash: pkHash,
+		PubKey:     pubKey,
+		Verified:   false,
 	}
 	client.contactMap[pkHashStr] = &contact
 	return true
 }
 
+// Contacts returns every contact sorted by name
+func (client *Client) Contacts() (contacts []*Contact) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	for _, contact := range client.contactMap {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		if contacts[i].FirstName != contacts[j].FirstName {
+			return contacts[i].FirstName < contacts[j].FirstName
+		}
+		if contacts[i].LastName != contacts[j].LastName {
+			return contacts[i].LastName < contacts[j].LastName
+		}
+		return contacts[i].Fingerprint() < contacts[j].Fingerprint()
+	})
+	return contacts
+}
+
+// FindContact returns the contact with hex encoded fingerprint
+// Returns ContactNotFoundError if the contact does not exist
+func (client *Client) FindContact(fingerprint string) (contact *Contact, err error) {
+	pkHash, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		log.Debug(err)
+		return nil, ContactNotFoundError
+	}
+	contact, ok := client.lookupContact(string(pkHash))
+	if !ok {
+		return nil, ContactNotFoundError
+	}
+	return contact, nil
+}
+
 // RemoveContact removes contact with specified public key hash
 // Returns true if found and removed, false if not found
 func (client *Client) RemoveContact(pkHash string) (b bool) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
 	if _, exist := client.contactMap[pkHash]; exist {
 		delete(client.contactMap, pkHash)
 		return true
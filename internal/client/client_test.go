@@ -1,14 +1,26 @@
 package client
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
 )
 
-func init() {
-	log.Init(os.Stdout, log.DEBUG)
-}
-
 //func TestDoOpenHolePunch(t *testing.T) {
 //	client := InitConfig()
 //	err := client.DoOpenHolePunch("127.0.0.1:1234", "127.0.0.1:28282")
@@ -153,3 +165,677 @@ func init() {
 //	}
 //	log.Debug(client.contactMap)
 //}
+
+// contactHelper creates a contact with a newly generated public key
+func contactHelper(t *testing.T, firstName string, lastName string) *Contact {
+	t.Helper()
+	contact, _ := contactKeyHelper(t, firstName, lastName)
+	return contact
+}
+
+// contactKeyHelper creates a contact with a newly generated key pair and returns
+// the contact with its private key
+func contactKeyHelper(t *testing.T, firstName string, lastName string) (*Contact, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact, err := newContact(firstName, lastName, x509.MarshalPKCS1PublicKey(&key.PublicKey), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contact, key
+}
+
+func TestExportImportContacts(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "contacts.json")
+
+	client := InitConfig()
+	contact1 := contactHelper(t, "Jaeha", "Choi")
+	contact1.Verified = true
+	contact2 := contactHelper(t, "Build", "Server")
+	client.mergeContact(contact1)
+	client.mergeContact(contact2)
+
+	if err := client.ExportContacts(fileName); err != nil {
+		t.Error(err)
+		return
+	}
+
+	client2 := InitConfig()
+	added, err := client2.ImportContacts(fileName)
+	if err != nil || added != 2 {
+		t.Error("Error in ImportContacts: ", err)
+		return
+	}
+	imported, ok := client2.contactMap[string(contact1.PubKeyHash)]
+	if !ok || imported.FirstName != "Jaeha" || imported.LastName != "Choi" || !imported.Verified {
+		t.Error("Imported contact mismatch")
+		return
+	}
+	if !bytes.Equal(imported.PubKey.Bytes, contact1.PubKey.Bytes) {
+		t.Error("Imported public key mismatch")
+		return
+	}
+
+	// Importing again should not add duplicates
+	if added, err = client2.ImportContacts(fileName); err != nil || added != 0 || len(client2.contactMap) != 2 {
+		t.Error("Duplicate contacts were added")
+		return
+	}
+}
+
+func TestExportSingleContact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "contact.json")
+
+	client := InitConfig()
+	contact1 := contactHelper(t, "Jaeha", "Choi")
+	contact2 := contactHelper(t, "Build", "Server")
+	client.mergeContact(contact1)
+	client.mergeContact(contact2)
+
+	if err := client.ExportContacts(fileName, string(contact2.PubKeyHash)); err != nil {
+		t.Error(err)
+		return
+	}
+	client2 := InitConfig()
+	if added, err := client2.ImportContacts(fileName); err != nil || added != 1 {
+		t.Error("Error in ImportContacts: ", err)
+		return
+	}
+	if _, ok := client2.contactMap[string(contact2.PubKeyHash)]; !ok {
+		t.Error("Exported contact was not imported")
+		return
+	}
+
+	if err := client.ExportContacts(fileName, "unknown"); err != ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError, got: ", err)
+		return
+	}
+}
+
+func TestImportContactsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	contact := contactHelper(t, "Jaeha", "Choi")
+	card := contact.toCard()
+
+	tests := []struct {
+		name     string
+		contents string
+		err      error
+	}{
+		{"not json", "contacts", InvalidContactError},
+		{"newer version", `{"version": 100, "contacts": []}`, UnsupportedVersionError},
+		{"no pem block", `{"version": 1, "contacts": [{"public_key": "key"}]}`, InvalidContactError},
+		{"wrong fingerprint", `{"version": 1, "contacts": [{"public_key": ` + strconv.Quote(card.PubKey) +
+			`, "fingerprint": "00"}]}`, FingerprintMismatchError},
+		{"wrong pem type", `{"version": 1, "contacts": [{"public_key": ` +
+			strconv.Quote(strings.ReplaceAll(card.PubKey, "RSA PUBLIC KEY", "PRIVATE KEY")) + `}]}`, InvalidContactError},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_"))
+		if err := ioutil.WriteFile(fileName, []byte(test.contents), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		client := InitConfig()
+		if _, err := client.ImportContacts(fileName); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		if len(client.contactMap) != 0 {
+			t.Errorf("%s: invalid contact was added", test.name)
+		}
+	}
+}
+
+func TestImportContactsPKIX(t *testing.T) {
+	contact := contactHelper(t, "Jaeha", "Choi")
+	pubKey, _, err := cryptography.ImportPubKey([]byte(contact.toCard().PubKey))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pkixPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	fileName := filepath.Join(t.TempDir(), "contacts.json")
+	contents := `{"version": 1, "contacts": [{"first_name": "Jaeha", "public_key": ` + strconv.Quote(string(pkixPem)) +
+		`, "fingerprint": "` + contact.Fingerprint() + `"}]}`
+	if err = ioutil.WriteFile(fileName, []byte(contents), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := InitConfig()
+	if added, err := client.ImportContacts(fileName); err != nil || added != 1 {
+		t.Error("Expected 1 contact, got: ", added, err)
+		return
+	}
+	imported, ok := client.contactMap[string(contact.PubKeyHash)]
+	if !ok {
+		t.Error("Contact was not added with PKCS #1 fingerprint")
+		return
+	}
+	if imported.PubKey.Type != "RSA PUBLIC KEY" || !bytes.Equal(imported.PubKey.Bytes, contact.PubKey.Bytes) {
+		t.Error("Imported public key was not stored in canonical format")
+	}
+}
+
+func TestContactString(t *testing.T) {
+	client := InitConfig()
+	contact := contactHelper(t, "Jaeha", "Choi")
+	contact.Verified = true
+	client.mergeContact(contact)
+
+	str, err := client.ExportContactString(string(contact.PubKeyHash))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(str, contactStringPrefix) {
+		t.Error("Contact string does not have prefix")
+		return
+	}
+
+	client2 := InitConfig()
+	imported, added, err := client2.ImportContactString(str)
+	if err != nil || !added {
+		t.Error("Error in ImportContactString: ", err)
+		return
+	}
+	if imported.FirstName != "Jaeha" || imported.LastName != "Choi" || !imported.Verified ||
+		imported.Fingerprint() != contact.Fingerprint() {
+		t.Error("Imported contact mismatch")
+		return
+	}
+
+	if _, _, err = client2.ImportContactString(str[:len(str)-10]); err != InvalidContactError {
+		t.Error("Expected InvalidContactError, got: ", err)
+		return
+	}
+	if _, _, err = client2.ImportContactString("coconut:AA"); err != InvalidContactError {
+		t.Error("Expected InvalidContactError, got: ", err)
+		return
+	}
+}
+
+func TestGroups(t *testing.T) {
+	client := InitConfig()
+	client.DataPath = t.TempDir()
+	contact1 := contactHelper(t, "Build", "Server1")
+	contact2 := contactHelper(t, "Build", "Server2")
+	client.mergeContact(contact1)
+	client.mergeContact(contact2)
+
+	if err := client.CreateGroup("builders"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := client.CreateGroup("builders"); err != GroupExistsError {
+		t.Error("Expected GroupExistsError, got: ", err)
+		return
+	}
+	if err := client.AddGroupMember("unknown", string(contact1.PubKeyHash)); err != GroupNotFoundError {
+		t.Error("Expected GroupNotFoundError, got: ", err)
+		return
+	}
+	if err := client.AddGroupMember("builders", "unknown"); err != ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError, got: ", err)
+		return
+	}
+	for _, contact := range []*Contact{contact1, contact2, contact1} {
+		if err := client.AddGroupMember("builders", string(contact.PubKeyHash)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if len(client.groupMap["builders"].Members) != 2 {
+		t.Error("Duplicate member was added")
+		return
+	}
+
+	// Groups should persist
+	if err := client.WriteGroupsFile(); err != nil {
+		t.Error(err)
+		return
+	}
+	client2 := InitConfig()
+	client2.DataPath = client.DataPath
+	if err := client2.ReadGroupsFile(); err != nil {
+		t.Error(err)
+		return
+	}
+	groups := client2.Groups()
+	if len(groups) != 1 || groups[0].Name != "builders" || len(groups[0].Members) != 2 {
+		t.Error("Groups were not restored")
+		return
+	}
+
+	if !client.RemoveGroupMember("builders", string(contact1.PubKeyHash)) ||
+		client.RemoveGroupMember("builders", string(contact1.PubKeyHash)) {
+		t.Error("Error in RemoveGroupMember")
+		return
+	}
+	if !client.RemoveGroup("builders") || client.RemoveGroup("builders") {
+		t.Error("Error in RemoveGroup")
+		return
+	}
+}
+
+func TestSendToContacts(t *testing.T) {
+	defer func() {
+		if err := os.RemoveAll(util.DownloadPath); err != nil {
+			log.Debug(err)
+		}
+	}()
+	testFileN := "../../pkg/testdata/checksum.txt"
+
+	client := InitConfig()
+	var err error
+	if client.privKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Error(err)
+		return
+	}
+
+	contact1, key1 := contactKeyHelper(t, "Build", "Server1")
+	contact2, key2 := contactKeyHelper(t, "Build", "Server2")
+	contact3 := &Contact{PubKeyHash: []byte("removed contact")}
+	contact4 := contactHelper(t, "Build", "Offline")
+	keys := map[string]*rsa.PrivateKey{
+		string(contact1.PubKeyHash): key1,
+		string(contact2.PubKeyHash): key2,
+	}
+
+	streams := make(map[string]*bytes.Buffer)
+	relay := func(rxPubKeyHash string, writeData func(writer io.Writer) error) error {
+		if rxPubKeyHash == string(contact4.PubKeyHash) {
+			return common.ReceiverNotAvailable
+		}
+		streams[rxPubKeyHash] = &bytes.Buffer{}
+		return writeData(streams[rxPubKeyHash])
+	}
+
+	results, err := client.sendToContacts([]*Contact{contact1, contact2, contact3, contact4}, testFileN, relay)
+	if err != nil || len(results) != 4 {
+		t.Error("Error in sendToContacts: ", err)
+		return
+	}
+	if results[0].Err != nil || results[1].Err != nil ||
+		results[2].Err != ContactNotFoundError || results[3].Err != common.ReceiverNotAvailable {
+		t.Error("Unexpected results")
+		return
+	}
+
+	// Each receiver should be able to decrypt the file with its own key
+	for pkHash, stream := range streams {
+		ag, err := cryptography.DecryptSetup()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = ag.Decrypt(stream, &client.privKey.PublicKey, keys[pkHash]); err != nil {
+			t.Error("Error in Decrypt: ", err)
+			return
+		}
+		expected, _ := ioutil.ReadFile(testFileN)
+		received, _ := ioutil.ReadFile(filepath.Join(util.DownloadPath, "checksum.txt"))
+		if !bytes.Equal(expected, received) {
+			t.Error("Decrypted file mismatch")
+			return
+		}
+	}
+}
+
+func TestKeyHandover(t *testing.T) {
+	alice0, key0 := contactKeyHelper(t, "Alice", "Laptop")
+	alice0.Verified = true
+	_, key1 := contactKeyHelper(t, "Alice", "Laptop")
+	alice2, key2 := contactKeyHelper(t, "Alice", "Laptop")
+	handover1, err := cryptography.SignHandover(key0, &key1.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handover2, err := cryptography.SignHandover(key1, &key2.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice rotated keys twice; one of her contacts is offline
+	sender := InitConfig()
+	sender.handovers = []*cryptography.KeyHandover{handover1, handover2}
+	bob := contactHelper(t, "Bob", "Desktop")
+	offline := contactHelper(t, "Build", "Offline")
+	bob.HandoverPending = true
+	offline.HandoverPending = true
+	sender.mergeContact(bob)
+	sender.mergeContact(offline)
+
+	var stream bytes.Buffer
+	relay := func(rxPubKeyHash string, writeData func(writer io.Writer) error) error {
+		if rxPubKeyHash == string(offline.PubKeyHash) {
+			return common.ReceiverNotAvailable
+		}
+		return writeData(&stream)
+	}
+	if results := sender.announceKey(relay); len(results) != 2 {
+		t.Fatal("Expected 2 results, got: ", len(results))
+	}
+	if bob.HandoverPending || !offline.HandoverPending || !sender.HasPendingHandover() {
+		t.Error("Unexpected pending handover status")
+	}
+
+	// Bob knows Alice's original key and follows the chain of keys
+	receiver := InitConfig()
+	receiver.DataPath = t.TempDir()
+	alice0Key := alice0.PubKey.Bytes
+	receiver.mergeContact(alice0)
+	if err = receiver.CreateGroup("friends"); err != nil {
+		t.Fatal(err)
+	}
+	if err = receiver.AddGroupMember("friends", string(alice0.PubKeyHash)); err != nil {
+		t.Fatal(err)
+	}
+	streamBytes := stream.Bytes()
+	for i := 0; i < 2; i++ {
+		msg, err := util.ReadMessage(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if common.CommandCodes[msg.CommandCode] != common.KeyHandover {
+			t.Fatal("Unexpected command: ", msg.CommandCode)
+		}
+		if err = receiver.handleKeyHandover(msg); err != nil {
+			t.Fatal("Error in handleKeyHandover: ", err)
+		}
+	}
+	contact, ok := receiver.contactMap[string(alice2.PubKeyHash)]
+	if !ok || len(receiver.contactMap) != 1 {
+		t.Fatal("Contact was not replaced with the successor key")
+	}
+	if !contact.Verified || contact.FirstName != "Alice" || len(contact.PreviousKeys) != 2 ||
+		!bytes.Equal(contact.PreviousKeys[0].Bytes, alice0Key) {
+		t.Error("Contact information was not kept")
+	}
+	if members := receiver.groupMap["friends"].Members; len(members) != 1 || members[0] != string(alice2.PubKeyHash) {
+		t.Error("Group membership was not updated")
+	}
+
+	// Announcing again does not change anything
+	stream.Write(streamBytes)
+	for i := 0; i < 2; i++ {
+		msg, _ := util.ReadMessage(&stream)
+		if err = receiver.handleKeyHandover(msg); err != nil {
+			t.Error("Replayed handover should be ignored, got: ", err)
+		}
+	}
+	if len(receiver.contactMap) != 1 {
+		t.Error("Replayed handover changed contacts")
+	}
+
+	// Successor not signed by the current key is rejected
+	_, attackerKey := contactKeyHelper(t, "Mallory", "")
+	forged, err := cryptography.SignHandover(attackerKey, &attackerKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.OldPubKey = alice2.PubKey.Bytes
+	data, _ := forged.MarshalBinary()
+	if _, err = receiver.HandleKeyHandover(data); err != cryptography.InvalidHandoverSignature {
+		t.Error("Expected InvalidHandoverSignature, got: ", err)
+	}
+	if _, ok = receiver.contactMap[string(alice2.PubKeyHash)]; !ok {
+		t.Error("Forged handover changed contact")
+	}
+}
+
+// TestKeyHandoverConcurrent reads contacts while handovers are applied, as commandHandler
+// applies them while other methods are called. Run with -race.
+func TestKeyHandoverConcurrent(t *testing.T) {
+	alice, key := contactKeyHelper(t, "Alice", "Laptop")
+	var handovers [][]byte
+	for i := 0; i < 5; i++ {
+		_, next := contactKeyHelper(t, "Alice", "Laptop")
+		handover, err := cryptography.SignHandover(key, &next.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := handover.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		handovers = append(handovers, data)
+		key = next
+	}
+
+	client := InitConfig()
+	client.DataPath = t.TempDir()
+	client.mergeContact(alice)
+	if err := client.CreateGroup("friends"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddGroupMember("friends", string(alice.PubKeyHash)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, data := range handovers {
+			if _, err := client.HandleKeyHandover(data); err != nil {
+				t.Error("Error in HandleKeyHandover: ", err)
+			}
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		for _, contact := range client.Contacts() {
+			client.RLockContacts()
+			_ = contact.Fingerprint()
+			client.RUnlockContacts()
+		}
+		if err := client.WriteContactsFile(); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.HasPendingHandover()
+	}
+
+	last := cryptography.PemToSha256(cryptography.PubKeyToPem(&key.PublicKey))
+	if contact, err := client.FindContact(hex.EncodeToString(last)); err != nil || len(contact.PreviousKeys) != 5 {
+		t.Error("Contact was not replaced with the last successor key: ", err)
+	}
+}
+
+func TestLoadKeysStorage(t *testing.T) {
+	// Another directory stands in for a storage other than files in KeyPath
+	storage := cryptography.NewFileStorage(t.TempDir())
+	keyStorages["other"] = func(keyPath string) cryptography.KeyStorage { return storage }
+	defer delete(keyStorages, "other")
+
+	// Keys created with the file storage
+	client := InitConfig()
+	client.KeyPath = t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(client.KeyPath, "key.priv"), contactKeyPemHelper(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := client.Fingerprint()
+
+	// Private key is moved to the configured storage
+	client.KeyStorage = "other"
+	if err := client.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Fingerprint() != fingerprint {
+		t.Error("Different key loaded after migration")
+	}
+	if _, err := os.Stat(filepath.Join(client.KeyPath, "key.priv")); !os.IsNotExist(err) {
+		t.Error("Private key file was not removed")
+	}
+	if _, err := storage.Load("key.priv"); err != nil {
+		t.Error("Private key was not moved: ", err)
+	}
+
+	// Switching back to file does not find the private key
+	client.KeyStorage = keyStorageFile
+	if err := client.LoadKeys(); !errors.Is(err, cryptography.KeyMissing) {
+		t.Error("Expected KeyMissing, got: ", err)
+	}
+
+	client.KeyStorage = "unknown"
+	if err := client.LoadKeys(); err != UnknownKeyStorageError {
+		t.Error("Expected UnknownKeyStorageError, got: ", err)
+	}
+}
+
+// contactKeyPemHelper returns a newly generated private key in PEM format
+func contactKeyPemHelper(t *testing.T) []byte {
+	t.Helper()
+	_, key := contactKeyHelper(t, "", "")
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// backupClientHelper creates a client with keys, a contact and config in a temporary directory
+func backupClientHelper(t *testing.T) (client *Client, configPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	client = InitConfig()
+	client.KeyPath = filepath.Join(dir, "keys")
+	client.DataPath = filepath.Join(dir, "data")
+	configPath = filepath.Join(dir, "config.yml")
+	for _, path := range []string{client.KeyPath, client.DataPath} {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := util.WriteConfig(configPath, client); err != nil {
+		t.Fatal(err)
+	}
+	return client, configPath
+}
+
+func TestBackupRestore(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	client, configPath := backupClientHelper(t)
+	if err := ioutil.WriteFile(filepath.Join(client.KeyPath, "key.priv"), contactKeyPemHelper(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	contact := contactHelper(t, "Jaeha", "Choi")
+	client.mergeContact(contact)
+	if err := client.WriteContactsFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	backupFileN := filepath.Join(t.TempDir(), "identity.backup")
+	if err := client.CreateBackup(backupFileN, configPath, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateBackup(backupFileN, configPath, passphrase); !os.IsExist(err) {
+		t.Error("Existing backup should not be overwritten, got: ", err)
+	}
+
+	// Restored config points to the existing identity
+	newConfigPath := filepath.Join(t.TempDir(), "config.yml")
+	if _, err := RestoreBackup(backupFileN, newConfigPath, DefaultConfig(), passphrase, false); err != IdentityExistsError {
+		t.Error("Expected IdentityExistsError, got: ", err)
+	}
+	if _, err := RestoreBackup(backupFileN, newConfigPath, DefaultConfig(), []byte("wrong"), false); err != cryptography.InvalidPassphrase {
+		t.Error("Expected InvalidPassphrase, got: ", err)
+	}
+
+	// Restore on a new device with its own config
+	newClient, newConfigPath := backupClientHelper(t)
+	restored, err := RestoreBackup(backupFileN, newConfigPath, DefaultConfig(), passphrase, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.KeyPath != newClient.KeyPath || restored.Fingerprint() != client.Fingerprint() {
+		t.Error("Identity was not restored to the new device")
+	}
+	if err = restored.ReadContactsFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.contactMap[string(contact.PubKeyHash)]; !ok {
+		t.Error("Contacts were not restored")
+	}
+	if info, err := os.Stat(filepath.Join(restored.KeyPath, "key.priv")); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Unexpected private key permissions")
+	}
+
+	// Existing identity is only replaced with force
+	if _, err = RestoreBackup(backupFileN, newConfigPath, DefaultConfig(), passphrase, false); err != IdentityExistsError {
+		t.Error("Expected IdentityExistsError, got: ", err)
+	}
+	if _, err = RestoreBackup(backupFileN, newConfigPath, DefaultConfig(), passphrase, true); err != nil {
+		t.Error("Error in RestoreBackup with force: ", err)
+	}
+	if _, err = os.Stat(filepath.Join(restored.DataPath, "contacts.gob.bak")); err != nil {
+		t.Error("Existing contacts were not kept: ", err)
+	}
+}
+
+func TestReadBackupArchiveModified(t *testing.T) {
+	files := map[string][]byte{
+		"key.pub":    []byte("public key"),
+		"key.priv":   []byte("private key"),
+		"config.yml": []byte("server_port: 9129"),
+	}
+	archive, err := writeBackupArchive(files, "fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, manifest, err := readBackupArchive(archive); err != nil || manifest.Fingerprint != "fingerprint" {
+		t.Fatal("Error in readBackupArchive: ", err)
+	}
+
+	modified := bytes.Replace(archive, []byte("private key"), []byte("private kez"), 1)
+	if _, _, err = readBackupArchive(modified); err != InvalidBackupError {
+		t.Error("Expected InvalidBackupError, got: ", err)
+	}
+
+	delete(files, "key.priv")
+	archive, err = writeBackupArchive(files, "fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = readBackupArchive(archive); err != InvalidBackupError {
+		t.Error("Expected InvalidBackupError, got: ", err)
+	}
+}
+
+func TestWriteDataFile(t *testing.T) {
+	client := InitConfig()
+	client.DataPath = t.TempDir()
+	client.mergeContact(contactHelper(t, "Jaeha", "Choi"))
+	if err := client.WriteContactsFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed write keeps the existing file
+	if err := client.writeDataFile("contacts.gob", make(chan int)); err == nil {
+		t.Error("Expected error while encoding channel")
+	}
+	client2 := InitConfig()
+	client2.DataPath = client.DataPath
+	if err := client2.ReadContactsFile(); err != nil || len(client2.Contacts()) != 1 {
+		t.Error("Contacts file was not kept: ", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(client.DataPath, "*")); len(files) != 1 {
+		t.Error("Unexpected files in the data directory: ", files)
+	}
+	if info, err := os.Stat(filepath.Join(client.DataPath, "contacts.gob")); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Unexpected contacts file mode: ", err)
+	}
+}
@@ -0,0 +1,759 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// defaultConnectTimeout is a default time limit for connecting to the relay server
+	defaultConnectTimeout = 10 * time.Second
+	// defaultRequestTimeout is a default time limit for the result of a request to the relay server
+	defaultRequestTimeout = 60 * time.Second
+	// envPrefix is the prefix of environment variables for settings
+	envPrefix = "COCONUT_"
+)
+
+// Accepted senders of AutoAcceptConfig.From
+const (
+	AcceptContacts = "contacts"
+	AcceptVerified = "verified"
+	AcceptNone     = "none"
+)
+
+// Source is where the value of a setting was set
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// logLevels maps LogConfig.Level to logging modes
+var logLevels = map[string]log.LoggingMode{
+	"debug":   log.DEBUG,
+	"info":    log.INFO,
+	"warning": log.WARNING,
+	"error":   log.ERROR,
+	"fatal":   log.FATAL,
+}
+
+// Config stores settings of the client. Settings are layered in the order of defaults,
+// config file, environment variables and flags, and later layers override earlier ones.
+type Config struct {
+	// Profile is the name of the profile these settings belong to. It is not a setting.
+	Profile string `yaml:"-"`
+	// ServerHost is the central relay server's ip address
+	ServerHost string `yaml:"server_host"`
+	// ServerPort is the central relay server's port
+	ServerPort uint16 `yaml:"server_port"`
+	// FallbackServers are relay servers ("host:port") tried in order if ServerHost cannot be reached
+	FallbackServers []string `yaml:"fallback_servers"`
+	// LocalPort is a client port that will be opened for P2P connection,
+	// in case hole punching fails
+	LocalPort uint16 `yaml:"local_port"`
+	// KeyPath is a path for asymmetric keys
+	KeyPath string `yaml:"key_path"`
+	// DataPath is a path for various data,
+	// including UI interface, gob file that contains contact list, etc.
+	DataPath string `yaml:"data_path"`
+	// DownloadPath is a path for received files
+	DownloadPath string `yaml:"download_path"`
+	// KeyStorage is the name of the storage for the private key ("file" or "secret-service").
+	// Public key is always stored in KeyPath.
+	KeyStorage string `yaml:"key_storage"`
+	// SocketPath is a path for the Unix domain socket of the daemon
+	SocketPath string `yaml:"socket_path"`
+	// ConnectTimeout limits the time to connect to each relay server
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// RequestTimeout limits the time to wait for the result of a request to the relay server
+	RequestTimeout time.Duration    `yaml:"request_timeout"`
+	AutoAccept     AutoAcceptConfig `yaml:"auto_accept"`
+	Bandwidth      BandwidthConfig  `yaml:"bandwidth"`
+	History        HistoryConfig    `yaml:"history"`
+	Log            LogConfig        `yaml:"log"`
+}
+
+// AutoAcceptConfig decides which received files are kept
+type AutoAcceptConfig struct {
+	// From is AcceptContacts to keep files from every contact, AcceptVerified to keep files
+	// only from verified contacts, or AcceptNone to discard every file
+	From string `yaml:"from"`
+	// MaxFileSize is the size of the largest file that is received. 0 for no limit.
+	MaxFileSize ByteSize `yaml:"max_file_size"`
+}
+
+// BandwidthConfig limits transfer rates in bytes per second. 0 for no limit.
+type BandwidthConfig struct {
+	Upload   ByteSize `yaml:"upload"`
+	Download ByteSize `yaml:"download"`
+}
+
+// HistoryConfig limits the transfer history
+type HistoryConfig struct {
+	// MaxEntries is the number of transfers kept. 0 for no limit.
+	MaxEntries int `yaml:"max_entries"`
+	// MaxAge is how long transfers are kept. 0 for no limit.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// LogConfig stores logging settings
+type LogConfig struct {
+	// Level is one of "debug", "info", "warning", "error" and "fatal"
+	Level string `yaml:"level"`
+	// File is the path of the log file, relative to DataPath unless absolute. Logs are written to the
+	// file in addition to stderr. Empty for no log file.
+	File string `yaml:"file"`
+	// MaxSize is the size of the log file when it is rotated
+	MaxSize ByteSize `yaml:"max_size"`
+	// MaxAge is how long rotated log files are kept. 0 to keep them until maxLogBackups is reached.
+	// The current log file is only rotated by MaxSize.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Redact lists information masked in logs written to stderr, in addition to Add Codes and
+	// key material: RedactFileNames and RedactAddresses
+	Redact []string `yaml:"redact"`
+	// FileRedact lists information masked in the log file, like Redact
+	FileRedact []string `yaml:"file_redact"`
+	// Format is LogFormatText or LogFormatJSON
+	Format string `yaml:"format"`
+	// Subsystems are logging levels of subsystems as "subsystem=level", such as "transfer=debug".
+	// Subsystems not listed use Level.
+	Subsystems []string `yaml:"subsystems"`
+}
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Information that can be masked in logs
+const (
+	RedactFileNames = "file_names"
+	RedactAddresses = "addresses"
+)
+
+const (
+	// defaultLogFile is the log file in the data directory
+	defaultLogFile = "logs/coconut.log"
+	// MaxLogBackups is the number of rotated log files kept
+	MaxLogBackups = 5
+)
+
+// Mode returns the logging mode of Level, or log.WARNING if Level is invalid
+func (config LogConfig) Mode() log.LoggingMode {
+	if mode, ok := logLevels[config.Level]; ok {
+		return mode
+	}
+	return log.WARNING
+}
+
+// SubsystemModes returns logging modes of Subsystems. Invalid entries are ignored.
+func (config LogConfig) SubsystemModes() map[string]log.LoggingMode {
+	modes := make(map[string]log.LoggingMode)
+	for _, entry := range config.Subsystems {
+		name, level, _ := strings.Cut(entry, "=")
+		if mode, ok := logLevels[level]; ok && name != "" {
+			modes[name] = mode
+		}
+	}
+	return modes
+}
+
+// FilePath returns the path of the log file in dataPath, or an empty string if File is empty
+func (config LogConfig) FilePath(dataPath string) string {
+	if config.File == "" || filepath.IsAbs(config.File) {
+		return config.File
+	}
+	return filepath.Join(dataPath, config.File)
+}
+
+// StderrRedaction returns information masked in logs written to stderr
+func (config LogConfig) StderrRedaction() log.Redaction {
+	return redaction(config.Redact)
+}
+
+// FileRedaction returns information masked in the log file
+func (config LogConfig) FileRedaction() log.Redaction {
+	return redaction(config.FileRedact)
+}
+
+// redaction returns log.Redaction of names
+func redaction(names []string) (r log.Redaction) {
+	for _, name := range names {
+		switch name {
+		case RedactFileNames:
+			r.FileNames = true
+		case RedactAddresses:
+			r.Addresses = true
+		}
+	}
+	return r
+}
+
+// Equal returns true if config and other are the same settings
+func (config LogConfig) Equal(other LogConfig) bool {
+	return reflect.DeepEqual(config, other)
+}
+
+// DefaultConfig returns default settings of the default profile. Paths are platform-appropriate
+// (see DefaultPaths).
+func DefaultConfig() Config {
+	return ConfigWithPaths(DefaultPaths())
+}
+
+// ConfigWithPaths returns default settings with locations in paths
+func ConfigWithPaths(paths Paths) Config {
+	return Config{
+		Profile:         DefaultProfile,
+		ServerHost:      "127.0.0.1", // TODO: update this value after deploying the relay server
+		ServerPort:      defaultServerPort,
+		FallbackServers: nil,
+		LocalPort:       defaultLocalPort,
+		KeyPath:         paths.Key,
+		DataPath:        paths.Data,
+		DownloadPath:    paths.Download,
+		KeyStorage:      keyStorageFile,
+		SocketPath:      paths.Socket,
+		ConnectTimeout:  defaultConnectTimeout,
+		RequestTimeout:  defaultRequestTimeout,
+		AutoAccept:      AutoAcceptConfig{From: AcceptContacts, MaxFileSize: 0},
+		Bandwidth:       BandwidthConfig{Upload: 0, Download: 0},
+		History:         HistoryConfig{MaxEntries: 1000, MaxAge: 90 * 24 * time.Hour},
+		Log: LogConfig{Level: "warning", File: defaultLogFile, MaxSize: 10 << 20, MaxAge: 7 * 24 * time.Hour,
+			Redact: nil, FileRedact: []string{RedactFileNames, RedactAddresses}, Format: LogFormatText, Subsystems: nil},
+	}
+}
+
+// ConfigError is returned when settings are invalid. Each problem names the setting.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// ByteSize is a number of bytes. In config files, environment variables and flags, it can be
+// written with a unit (B, KB, MB, GB, KiB, MiB, GiB), e.g. "10MB".
+type ByteSize int64
+
+// byteUnits are units of ByteSize, largest first
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+}
+
+// String returns size with the largest unit that represents it exactly
+func (size ByteSize) String() string {
+	if size == 0 {
+		return "0"
+	}
+	for _, unit := range []int{3, 4, 5} {
+		if size%byteUnits[unit].size == 0 {
+			return strconv.FormatInt(int64(size/byteUnits[unit].size), 10) + byteUnits[unit].suffix
+		}
+	}
+	return strconv.FormatInt(int64(size), 10)
+}
+
+// Set parses s as ByteSize
+func (size *ByteSize) Set(s string) (err error) {
+	s = strings.TrimSpace(s)
+	multiplier := ByteSize(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > int64(1<<62/multiplier) {
+		return errors.New("must be a non-negative size such as 500KB or 10MB")
+	}
+	*size = ByteSize(n) * multiplier
+	return nil
+}
+
+// UnmarshalYAML parses sizes with or without a unit
+func (size *ByteSize) UnmarshalYAML(value *yaml.Node) (err error) {
+	var s string
+	if err = value.Decode(&s); err != nil {
+		return err
+	}
+	if err = size.Set(s); err != nil {
+		// TypeError is reported with other errors in the file
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %v, got %q", value.Line, err, s)}}
+	}
+	return nil
+}
+
+// MarshalYAML writes size with a unit, or as a number if no unit represents it exactly
+func (size ByteSize) MarshalYAML() (interface{}, error) {
+	if s := size.String(); strings.IndexFunc(s, unicode.IsLetter) != -1 {
+		return s, nil
+	}
+	return int64(size), nil
+}
+
+// stringValue is flag.Value for string settings
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+// portValue is flag.Value for port settings
+type portValue uint16
+
+func (v *portValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *portValue) Set(s string) error {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return errors.New("must be a port between 1 and 65535")
+	}
+	*v = portValue(port)
+	return nil
+}
+
+// intValue is flag.Value for settings that are non-negative integers
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return errors.New("must be a non-negative integer")
+	}
+	*v = intValue(i)
+	return nil
+}
+
+// durationValue is flag.Value for duration settings
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("must be a duration such as 30s or 1m")
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// listValue is flag.Value for comma separated lists
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+// Reload is how changes of a setting are applied to a running client (see Client.ApplyConfig)
+type Reload int
+
+const (
+	// ReloadLive settings are applied immediately
+	ReloadLive Reload = iota
+	// ReloadReconnect settings are applied when the client connects to the relay server
+	ReloadReconnect
+	// ReloadRestart settings are applied when the program is restarted
+	ReloadRestart
+)
+
+// setting is a setting that can be set by environment variables and flags
+type setting struct {
+	// key is the key in config files. Keys of nested settings are joined with ".".
+	key string
+	// flag is the name of the command line flag
+	flag  string
+	usage string
+	// reload is how changes of the setting are applied to a running client
+	reload Reload
+	// value returns the setting in config
+	value func(config *Config) flag.Value
+}
+
+// settings lists every setting in the order of config files
+var settings = []setting{
+	{"server_host", "host", "Server address", ReloadReconnect,
+		func(c *Config) flag.Value { return (*stringValue)(&c.ServerHost) }},
+	{"server_port", "port", "Server port", ReloadReconnect,
+		func(c *Config) flag.Value { return (*portValue)(&c.ServerPort) }},
+	{"fallback_servers", "fallback-servers", "Comma separated relay servers (host:port) tried if the server cannot be reached", ReloadReconnect,
+		func(c *Config) flag.Value { return (*listValue)(&c.FallbackServers) }},
+	{"local_port", "local-port", "Local port", ReloadReconnect,
+		func(c *Config) flag.Value { return (*portValue)(&c.LocalPort) }},
+	{"key_path", "cert-path", "Key pair path", ReloadRestart,
+		func(c *Config) flag.Value { return (*stringValue)(&c.KeyPath) }},
+	{"data_path", "data-path", "Data path", ReloadRestart,
+		func(c *Config) flag.Value { return (*stringValue)(&c.DataPath) }},
+	{"download_path", "download-path", "Path for received files", ReloadLive,
+		func(c *Config) flag.Value { return (*stringValue)(&c.DownloadPath) }},
+	{"key_storage", "key-storage", "Private key storage (file or secret-service)", ReloadRestart,
+		func(c *Config) flag.Value { return (*stringValue)(&c.KeyStorage) }},
+	{"socket_path", "socket-path", "Daemon socket path", ReloadRestart,
+		func(c *Config) flag.Value { return (*stringValue)(&c.SocketPath) }},
+	{"connect_timeout", "connect-timeout", "Time limit for connecting to a relay server", ReloadLive,
+		func(c *Config) flag.Value { return (*durationValue)(&c.ConnectTimeout) }},
+	{"request_timeout", "request-timeout", "Time limit for results of requests to the relay server", ReloadLive,
+		func(c *Config) flag.Value { return (*durationValue)(&c.RequestTimeout) }},
+	{"auto_accept.from", "auto-accept-from", "Keep received files from contacts, verified contacts or none", ReloadLive,
+		func(c *Config) flag.Value { return (*stringValue)(&c.AutoAccept.From) }},
+	{"auto_accept.max_file_size", "auto-accept-max-file-size", "Largest received file that is kept. 0 for no limit.", ReloadLive,
+		func(c *Config) flag.Value { return &c.AutoAccept.MaxFileSize }},
+	{"bandwidth.upload", "bandwidth-upload", "Upload limit per second. 0 for no limit.", ReloadLive,
+		func(c *Config) flag.Value { return &c.Bandwidth.Upload }},
+	{"bandwidth.download", "bandwidth-download", "Download limit per second. 0 for no limit.", ReloadLive,
+		func(c *Config) flag.Value { return &c.Bandwidth.Download }},
+	{"history.max_entries", "history-max-entries", "Number of transfers kept in the history. 0 for no limit.", ReloadLive,
+		func(c *Config) flag.Value { return (*intValue)(&c.History.MaxEntries) }},
+	{"history.max_age", "history-max-age", "Time transfers are kept in the history. 0 for no limit.", ReloadLive,
+		func(c *Config) flag.Value { return (*durationValue)(&c.History.MaxAge) }},
+	{"log.level", "log-level", "Logging level (debug, info, warning, error or fatal)", ReloadLive,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Level) }},
+	{"log.file", "log-file", "Log file in the data directory, or an absolute path. Empty for no log file.", ReloadLive,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.File) }},
+	{"log.max_size", "log-max-size", "Size of the log file when it is rotated", ReloadLive,
+		func(c *Config) flag.Value { return &c.Log.MaxSize }},
+	{"log.max_age", "log-max-age", "Time rotated log files are kept. 0 to keep the last 5.", ReloadLive,
+		func(c *Config) flag.Value { return (*durationValue)(&c.Log.MaxAge) }},
+	{"log.redact", "log-redact", "Comma separated information masked on stderr (file_names, addresses)", ReloadLive,
+		func(c *Config) flag.Value { return (*listValue)(&c.Log.Redact) }},
+	{"log.file_redact", "log-file-redact", "Comma separated information masked in the log file (file_names, addresses)", ReloadLive,
+		func(c *Config) flag.Value { return (*listValue)(&c.Log.FileRedact) }},
+	{"log.format", "log-format", "Log format (text or json)", ReloadLive,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Format) }},
+	{"log.subsystems", "log-subsystems", "Comma separated logging levels of subsystems, such as transfer=debug", ReloadLive,
+		func(c *Config) flag.Value { return (*listValue)(&c.Log.Subsystems) }},
+}
+
+// envName returns the environment variable for the setting with key
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// recordedFlag records the value of a flag without parsing it, so that flags can be parsed
+// before the config file is read
+type recordedFlag struct {
+	key    string
+	values map[string]string
+}
+
+func (f *recordedFlag) String() string { return f.values[f.key] }
+
+func (f *recordedFlag) Set(s string) error {
+	f.values[f.key] = s
+	return nil
+}
+
+// RegisterFlags defines a flag for every setting in flags. When flags are parsed, values of
+// flags that were set are stored in the returned map by setting key, to be passed to LoadConfig.
+func RegisterFlags(flags *flag.FlagSet) (values map[string]string) {
+	values = make(map[string]string)
+	for _, s := range settings {
+		flags.Var(&recordedFlag{key: s.key, values: values}, s.flag, s.usage)
+	}
+	return values
+}
+
+// LoadConfig returns settings from defaults, fileName, environment variables in environ
+// ("KEY=value", as returned by os.Environ) and flags by setting key, and the source of each
+// setting. Settings are validated after every layer is applied. A missing fileName is not an error.
+// Returns *ConfigError if fileName cannot be parsed or a setting is invalid.
+func LoadConfig(fileName string, environ []string, flags map[string]string) (
+	config *Config, sources map[string]Source, err error) {
+	return LoadConfigWithDefaults(DefaultConfig(), fileName, environ, flags)
+}
+
+// LoadConfigWithDefaults is LoadConfig with default settings in defaults, e.g. from ProfileConfig
+func LoadConfigWithDefaults(defaults Config, fileName string, environ []string, flags map[string]string) (
+	config *Config, sources map[string]Source, err error) {
+	config = &defaults
+	sources = make(map[string]Source)
+	for _, s := range settings {
+		sources[s.key] = SourceDefault
+	}
+	var problems []string
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		log.Debug(err)
+		log.Error("Error while reading config file")
+		return nil, nil, err
+	} else if err == nil {
+		keys, err := readConfigData(data, config)
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			// Other settings are decoded, so that every problem is reported
+			for _, e := range typeErr.Errors {
+				problems = append(problems, fileName+": "+e)
+			}
+		} else if err != nil {
+			return nil, nil, &ConfigError{Problems: []string{fileName + ": " + strings.TrimPrefix(err.Error(), "yaml: ")}}
+		}
+		for _, key := range keys {
+			if _, ok := sources[key]; ok {
+				sources[key] = SourceFile
+			}
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i != -1 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for _, s := range settings {
+		if value, ok := env[envName(s.key)]; ok {
+			if err := s.value(config).Set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v, got %q", envName(s.key), err, value))
+				continue
+			}
+			sources[s.key] = SourceEnv
+		}
+	}
+	for _, s := range settings {
+		if value, ok := flags[s.key]; ok {
+			if err := s.value(config).Set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v, got %q", s.flag, err, value))
+				continue
+			}
+			sources[s.key] = SourceFlag
+		}
+	}
+
+	if err = config.Validate(); err != nil {
+		problems = append(problems, err.(*ConfigError).Problems...)
+	}
+	if len(problems) != 0 {
+		return nil, nil, &ConfigError{Problems: problems}
+	}
+	return config, sources, nil
+}
+
+// readConfigData parses data over config, and returns keys of settings in data.
+// Unknown keys are errors. If *yaml.TypeError is returned, other settings in data are applied.
+func readConfigData(data []byte, config *Config) (keys []string, err error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var typeErr *yaml.TypeError
+	if err = decoder.Decode(config); err != nil && err != io.EOF && !errors.As(err, &typeErr) {
+		log.Debug(err)
+		return nil, err
+	}
+	var node yaml.Node
+	if err = yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) != 0 {
+		keys = nodeKeys(node.Content[0], "")
+	}
+	if typeErr != nil {
+		return keys, typeErr
+	}
+	return keys, nil
+}
+
+// nodeKeys returns keys of values in mapping node, joined with "." and prefixed with prefix
+func nodeKeys(node *yaml.Node, prefix string) (keys []string) {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := prefix + node.Content[i].Value
+		if node.Content[i+1].Kind == yaml.MappingNode {
+			keys = append(keys, nodeKeys(node.Content[i+1], key+".")...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Validate returns *ConfigError listing every invalid setting
+func (config *Config) Validate() (err error) {
+	var problems []string
+	invalid := func(key string, format string, v ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, v...))
+	}
+
+	if config.ServerHost == "" {
+		invalid("server_host", "must not be empty")
+	}
+	if config.ServerPort == 0 {
+		invalid("server_port", "must be a port between 1 and 65535")
+	}
+	for _, server := range config.FallbackServers {
+		if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+			invalid("fallback_servers", "%q must be host:port", server)
+		} else if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			invalid("fallback_servers", "%q has an invalid port", server)
+		}
+	}
+	if config.LocalPort == 0 {
+		invalid("local_port", "must be a port between 1 and 65535")
+	}
+	for key, path := range map[string]string{"key_path": config.KeyPath, "data_path": config.DataPath,
+		"download_path": config.DownloadPath, "socket_path": config.SocketPath} {
+		if path == "" {
+			invalid(key, "must not be empty")
+		}
+	}
+	if _, ok := keyStorages[config.KeyStorage]; !ok {
+		invalid("key_storage", "must be one of %s, got %q", strings.Join(keyStorageNames(), ", "), config.KeyStorage)
+	}
+	if config.ConnectTimeout <= 0 {
+		invalid("connect_timeout", "must be positive, got %v", config.ConnectTimeout)
+	}
+	if config.RequestTimeout <= 0 {
+		invalid("request_timeout", "must be positive, got %v", config.RequestTimeout)
+	}
+	switch config.AutoAccept.From {
+	case AcceptContacts, AcceptVerified, AcceptNone:
+	default:
+		invalid("auto_accept.from", "must be one of %s, %s, %s, got %q",
+			AcceptContacts, AcceptVerified, AcceptNone, config.AutoAccept.From)
+	}
+	for key, size := range map[string]ByteSize{"auto_accept.max_file_size": config.AutoAccept.MaxFileSize,
+		"bandwidth.upload": config.Bandwidth.Upload, "bandwidth.download": config.Bandwidth.Download} {
+		if size < 0 {
+			invalid(key, "must not be negative")
+		}
+	}
+	if config.History.MaxEntries < 0 {
+		invalid("history.max_entries", "must not be negative, got %d", config.History.MaxEntries)
+	}
+	if config.History.MaxAge < 0 {
+		invalid("history.max_age", "must not be negative, got %v", config.History.MaxAge)
+	}
+	if _, ok := logLevels[config.Log.Level]; !ok {
+		invalid("log.level", "must be one of debug, info, warning, error, fatal, got %q", config.Log.Level)
+	}
+	if config.Log.Format != LogFormatText && config.Log.Format != LogFormatJSON {
+		invalid("log.format", "must be %s or %s, got %q", LogFormatText, LogFormatJSON, config.Log.Format)
+	}
+	if config.Log.MaxSize <= 0 {
+		invalid("log.max_size", "must be positive, got %v", config.Log.MaxSize)
+	}
+	if config.Log.MaxAge < 0 {
+		invalid("log.max_age", "must not be negative, got %v", config.Log.MaxAge)
+	}
+	for key, names := range map[string][]string{"log.redact": config.Log.Redact, "log.file_redact": config.Log.FileRedact} {
+		for _, name := range names {
+			if name != RedactFileNames && name != RedactAddresses {
+				invalid(key, "must be %s or %s, got %q", RedactFileNames, RedactAddresses, name)
+			}
+		}
+	}
+	for _, entry := range config.Log.Subsystems {
+		name, level, _ := strings.Cut(entry, "=")
+		if _, ok := logLevels[level]; !ok || name == "" {
+			invalid("log.subsystems", "must be subsystem=level, got %q", entry)
+		}
+	}
+
+	if len(problems) != 0 {
+		// Maps are iterated in random order
+		sort.Strings(problems)
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// EffectiveSetting is the value of a setting and where it was set
+type EffectiveSetting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source Source `json:"source"`
+	// Env is the environment variable for the setting
+	Env string `json:"env"`
+	// Flag is the command line flag for the setting
+	Flag string `json:"flag"`
+}
+
+// EffectiveSettings returns every setting of config with sources returned by LoadConfig
+func (config *Config) EffectiveSettings(sources map[string]Source) (effective []*EffectiveSetting) {
+	for _, s := range settings {
+		source := sources[s.key]
+		if source == "" {
+			source = SourceDefault
+		}
+		effective = append(effective, &EffectiveSetting{
+			Key:    s.key,
+			Value:  s.value(config).String(),
+			Source: source,
+			Env:    envName(s.key),
+			Flag:   "-" + s.flag,
+		})
+	}
+	return effective
+}
+
+// WriteDefaultConfig writes default settings in defaults to fileName, creating its directory.
+// Returns an error satisfying os.IsExist if fileName exists; existing files are never overwritten.
+func WriteDefaultConfig(fileName string, defaults Config) (err error) {
+	return writeConfigFile(fileName, defaults)
+}
+
+// writeConfigFile writes config to a new file fileName, creating its directory
+func writeConfigFile(fileName string, config Config) (err error) {
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating config directory")
+		return err
+	}
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while encoding config")
+		return err
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Debug(err)
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		log.Debug(err)
+		log.Error("Error while writing config file")
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
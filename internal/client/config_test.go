@@ -0,0 +1,219 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configFileHelper writes data to a config file in a temporary directory
+func configFileHelper(t *testing.T, data string) (fileName string) {
+	t.Helper()
+	fileName = filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadConfig(t *testing.T) {
+	fileName := configFileHelper(t, `server_host: relay.example.com
+server_port: 9000
+connect_timeout: 5s
+auto_accept:
+  max_file_size: 10MB
+bandwidth:
+  upload: 1MiB
+log:
+  level: info
+`)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagValues := RegisterFlags(flags)
+	if err := flags.Parse([]string{"-port", "9001", "-log-level", "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"COCONUT_SERVER_PORT=9002", "COCONUT_LOG_LEVEL=error", "COCONUT_AUTO_ACCEPT_FROM=verified",
+		"COCONUT_FALLBACK_SERVERS=a.example.com:9129, b.example.com:9129", "COCONUT_LOG_SUBSYSTEMS=transfer=debug",
+		"PATH=/bin"}
+
+	config, sources, err := LoadConfig(fileName, environ, flagValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerHost != "relay.example.com" || config.ServerPort != 9001 || config.ConnectTimeout != 5*time.Second ||
+		config.RequestTimeout != defaultRequestTimeout || config.AutoAccept.From != AcceptVerified ||
+		config.AutoAccept.MaxFileSize != 10e6 || config.Bandwidth.Upload != 1<<20 || config.Log.Level != "debug" ||
+		len(config.FallbackServers) != 2 || config.FallbackServers[1] != "b.example.com:9129" {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if modes := config.Log.SubsystemModes(); len(modes) != 1 || modes["transfer"] != log.DEBUG {
+		t.Error("Unexpected subsystem modes: ", modes)
+	}
+	if config.Log.FilePath("/data") != filepath.Join("/data", "logs", "coconut.log") ||
+		config.Log.StderrRedaction() != (log.Redaction{}) ||
+		config.Log.FileRedaction() != (log.Redaction{FileNames: true, Addresses: true}) {
+		t.Errorf("Unexpected log settings: %+v", config.Log)
+	}
+	expected := map[string]Source{
+		"server_host":               SourceFile,
+		"server_port":               SourceFlag,
+		"fallback_servers":          SourceEnv,
+		"local_port":                SourceDefault,
+		"connect_timeout":           SourceFile,
+		"auto_accept.from":          SourceEnv,
+		"auto_accept.max_file_size": SourceFile,
+		"bandwidth.download":        SourceDefault,
+		"log.level":                 SourceFlag,
+	}
+	for key, source := range expected {
+		if sources[key] != source {
+			t.Errorf("Expected source of %s to be %s, got %s", key, source, sources[key])
+		}
+	}
+
+	for _, setting := range config.EffectiveSettings(sources) {
+		if setting.Key == "auto_accept.max_file_size" && (setting.Value != "10MB" ||
+			setting.Env != "COCONUT_AUTO_ACCEPT_MAX_FILE_SIZE" || setting.Flag != "-auto-accept-max-file-size") {
+			t.Errorf("Unexpected effective setting: %+v", setting)
+		}
+	}
+
+	// Missing config file uses defaults
+	config, _, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yml"), nil, nil)
+	if err != nil || config.ServerPort != defaultServerPort || config.DownloadPath != DefaultPaths().Download {
+		t.Error("Unexpected config without config file: ", config, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	fileName := configFileHelper(t, `server_host: ""
+sever_port: 9000
+bandwidth:
+  upload: fast
+`)
+	// Settings are validated even if the file has errors
+	_, _, err := LoadConfig(fileName, nil, nil)
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || len(configErr.Problems) != 3 ||
+		!strings.Contains(configErr.Problems[0], "line 2: field sever_port not found") ||
+		!strings.Contains(configErr.Problems[1], "line 4: must be a non-negative size") ||
+		configErr.Problems[2] != "server_host: must not be empty" {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// Every invalid setting is reported
+	fileName = configFileHelper(t, `server_host: ""
+key_storage: usb
+connect_timeout: 0s
+fallback_servers: [relay.example.com]
+auto_accept:
+  from: everyone
+log:
+  level: verbose
+  format: xml
+  subsystems: [transfer=loud]
+  max_size: 0
+  file_redact: [names]
+`)
+	environ := []string{"COCONUT_LOCAL_PORT=70000"}
+	_, _, err = LoadConfig(fileName, environ, map[string]string{"request_timeout": "soon"})
+	if !errors.As(err, &configErr) {
+		t.Fatal("Expected ConfigError, got: ", err)
+	}
+	for _, prefix := range []string{"COCONUT_LOCAL_PORT: must be a port", "-request-timeout: must be a duration",
+		"server_host:", "key_storage: must be one of file, secret-service", "connect_timeout:",
+		"fallback_servers: \"relay.example.com\"", "auto_accept.from:", "log.level:", "log.format:",
+		"log.subsystems: must be subsystem=level, got \"transfer=loud\"", "log.max_size:",
+		"log.file_redact: must be file_names or addresses, got \"names\""} {
+		found := false
+		for _, problem := range configErr.Problems {
+			found = found || strings.HasPrefix(problem, prefix)
+		}
+		if !found {
+			t.Error("Problem not reported: ", prefix, configErr.Problems)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for s, expected := range map[string]ByteSize{"0": 0, "512": 512, "10KB": 10e3, "1 MiB": 1 << 20, "2GB": 2e9} {
+		var size ByteSize
+		if err := size.Set(s); err != nil || size != expected {
+			t.Error("Unexpected size of ", s, ": ", size, err)
+		}
+		// Sizes are written with units, and can be read back
+		b, err := yaml.Marshal(&struct{ Size ByteSize }{size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct{ Size ByteSize }
+		if err = yaml.Unmarshal(b, &decoded); err != nil || decoded.Size != size {
+			t.Error("Could not decode ", string(b), err)
+		}
+	}
+	if b, err := yaml.Marshal(ByteSize(1001)); err != nil || string(b) != "1001\n" {
+		t.Error("Sizes without unit should be written as numbers: ", string(b), err)
+	}
+	for _, s := range []string{"-1", "1.5MB", "MB", "10TB"} {
+		var size ByteSize
+		if err := size.Set(s); err == nil {
+			t.Error("Expected error for ", s)
+		}
+	}
+}
+
+func TestAcceptFile(t *testing.T) {
+	client := InitConfig()
+	contact := &Contact{FirstName: "Build", LastName: "Server", PubKeyHash: []byte{1}, Verified: false}
+	if err := client.acceptSender(contact); err != nil {
+		t.Error(err)
+	}
+	if err := client.acceptSize(contact, 100); err != nil {
+		t.Error(err)
+	}
+	client.AutoAccept.From = AcceptVerified
+	if err := client.acceptSender(contact); err != FileRejectedError {
+		t.Error("Expected FileRejectedError, got: ", err)
+	}
+	contact.Verified = true
+	if err := client.acceptSender(contact); err != nil {
+		t.Error(err)
+	}
+	client.AutoAccept.MaxFileSize = 99
+	if err := client.acceptSize(contact, 100); err != FileRejectedError {
+		t.Error("Expected FileRejectedError, got: ", err)
+	}
+	client.AutoAccept.MaxFileSize = 100
+	if err := client.acceptSize(contact, 100); err != nil {
+		t.Error(err)
+	}
+	client.AutoAccept.From = AcceptNone
+	if err := client.acceptSender(contact); err != FileRejectedError {
+		t.Error("Expected FileRejectedError, got: ", err)
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := limitWriter(&buffer, 100*1000)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := writer.Write(make([]byte, 2000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 20KB at 100KB/s
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond || buffer.Len() != 20000 {
+		t.Error("Transfer rate was not limited: ", elapsed)
+	}
+	if limitWriter(&buffer, 0) != &buffer {
+		t.Error("Writer without limit should not be wrapped")
+	}
+}
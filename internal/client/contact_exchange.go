@@ -0,0 +1,323 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	// contactFileVersion is the version of the contact exchange file format.
+	// Increase this value when ContactFile or ContactCard changes in an incompatible way.
+	contactFileVersion = 1
+	// contactStringPrefix is prepended to compact contact strings
+	contactStringPrefix = "coconut:"
+	// contactStringVersion is the first byte of the payload of compact contact strings
+	contactStringVersion = 1
+)
+
+// InvalidContactError is returned when the imported contact cannot be parsed
+var InvalidContactError = errors.New("invalid contact")
+
+// FingerprintMismatchError is returned when the fingerprint of the imported contact
+// does not match its public key
+var FingerprintMismatchError = errors.New("fingerprint does not match public key")
+
+// UnsupportedVersionError is returned when the contact file or string was created with
+// a newer format version
+var UnsupportedVersionError = errors.New("unsupported contact format version")
+
+// ContactNotFoundError is returned when the contact does not exist in the contact list
+var ContactNotFoundError = errors.New("contact not found")
+
+// ContactFile is a portable file format for sharing contacts.
+//
+// Example:
+//
+//	{
+//	  "version": 1,
+//	  "contacts": [
+//	    {
+//	      "first_name": "Jaeha",
+//	      "last_name": "Choi",
+//	      "public_key": "-----BEGIN RSA PUBLIC KEY-----\n...\n-----END RSA PUBLIC KEY-----\n",
+//	      "fingerprint": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+//	      "verified": true
+//	    }
+//	  ]
+//	}
+type ContactFile struct {
+	// Version is the version of this format
+	Version int `json:"version"`
+	// Contacts is the list of exported contacts
+	Contacts []*ContactCard `json:"contacts"`
+}
+
+// ContactCard stores a single contact in the portable format
+type ContactCard struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	// PubKey is the PEM encoded public key of the contact. Exported as "RSA PUBLIC KEY" block,
+	// but any format supported by cryptography.ImportPubKey is accepted.
+	PubKey string `json:"public_key"`
+	// Fingerprint is the hex encoded SHA256 hash of the public key.
+	// If provided, it must match PubKey.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Verified indicates whether the fingerprint was confirmed by the exporting user
+	Verified bool `json:"verified"`
+}
+
+// Fingerprint returns hex encoded SHA256 hash of the contact's public key
+func (contact *Contact) Fingerprint() string {
+	return hex.EncodeToString(contact.PubKeyHash)
+}
+
+// toCard converts contact to ContactCard
+func (contact *Contact) toCard() *ContactCard {
+	return &ContactCard{
+		FirstName:   contact.FirstName,
+		LastName:    contact.LastName,
+		PubKey:      string(pem.EncodeToMemory(contact.PubKey)),
+		Fingerprint: contact.Fingerprint(),
+		Verified:    contact.Verified,
+	}
+}
+
+// toContact validates card and converts it to Contact.
+// Returns InvalidContactError if public key is not a valid RSA public key,
+// FingerprintMismatchError if the fingerprint does not match the public key
+func (card *ContactCard) toContact() (contact *Contact, err error) {
+	return newContact(card.FirstName, card.LastName, []byte(card.PubKey), card.Fingerprint, card.Verified)
+}
+
+// newContact creates a contact from public key in any format supported by cryptography.ImportPubKey.
+// If fingerprint is not empty, it must match the public key.
+func newContact(firstName string, lastName string, pubKeyBytes []byte, fingerprint string, verified bool) (
+	contact *Contact, err error) {
+	pubKey, pkHash, err := cryptography.ImportPubKey(pubKeyBytes)
+	if err != nil {
+		log.Error("Contact public key could not be parsed")
+		return nil, InvalidContactError
+	}
+	if fingerprint != "" && !strings.EqualFold(fingerprint, hex.EncodeToString(pkHash)) {
+		log.Error("Contact fingerprint does not match public key")
+		return nil, FingerprintMismatchError
+	}
+	return &Contact{
+		FirstName:  firstName,
+		LastName:   lastName,
+		PubKeyHash: pkHash,
+		PubKey:     cryptography.PubKeyToPem(pubKey),
+		Verified:   verified,
+	}, nil
+}
+
+// mergeContact adds contact to client.contactMap. If the contact already exists,
+// only the verification status is updated.
+// Returns true if a new contact was added, false otherwise.
+func (client *Client) mergeContact(contact *Contact) (added bool) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	if existing, ok := client.contactMap[string(contact.PubKeyHash)]; ok {
+		existing.Verified = existing.Verified || contact.Verified
+		return false
+	}
+	client.contactMap[string(contact.PubKeyHash)] = contact
+	return true
+}
+
+// exportCards returns contact cards for contacts with pkHashes, sorted by name.
+// If pkHashes is empty, every contact is exported.
+func (client *Client) exportCards(pkHashes ...string) (cards []*ContactCard, err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	if len(pkHashes) == 0 {
+		for pkHash := range client.contactMap {
+			pkHashes = append(pkHashes, pkHash)
+		}
+	}
+	for _, pkHash := range pkHashes {
+		contact, ok := client.contactMap[pkHash]
+		if !ok {
+			return nil, ContactNotFoundError
+		}
+		cards = append(cards, contact.toCard())
+	}
+	sort.Slice(cards, func(i, j int) bool {
+		if cards[i].FirstName+cards[i].LastName == cards[j].FirstName+cards[j].LastName {
+			return cards[i].Fingerprint < cards[j].Fingerprint
+		}
+		return cards[i].FirstName+cards[i].LastName < cards[j].FirstName+cards[j].LastName
+	})
+	return cards, nil
+}
+
+// ExportContacts writes contacts with pkHashes to fileName in ContactFile format.
+// If pkHashes is empty, every contact is exported.
+func (client *Client) ExportContacts(fileName string, pkHashes ...string) (err error) {
+	cards, err := client.exportCards(pkHashes...)
+	if err != nil {
+		return err
+	}
+	if cards == nil {
+		cards = []*ContactCard{}
+	}
+	data, err := json.MarshalIndent(&ContactFile{Version: contactFileVersion, Contacts: cards}, "", "  ")
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while encoding contacts")
+		return err
+	}
+	if err = ioutil.WriteFile(fileName, append(data, '\n'), 0644); err != nil {
+		log.Debug(err)
+		log.Error("Error while writing contacts file")
+		return err
+	}
+	return nil
+}
+
+// ImportContacts reads contacts from fileName in ContactFile format and merge them into client.contactMap.
+// Every contact is validated before any of them are merged.
+// Returns the number of newly added contacts.
+func (client *Client) ImportContacts(fileName string) (added int, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading contacts file")
+		return 0, err
+	}
+	var contactFile ContactFile
+	if err = json.Unmarshal(data, &contactFile); err != nil {
+		log.Debug(err)
+		log.Error("Error while decoding contacts file")
+		return 0, InvalidContactError
+	}
+	if contactFile.Version > contactFileVersion {
+		log.Error("Contacts file version ", contactFile.Version, " is not supported")
+		return 0, UnsupportedVersionError
+	}
+
+	contacts := make([]*Contact, 0, len(contactFile.Contacts))
+	for _, card := range contactFile.Contacts {
+		if card == nil {
+			return 0, InvalidContactError
+		}
+		contact, err := card.toContact()
+		if err != nil {
+			return 0, err
+		}
+		contacts = append(contacts, contact)
+	}
+	for _, contact := range contacts {
+		if client.mergeContact(contact) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// ExportContactString returns a compact string for the contact with pkHash, which is
+// short enough to be encoded as a QR code.
+//
+// Payload (before base64url encoding):
+//
+//	1 byte: version
+//	1 byte: verified (0 or 1)
+//	1 byte: length of first name, followed by first name
+//	1 byte: length of last name, followed by last name
+//	rest:   PKCS #1 DER encoded public key
+func (client *Client) ExportContactString(pkHash string) (str string, err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	contact, ok := client.contactMap[pkHash]
+	if !ok {
+		return "", ContactNotFoundError
+	}
+	firstName := truncateName(contact.FirstName)
+	lastName := truncateName(contact.LastName)
+
+	var verified byte = 0
+	if contact.Verified {
+		verified = 1
+	}
+	payload := make([]byte, 0, 4+len(firstName)+len(lastName)+len(contact.PubKey.Bytes))
+	payload = append(payload, contactStringVersion, verified)
+	payload = append(payload, byte(len(firstName)))
+	payload = append(payload, firstName...)
+	payload = append(payload, byte(len(lastName)))
+	payload = append(payload, lastName...)
+	payload = append(payload, contact.PubKey.Bytes...)
+
+	return contactStringPrefix + base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+// ImportContactString parses a string created by ExportContactString and merge
+// the contact into client.contactMap.
+// Returns the imported contact and true if it was newly added.
+func (client *Client) ImportContactString(str string) (contact *Contact, added bool, err error) {
+	str = strings.TrimSpace(str)
+	if !strings.HasPrefix(str, contactStringPrefix) {
+		return nil, false, InvalidContactError
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(str, contactStringPrefix))
+	if err != nil {
+		log.Debug(err)
+		return nil, false, InvalidContactError
+	}
+	if len(payload) < 4 {
+		return nil, false, InvalidContactError
+	}
+	if payload[0] != contactStringVersion {
+		return nil, false, UnsupportedVersionError
+	}
+	verified := payload[1] == 1
+	payload = payload[2:]
+
+	firstName, payload, err := readLengthPrefixed(payload)
+	if err != nil {
+		return nil, false, err
+	}
+	lastName, payload, err := readLengthPrefixed(payload)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if contact, err = newContact(firstName, lastName, payload, "", verified); err != nil {
+		return nil, false, err
+	}
+	added = client.mergeContact(contact)
+	contact, _ = client.lookupContact(string(contact.PubKeyHash))
+	return contact, added, nil
+}
+
+// readLengthPrefixed reads a string prefixed with 1 byte length from b.
+// Returns the string and the remaining bytes.
+func readLengthPrefixed(b []byte) (str string, rest []byte, err error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, InvalidContactError
+	}
+	return string(b[1 : 1+int(b[0])]), b[1+int(b[0]):], nil
+}
+
+// truncateName truncates name so that its length fits in a single byte
+// without splitting a multibyte character.
+func truncateName(name string) string {
+	if len(name) <= 255 {
+		return name
+	}
+	end := 0
+	for i := range name {
+		if i > 255 {
+			break
+		}
+		end = i
+	}
+	return name[:end]
+}
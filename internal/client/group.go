@@ -0,0 +1,289 @@
+package client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// GroupNotFoundError is returned when the group does not exist
+var GroupNotFoundError = errors.New("group not found")
+
+// GroupExistsError is returned when a group with the same name already exists
+var GroupExistsError = errors.New("group already exists")
+
+// EmptyGroupError is returned when sending a file to a group without members
+var EmptyGroupError = errors.New("group has no members")
+
+// Group stores a named list of contacts
+type Group struct {
+	// Name is a unique name of the group
+	Name string
+	// Members stores public key hashes of contacts in this group.
+	// Uses the same key as client.contactMap.
+	Members []string
+}
+
+// SendResult stores the outcome of sending a file to a single contact
+type SendResult struct {
+	// Contact is the receiver of the file
+	Contact *Contact
+	// Err is nil if the file was sent successfully
+	Err error
+}
+
+// relayFunc relays data written by writeData to the client with rxPubKeyHash
+type relayFunc func(rxPubKeyHash string, writeData func(writer io.Writer) error) (err error)
+
+// ReadGroupsFile read the contents of groups.gob into client.groupMap
+func (client *Client) ReadGroupsFile() (err error) {
+	file, err := os.OpenFile(filepath.Join(client.DataPath, "groups.gob"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Error opening file: ", err)
+		return err
+	}
+
+	defer func() {
+		err = file.Close()
+		if err != nil {
+			log.Error("Error closing file: ", err)
+		}
+	}()
+
+	client.mapMutex.Lock()
+	err = gob.NewDecoder(file).Decode(&client.groupMap)
+	client.mapMutex.Unlock()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error decoding file: ", err)
+		return err
+	}
+	return err
+}
+
+// WriteGroupsFile write contents of groups map into groups.gob file
+func (client *Client) WriteGroupsFile() (err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	return client.writeDataFile("groups.gob", client.groupMap)
+}
+
+// CreateGroup creates an empty group with name
+// Returns GroupExistsError if group with the same name already exist
+func (client *Client) CreateGroup(name string) (err error) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	if _, exist := client.groupMap[name]; exist {
+		return GroupExistsError
+	}
+	client.groupMap[name] = &Group{Name: name, Members: nil}
+	return nil
+}
+
+// RemoveGroup removes group with name. Contacts in the group are not affected.
+// Returns true if found and removed, false if not found
+func (client *Client) RemoveGroup(name string) (b bool) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	if _, exist := client.groupMap[name]; exist {
+		delete(client.groupMap, name)
+		return true
+	}
+	return false
+}
+
+// Groups returns every group sorted by name
+func (client *Client) Groups() (groups []*Group) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	for _, group := range client.groupMap {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// AddGroupMember adds contact with pkHash to group with name
+// Returns GroupNotFoundError or ContactNotFoundError if either of them does not exist
+func (client *Client) AddGroupMember(name string, pkHash string) (err error) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	group, exist := client.groupMap[name]
+	if !exist {
+		return GroupNotFoundError
+	}
+	if _, exist = client.contactMap[pkHash]; !exist {
+		return ContactNotFoundError
+	}
+	for _, member := range group.Members {
+		if member == pkHash {
+			return nil
+		}
+	}
+	group.Members = append(group.Members, pkHash)
+	return nil
+}
+
+// RemoveGroupMember removes contact with pkHash from group with name
+// Returns true if found and removed, false if not found
+func (client *Client) RemoveGroupMember(name string, pkHash string) (b bool) {
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	group, exist := client.groupMap[name]
+	if !exist {
+		return false
+	}
+	for i, member := range group.Members {
+		if member == pkHash {
+			group.Members = append(group.Members[:i], group.Members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// groupContacts returns contacts in group with name. Members that are no longer
+// in the contact list are returned with a nil contact.
+func (client *Client) groupContacts(name string) (contacts []*Contact, err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	group, exist := client.groupMap[name]
+	if !exist {
+		return nil, GroupNotFoundError
+	}
+	if len(group.Members) == 0 {
+		return nil, EmptyGroupError
+	}
+	for _, member := range group.Members {
+		contact, ok := client.contactMap[member]
+		if !ok {
+			contact = &Contact{PubKeyHash: []byte(member)}
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+// DoSendToGroup sends fileName to every member of the group with name.
+// The file is encrypted only once, and the symmetric encryption key is encrypted
+// for each receiver.
+// Returns the outcome for each member of the group, and error if the file could not be
+// encrypted at all.
+func (client *Client) DoSendToGroup(name string, fileName string) (results []*SendResult, err error) {
+	contacts, err := client.groupContacts(name)
+	if err != nil {
+		return nil, err
+	}
+	return client.sendToContacts(contacts, fileName, client.doRelay)
+}
+
+// sendToContacts encrypts fileName once and relays it to each contact with relay
+func (client *Client) sendToContacts(contacts []*Contact, fileName string, relay relayFunc) (
+	results []*SendResult, err error) {
+	// Encrypt payload to temp file
+	payloadFile, err := ioutil.TempFile("", ".tmp_encrypted_")
+	if err != nil {
+		log.Debug(err)
+		log.Error("Temp file could not be created")
+		return nil, err
+	}
+	defer func() {
+		if err := payloadFile.Close(); err != nil {
+			log.Debug(err)
+			log.Error("Error while closing temp file")
+		}
+		if err := os.Remove(payloadFile.Name()); err != nil {
+			log.Debug(err)
+			log.Error("Error while removing temp file. Temp file at: ", payloadFile.Name())
+		}
+	}()
+	// Source file is opened last, so that it is closed by EncryptPayload on every path
+	ag, err := cryptography.EncryptSetup(fileName)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error in EncryptSetup")
+		return nil, err
+	}
+	if err = ag.EncryptPayload(payloadFile); err != nil {
+		log.Debug(err)
+		log.Error("Error in EncryptPayload")
+		return nil, err
+	}
+
+	// Size and hash are recorded in the history
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		absFileName = fileName
+	}
+	size, hash, err := fileInfo(fileName)
+	if err != nil {
+		log.Debug(err)
+	}
+
+	for _, contact := range contacts {
+		result := &SendResult{Contact: contact, Err: nil}
+		results = append(results, result)
+		client.mapMutex.RLock()
+		fingerprint, name := contact.Fingerprint(), contact.name()
+		client.mapMutex.RUnlock()
+		logger := transferLog.With("peer", fingerprint, "file", filepath.Base(fileName))
+		start := time.Now()
+		transfer := &Transfer{Direction: DirectionSent, Peer: fingerprint,
+			PeerName: name, FileName: absFileName, Size: size, Hash: hash, Route: RouteRelay,
+			Server: client.serverAddr()}
+
+		result.Err = client.relayPayload(contact, ag, payloadFile, relay)
+		if result.Err != nil {
+			logger.Error("Error while sending file", "error", result.Err)
+		} else {
+			logger.Info("Sent file")
+		}
+		client.recordTransfer(transfer, start, result.Err)
+	}
+	return results, nil
+}
+
+// relayPayload encrypts the key of ag for contact, and relays it to contact with the encrypted
+// payload in payloadFile
+func (client *Client) relayPayload(contact *Contact, ag *cryptography.AesGcmChunk, payloadFile *os.File,
+	relay relayFunc) (err error) {
+	client.mapMutex.RLock()
+	pubKeyBlock, pkHash := contact.PubKey, string(contact.PubKeyHash)
+	client.mapMutex.RUnlock()
+	if pubKeyBlock == nil {
+		return ContactNotFoundError
+	}
+	pubKey, err := x509.ParsePKCS1PublicKey(pubKeyBlock.Bytes)
+	if err != nil {
+		log.Debug(err)
+		return InvalidContactError
+	}
+	// Encrypt symmetric encryption key for this contact only
+	var keyBuffer bytes.Buffer
+	if err = ag.EncryptKey(&keyBuffer, pubKey, client.privKey); err != nil {
+		return err
+	}
+	return relay(pkHash, func(writer io.Writer) (err error) {
+		if _, err = payloadFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = writer.Write(keyBuffer.Bytes()); err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, payloadFile)
+		return err
+	})
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// historyFileName is the name of the transfer history in DataPath
+const historyFileName = "history.gob"
+
+// Transfer directions
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+)
+
+// Transfer results
+const (
+	ResultOK       = "ok"
+	ResultFailed   = "failed"
+	ResultRejected = "rejected"
+)
+
+// RouteRelay is the route of files relayed by the relay server
+const RouteRelay = "relay"
+
+// TransferNotFoundError is returned when a transfer is not in the history
+var TransferNotFoundError = errors.New("transfer not found")
+
+// NotResendableError is returned when a transfer that was not sent by this client is sent again
+var NotResendableError = errors.New("only sent files can be sent again")
+
+// Transfer is a file transfer recorded in the history
+type Transfer struct {
+	// ID increases with every transfer, starting from 1. IDs of removed transfers are not reused.
+	ID uint64
+	// Time is when the transfer started
+	Time time.Time
+	// Direction is DirectionSent or DirectionReceived
+	Direction string
+	// Peer is the fingerprint of the receiver or the sender
+	Peer string
+	// PeerName is the name of Peer when the file was transferred. Empty if Peer is not a contact.
+	PeerName string
+	// FileName is the absolute path of the sent file, or the path of the received file
+	FileName string
+	// Size is the size of the file in bytes
+	Size int64
+	// Hash is hex encoded SHA256 hash of the file. Empty if the file could not be read.
+	Hash string
+	// Route is the path the file took, such as RouteRelay
+	Route string
+	// Server is the address of the relay server
+	Server string
+	// Duration is the time the transfer took
+	Duration time.Duration
+	// Result is ResultOK, ResultFailed or ResultRejected
+	Result string
+	// Error is empty if the transfer succeeded
+	Error string
+}
+
+// history is the content of history.gob
+type history struct {
+	// LastID is the ID of the last recorded transfer
+	LastID uint64
+	// Transfers are recorded transfers, oldest first
+	Transfers []*Transfer
+}
+
+// ReadHistoryFile reads history.gob. Transfers are written to the file only after it was read,
+// so that clients that did not read the history do not overwrite it.
+func (client *Client) ReadHistoryFile() (err error) {
+	client.historyMutex.Lock()
+	defer client.historyMutex.Unlock()
+	file, err := os.Open(filepath.Join(client.DataPath, historyFileName))
+	if os.IsNotExist(err) {
+		client.historyLoaded = true
+		return nil
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error while opening history file")
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug(err)
+		}
+	}()
+
+	var h history
+	if err = gob.NewDecoder(file).Decode(&h); err != nil && err != io.EOF {
+		log.Debug(err)
+		log.Error("Error while decoding history file")
+		return err
+	}
+	// Transfers recorded before reading the file are kept
+	for _, transfer := range client.history.Transfers {
+		h.LastID++
+		transfer.ID = h.LastID
+		h.Transfers = append(h.Transfers, transfer)
+	}
+	client.history = h
+	client.historyLoaded = true
+	client.pruneHistory()
+	return nil
+}
+
+// writeHistoryFile writes history.gob. Must be called with historyMutex locked.
+func (client *Client) writeHistoryFile() (err error) {
+	return client.writeDataFile(historyFileName, &client.history)
+}
+
+// pruneHistory removes transfers older than History.MaxAge, then the oldest transfers beyond
+// History.MaxEntries. Must be called with historyMutex locked.
+func (client *Client) pruneHistory() {
+	limits := client.currentConfig().History
+	transfers := client.history.Transfers
+	if limits.MaxAge > 0 {
+		for len(transfers) != 0 && time.Since(transfers[0].Time) > limits.MaxAge {
+			transfers = transfers[1:]
+		}
+	}
+	if limits.MaxEntries > 0 && len(transfers) > limits.MaxEntries {
+		transfers = transfers[len(transfers)-limits.MaxEntries:]
+	}
+	client.history.Transfers = append([]*Transfer(nil), transfers...)
+}
+
+// recordTransfer completes transfer that started at start with the result of err, and adds it
+// to the history. The history file is written if it was read.
+func (client *Client) recordTransfer(transfer *Transfer, start time.Time, err error) {
+	transfer.Time = start
+	transfer.Duration = time.Since(start)
+	switch {
+	case err == nil:
+		transfer.Result = ResultOK
+	case errors.Is(err, FileRejectedError):
+		transfer.Result = ResultRejected
+	default:
+		transfer.Result = ResultFailed
+	}
+	if err != nil {
+		transfer.Error = err.Error()
+	}
+
+	client.historyMutex.Lock()
+	defer client.historyMutex.Unlock()
+	client.history.LastID++
+	transfer.ID = client.history.LastID
+	client.history.Transfers = append(client.history.Transfers, transfer)
+	client.pruneHistory()
+	if !client.historyLoaded {
+		return
+	}
+	if err := client.writeHistoryFile(); err != nil {
+		log.Debug(err)
+		log.Error("Error while writing history file")
+	}
+}
+
+// History returns copies of recorded transfers, newest first
+func (client *Client) History() (transfers []*Transfer) {
+	client.historyMutex.Lock()
+	defer client.historyMutex.Unlock()
+	transfers = make([]*Transfer, 0, len(client.history.Transfers))
+	for i := len(client.history.Transfers) - 1; i >= 0; i-- {
+		transfer := *client.history.Transfers[i]
+		transfers = append(transfers, &transfer)
+	}
+	return transfers
+}
+
+// FindTransfer returns a copy of the transfer with id
+// Returns TransferNotFoundError if the transfer is not in the history
+func (client *Client) FindTransfer(id uint64) (transfer *Transfer, err error) {
+	client.historyMutex.Lock()
+	defer client.historyMutex.Unlock()
+	for _, t := range client.history.Transfers {
+		if t.ID == id {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, TransferNotFoundError
+}
+
+// DoResend sends the file of the sent transfer with id to its receiver again. The file is read
+// again, so changes made after the transfer are sent.
+// Returns TransferNotFoundError if the transfer is not in the history, NotResendableError if the
+// file was received, and ContactNotFoundError if the receiver is no longer a contact.
+func (client *Client) DoResend(id uint64) (err error) {
+	transfer, err := client.FindTransfer(id)
+	if err != nil {
+		return err
+	}
+	if transfer.Direction != DirectionSent {
+		return NotResendableError
+	}
+	contact, err := client.FindContact(transfer.Peer)
+	if err != nil {
+		return err
+	}
+	client.mapMutex.RLock()
+	pkHash := string(contact.PubKeyHash)
+	client.mapMutex.RUnlock()
+	return client.DoSendFile(pkHash, transfer.FileName)
+}
+
+// name returns the full name of contact
+func (contact *Contact) name() string {
+	return strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+}
+
+// serverAddr returns the address of the relay server, or an empty string if not connected
+func (client *Client) serverAddr() string {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	if client.conn == nil || client.conn.RemoteAddr() == nil {
+		return ""
+	}
+	return client.conn.RemoteAddr().String()
+}
+
+// fileInfo returns the size and hex encoded SHA256 hash of fileName
+func fileInfo(fileName string) (size int64, hash string, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug(err)
+		}
+	}()
+	h := sha256.New()
+	if size, err = io.Copy(h, file); err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
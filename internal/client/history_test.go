@@ -0,0 +1,92 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordTransfer(t *testing.T) {
+	client := InitConfig()
+	client.DataPath = t.TempDir()
+
+	// Transfers recorded before the history is read are kept, but not written
+	client.recordTransfer(&Transfer{Direction: DirectionSent, Peer: "aa"}, time.Now(), nil)
+	reader := InitConfig()
+	reader.DataPath = client.DataPath
+	if err := reader.ReadHistoryFile(); err != nil || len(reader.History()) != 0 {
+		t.Error("Expected empty history, got: ", err, reader.History())
+	}
+
+	if err := client.ReadHistoryFile(); err != nil {
+		t.Fatal(err)
+	}
+	client.recordTransfer(&Transfer{Direction: DirectionReceived, Peer: "bb"}, time.Now(), FileRejectedError)
+	history := client.History()
+	if len(history) != 2 || history[0].ID != 2 || history[0].Result != ResultRejected ||
+		history[0].Error != FileRejectedError.Error() || history[1].ID != 1 || history[1].Result != ResultOK {
+		t.Fatal("Unexpected history: ", history)
+	}
+
+	// History is returned as copies
+	history[0].Peer = "cc"
+	if transfer, err := client.FindTransfer(2); err != nil || transfer.Peer != "bb" {
+		t.Error("Unexpected transfer: ", err, transfer)
+	}
+
+	reader = InitConfig()
+	reader.DataPath = client.DataPath
+	if err := reader.ReadHistoryFile(); err != nil {
+		t.Fatal(err)
+	}
+	if history = reader.History(); len(history) != 2 || history[0].Peer != "bb" || history[1].Peer != "aa" {
+		t.Error("Unexpected history after reading: ", history)
+	}
+	// History is replaced, and temp files are removed
+	if files, _ := filepath.Glob(filepath.Join(client.DataPath, "*")); len(files) != 1 {
+		t.Error("Unexpected files in data path: ", files)
+	}
+	// IDs are not reused
+	reader.recordTransfer(&Transfer{Direction: DirectionSent}, time.Now(), nil)
+	if history = reader.History(); history[0].ID != 3 {
+		t.Error("Expected ID 3, got: ", history[0].ID)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	client := InitConfig()
+	client.DataPath = t.TempDir()
+	client.Config.History = HistoryConfig{MaxEntries: 2, MaxAge: time.Hour}
+	if err := client.ReadHistoryFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.recordTransfer(&Transfer{Peer: "old"}, time.Now().Add(-2*time.Hour), nil)
+	if history := client.History(); len(history) != 0 {
+		t.Error("Expected old transfer to be removed, got: ", history)
+	}
+	for _, peer := range []string{"aa", "bb", "cc"} {
+		client.recordTransfer(&Transfer{Peer: peer}, time.Now(), nil)
+	}
+	if history := client.History(); len(history) != 2 || history[0].Peer != "cc" || history[1].Peer != "bb" {
+		t.Error("Unexpected history: ", history)
+	}
+}
+
+func TestDoResend(t *testing.T) {
+	client := InitConfig()
+	contact := contactHelper(t, "Build", "Server")
+	client.recordTransfer(&Transfer{Direction: DirectionReceived, Peer: contact.Fingerprint()}, time.Now(), nil)
+	client.recordTransfer(&Transfer{Direction: DirectionSent, Peer: contact.Fingerprint()}, time.Now(), nil)
+
+	if err := client.DoResend(3); err != TransferNotFoundError {
+		t.Error("Expected TransferNotFoundError, got: ", err)
+	}
+	if err := client.DoResend(1); err != NotResendableError {
+		t.Error("Expected NotResendableError, got: ", err)
+	}
+	// Receiver is no longer a contact
+	if err := client.DoResend(2); err != ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError, got: ", err)
+	}
+}
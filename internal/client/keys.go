@@ -0,0 +1,99 @@
+package client
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// keyStorageFile stores the private key as a file in KeyPath
+	keyStorageFile = "file"
+	// keyStorageSecretService stores the private key in freedesktop Secret Service
+	keyStorageSecretService = "secret-service"
+)
+
+// UnknownKeyStorageError is returned when KeyStorage in config is not supported
+var UnknownKeyStorageError = errors.New("unknown key storage")
+
+// keyStorages maps KeyStorage names in config to the storage for keys in keyPath
+var keyStorages = map[string]func(keyPath string) cryptography.KeyStorage{
+	keyStorageFile: func(keyPath string) cryptography.KeyStorage {
+		return cryptography.NewFileStorage(keyPath)
+	},
+	keyStorageSecretService: func(keyPath string) cryptography.KeyStorage {
+		// Absolute key path distinguishes keys of multiple clients in the same keyring
+		if absPath, err := filepath.Abs(keyPath); err == nil {
+			keyPath = absPath
+		}
+		return cryptography.NewSecretServiceStorage(keyPath)
+	},
+}
+
+// keyStorageNames returns sorted names of supported key storages
+func keyStorageNames() (names []string) {
+	for name := range keyStorages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keyStore returns KeyStore for the configured KeyStorage
+// Returns UnknownKeyStorageError if KeyStorage is not supported
+func (client *Client) keyStore() (ks *cryptography.KeyStore, err error) {
+	newStorage, ok := keyStorages[client.KeyStorage]
+	if !ok {
+		log.Error("Key storage ", client.KeyStorage, " is not supported")
+		return nil, UnknownKeyStorageError
+	}
+	return cryptography.NewKeyStoreWithStorage(client.KeyPath, newStorage(client.KeyPath)), nil
+}
+
+// LoadKeys opens RSA keys in the configured KeyStorage. If keys are not found, new keys will be created.
+// If KeyStorage is not "file" and the private key file exists in KeyPath, the private key
+// is moved to KeyStorage first.
+func (client *Client) LoadKeys() (err error) {
+	ks, err := client.keyStore()
+	if err != nil {
+		return err
+	}
+	if client.KeyStorage != keyStorageFile {
+		if err = client.migratePrivKey(); err != nil {
+			return err
+		}
+	}
+
+	pubBlock, privBlock, err := ks.Open()
+	if err != nil {
+		return err
+	}
+	if client.privKey, err = cryptography.PemToKeys(privBlock); err != nil {
+		return err
+	}
+	client.pubKeyBlock = pubBlock
+	return nil
+}
+
+// migratePrivKey moves the private key file in KeyPath to the configured KeyStorage.
+// Does nothing if the private key file does not exist.
+func (client *Client) migratePrivKey() (err error) {
+	dst := keyStorages[client.KeyStorage](client.KeyPath)
+	err = cryptography.MigratePrivKey(keyStorages[keyStorageFile](client.KeyPath), dst)
+	if errors.Is(err, cryptography.KeyMissing) {
+		// Nothing to migrate
+		return nil
+	} else if errors.Is(err, os.ErrExist) {
+		log.Warning("Private key exists in both ", keyStorageFile, " and ", client.KeyStorage,
+			"; using ", client.KeyStorage)
+		return nil
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error while moving private key to ", client.KeyStorage)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bufio"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"time"
+)
+
+// controlConn returns the connection commands are sent on. It is the control stream of session
+// if common.FeatureMux was negotiated, conn otherwise. Reads and writes return
+// NotConnectedError if this client is not connected.
+func (client *Client) controlConn() io.ReadWriter {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	if client.session != nil {
+		return client.session.Control()
+	}
+	if client.conn == nil {
+		return disconnected{}
+	}
+	return client.conn
+}
+
+// disconnected is the connection of a client that is not connected to the relay server
+type disconnected struct{}
+
+func (disconnected) Read([]byte) (int, error) {
+	return 0, NotConnectedError
+}
+
+func (disconnected) Write([]byte) (int, error) {
+	return 0, NotConnectedError
+}
+
+// startSession multiplexes conn after common.FeatureMux was negotiated. Commands are sent on
+// the control stream, and each relay is sent on its own stream, so a transfer does not
+// block other commands.
+func (client *Client) startSession() {
+	client.connMutex.Lock()
+	if client.conn == nil {
+		client.connMutex.Unlock()
+		return
+	}
+	client.session = util.NewMuxSession(client.conn, true)
+	session := client.session
+	client.connMutex.Unlock()
+	go client.commandHandler()
+	go client.acceptStreams(session)
+}
+
+// relayStream is doRelay on a new stream of session. The result of the relay is read from the stream.
+func (client *Client) relayStream(session *util.MuxSession, rxPubKeyHash string,
+	writeData func(writer io.Writer) error) (err error) {
+	var command = common.RequestRelay
+	stream, err := session.Open()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while opening stream")
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = stream.Reset()
+		} else {
+			err = stream.Close()
+		}
+	}()
+
+	if _, err = util.WriteMessage(stream, nil, nil, command); err != nil {
+		return err
+	}
+	if _, err = util.WriteMessage(stream, []byte(rxPubKeyHash), nil, command); err != nil {
+		return err
+	}
+	if writeData != nil {
+		if err = writeData(limitWriter(stream, client.currentConfig().Bandwidth.Upload)); err != nil {
+			log.Debug(err)
+			log.Error("Error while relaying data")
+			return err
+		}
+	}
+
+	// Stream is reset if the relay server does not reply in time
+	timer := time.AfterFunc(client.currentConfig().RequestTimeout, func() { _ = stream.Reset() })
+	msg, err := util.ReadMessage(stream)
+	if !timer.Stop() {
+		log.Error("Timed out while waiting for the result of ", command.String)
+		return RequestTimeoutError
+	}
+	if err != nil {
+		log.Debug(err)
+		return err
+	}
+	if errCode := common.ErrorCodes[msg.ErrorCode]; errCode != nil {
+		return errCode
+	}
+	return nil
+}
+
+// acceptStreams handles streams opened by the relay server until session is closed
+func (client *Client) acceptStreams(session *util.MuxSession) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Debug(err)
+			return
+		}
+		go client.handleStream(stream)
+	}
+}
+
+// handleStream handles a stream opened by the relay server. The stream starts with RequestRelay
+// containing the public key hash of the sender, followed by a file or key handovers.
+// The stream is reset if the relay was rejected, so the rest of it is not sent.
+func (client *Client) handleStream(stream *util.MuxStream) {
+	if err := client.readStream(bufio.NewReader(stream)); err != nil {
+		log.Debug(err)
+		_ = stream.Reset()
+		return
+	}
+	_ = stream.Close()
+}
+
+// readStream reads a relay from reader. See handleStream.
+func (client *Client) readStream(reader *bufio.Reader) (err error) {
+	msg, err := util.ReadMessage(reader)
+	if err != nil {
+		return err
+	}
+	if common.CommandCodes[msg.CommandCode] != common.RequestRelay || len(msg.Data) == 0 {
+		log.Error("Unexpected command code ", msg.CommandCode, " on relay stream")
+		return util.UnexpectedCommandError
+	}
+
+	// Command code is the last byte of the header of the next message
+	header, err := reader.Peek(util.HeaderSize)
+	if err != nil {
+		return err
+	}
+	if common.CommandCodes[header[util.HeaderSize-1]] != common.KeyHandover {
+		return client.handleRelay(msg, reader)
+	}
+	for {
+		if msg, err = util.ReadMessage(reader); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if common.CommandCodes[msg.CommandCode] != common.KeyHandover {
+			log.Error("Unexpected command code ", msg.CommandCode, " after key handover")
+			return util.UnexpectedCommandError
+		}
+		if err = client.handleKeyHandover(msg); err != nil {
+			return err
+		}
+	}
+}
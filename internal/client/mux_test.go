@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// muxServerHelper negotiates common.FeatureMux with client over a pipe, and returns the session
+// of the relay server
+func muxServerHelper(t *testing.T, client *Client) *util.MuxSession {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	client.conn = clientConn
+	go client.commandHandler()
+	go func() {
+		msg, err := util.ReadMessage(serverConn)
+		if err != nil || msg.CommandCode != common.Version.Code {
+			return
+		}
+		data, _ := common.NewHello(common.FeatureRelay|common.FeatureMux, "server/1.0").MarshalBinary()
+		_, _ = util.WriteMessage(serverConn, data, nil, common.Version)
+	}()
+	if err := client.doVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if !client.HasFeature(common.FeatureMux) {
+		t.Fatal("Mux was not negotiated")
+	}
+	client.startSession()
+	session := client.session
+	server := util.NewMuxSession(serverConn, false)
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = session.Close()
+	})
+	return server
+}
+
+func TestMuxRelay(t *testing.T) {
+	testFileN := "../../pkg/testdata/checksum.txt"
+
+	receiver := InitConfig()
+	receiver.DownloadPath = t.TempDir()
+	var err error
+	if receiver.privKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	receiverContact, err := newContact("Build", "Receiver",
+		cryptography.PubKeyToPem(&receiver.privKey.PublicKey).Bytes, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderContact, senderKey := contactKeyHelper(t, "Build", "Sender")
+	receiver.mergeContact(senderContact)
+	sender := InitConfig()
+	sender.privKey = senderKey
+
+	// Relayed file as written by the relay server
+	var relayed bytes.Buffer
+	if _, err = util.WriteMessage(&relayed, senderContact.PubKeyHash, nil, common.RequestRelay); err != nil {
+		t.Fatal(err)
+	}
+	relay := func(rxPubKeyHash string, writeData func(writer io.Writer) error) error {
+		return writeData(&relayed)
+	}
+	if results, err := sender.sendToContacts([]*Contact{receiverContact}, testFileN, relay); err != nil ||
+		results[0].Err != nil {
+		t.Fatal("Error while encrypting file: ", err)
+	}
+	data := relayed.Bytes()
+
+	server := muxServerHelper(t, receiver)
+
+	// Commands are not blocked while a file is relayed
+	stream, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		control := server.Control()
+		msg, err := util.ReadMessage(control)
+		if err != nil || msg.CommandCode != common.GetAddCode.Code {
+			return
+		}
+		_, _ = util.WriteMessage(control, []byte("ABC123"), nil, common.GetAddCode)
+		_, _ = util.WriteMessage(control, nil, nil, common.GetAddCode)
+	}()
+	if err = receiver.DoGetAddCode(); err != nil || receiver.AddCode() != "ABC123" {
+		t.Error("Unexpected Add Code: ", receiver.AddCode(), err)
+	}
+	if _, err = stream.Write(data[len(data)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	result := receivedHelper(t, receiver)
+	expected, _ := ioutil.ReadFile(testFileN)
+	if received, _ := ioutil.ReadFile(result.FileName); result.Err != nil || !bytes.Equal(expected, received) {
+		t.Error("Received file mismatch: ", result.Err)
+	}
+
+	// Rejected files are reset, so the rest of the file is not relayed
+	receiver.AutoAccept.From = AcceptNone
+	if stream, err = server.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = stream.Write(data)
+	if _, err = stream.Read(make([]byte, 1)); err != util.MuxStreamResetError {
+		t.Error("Expected MuxStreamResetError, got: ", err)
+	}
+	if result = receivedHelper(t, receiver); result.Err != FileRejectedError {
+		t.Error("Expected FileRejectedError, got: ", result.Err)
+	}
+
+	// Relays are sent on their own stream, and the result is read from the stream
+	go func() {
+		stream, err := server.Accept()
+		if err != nil {
+			return
+		}
+		for i := 0; i < 3; i++ {
+			if _, err = util.ReadMessage(stream); err != nil {
+				return
+			}
+		}
+		_, _ = util.WriteMessage(stream, nil, common.ReceiverNotAvailable, common.RequestRelay)
+	}()
+	err = receiver.doRelay("hash", func(writer io.Writer) error {
+		_, err := util.WriteMessage(writer, []byte("data"), nil, common.File)
+		return err
+	})
+	if err != common.ReceiverNotAvailable {
+		t.Error("Expected ReceiverNotAvailable, got: ", err)
+	}
+}
+
+func TestMuxKeyHandover(t *testing.T) {
+	alice, key0 := contactKeyHelper(t, "Alice", "Laptop")
+	_, key1 := contactKeyHelper(t, "Alice", "Laptop")
+	handover, err := cryptography.SignHandover(key0, &key1.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handoverData, err := handover.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := InitConfig()
+	receiver.DataPath = t.TempDir()
+	receiver.mergeContact(alice)
+	server := muxServerHelper(t, receiver)
+
+	stream, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = util.WriteMessage(stream, alice.PubKeyHash, nil, common.RequestRelay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = util.WriteMessage(stream, handoverData, nil, common.KeyHandover); err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Stream is closed by the client after the handover is applied
+	if _, err = stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Expected io.EOF, got: ", err)
+	}
+
+	fingerprint := hex.EncodeToString(cryptography.PemToSha256(cryptography.PubKeyToPem(&key1.PublicKey)))
+	if _, err = receiver.FindContact(fingerprint); err != nil {
+		t.Error("Key handover was not applied: ", err)
+	}
+}
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// appDirName is the name of the directory for this program in platform directories
+	appDirName = "coconut"
+	// configFileName is the name of the config file in the config directory
+	configFileName = "config.yml"
+	// socketFileName is the name of the Unix domain socket of the daemon
+	socketFileName = "coconut.sock"
+)
+
+// MigrationConflictError is returned if files to migrate already exist in the default locations
+var MigrationConflictError = errors.New("identity already exists in default location")
+
+// Paths are locations of files used by the program
+type Paths struct {
+	// Config is the path of the config file
+	Config string
+	// Key is a directory for asymmetric keys
+	Key string
+	// Data is a directory for contacts and other data
+	Data string
+	// Download is a directory for received files
+	Download string
+	// Socket is the path of the Unix domain socket of the daemon
+	Socket string
+}
+
+// DefaultPaths returns platform-appropriate default locations. On Linux and other Unix-like
+// systems, XDG base directories are used. If the home directory is unknown, locations relative
+// to the working directory are used, as in earlier versions.
+func DefaultPaths() Paths {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Debug(err)
+		log.Warning("Could not find home directory, using working directory")
+		return legacyPaths(".")
+	}
+	return platformPaths(runtime.GOOS, os.Getenv, home)
+}
+
+// platformPaths returns default locations on goos with environment variables from getenv
+func platformPaths(goos string, getenv func(string) string, home string) (paths Paths) {
+	var configDir, dataDir string
+	switch goos {
+	case "windows":
+		configDir = filepath.Join(envDir(getenv, "AppData", filepath.Join(home, "AppData", "Roaming")), appDirName)
+		dataDir = filepath.Join(envDir(getenv, "LocalAppData", filepath.Join(home, "AppData", "Local")), appDirName)
+		paths.Socket = filepath.Join(dataDir, socketFileName)
+	case "darwin", "ios":
+		configDir = filepath.Join(home, "Library", "Application Support", appDirName)
+		dataDir = configDir
+		paths.Socket = filepath.Join(dataDir, socketFileName)
+	default:
+		configHome := envDir(getenv, "XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+		configDir = filepath.Join(configHome, appDirName)
+		dataDir = filepath.Join(envDir(getenv, "XDG_DATA_HOME", filepath.Join(home, ".local", "share")), appDirName)
+		if runtimeDir := envDir(getenv, "XDG_RUNTIME_DIR", ""); runtimeDir != "" {
+			paths.Socket = filepath.Join(runtimeDir, socketFileName)
+		} else {
+			paths.Socket = filepath.Join(dataDir, socketFileName)
+		}
+		paths.Download = xdgUserDir(getenv, configHome, home, "DOWNLOAD")
+	}
+	if paths.Download == "" {
+		paths.Download = filepath.Join(home, "Downloads")
+	}
+	paths.Config = filepath.Join(configDir, configFileName)
+	paths.Key = filepath.Join(dataDir, "keys")
+	paths.Data = dataDir
+	return paths
+}
+
+// envDir returns the directory in environment variable name, or fallback if it is not
+// an absolute path. Relative paths are ignored as required by the XDG base directory spec.
+func envDir(getenv func(string) string, name string, fallback string) string {
+	if dir := getenv(name); filepath.IsAbs(dir) {
+		return dir
+	}
+	return fallback
+}
+
+// xdgUserDir returns the XDG user directory such as "DOWNLOAD" from the environment variable,
+// or user-dirs.dirs in configHome. Returns an empty string if it is not set.
+func xdgUserDir(getenv func(string) string, configHome string, home string, name string) string {
+	name = "XDG_" + name + "_DIR"
+	if dir := envDir(getenv, name, ""); dir != "" {
+		return dir
+	}
+	file, err := os.Open(filepath.Join(configHome, "user-dirs.dirs"))
+	if err != nil {
+		return ""
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug(err)
+		}
+	}()
+	// Lines are in the form of XDG_DOWNLOAD_DIR="$HOME/Downloads"
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, name+"=") {
+			continue
+		}
+		value := strings.Trim(strings.TrimPrefix(line, name+"="), `"`)
+		if strings.HasPrefix(value, "$HOME") {
+			value = home + strings.TrimPrefix(value, "$HOME")
+		}
+		// $HOME itself means the directory is disabled
+		if filepath.Clean(value) == filepath.Clean(home) || !filepath.IsAbs(value) {
+			return ""
+		}
+		return filepath.Clean(value)
+	}
+	return ""
+}
+
+// legacyPaths returns locations relative to dir, used by earlier versions
+func legacyPaths(dir string) Paths {
+	return Paths{
+		Config:   filepath.Join(dir, "config", configFileName),
+		Key:      dir,
+		Data:     filepath.Join(dir, "data"),
+		Download: filepath.Join(dir, util.DownloadPath),
+		Socket:   filepath.Join(dir, "data", socketFileName),
+	}
+}
+
+// MigrateLegacyPaths moves the identity that earlier versions kept relative to the working
+// directory dir to the default locations, and writes its config to configPath with updated paths.
+// Paths that were changed from the old defaults are kept, and relative ones are made absolute.
+// Received files are not moved. Nothing is done if configPath exists or dir has no config or
+// identity. If a file cannot be moved, files moved so far are moved back.
+// Returns true if the identity was migrated.
+func MigrateLegacyPaths(dir string, configPath string) (migrated bool, err error) {
+	if _, err = os.Stat(configPath); err == nil || !os.IsNotExist(err) {
+		return false, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		log.Debug(err)
+		log.Error("Error while resolving working directory")
+		return false, err
+	}
+
+	// Old config files have paths relative to dir
+	legacy := legacyPaths(".")
+	legacyDefaults := DefaultConfig()
+	legacyDefaults.KeyPath, legacyDefaults.DataPath = legacy.Key, legacy.Data
+	legacyDefaults.DownloadPath, legacyDefaults.SocketPath = legacy.Download, legacy.Socket
+	legacyConfigPath := filepath.Join(dir, legacy.Config)
+	config, _, err := LoadConfigWithDefaults(legacyDefaults, legacyConfigPath, nil, nil)
+	if err != nil {
+		log.Error("Could not read config of earlier version")
+		return false, err
+	}
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	oldKeyPath, oldDataPath := resolve(config.KeyPath), resolve(config.DataPath)
+
+	// moves maps old file names to new file names
+	moves := make(map[string]string)
+	defaults := DefaultConfig()
+	for _, path := range []struct {
+		value      *string
+		legacy     string
+		defaultDir string
+	}{
+		{&config.KeyPath, legacy.Key, defaults.KeyPath},
+		{&config.DataPath, legacy.Data, defaults.DataPath},
+		{&config.DownloadPath, legacy.Download, defaults.DownloadPath},
+		{&config.SocketPath, legacy.Socket, defaults.SocketPath},
+	} {
+		if filepath.Clean(*path.value) == path.legacy {
+			*path.value = path.defaultDir
+		} else {
+			*path.value = resolve(*path.value)
+		}
+	}
+	// Private keys in secret-service are stored by the absolute key path, so keys are not moved
+	if config.KeyStorage != keyStorageFile {
+		config.KeyPath = oldKeyPath
+	}
+	addMoves := func(oldDir string, newDir string, names []string) {
+		if filepath.Clean(oldDir) == filepath.Clean(newDir) {
+			return
+		}
+		for _, name := range names {
+			moves[filepath.Join(oldDir, name)] = filepath.Join(newDir, name)
+		}
+	}
+	addMoves(oldKeyPath, config.KeyPath, []string{"key.pub", "key.priv"})
+	addMoves(oldKeyPath, config.KeyPath, archivedKeyFiles(oldKeyPath))
+	addMoves(oldDataPath, config.DataPath, backupDataFiles)
+
+	// Only files that exist are moved. Existing files are never overwritten.
+	found := false
+	if _, err = os.Stat(legacyConfigPath); err == nil {
+		found = true
+	}
+	for oldName, newName := range moves {
+		if _, err = os.Stat(oldName); os.IsNotExist(err) {
+			delete(moves, oldName)
+			continue
+		}
+		found = true
+		if _, err = os.Stat(newName); err == nil {
+			log.Error("Could not migrate ", oldName, ": ", newName, " already exists")
+			return false, MigrationConflictError
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	// moved lists old names of moved files, which are moved back if migration fails
+	moved := make([]string, 0, len(moves))
+	for oldName, newName := range moves {
+		if err = moveFile(oldName, newName); err != nil {
+			log.Error("Could not move ", oldName, " to ", newName)
+			undoMoves(moves, moved)
+			return false, err
+		}
+		moved = append(moved, oldName)
+		log.Info("Moved ", oldName, " to ", newName)
+	}
+	if err = writeConfigFile(configPath, *config); err != nil {
+		log.Error("Error while writing migrated config")
+		if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
+			log.Debug(err)
+		}
+		undoMoves(moves, moved)
+		return false, err
+	}
+	log.Info("Migrated config from ", legacyConfigPath, " to ", configPath)
+	return true, nil
+}
+
+// undoMoves moves files in moved back to their old names, newest first
+func undoMoves(moves map[string]string, moved []string) {
+	for i := len(moved) - 1; i >= 0; i-- {
+		if err := moveFile(moves[moved[i]], moved[i]); err != nil {
+			log.Debug(err)
+			log.Error("Could not move ", moves[moved[i]], " back to ", moved[i])
+		}
+	}
+}
+
+// archivedKeyFiles returns names of rotated keys under keyPath, relative to keyPath
+func archivedKeyFiles(keyPath string) (names []string) {
+	_ = filepath.Walk(filepath.Join(keyPath, "archive"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if name, err := filepath.Rel(keyPath, path); err == nil {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
+
+// moveFile moves oldName to newName, creating the directory of newName.
+// Files are copied if they can not be renamed, e.g. across file systems.
+func moveFile(oldName string, newName string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(newName), 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating directory")
+		return err
+	}
+	if err = os.Rename(oldName, newName); err == nil {
+		return nil
+	}
+	info, err := os.Stat(oldName)
+	if err != nil {
+		log.Debug(err)
+		return err
+	}
+	src, err := os.Open(oldName)
+	if err != nil {
+		log.Debug(err)
+		return err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Debug(err)
+		}
+	}()
+	dst, err := os.OpenFile(newName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		log.Debug(err)
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		log.Debug(err)
+		_ = dst.Close()
+		_ = os.Remove(newName)
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		log.Debug(err)
+		_ = os.Remove(newName)
+		return err
+	}
+	return os.Remove(oldName)
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPlatformPaths(t *testing.T) {
+	home := "/home/build"
+	configHome := t.TempDir()
+	env := map[string]string{
+		"XDG_CONFIG_HOME": configHome,
+		"XDG_DATA_HOME":   "/xdg/data",
+		"XDG_RUNTIME_DIR": "/run/user/1000",
+	}
+	getenv := func(name string) string { return env[name] }
+	userDirs := "# Written by xdg-user-dirs-update\nXDG_DESKTOP_DIR=\"$HOME/Desktop\"\nXDG_DOWNLOAD_DIR=\"$HOME/Incoming\"\n"
+	if err := ioutil.WriteFile(filepath.Join(configHome, "user-dirs.dirs"), []byte(userDirs), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := platformPaths("linux", getenv, home)
+	expected := Paths{
+		Config:   filepath.Join(configHome, "coconut", "config.yml"),
+		Key:      "/xdg/data/coconut/keys",
+		Data:     "/xdg/data/coconut",
+		Download: "/home/build/Incoming",
+		Socket:   "/run/user/1000/coconut.sock",
+	}
+	if paths != expected {
+		t.Errorf("Unexpected paths with XDG variables: %+v", paths)
+	}
+
+	// Relative paths in XDG variables are ignored
+	env = map[string]string{"XDG_DATA_HOME": "data", "XDG_CONFIG_HOME": "config"}
+	paths = platformPaths("linux", getenv, home)
+	expected = Paths{
+		Config:   "/home/build/.config/coconut/config.yml",
+		Key:      "/home/build/.local/share/coconut/keys",
+		Data:     "/home/build/.local/share/coconut",
+		Download: "/home/build/Downloads",
+		Socket:   "/home/build/.local/share/coconut/coconut.sock",
+	}
+	if paths != expected {
+		t.Errorf("Unexpected default XDG paths: %+v", paths)
+	}
+
+	if paths = platformPaths("darwin", getenv, home); paths.Data != "/home/build/Library/Application Support/coconut" ||
+		paths.Config != filepath.Join(paths.Data, "config.yml") {
+		t.Errorf("Unexpected paths on macOS: %+v", paths)
+	}
+}
+
+// legacyIdentityHelper creates files of an identity of earlier versions in a temporary directory
+func legacyIdentityHelper(t *testing.T, config string) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	for name, data := range map[string]string{
+		"key.pub":                "public key",
+		"key.priv":               "private key",
+		"archive/0123abcd.pub":   "old public key",
+		"data/contacts.gob":      "contacts",
+		"config/config.yml":      config,
+		"downloaded/received.md": "received file",
+	} {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMigrateLegacyPaths(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, "data"))
+	t.Setenv("XDG_DOWNLOAD_DIR", "")
+	paths := DefaultPaths()
+
+	dir := legacyIdentityHelper(t, "server_host: relay.example.com\nkey_path: ./\ndata_path: ./data/\n"+
+		"download_path: ./received\n")
+	migrated, err := MigrateLegacyPaths(dir, paths.Config)
+	if err != nil || !migrated {
+		t.Fatal("Expected migration, got: ", migrated, err)
+	}
+	for _, name := range []string{filepath.Join(paths.Key, "key.pub"), filepath.Join(paths.Key, "key.priv"),
+		filepath.Join(paths.Key, "archive", "0123abcd.pub"), filepath.Join(paths.Data, "contacts.gob")} {
+		if _, err = os.Stat(name); err != nil {
+			t.Error("File was not migrated: ", err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "key.priv")); !os.IsNotExist(err) {
+		t.Error("Old private key should be removed, got: ", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "downloaded", "received.md")); err != nil {
+		t.Error("Received files should not be moved: ", err)
+	}
+
+	config, _, err := LoadConfig(paths.Config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerHost != "relay.example.com" || config.KeyPath != paths.Key || config.DataPath != paths.Data ||
+		config.DownloadPath != filepath.Join(dir, "received") || config.SocketPath != paths.Socket {
+		t.Errorf("Unexpected migrated config: %+v", config)
+	}
+
+	// Migration is done only once
+	if migrated, err = MigrateLegacyPaths(dir, paths.Config); err != nil || migrated {
+		t.Error("Migration should be skipped if config exists, got: ", migrated, err)
+	}
+
+	// Existing identity in default locations is not overwritten
+	if err = os.Remove(paths.Config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = MigrateLegacyPaths(legacyIdentityHelper(t, ""), paths.Config); err != MigrationConflictError {
+		t.Error("Expected MigrationConflictError, got: ", err)
+	}
+
+	// Nothing to migrate
+	if migrated, err = MigrateLegacyPaths(t.TempDir(), paths.Config); err != nil || migrated {
+		t.Error("Expected no migration, got: ", migrated, err)
+	}
+}
+
+func TestMigrateLegacyPathsRollback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symbolic links require privileges on Windows")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, "data"))
+	t.Setenv("XDG_DOWNLOAD_DIR", "")
+	paths := DefaultPaths()
+
+	// Archived keys cannot be moved, as the archive directory is a broken link
+	if err := os.MkdirAll(paths.Key, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(home, "missing"), filepath.Join(paths.Key, "archive")); err != nil {
+		t.Fatal(err)
+	}
+	dir := legacyIdentityHelper(t, "")
+	if migrated, err := MigrateLegacyPaths(dir, paths.Config); err == nil || migrated {
+		t.Fatal("Expected migration to fail, got: ", migrated, err)
+	}
+	for _, name := range []string{"key.pub", "key.priv", filepath.Join("archive", "0123abcd.pub"),
+		filepath.Join("data", "contacts.gob")} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error("File was not moved back: ", err)
+		}
+	}
+	for _, name := range []string{filepath.Join(paths.Key, "key.priv"), filepath.Join(paths.Data, "contacts.gob"),
+		paths.Config} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Error("File should not exist after rollback: ", name, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// DefaultProfile is the name of the profile that uses DefaultPaths
+	DefaultProfile = "default"
+	// profilesDirName is the directory for named profiles in the config and data directories
+	profilesDirName = "profiles"
+	// maxProfileNameLen is the maximum length of profile names
+	maxProfileNameLen = 32
+)
+
+// InvalidProfileError is returned if a profile name is not valid
+var InvalidProfileError = errors.New("profile name must be 1-32 lowercase letters, digits, '-' or '_'")
+
+// validProfileName returns true if name can be used as a directory name of a profile
+func validProfileName(name string) bool {
+	if name == "" || len(name) > maxProfileNameLen {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// ProfilePaths returns default locations of the profile with name. An empty name is the default
+// profile, which uses DefaultPaths. Other profiles are stored in "profiles/<name>" in the config and
+// data directories, receive files in "<name>" in the download directory, and have their own socket.
+// Returns InvalidProfileError if name is not valid.
+func ProfilePaths(name string) (paths Paths, err error) {
+	if name == "" || name == DefaultProfile {
+		return DefaultPaths(), nil
+	}
+	if !validProfileName(name) {
+		return Paths{}, InvalidProfileError
+	}
+	return profilePaths(DefaultPaths(), name), nil
+}
+
+// profilePaths returns locations of the profile with name, based on locations of the default profile
+func profilePaths(base Paths, name string) Paths {
+	return Paths{
+		Config:   filepath.Join(filepath.Dir(base.Config), profilesDirName, name, configFileName),
+		Key:      filepath.Join(base.Data, profilesDirName, name, "keys"),
+		Data:     filepath.Join(base.Data, profilesDirName, name),
+		Download: filepath.Join(base.Download, name),
+		Socket:   filepath.Join(filepath.Dir(base.Socket), "coconut-"+name+".sock"),
+	}
+}
+
+// ProfileConfig returns default settings of the profile with name (see ProfilePaths)
+func ProfileConfig(name string) (config Config, err error) {
+	paths, err := ProfilePaths(name)
+	if err != nil {
+		return Config{}, err
+	}
+	config = ConfigWithPaths(paths)
+	if name != "" {
+		config.Profile = name
+	}
+	return config, nil
+}
+
+// ListProfiles returns the default profile and profiles with a config file, sorted by name
+func ListProfiles() (names []string, err error) {
+	names = []string{DefaultProfile}
+	dir := filepath.Join(filepath.Dir(DefaultPaths().Config), profilesDirName)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading profiles directory")
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validProfileName(entry.Name()) || entry.Name() == DefaultProfile {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(dir, entry.Name(), configFileName)); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+// CheckProfileIsolation returns *ConfigError if the key, data or socket path of config is used by
+// another profile, so that profiles never share keys, contacts or a daemon
+func CheckProfileIsolation(config *Config) (err error) {
+	names, err := ListProfiles()
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, name := range names {
+		if name == config.Profile {
+			continue
+		}
+		other, err := ProfileConfig(name)
+		if err != nil {
+			return err
+		}
+		paths, _ := ProfilePaths(name)
+		// Default paths are checked if the config of the other profile is invalid
+		if loaded, _, err := LoadConfigWithDefaults(other, paths.Config, nil, nil); err == nil {
+			other = *loaded
+		}
+		for _, path := range []struct {
+			key   string
+			path  string
+			other string
+		}{
+			{"key_path", config.KeyPath, other.KeyPath},
+			{"data_path", config.DataPath, other.DataPath},
+			{"socket_path", config.SocketPath, other.SocketPath},
+		} {
+			if samePath(path.path, path.other) {
+				problems = append(problems, fmt.Sprintf("%s: %s is used by profile %s", path.key, path.path, name))
+			}
+		}
+	}
+	if len(problems) != 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// samePath returns true if a and b are the same location
+func samePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
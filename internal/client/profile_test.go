@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// profileHomeHelper sets XDG base directories to a temporary directory
+func profileHomeHelper(t *testing.T) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, "data"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(home, "run"))
+	t.Setenv("XDG_DOWNLOAD_DIR", filepath.Join(home, "Downloads"))
+}
+
+func TestProfilePaths(t *testing.T) {
+	profileHomeHelper(t)
+	base := DefaultPaths()
+	for _, name := range []string{"", "default"} {
+		if paths, err := ProfilePaths(name); err != nil || paths != base {
+			t.Error("Default profile should use default paths, got: ", paths, err)
+		}
+	}
+	for _, name := range []string{"Work", "../work", "work/1", "w o", strings.Repeat("w", 33)} {
+		if _, err := ProfilePaths(name); err != InvalidProfileError {
+			t.Error("Expected InvalidProfileError for ", name, ", got: ", err)
+		}
+	}
+
+	work, err := ProfilePaths("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	personal, _ := ProfilePaths("personal")
+	for _, paths := range [][2]string{
+		{work.Config, base.Config}, {work.Key, base.Key}, {work.Data, base.Data},
+		{work.Download, base.Download}, {work.Socket, base.Socket},
+		{work.Key, personal.Key}, {work.Data, personal.Data}, {work.Socket, personal.Socket},
+	} {
+		if paths[0] == paths[1] {
+			t.Error("Profiles should not share ", paths[0])
+		}
+	}
+
+	config, err := ProfileConfig("work")
+	if err != nil || config.Profile != "work" || config.KeyPath != work.Key || config.DownloadPath != work.Download {
+		t.Errorf("Unexpected profile config: %+v %v", config, err)
+	}
+	if config, _ = ProfileConfig(""); config.Profile != DefaultProfile {
+		t.Error("Unexpected name of default profile: ", config.Profile)
+	}
+}
+
+func TestCheckProfileIsolation(t *testing.T) {
+	profileHomeHelper(t)
+	if names, err := ListProfiles(); err != nil || len(names) != 1 || names[0] != DefaultProfile {
+		t.Error("Unexpected profiles: ", names, err)
+	}
+	for _, name := range []string{"work", "personal"} {
+		paths, _ := ProfilePaths(name)
+		config, _ := ProfileConfig(name)
+		if err := WriteDefaultConfig(paths.Config, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Directories without config are not profiles
+	if err := os.MkdirAll(filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "coconut", "profiles", "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	names, err := ListProfiles()
+	if err != nil || strings.Join(names, ",") != "default,personal,work" {
+		t.Error("Unexpected profiles: ", names, err)
+	}
+
+	work, _ := ProfileConfig("work")
+	if err = CheckProfileIsolation(&work); err != nil {
+		t.Error(err)
+	}
+
+	// Keys of another profile cannot be used
+	personal, _ := ProfileConfig("personal")
+	work.KeyPath = personal.KeyPath
+	work.SocketPath = DefaultConfig().SocketPath
+	var configErr *ConfigError
+	if err = CheckProfileIsolation(&work); !errors.As(err, &configErr) || len(configErr.Problems) != 2 ||
+		!strings.HasPrefix(configErr.Problems[0], "socket_path:") ||
+		!strings.HasSuffix(configErr.Problems[1], "is used by profile personal") {
+		t.Error("Expected ConfigError, got: ", err)
+	}
+
+	// Paths in config files of other profiles are checked
+	paths, _ := ProfilePaths("personal")
+	sharedData := t.TempDir()
+	if err = ioutil.WriteFile(paths.Config, []byte("data_path: "+sharedData+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	work, _ = ProfileConfig("work")
+	work.DataPath = sharedData
+	if err = CheckProfileIsolation(&work); !errors.As(err, &configErr) || len(configErr.Problems) != 1 {
+		t.Error("Expected ConfigError, got: ", err)
+	}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"io"
+	"time"
+)
+
+// rateLimiter keeps the average transfer rate since the first transfer at or below limit
+// bytes per second
+type rateLimiter struct {
+	limit ByteSize
+	start time.Time
+	total int64
+}
+
+// wait records n transferred bytes, and sleeps until the average rate is within the limit
+func (limiter *rateLimiter) wait(n int) {
+	if limiter.start.IsZero() {
+		limiter.start = time.Now()
+	}
+	limiter.total += int64(n)
+	expected := time.Duration(float64(limiter.total) / float64(limiter.limit) * float64(time.Second))
+	if d := expected - time.Since(limiter.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type limitedWriter struct {
+	writer  io.Writer
+	limiter *rateLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (n int, err error) {
+	n, err = w.writer.Write(p)
+	w.limiter.wait(n)
+	return n, err
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// limitWriter returns writer limited to limit bytes per second, or writer if limit is 0
+func limitWriter(writer io.Writer, limit ByteSize) io.Writer {
+	if limit <= 0 {
+		return writer
+	}
+	return &limitedWriter{writer: writer, limiter: &rateLimiter{limit: limit}}
+}
+
+// limitReader returns reader limited to limit bytes per second, or reader if limit is 0
+func limitReader(reader io.Reader, limit ByteSize) io.Reader {
+	if limit <= 0 {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: &rateLimiter{limit: limit}}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// FileRejectedError is returned when a received file is discarded by AutoAccept settings
+var FileRejectedError = errors.New("file rejected by auto accept settings")
+
+// transferLog logs sending and receiving files with the fingerprint of the peer
+var transferLog = log.Subsystem("transfer")
+
+// ReceiveResult stores the outcome of receiving a single file
+type ReceiveResult struct {
+	// Contact is the sender of the file. nil if the sender is not a contact.
+	Contact *Contact
+	// FileName is the path of the decrypted file
+	FileName string
+	// Err is nil if the file was received successfully
+	Err error
+}
+
+// Received returns the channel that receives the outcome of every file relayed to this client.
+// Results are dropped if the channel is full.
+func (client *Client) Received() <-chan *ReceiveResult {
+	return client.received
+}
+
+// handleConnRelay is called when a relay to this client arrives on a connection without mux.
+// msg contains the public key hash of the sender. The relay is a file or key handovers, which
+// are told apart by the next message. Key handovers after the first one are handled by
+// commandHandler.
+func (client *Client) handleConnRelay(msg *util.Message, conn io.Reader) (err error) {
+	next, err := util.ReadMessage(conn)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading relay")
+		return err
+	}
+	command := common.CommandCodes[next.CommandCode]
+	if command == common.KeyHandover {
+		return client.handleKeyHandover(next)
+	}
+	if command == nil || next.ErrorCode != 0 {
+		log.Error("Unexpected command code ", next.CommandCode, " in relay")
+		return util.UnexpectedCommandError
+	}
+	// handleRelay reads the file from the first message
+	var buffer bytes.Buffer
+	if _, err = util.WriteMessage(&buffer, next.Data, nil, command); err != nil {
+		return err
+	}
+	return client.handleRelay(msg, io.MultiReader(&buffer, conn))
+}
+
+// handleRelay is called when the relay server starts relaying a file to this client.
+// msg contains the public key hash of the sender, and the encrypted file follows msg in reader.
+// The sender and the file size are checked before the file is written, and existing files
+// are never replaced. Messages of a file that was rejected or could not be decrypted are
+// ignored by commandHandler, or discarded by resetting the stream (see handleStream).
+func (client *Client) handleRelay(msg *util.Message, reader io.Reader) (err error) {
+	result := &ReceiveResult{Contact: nil, FileName: "", Err: nil}
+	defer client.reportReceived(result)
+	start := time.Now()
+	transfer := &Transfer{Direction: DirectionReceived, Peer: hex.EncodeToString(msg.Data), Route: RouteRelay,
+		Server: client.serverAddr()}
+	defer func() {
+		client.recordTransfer(transfer, start, result.Err)
+	}()
+
+	contact, ok := client.lookupContact(string(msg.Data))
+	if !ok {
+		log.Error("Received file from unknown sender")
+		result.Err = ContactNotFoundError
+		return result.Err
+	}
+	result.Contact = contact
+	client.mapMutex.RLock()
+	transfer.PeerName = contact.name()
+	logger := transferLog.With("peer", contact.Fingerprint())
+	pubKey, err := x509.ParsePKCS1PublicKey(contact.PubKey.Bytes)
+	client.mapMutex.RUnlock()
+	if err != nil {
+		log.Debug(err)
+		result.Err = InvalidContactError
+		return result.Err
+	}
+
+	// Files from senders that are not accepted are never decrypted
+	if err = client.acceptSender(contact); err != nil {
+		result.Err = err
+		return err
+	}
+
+	config := client.currentConfig()
+	ag, err := cryptography.DecryptSetupDir(config.DownloadPath)
+	if err != nil {
+		result.Err = err
+		return err
+	}
+	ag.SetAccept(func(fileName string, fileSize uint64) error {
+		transfer.FileName, transfer.Size = fileName, int64(fileSize)
+		return client.acceptSize(contact, fileSize)
+	})
+	if err = ag.Decrypt(limitReader(reader, config.Bandwidth.Download), pubKey, client.privKey); err != nil {
+		logger.Error("Error while receiving file", "error", err)
+		result.Err = err
+		return err
+	}
+	fileName := filepath.Join(config.DownloadPath, ag.FileName())
+	transfer.FileName = fileName
+	if transfer.Size, transfer.Hash, err = fileInfo(fileName); err != nil {
+		log.Debug(err)
+	}
+	result.FileName = fileName
+	logger.Info("Received file", "file", result.FileName)
+	return nil
+}
+
+// acceptSender returns FileRejectedError if files from contact should not be received
+func (client *Client) acceptSender(contact *Contact) (err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	switch accept := client.currentConfig().AutoAccept; {
+	case accept.From == AcceptNone:
+		transferLog.Warn("Discarded file, receiving files is disabled", "peer", contact.Fingerprint())
+		return FileRejectedError
+	case accept.From == AcceptVerified && !contact.Verified:
+		transferLog.Warn("Discarded file from unverified contact", "peer", contact.Fingerprint())
+		return FileRejectedError
+	}
+	return nil
+}
+
+// acceptSize returns FileRejectedError if a file of size bytes from contact should not be received
+func (client *Client) acceptSize(contact *Contact, size uint64) (err error) {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	accept := client.currentConfig().AutoAccept
+	if accept.MaxFileSize > 0 && size > uint64(accept.MaxFileSize) {
+		transferLog.Warn("Discarded file larger than limit", "peer", contact.Fingerprint(),
+			"size", size, "limit", accept.MaxFileSize)
+		return FileRejectedError
+	}
+	return nil
+}
+
+// reportReceived sends result to the Received channel without blocking
+func (client *Client) reportReceived(result *ReceiveResult) {
+	select {
+	case client.received <- result:
+	default:
+		log.Warning("Receive result dropped")
+	}
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// receivedHelper waits for a receive result of client
+func receivedHelper(t *testing.T, client *Client) *ReceiveResult {
+	t.Helper()
+	select {
+	case result := <-client.Received():
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out while waiting for receive result")
+		return nil
+	}
+}
+
+func TestHandleRelay(t *testing.T) {
+	testFileN := "../../pkg/testdata/checksum.txt"
+
+	receiver := InitConfig()
+	receiver.DownloadPath = t.TempDir()
+	var err error
+	if receiver.privKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	receiverContact, err := newContact("Build", "Receiver",
+		cryptography.PubKeyToPem(&receiver.privKey.PublicKey).Bytes, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderContact, senderKey := contactKeyHelper(t, "Build", "Sender")
+	receiver.mergeContact(senderContact)
+	sender := InitConfig()
+	sender.privKey = senderKey
+
+	serverConn, clientConn := net.Pipe()
+	receiver.conn = clientConn
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	go receiver.commandHandler()
+
+	// relayFrom relays the file to receiver as if it was sent by senderHash
+	relayFrom := func(senderHash []byte) {
+		relay := func(rxPubKeyHash string, writeData func(writer io.Writer) error) (err error) {
+			if _, err = util.WriteMessage(serverConn, senderHash, nil, common.RequestRelay); err != nil {
+				return err
+			}
+			return writeData(serverConn)
+		}
+		results, err := sender.sendToContacts([]*Contact{receiverContact}, testFileN, relay)
+		if err != nil || results[0].Err != nil {
+			t.Error("Error while relaying file: ", err)
+		}
+	}
+
+	// Files from unknown senders are rejected, and the rest of the stream is ignored
+	done := make(chan struct{})
+	go func() {
+		relayFrom([]byte("unknown sender"))
+		close(done)
+	}()
+	if result := receivedHelper(t, receiver); result.Err != ContactNotFoundError || result.Contact != nil {
+		t.Error("Expected ContactNotFoundError, got: ", result.Err)
+	}
+
+	<-done
+	go relayFrom(senderContact.PubKeyHash)
+	result := receivedHelper(t, receiver)
+	if result.Err != nil || result.Contact != senderContact ||
+		result.FileName != filepath.Join(receiver.DownloadPath, "checksum.txt") {
+		t.Error("Unexpected result: ", result.Err, result.FileName)
+		return
+	}
+	expected, _ := ioutil.ReadFile(testFileN)
+	received, _ := ioutil.ReadFile(result.FileName)
+	if !bytes.Equal(expected, received) {
+		t.Error("Received file mismatch")
+	}
+
+	// Both files are recorded, newest first
+	_, hash, _ := fileInfo(testFileN)
+	history := receiver.History()
+	if len(history) != 2 || history[0].Direction != DirectionReceived || history[0].Result != ResultOK ||
+		history[0].Peer != senderContact.Fingerprint() || history[0].PeerName != "Build Sender" ||
+		history[0].Hash != hash || history[0].Size != int64(len(expected)) || history[1].Result != ResultFailed {
+		t.Error("Unexpected history: ", history)
+	}
+
+	// Rejected files are never written
+	receiver.AutoAccept.MaxFileSize = ByteSize(len(expected) - 1)
+	go relayFrom(senderContact.PubKeyHash)
+	if result = receivedHelper(t, receiver); result.Err != FileRejectedError {
+		t.Error("Expected FileRejectedError, got: ", result.Err)
+	}
+	receiver.AutoAccept.MaxFileSize = 0
+	receiver.AutoAccept.From = AcceptVerified
+	go relayFrom(senderContact.PubKeyHash)
+	if result = receivedHelper(t, receiver); result.Err != FileRejectedError {
+		t.Error("Expected FileRejectedError, got: ", result.Err)
+	}
+	if history = receiver.History(); history[0].Result != ResultRejected || history[1].Result != ResultRejected ||
+		history[1].FileName != "checksum.txt" || history[1].Size != int64(len(expected)) {
+		t.Error("Unexpected history: ", history)
+	}
+
+	// Existing files are not replaced
+	receiver.AutoAccept.From = AcceptContacts
+	if err = ioutil.WriteFile(filepath.Join(receiver.DownloadPath, "checksum.txt"), []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	go relayFrom(senderContact.PubKeyHash)
+	if result = receivedHelper(t, receiver); result.Err != nil ||
+		result.FileName != filepath.Join(receiver.DownloadPath, "checksum (1).txt") {
+		t.Error("Unexpected result: ", result.Err, result.FileName)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(receiver.DownloadPath, "checksum.txt")); string(b) != "existing" {
+		t.Error("Existing file was replaced")
+	}
+	if files, _ := filepath.Glob(filepath.Join(receiver.DownloadPath, "*")); len(files) != 2 {
+		t.Error("Unexpected files in the download directory: ", files)
+	}
+}
+
+func TestHandleRelayHandover(t *testing.T) {
+	testFileN := "../../pkg/testdata/checksum.txt"
+
+	alice, key0 := contactKeyHelper(t, "Alice", "Laptop")
+	_, key1 := contactKeyHelper(t, "Alice", "Laptop")
+	_, key2 := contactKeyHelper(t, "Alice", "Laptop")
+	sender := InitConfig()
+	sender.privKey = key2
+	for _, keys := range [][2]*rsa.PrivateKey{{key0, key1}, {key1, key2}} {
+		handover, err := cryptography.SignHandover(keys[0], &keys[1].PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.handovers = append(sender.handovers, handover)
+	}
+
+	receiver := InitConfig()
+	receiver.DataPath = t.TempDir()
+	receiver.DownloadPath = t.TempDir()
+	var err error
+	if receiver.privKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	receiverContact, err := newContact("Build", "Receiver",
+		cryptography.PubKeyToPem(&receiver.privKey.PublicKey).Bytes, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.mergeContact(alice)
+	oldFingerprint := alice.Fingerprint()
+
+	serverConn, clientConn := net.Pipe()
+	receiver.conn = clientConn
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	go receiver.commandHandler()
+
+	// Handovers are relayed without mux, followed by a file signed with the latest key
+	newHash := cryptography.PemToSha256(cryptography.PubKeyToPem(&key2.PublicKey))
+	go func() {
+		if _, err := util.WriteMessage(serverConn, alice.PubKeyHash, nil, common.RequestRelay); err != nil {
+			return
+		}
+		if err := sender.writeHandovers(serverConn); err != nil {
+			return
+		}
+		relay := func(rxPubKeyHash string, writeData func(writer io.Writer) error) (err error) {
+			if _, err = util.WriteMessage(serverConn, newHash, nil, common.RequestRelay); err != nil {
+				return err
+			}
+			return writeData(serverConn)
+		}
+		_, _ = sender.sendToContacts([]*Contact{receiverContact}, testFileN, relay)
+	}()
+
+	result := receivedHelper(t, receiver)
+	if result.Err != nil || result.Contact == nil || !bytes.Equal(result.Contact.PubKeyHash, newHash) {
+		t.Fatal("Unexpected result: ", result.Err)
+	}
+	if _, err = receiver.FindContact(oldFingerprint); err != ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError for the old key, got: ", err)
+	}
+	if history := receiver.History(); len(history) != 1 || history[0].Result != ResultOK {
+		t.Error("Unexpected history: ", history)
+	}
+}
+
+func TestContacts(t *testing.T) {
+	client := InitConfig()
+	contact1 := contactHelper(t, "Build", "Server2")
+	contact2 := contactHelper(t, "Build", "Server1")
+	contact3 := contactHelper(t, "Alice", "")
+	for _, contact := range []*Contact{contact1, contact2, contact3} {
+		client.mergeContact(contact)
+	}
+
+	contacts := client.Contacts()
+	if len(contacts) != 3 || contacts[0] != contact3 || contacts[1] != contact2 || contacts[2] != contact1 {
+		t.Error("Contacts are not sorted by name")
+	}
+
+	if contact, err := client.FindContact(contact1.Fingerprint()); err != nil || contact != contact1 {
+		t.Error("Contact not found: ", err)
+	}
+	if _, err := client.FindContact("not a fingerprint"); err != ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError, got: ", err)
+	}
+	if _, err := client.FindContact("00"); err != ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError, got: ", err)
+	}
+}
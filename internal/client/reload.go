@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConfigChange is a setting changed by ApplyConfig
+type ConfigChange struct {
+	Key    string
+	Reload Reload
+}
+
+// currentConfig returns a copy of settings of client. Must be used instead of client.Config
+// in goroutines that are not serialized with ApplyConfig, such as commandHandler.
+func (client *Client) currentConfig() Config {
+	client.configMutex.RLock()
+	defer client.configMutex.RUnlock()
+	return client.Config
+}
+
+// ApplyConfig replaces settings of client with config and returns changed settings.
+// ReloadRestart settings are kept. ReloadReconnect settings take effect when the client
+// connects next time, so the caller should reconnect if the client is connected.
+func (client *Client) ApplyConfig(config Config) (changes []ConfigChange) {
+	client.configMutex.Lock()
+	defer client.configMutex.Unlock()
+	old := client.Config
+	for _, s := range settings {
+		if s.value(&old).String() == s.value(&config).String() {
+			continue
+		}
+		changes = append(changes, ConfigChange{Key: s.key, Reload: s.reload})
+		if s.reload == ReloadRestart {
+			_ = s.value(&config).Set(s.value(&old).String())
+		}
+	}
+	client.Config = config
+	return changes
+}
+
+// ConfigWatcher polls a config file for changes
+type ConfigWatcher struct {
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// WatchConfig reads fileName every interval, and calls onChange with settings from
+// LoadConfigWithDefaults with defaults, environ and flags when the content of the file changes. Invalid configs are logged and
+// ignored until the file changes again. A missing file is ignored. The file is never written.
+func WatchConfig(fileName string, defaults Config, environ []string, flags map[string]string, interval time.Duration,
+	onChange func(config *Config)) (watcher *ConfigWatcher) {
+	watcher = &ConfigWatcher{done: make(chan struct{})}
+	hash := configHash(fileName)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watcher.done:
+				return
+			case <-ticker.C:
+			}
+			newHash := configHash(fileName)
+			if newHash == nil || bytes.Equal(newHash, hash) {
+				continue
+			}
+			hash = newHash
+			config, _, err := LoadConfigWithDefaults(defaults, fileName, environ, flags)
+			if err != nil {
+				log.Error("Config was not reloaded: ", err)
+				continue
+			}
+			log.Info("Config changed, reloading ", fileName)
+			onChange(config)
+		}
+	}()
+	return watcher
+}
+
+// configHash returns SHA256 hash of fileName, or nil if it cannot be read
+func configHash(fileName string) []byte {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Debug(err)
+			log.Warning("Could not read config file")
+		}
+		return nil
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// Close stops watching fileName
+func (watcher *ConfigWatcher) Close() {
+	watcher.closeOnce.Do(func() { close(watcher.done) })
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	client := InitConfig()
+	config := client.Config
+	config.ServerHost = "relay.example.com"
+	config.DataPath = filepath.Join(t.TempDir(), "data")
+	config.Bandwidth.Download = 1 << 20
+	config.Log.Level = "debug"
+
+	expected := map[string]Reload{
+		"server_host":        ReloadReconnect,
+		"data_path":          ReloadRestart,
+		"bandwidth.download": ReloadLive,
+		"log.level":          ReloadLive,
+	}
+	changes := client.ApplyConfig(config)
+	if len(changes) != len(expected) {
+		t.Error("Unexpected changes: ", changes)
+	}
+	for _, change := range changes {
+		if reload, ok := expected[change.Key]; !ok || reload != change.Reload {
+			t.Error("Unexpected change: ", change)
+		}
+	}
+	if current := client.currentConfig(); current.ServerHost != config.ServerHost ||
+		current.Bandwidth.Download != 1<<20 || current.DataPath == config.DataPath {
+		t.Errorf("Unexpected config after ApplyConfig: %+v", current)
+	}
+	if changes = client.ApplyConfig(client.Config); len(changes) != 0 {
+		t.Error("Expected no changes, got: ", changes)
+	}
+}
+
+func TestWriteDefaultConfig(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "coconut", "config.yml")
+	if err := WriteDefaultConfig(fileName, DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadConfig(fileName, nil, nil); err != nil {
+		t.Error("Default config should be valid: ", err)
+	}
+	// Broken config is not overwritten
+	if err := ioutil.WriteFile(fileName, []byte("server_port: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDefaultConfig(fileName, DefaultConfig()); !os.IsExist(err) {
+		t.Error("Expected error for existing file, got: ", err)
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != "server_port: [\n" {
+		t.Error("Existing config was overwritten")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	fileName := configFileHelper(t, "server_port: 9000\n")
+	changed := make(chan *Config, 1)
+	watcher := WatchConfig(fileName, DefaultConfig(), nil, map[string]string{"server_host": "relay.example.com"},
+		10*time.Millisecond, func(config *Config) { changed <- config })
+	defer watcher.Close()
+
+	waitChange := func() *Config {
+		t.Helper()
+		select {
+		case config := <-changed:
+			return config
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	if config := waitChange(); config != nil {
+		t.Error("Unchanged config should not be reloaded")
+	}
+
+	// Invalid config is ignored and left as it is
+	if err := ioutil.WriteFile(fileName, []byte("server_port: 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if config := waitChange(); config != nil {
+		t.Error("Invalid config should not be reloaded: ", config)
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != "server_port: 0\n" {
+		t.Error("Invalid config was overwritten")
+	}
+
+	// Flags still override the file
+	if err := ioutil.WriteFile(fileName, []byte("server_port: 9001\nserver_host: ignored\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if config := waitChange(); config == nil || config.ServerPort != 9001 || config.ServerHost != "relay.example.com" {
+		t.Errorf("Unexpected reloaded config: %+v", config)
+	}
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"encoding/gob"
+	"encoding/pem"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ReadHandoversFile read the contents of handovers.gob into client.handovers
+func (client *Client) ReadHandoversFile() (err error) {
+	file, err := os.OpenFile(filepath.Join(client.DataPath, "handovers.gob"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Error opening file: ", err)
+		return err
+	}
+
+	defer func() {
+		err = file.Close()
+		if err != nil {
+			log.Error("Error closing file: ", err)
+		}
+	}()
+
+	err = gob.NewDecoder(file).Decode(&client.handovers)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error decoding file: ", err)
+		return err
+	}
+	return err
+}
+
+// WriteHandoversFile write client.handovers into handovers.gob file
+func (client *Client) WriteHandoversFile() (err error) {
+	return client.writeDataFile("handovers.gob", client.handovers)
+}
+
+// RotateKeys replaces the key pair of this client with a new key pair. The new public key is
+// signed with the old private key, and every contact is marked to receive the handover
+// with DoAnnounceKey. Old keys are archived in KeyPath and KeyStorage.
+// Since the old private key is no longer available after rotation, handovers and
+// contacts are saved immediately. If connected, the client reconnects so that the relay server
+// knows this client by the new public key; the error of Connect is returned if it fails.
+func (client *Client) RotateKeys() (err error) {
+	ks, err := client.keyStore()
+	if err != nil {
+		return err
+	}
+	handover, pubBlock, privBlock, err := ks.Rotate()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while rotating keys")
+		return err
+	}
+	if client.privKey, err = cryptography.PemToKeys(privBlock); err != nil {
+		return err
+	}
+	client.pubKeyBlock = pubBlock
+
+	client.handovers = append(client.handovers, handover)
+	client.mapMutex.Lock()
+	for _, contact := range client.contactMap {
+		contact.HandoverPending = true
+	}
+	client.mapMutex.Unlock()
+	if err = client.WriteHandoversFile(); err != nil {
+		return err
+	}
+	if err = client.WriteContactsFile(); err != nil {
+		return err
+	}
+	if !client.IsConnected() {
+		return nil
+	}
+	// Relay server registered the old public key with Init
+	if err = client.Disconnect(); err != nil {
+		log.Debug(err)
+		log.Warning("Relay server did not complete disconnecting")
+	}
+	return client.Connect()
+}
+
+// HasPendingHandover returns true if any contact has not received the key handover yet
+func (client *Client) HasPendingHandover() bool {
+	client.mapMutex.RLock()
+	defer client.mapMutex.RUnlock()
+	for _, contact := range client.contactMap {
+		if contact.HandoverPending {
+			return true
+		}
+	}
+	return false
+}
+
+// DoAnnounceKey relays key handovers to every contact that has not received them yet,
+// then saves contacts. Contacts that could not be reached receive handovers next time.
+// Returns the outcome for each contact.
+func (client *Client) DoAnnounceKey() (results []*SendResult, err error) {
+	results = client.announceKey(client.doRelay)
+	return results, client.WriteContactsFile()
+}
+
+// announceKey sends key handovers with relay to every contact with pending handover.
+// The lock is not held while relaying, as replies are received by commandHandler.
+func (client *Client) announceKey(relay relayFunc) (results []*SendResult) {
+	var pkHashes []string
+	client.mapMutex.RLock()
+	for pkHash, contact := range client.contactMap {
+		if contact.HandoverPending {
+			pkHashes = append(pkHashes, pkHash)
+		}
+	}
+	client.mapMutex.RUnlock()
+
+	for _, pkHash := range pkHashes {
+		contact, ok := client.lookupContact(pkHash)
+		if !ok {
+			continue
+		}
+		result := &SendResult{Contact: contact, Err: nil}
+		results = append(results, result)
+
+		if result.Err = relay(pkHash, client.writeHandovers); result.Err != nil {
+			log.Debug(result.Err)
+			log.Errorf("Error while announcing key to %x", pkHash)
+			continue
+		}
+		client.mapMutex.Lock()
+		contact.HandoverPending = false
+		client.mapMutex.Unlock()
+	}
+	return results
+}
+
+// writeHandovers writes every key handover of this client to writer, oldest first, so that
+// contacts that missed previous rotations can follow the chain of keys.
+func (client *Client) writeHandovers(writer io.Writer) (err error) {
+	for _, handover := range client.handovers {
+		data, err := handover.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if _, err = util.WriteMessage(writer, data, nil, common.KeyHandover); err != nil {
+			log.Debug(err)
+			log.Error("Error while sending key handover")
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleKeyHandover verifies key handover received from a contact and replaces the public key
+// of the contact with its successor. The old public key is archived in Contact.PreviousKeys,
+// and the verification status and group memberships are kept.
+// Returns ContactNotFoundError if the old key does not belong to any contact, or
+// the handover was already applied.
+// Contacts and groups are locked while they are changed, as handovers are received by commandHandler.
+func (client *Client) HandleKeyHandover(data []byte) (contact *Contact, err error) {
+	var handover cryptography.KeyHandover
+	if err = handover.UnmarshalBinary(data); err != nil {
+		log.Error("Key handover could not be decoded")
+		return nil, err
+	}
+	if _, _, err = handover.Verify(); err != nil {
+		return nil, err
+	}
+
+	oldBlock := &pem.Block{Type: "RSA PUBLIC KEY", Headers: nil, Bytes: handover.OldPubKey}
+	newBlock := &pem.Block{Type: "RSA PUBLIC KEY", Headers: nil, Bytes: handover.NewPubKey}
+	oldHash := string(cryptography.PemToSha256(oldBlock))
+	newHash := string(cryptography.PemToSha256(newBlock))
+
+	client.mapMutex.Lock()
+	defer client.mapMutex.Unlock()
+	contact, ok := client.contactMap[oldHash]
+	if !ok {
+		return nil, ContactNotFoundError
+	}
+	delete(client.contactMap, oldHash)
+	if existing, ok := client.contactMap[newHash]; ok {
+		// Successor was already added as a separate contact
+		existing.Verified = existing.Verified || contact.Verified
+		existing.PreviousKeys = append(existing.PreviousKeys, contact.PreviousKeys...)
+		contact = existing
+	} else {
+		contact.PubKeyHash = []byte(newHash)
+		contact.PubKey = newBlock
+		client.contactMap[newHash] = contact
+	}
+	contact.PreviousKeys = append(contact.PreviousKeys, oldBlock)
+
+	for _, group := range client.groupMap {
+		for i, member := range group.Members {
+			if member == oldHash {
+				group.Members[i] = newHash
+			}
+		}
+		group.Members = uniqueMembers(group.Members)
+	}
+	log.Info("Contact ", contact.FirstName, " ", contact.LastName, " rotated key to ", contact.Fingerprint())
+	return contact, nil
+}
+
+// handleKeyHandover is called when a contact announces a rotated key
+func (client *Client) handleKeyHandover(msg *util.Message) (err error) {
+	if _, err = client.HandleKeyHandover(msg.Data); err == ContactNotFoundError {
+		// Handovers for older rotations are sent again with every announcement
+		return nil
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Key handover rejected")
+		return err
+	}
+	if err = client.WriteContactsFile(); err != nil {
+		return err
+	}
+	return client.WriteGroupsFile()
+}
+
+// uniqueMembers removes duplicated members while keeping the order
+func uniqueMembers(members []string) []string {
+	seen := make(map[string]struct{}, len(members))
+	result := members[:0]
+	for _, member := range members {
+		if _, ok := seen[member]; ok {
+			continue
+		}
+		seen[member] = struct{}{}
+		result = append(result, member)
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"time"
+)
+
+const (
+	// AppVersion is the version of this application sent to the relay server
+	AppVersion = "coconut-desktop/0.1.0"
+	// clientFeatures are protocol features supported by this client
+	clientFeatures = common.FeatureRelay | common.FeatureP2P | common.FeatureMux
+)
+
+// UnsupportedFeatureError is returned when the relay server does not support the requested feature
+var UnsupportedFeatureError = errors.New("feature not supported by the server")
+
+// doVersion negotiates protocol version and features with the relay server. Relay servers that
+// do not know Version command reply with common.UnknownCommandError, in which case the
+// connection is downgraded to common.LegacyProtocolVersion. Servers that do not reply within
+// RequestTimeout are also treated as legacy servers.
+// Returns common.IncompatibleVersionError if the server does not support any common version.
+func (client *Client) doVersion() (err error) {
+	client.commandMutex.Lock()
+	defer client.commandMutex.Unlock()
+	var command = common.Version
+	// commandHandler waits for useMux after passing the reply, as conn is read by the session
+	// if common.FeatureMux is negotiated
+	useMux := false
+	client.versionDone = make(chan bool, 1)
+	defer func() { client.versionDone <- useMux }()
+	client.newChan(command)
+	defer client.removeChan(command)
+
+	local := common.NewHello(clientFeatures, AppVersion)
+	data, err := local.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err = util.WriteMessage(client.controlConn(), data, nil, command); err != nil {
+		log.Debug(err)
+		log.Error("Error while sending protocol version")
+		return err
+	}
+
+	var msg *util.Message
+	select {
+	case msg = <-client.replyChan(command):
+	case <-time.After(client.RequestTimeout):
+	}
+	remote := &common.Hello{}
+	switch {
+	case msg == nil:
+		log.Warning("Server did not reply to version negotiation; using legacy protocol")
+		remote = common.LegacyHello()
+	case msg.ErrorCode == 0:
+		if err = remote.UnmarshalBinary(msg.Data); err != nil {
+			log.Debug(err)
+			log.Error("Server sent invalid protocol version")
+			return err
+		}
+	case msg.ErrorCode == common.UnknownCommandError.ErrCode:
+		log.Warning("Server does not support version negotiation; using legacy protocol")
+		remote = common.LegacyHello()
+	default:
+		if errCode := common.ErrorCodes[msg.ErrorCode]; errCode != nil {
+			return errCode
+		}
+		return common.UnknownCodeError
+	}
+
+	version, features, err := common.Negotiate(local, remote)
+	if err != nil {
+		log.Error("Server protocol version ", remote.MinVersion, "-", remote.Version, " is not supported")
+		return err
+	}
+	client.connMutex.Lock()
+	client.protocolVersion = version
+	client.features = features
+	client.connMutex.Unlock()
+	useMux = features.Has(common.FeatureMux)
+	log.Debug("Using protocol version ", version, " with features [", features, "], server: ", remote.AppVersion)
+	return nil
+}
+
+// ProtocolVersion returns the protocol version negotiated with the relay server.
+// Returns 0 if this client is not connected.
+func (client *Client) ProtocolVersion() uint16 {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	return client.protocolVersion
+}
+
+// HasFeature returns true if feature is supported by both this client and the relay server
+func (client *Client) HasFeature(feature common.Feature) bool {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	return client.features.Has(feature)
+}
+
+// Features returns protocol features supported by both this client and the relay server.
+// Returns 0 if this client is not connected.
+func (client *Client) Features() common.Feature {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	return client.features
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// versionServerHelper starts client.commandHandler on a pipe and replies to Version command
+// with reply and errCode
+func versionServerHelper(t *testing.T, client *Client, reply *common.Hello, errCode *common.Error) {
+	serverConn, clientConn := net.Pipe()
+	client.conn = clientConn
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	go client.commandHandler()
+	go func() {
+		msg, err := util.ReadMessage(serverConn)
+		if err != nil || msg.CommandCode != common.Version.Code {
+			return
+		}
+		var data []byte
+		if reply != nil {
+			data, _ = reply.MarshalBinary()
+		}
+		_, _ = util.WriteMessage(serverConn, data, errCode, common.Version)
+	}()
+}
+
+func TestDoVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    *common.Hello
+		errCode  *common.Error
+		version  uint16
+		features common.Feature
+		err      error
+	}{
+		{"current", common.NewHello(common.FeatureRelay|common.FeatureResume|common.FeatureCompression, "server/1.0"),
+			nil, common.ProtocolVersion, common.FeatureRelay, nil},
+		{"legacy", nil, common.UnknownCommandError, common.LegacyProtocolVersion, common.LegacyFeatures, nil},
+		{"incompatible", &common.Hello{Version: common.ProtocolVersion + 1, MinVersion: common.ProtocolVersion + 1},
+			nil, 0, 0, common.IncompatibleVersionError},
+		{"refused", nil, common.IncompatibleVersionError, 0, 0, common.IncompatibleVersionError},
+		{"invalid", nil, nil, 0, 0, common.InvalidHello},
+	}
+	for _, test := range tests {
+		client := InitConfig()
+		versionServerHelper(t, client, test.reply, test.errCode)
+		if err := client.doVersion(); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if client.ProtocolVersion() != test.version || client.features != test.features {
+			t.Errorf("%s: expected version %d [%v], got %d [%v]", test.name,
+				test.version, test.features, client.ProtocolVersion(), client.features)
+		}
+	}
+}
+
+func TestDoVersionTimeout(t *testing.T) {
+	client := InitConfig()
+	client.RequestTimeout = 100 * time.Millisecond
+	serverConn, clientConn := net.Pipe()
+	client.conn = clientConn
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	go client.commandHandler()
+	// Server reads the request, but never replies
+	go func() { _, _ = util.ReadMessage(serverConn) }()
+
+	if err := client.doVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if client.ProtocolVersion() != common.LegacyProtocolVersion || client.features != common.LegacyFeatures {
+		t.Error("Expected legacy protocol, got: ", client.ProtocolVersion(), client.features)
+	}
+}
+
+func TestDoRelayUnsupported(t *testing.T) {
+	client := InitConfig()
+	versionServerHelper(t, client, common.NewHello(common.FeatureP2P, "server/1.0"), nil)
+	if err := client.doVersion(); err != nil {
+		t.Error(err)
+		return
+	}
+	if client.HasFeature(common.FeatureRelay) {
+		t.Error("Relay should not be supported")
+	}
+	if err := client.doRelay("hash", nil); err != UnsupportedFeatureError {
+		t.Error("Expected UnsupportedFeatureError, got: ", err)
+	}
+}
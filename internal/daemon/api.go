@@ -0,0 +1,135 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"time"
+)
+
+// ConnectError is wrapped by errors returned when the relay server could not be reached
+var ConnectError = errors.New("could not connect to the relay server")
+
+// API is the set of operations available to the GTK UI and the command line. It is implemented
+// by Local, which uses the client directly, and by Conn, which talks to a running daemon.
+type API interface {
+	// Status returns the status of the client
+	Status() (status *Status, err error)
+	// Connect connects to the relay server, and announces pending key handovers.
+	// Does nothing if already connected.
+	Connect() (err error)
+	// Disconnect disconnects from the relay server
+	Disconnect() (err error)
+	// Contacts returns every contact sorted by name
+	Contacts() (contacts []*Contact, err error)
+	// AddContact adds the client with addCode as a contact. Returns true if it was newly added.
+	AddContact(addCode string, firstName string, lastName string) (contact *Contact, added bool, err error)
+	// RemoveContact removes the contact with fingerprint
+	RemoveContact(fingerprint string) (contact *Contact, err error)
+	// SendFile sends fileName to the contact with fingerprint
+	SendFile(fingerprint string, fileName string) (err error)
+	// GetAddCode returns a new Add Code. The Add Code is valid until RemoveAddCode is called
+	// or the client disconnects.
+	GetAddCode() (addCode string, err error)
+	// RemoveAddCode removes addCode
+	RemoveAddCode(addCode string) (err error)
+	// Receive waits up to timeout for files received after the file with ID after.
+	// Returns an empty list if no file was received.
+	Receive(after uint64, timeout time.Duration) (files []*ReceivedFile, err error)
+	// History returns up to limit recorded transfers, newest first. Every transfer is returned
+	// if limit is 0.
+	History(limit int) (transfers []*Transfer, err error)
+	// Resend sends the file of the sent transfer with id to its receiver again
+	Resend(id uint64) (err error)
+	// Close releases resources used by the API. For Local, the client is disconnected.
+	Close() (err error)
+}
+
+// Status is the status of the client
+type Status struct {
+	// Profile is the name of the profile of the client
+	Profile         string `json:"profile"`
+	Fingerprint     string `json:"fingerprint"`
+	Server          string `json:"server"`
+	Connected       bool   `json:"connected"`
+	ProtocolVersion uint16 `json:"protocol_version,omitempty"`
+	Features        string `json:"features,omitempty"`
+	Contacts        int    `json:"contacts"`
+	PendingHandover bool   `json:"pending_handover"`
+	// LastReceivedID is the ID of the last received file, or 0 if there is none
+	LastReceivedID uint64 `json:"last_received_id"`
+	// Daemon is true if the status is reported by a running daemon
+	Daemon bool `json:"daemon"`
+}
+
+// Contact is a contact of the client
+type Contact struct {
+	Fingerprint string `json:"fingerprint"`
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name"`
+	Verified    bool   `json:"verified"`
+}
+
+// newContact converts client.Contact to Contact. Returns nil if contact is nil.
+func newContact(contact *client.Contact) *Contact {
+	if contact == nil {
+		return nil
+	}
+	return &Contact{
+		Fingerprint: contact.Fingerprint(),
+		FirstName:   contact.FirstName,
+		LastName:    contact.LastName,
+		Verified:    contact.Verified,
+	}
+}
+
+// ReceivedFile is the outcome of receiving a single file
+type ReceivedFile struct {
+	// ID increases with every received file, starting from 1
+	ID uint64 `json:"id"`
+	// FileName is the absolute path of the received file
+	FileName string `json:"file,omitempty"`
+	// Sender is the sender of the file, or nil if the sender is not a contact
+	Sender *Contact `json:"sender"`
+	// Error is empty if the file was received successfully
+	Error string `json:"error,omitempty"`
+}
+
+// Transfer is a file transfer recorded in the history
+type Transfer struct {
+	// ID increases with every transfer, starting from 1
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	// Peer is the fingerprint of the receiver or the sender
+	Peer     string `json:"peer"`
+	PeerName string `json:"peer_name,omitempty"`
+	FileName string `json:"file,omitempty"`
+	Size     int64  `json:"size"`
+	// Hash is hex encoded SHA256 hash of the file
+	Hash   string `json:"hash,omitempty"`
+	Route  string `json:"route"`
+	Server string `json:"server,omitempty"`
+	// Duration is in nanoseconds
+	Duration time.Duration `json:"duration"`
+	Result   string        `json:"result"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// newTransfer converts client.Transfer to Transfer
+func newTransfer(transfer *client.Transfer) *Transfer {
+	return &Transfer{
+		ID:        transfer.ID,
+		Time:      transfer.Time,
+		Direction: transfer.Direction,
+		Peer:      transfer.Peer,
+		PeerName:  transfer.PeerName,
+		FileName:  transfer.FileName,
+		Size:      transfer.Size,
+		Hash:      transfer.Hash,
+		Route:     transfer.Route,
+		Server:    transfer.Server,
+		Duration:  transfer.Duration,
+		Result:    transfer.Result,
+		Error:     transfer.Error,
+	}
+}
@@ -0,0 +1,155 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// knownErrors are restored from error messages received from the daemon, so that callers can
+// compare them as if the API was used in-process
+var knownErrors = []error{
+	ConnectError,
+	client.ContactNotFoundError,
+	client.InvalidContactError,
+	client.UnsupportedFeatureError,
+	client.TransferNotFoundError,
+	client.NotResendableError,
+}
+
+// Conn implements API by calling a running daemon
+type Conn struct {
+	rpc *rpc.Client
+}
+
+// Dial connects to the daemon listening on socketPath
+func Dial(socketPath string) (conn *Conn, err error) {
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		log.Debug(err)
+		return nil, err
+	}
+	return &Conn{rpc: jsonrpc.NewClient(c)}, nil
+}
+
+// call calls method of the daemon and restores known errors
+func (conn *Conn) call(method string, args interface{}, reply interface{}) (err error) {
+	err = conn.rpc.Call(serviceName+"."+method, args, reply)
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	return restoreError(string(serverErr))
+}
+
+// restoreError returns known error with msg, or error wrapping it if msg starts with its message
+func restoreError(msg string) error {
+	for _, code := range common.ErrorCodes {
+		if code != nil && code.Error() == msg {
+			return code
+		}
+	}
+	for _, known := range knownErrors {
+		if msg == known.Error() {
+			return known
+		}
+		if rest := strings.TrimPrefix(msg, known.Error()+": "); rest != msg {
+			return fmt.Errorf("%w: %s", known, rest)
+		}
+	}
+	return errors.New(msg)
+}
+
+// Status returns the status of the client
+func (conn *Conn) Status() (status *Status, err error) {
+	status = &Status{}
+	if err = conn.call("Status", &Empty{}, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Connect connects to the relay server
+func (conn *Conn) Connect() (err error) {
+	return conn.call("Connect", &Empty{}, &Empty{})
+}
+
+// Disconnect disconnects from the relay server
+func (conn *Conn) Disconnect() (err error) {
+	return conn.call("Disconnect", &Empty{}, &Empty{})
+}
+
+// Contacts returns every contact sorted by name
+func (conn *Conn) Contacts() (contacts []*Contact, err error) {
+	err = conn.call("Contacts", &Empty{}, &contacts)
+	return contacts, err
+}
+
+// AddContact adds the client with addCode as a contact
+func (conn *Conn) AddContact(addCode string, firstName string, lastName string) (
+	contact *Contact, added bool, err error) {
+	var reply AddContactReply
+	err = conn.call("AddContact", &AddContactArgs{AddCode: addCode, FirstName: firstName, LastName: lastName}, &reply)
+	return reply.Contact, reply.Added, err
+}
+
+// RemoveContact removes the contact with fingerprint
+func (conn *Conn) RemoveContact(fingerprint string) (contact *Contact, err error) {
+	contact = &Contact{}
+	if err = conn.call("RemoveContact", &fingerprint, contact); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// SendFile sends fileName to the contact with fingerprint. Relative fileName is resolved
+// in the current directory of this process.
+func (conn *Conn) SendFile(fingerprint string, fileName string) (err error) {
+	if fileName, err = filepath.Abs(fileName); err != nil {
+		return err
+	}
+	return conn.call("SendFile", &SendFileArgs{Fingerprint: fingerprint, FileName: fileName}, &Empty{})
+}
+
+// GetAddCode returns a new Add Code. The Add Code belongs to the connection of the daemon.
+func (conn *Conn) GetAddCode() (addCode string, err error) {
+	err = conn.call("GetAddCode", &Empty{}, &addCode)
+	return addCode, err
+}
+
+// RemoveAddCode removes addCode
+func (conn *Conn) RemoveAddCode(addCode string) (err error) {
+	return conn.call("RemoveAddCode", &addCode, &Empty{})
+}
+
+// Receive waits up to timeout for files received after the file with ID after.
+// The daemon limits the timeout of a single call to 30 seconds.
+func (conn *Conn) Receive(after uint64, timeout time.Duration) (files []*ReceivedFile, err error) {
+	err = conn.call("Receive", &ReceiveArgs{After: after, Timeout: timeout}, &files)
+	return files, err
+}
+
+// History returns up to limit recorded transfers, newest first
+func (conn *Conn) History(limit int) (transfers []*Transfer, err error) {
+	err = conn.call("History", &limit, &transfers)
+	return transfers, err
+}
+
+// Resend sends the file of the sent transfer with id to its receiver again. The file is read
+// by the daemon.
+func (conn *Conn) Resend(id uint64) (err error) {
+	return conn.call("Resend", &id, &Empty{})
+}
+
+// Close closes the connection to the daemon. The daemon stays connected to the relay server.
+func (conn *Conn) Close() (err error) {
+	return conn.rpc.Close()
+}
@@ -0,0 +1,392 @@
+package daemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// clientHelper returns a client with keypair1 and keypair2 as a contact. The relay server is
+// not reachable.
+func clientHelper(t *testing.T) *client.Client {
+	t.Helper()
+	cli := client.InitConfig()
+	cli.KeyPath = "../../pkg/testdata/keypair1"
+	cli.DataPath = t.TempDir()
+	cli.ServerHost = "127.0.0.1"
+	cli.ServerPort = 1
+	if err := cli.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	pubBlock, _, err := cryptography.OpenKeys("../../pkg/testdata/keypair2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := pem.EncodeToMemory(pubBlock)
+	contactFile, err := json.Marshal(&client.ContactFile{
+		Version:  1,
+		Contacts: []*client.ContactCard{{FirstName: "Build", LastName: "Server", PubKey: string(pubKey)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "contacts.json")
+	if err = ioutil.WriteFile(fileName, contactFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.ImportContacts(fileName); err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+// relayHelper starts a relay server for cli that replies to Version, Init, GetAddCode and Quit.
+// Connections accepted by the relay server are sent to conns, and public key hashes sent with
+// Init are sent to inits.
+func relayHelper(t *testing.T, cli *client.Client) (conns <-chan net.Conn, inits <-chan []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	cli.ServerPort = uint16(portNum)
+
+	accepted := make(chan net.Conn, 10)
+	pubKeyHashes := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			go serveRelay(conn, pubKeyHashes)
+		}
+	}()
+	return accepted, pubKeyHashes
+}
+
+// serveRelay replies to commands of a client on conn until conn is closed
+func serveRelay(conn net.Conn, pubKeyHashes chan<- []byte) {
+	defer conn.Close()
+	for {
+		msg, err := util.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		switch command := common.CommandCodes[msg.CommandCode]; command {
+		case common.Version:
+			data, _ := common.NewHello(common.FeatureRelay, "relay/test").MarshalBinary()
+			_, _ = util.WriteMessage(conn, data, nil, command)
+		case common.Init:
+			// Init is sent with the public key hash and the local address
+			if _, err = util.ReadMessage(conn); err != nil {
+				return
+			}
+			pubKeyHashes <- msg.Data
+			_, _ = util.WriteMessage(conn, nil, nil, command)
+		case common.GetAddCode:
+			_, _ = util.WriteMessage(conn, []byte("ABC123"), nil, command)
+			_, _ = util.WriteMessage(conn, nil, nil, command)
+		case common.Quit:
+			_, _ = util.WriteMessage(conn, nil, nil, command)
+		}
+	}
+}
+
+// serverHelper starts a daemon for cli and returns a connection to it
+func serverHelper(t *testing.T, cli *client.Client) (server *Server, conn *Conn, socketPath string) {
+	t.Helper()
+	socketPath = filepath.Join(t.TempDir(), "coconut.sock")
+	listener, err := Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err = NewServer(NewLocal(cli)); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	if conn, err = Dial(socketPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return server, conn, socketPath
+}
+
+func TestListen(t *testing.T) {
+	_, _, socketPath := serverHelper(t, clientHelper(t))
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Error("Unexpected socket mode: ", info.Mode())
+	}
+	if _, err = Listen(socketPath); err != DaemonRunningError {
+		t.Error("Expected DaemonRunningError, got: ", err)
+	}
+
+	// Files that are not sockets are never replaced
+	fileName := filepath.Join(t.TempDir(), "not_socket")
+	if err = ioutil.WriteFile(fileName, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Listen(fileName); !errors.Is(err, os.ErrExist) {
+		t.Error("Expected os.ErrExist, got: ", err)
+	}
+
+	// Stale socket is replaced
+	staleSocket := filepath.Join(t.TempDir(), "stale.sock")
+	listener, err := net.Listen("unix", staleSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = listener.Close()
+	if listener, err = Listen(staleSocket); err != nil {
+		t.Error("Stale socket was not replaced: ", err)
+		return
+	}
+	_ = listener.Close()
+}
+
+func TestServerAPI(t *testing.T) {
+	cli := clientHelper(t)
+	_, conn, _ := serverHelper(t, cli)
+
+	status, err := conn.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Daemon || status.Connected || status.Contacts != 1 || status.Fingerprint != cli.Fingerprint() ||
+		status.Server != "127.0.0.1:1" {
+		t.Error("Unexpected status: ", status)
+	}
+
+	contacts, err := conn.Contacts()
+	if err != nil || len(contacts) != 1 || contacts[0].FirstName != "Build" || contacts[0].LastName != "Server" {
+		t.Fatal("Unexpected contacts: ", contacts, err)
+	}
+	fingerprint := contacts[0].Fingerprint
+
+	// Errors are restored on the caller side
+	if _, err = conn.RemoveContact("00"); err != client.ContactNotFoundError {
+		t.Error("Expected ContactNotFoundError, got: ", err)
+	}
+	if err = conn.SendFile(fingerprint, "../../pkg/testdata/simple.txt"); !errors.Is(err, ConnectError) {
+		t.Error("Expected ConnectError, got: ", err)
+	}
+	if _, err = conn.GetAddCode(); !errors.Is(err, ConnectError) {
+		t.Error("Expected ConnectError, got: ", err)
+	}
+	// Files that were not sent because of connection errors are not recorded
+	if transfers, err := conn.History(0); err != nil || len(transfers) != 0 {
+		t.Error("Unexpected history: ", transfers, err)
+	}
+	if err = conn.Resend(1); err != client.TransferNotFoundError {
+		t.Error("Expected TransferNotFoundError, got: ", err)
+	}
+
+	contact, err := conn.RemoveContact(fingerprint)
+	if err != nil || contact.Fingerprint != fingerprint {
+		t.Error("Unexpected removed contact: ", contact, err)
+	}
+	// Contacts are saved by the daemon
+	if err = cli.ReadContactsFile(); err != nil || len(cli.Contacts()) != 0 {
+		t.Error("Contact was not removed from contacts file: ", err)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	cli := clientHelper(t)
+	sender := cli.Contacts()[0]
+	results := make(chan *client.ReceiveResult)
+	local := &Local{client: cli, notify: make(chan struct{})}
+	go local.collectReceived(results)
+	defer close(results)
+
+	if files, err := local.Receive(0, 10*time.Millisecond); err != nil || len(files) != 0 {
+		t.Error("Expected no files, got: ", files, err)
+	}
+
+	done := make(chan []*ReceivedFile)
+	go func() {
+		files, _ := local.Receive(0, 5*time.Second)
+		done <- files
+	}()
+	results <- &client.ReceiveResult{Contact: sender, FileName: "downloaded/simple.txt", Err: nil}
+	files := <-done
+	if len(files) != 1 || files[0].ID != 1 || files[0].Sender.Fingerprint != sender.Fingerprint() ||
+		!filepath.IsAbs(files[0].FileName) || files[0].Error != "" {
+		t.Fatal("Unexpected received files: ", files)
+	}
+
+	results <- &client.ReceiveResult{Contact: nil, FileName: "", Err: client.ContactNotFoundError}
+	if files, err := local.Receive(1, time.Second); err != nil || len(files) != 1 || files[0].ID != 2 ||
+		files[0].Error != client.ContactNotFoundError.Error() {
+		t.Error("Unexpected received files: ", files, err)
+	}
+
+	for i := 0; i < maxReceivedFiles; i++ {
+		results <- &client.ReceiveResult{Contact: sender, FileName: "file", Err: nil}
+	}
+	// Wait until the last result is stored
+	if _, err := local.Receive(maxReceivedFiles+1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := local.Receive(0, time.Second); len(files) != maxReceivedFiles || files[0].ID != 3 {
+		t.Error("Old files were not discarded: ", len(files))
+	}
+}
+
+func TestReload(t *testing.T) {
+	cli := clientHelper(t)
+	local := NewLocal(cli)
+	config := cli.Config
+	config.ServerHost = "relay.example.com"
+	config.KeyPath = t.TempDir()
+	changes, err := local.Reload(config)
+	if err != nil || len(changes) != 2 {
+		t.Fatal("Unexpected result of Reload: ", changes, err)
+	}
+	// Disconnected client is not connected by Reload
+	status, err := local.Status()
+	if err != nil || status.Connected || status.Server != "relay.example.com:1" || status.Profile != client.DefaultProfile {
+		t.Errorf("Unexpected status after Reload: %+v", status)
+	}
+	if cli.KeyPath != "../../pkg/testdata/keypair1" {
+		t.Error("Key path should be applied on restart, got: ", cli.KeyPath)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	cli := clientHelper(t)
+	conns, _ := relayHelper(t, cli)
+	local := NewLocal(cli)
+	t.Cleanup(func() { _ = cli.Disconnect() })
+
+	if addCode, err := local.GetAddCode(); err != nil || addCode != "ABC123" {
+		t.Fatal("Unexpected Add Code: ", addCode, err)
+	}
+	// Connection closed by the relay server is noticed by the client
+	_ = (<-conns).Close()
+	for i := 0; cli.IsConnected(); i++ {
+		if i == 100 {
+			t.Fatal("Lost connection was not noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if addCode, err := local.GetAddCode(); err != nil || addCode != "ABC123" {
+		t.Fatal("Unexpected Add Code after reconnecting: ", addCode, err)
+	}
+	select {
+	case <-conns:
+	default:
+		t.Error("Client did not reconnect")
+	}
+}
+
+func TestSendFileNotBlocking(t *testing.T) {
+	cli := clientHelper(t)
+	cli.RequestTimeout = 3 * time.Second
+	conns, _ := relayHelper(t, cli)
+	local := NewLocal(cli)
+	t.Cleanup(func() { _ = cli.Disconnect() })
+
+	// Relay server does not reply to relays, so the transfer waits for RequestTimeout
+	done := make(chan error)
+	go func() {
+		done <- local.SendFile(cli.Contacts()[0].Fingerprint(), "../../pkg/testdata/simple.txt")
+	}()
+	<-conns
+	if status, err := local.Status(); err != nil || !status.Connected {
+		t.Errorf("Unexpected status: %+v %v", status, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatal("Status was blocked by the transfer: ", err)
+	default:
+	}
+	if err := <-done; err != client.RequestTimeoutError {
+		t.Error("Expected RequestTimeoutError, got: ", err)
+	}
+}
+
+func TestRotateKeysReconnect(t *testing.T) {
+	cli := clientHelper(t)
+	// Keys are copied, as rotation replaces them
+	cli.KeyPath = t.TempDir()
+	for _, name := range []string{"key.pub", "key.priv"} {
+		data, err := ioutil.ReadFile(filepath.Join("../../pkg/testdata/keypair1", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(cli.KeyPath, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cli.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	_, inits := relayHelper(t, cli)
+	local := NewLocal(cli)
+	t.Cleanup(func() { _ = cli.Disconnect() })
+
+	if err := local.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if hash := hex.EncodeToString(<-inits); hash != cli.Fingerprint() {
+		t.Error("Unexpected public key hash in Init: ", hash)
+	}
+	if err := cli.RotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	// Relay server sees the new public key
+	select {
+	case hash := <-inits:
+		if hex.EncodeToString(hash) != cli.Fingerprint() {
+			t.Error("Old public key was sent with Init: ", hex.EncodeToString(hash))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not send Init after rotating keys")
+	}
+	if !cli.IsConnected() {
+		t.Error("Client is not connected after rotating keys")
+	}
+}
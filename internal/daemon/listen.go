@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate creates a Unix domain socket at socketPath with umask 0077, so that other users
+// cannot connect before the permission of the socket is set
+func listenPrivate(socketPath string) (listener net.Listener, err error) {
+	mask := syscall.Umask(0077)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,11 @@
+package daemon
+
+import (
+	"net"
+)
+
+// listenPrivate creates a Unix domain socket at socketPath. Access to sockets on Windows is
+// controlled by the permission of the socket directory.
+func listenPrivate(socketPath string) (listener net.Listener, err error) {
+	return net.Listen("unix", socketPath)
+}
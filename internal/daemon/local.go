@@ -0,0 +1,295 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/client"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxReceivedFiles is the number of received files kept by Local
+const maxReceivedFiles = 100
+
+// Local implements API with a client in this process. Operations of Local are serialized,
+// except for transfers, which are serialized by the client, and the client connects to the
+// relay server when an operation requires it. Files and key
+// handovers are handled by the client while operations run, so contacts are read with
+// the contact lock of the client held.
+type Local struct {
+	// mutex serializes operations of Local other than transfers
+	mutex  sync.Mutex
+	client *client.Client
+	// receivedMutex protects received, lastID and notify
+	receivedMutex sync.Mutex
+	// received stores the last maxReceivedFiles received files, oldest first
+	received []*ReceivedFile
+	lastID   uint64
+	// notify is closed and replaced when a file is received
+	notify chan struct{}
+	// daemon is reported in Status
+	daemon bool
+}
+
+// NewLocal returns Local for cli. Keys, contacts, groups and handovers of cli must be loaded.
+func NewLocal(cli *client.Client) (local *Local) {
+	local = &Local{
+		client:   cli,
+		received: nil,
+		lastID:   0,
+		notify:   make(chan struct{}),
+		daemon:   false,
+	}
+	go local.collectReceived(cli.Received())
+	return local
+}
+
+// collectReceived stores results of received files until results is closed
+func (local *Local) collectReceived(results <-chan *client.ReceiveResult) {
+	for result := range results {
+		local.client.RLockContacts()
+		file := &ReceivedFile{FileName: result.FileName, Sender: newContact(result.Contact), Error: ""}
+		local.client.RUnlockContacts()
+		if result.Err != nil {
+			file.Error = result.Err.Error()
+		} else if abs, err := filepath.Abs(result.FileName); err == nil {
+			file.FileName = abs
+		}
+
+		local.receivedMutex.Lock()
+		local.lastID++
+		file.ID = local.lastID
+		local.received = append(local.received, file)
+		if len(local.received) > maxReceivedFiles {
+			local.received = local.received[1:]
+		}
+		close(local.notify)
+		local.notify = make(chan struct{})
+		local.receivedMutex.Unlock()
+	}
+}
+
+// connect connects the client if it is not connected. Must be called with mutex locked.
+// Returns error wrapping ConnectError if the relay server could not be reached.
+func (local *Local) connect() (err error) {
+	if local.client.IsConnected() {
+		return nil
+	}
+	if err = local.client.Connect(); err != nil {
+		return fmt.Errorf("%w: %v", ConnectError, err)
+	}
+	if local.client.HasPendingHandover() {
+		if _, err = local.client.DoAnnounceKey(); err != nil {
+			log.Debug(err)
+			log.Warning("Could not announce new key, it will be announced on next connection")
+		}
+	}
+	return nil
+}
+
+// Status returns the status of the client
+func (local *Local) Status() (status *Status, err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	status = &Status{
+		Profile:         local.client.Profile,
+		Fingerprint:     local.client.Fingerprint(),
+		Server:          local.client.ServerHost + ":" + strconv.Itoa(int(local.client.ServerPort)),
+		Connected:       local.client.IsConnected(),
+		ProtocolVersion: local.client.ProtocolVersion(),
+		Features:        local.client.Features().String(),
+		Contacts:        len(local.client.Contacts()),
+		PendingHandover: local.client.HasPendingHandover(),
+		Daemon:          local.daemon,
+	}
+	local.receivedMutex.Lock()
+	status.LastReceivedID = local.lastID
+	local.receivedMutex.Unlock()
+	return status, nil
+}
+
+// Connect connects to the relay server, and announces pending key handovers
+func (local *Local) Connect() (err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	return local.connect()
+}
+
+// Disconnect disconnects from the relay server
+func (local *Local) Disconnect() (err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	return local.client.Disconnect()
+}
+
+// Reload applies config to the client and returns changed settings. If connection settings
+// changed while connected, the client reconnects. Settings that require restart are not applied.
+func (local *Local) Reload(config client.Config) (changes []client.ConfigChange, err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	changes = local.client.ApplyConfig(config)
+	for _, change := range changes {
+		if change.Reload == client.ReloadReconnect && local.client.IsConnected() {
+			log.Info("Reconnecting with new connection settings")
+			// Connection is closed even if Quit did not complete
+			if err = local.client.Disconnect(); err != nil {
+				log.Debug(err)
+				log.Warning("Relay server did not complete disconnecting")
+			}
+			return changes, local.connect()
+		}
+	}
+	return changes, nil
+}
+
+// Contacts returns every contact sorted by name
+func (local *Local) Contacts() (contacts []*Contact, err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	contacts = make([]*Contact, 0)
+	list := local.client.Contacts()
+	local.client.RLockContacts()
+	defer local.client.RUnlockContacts()
+	for _, contact := range list {
+		contacts = append(contacts, newContact(contact))
+	}
+	return contacts, nil
+}
+
+// AddContact adds the client with addCode as a contact
+func (local *Local) AddContact(addCode string, firstName string, lastName string) (
+	contact *Contact, added bool, err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	if err = local.connect(); err != nil {
+		return nil, false, err
+	}
+	c, added, err := local.client.DoAddContact(addCode, firstName, lastName)
+	if err != nil {
+		return nil, false, err
+	}
+	local.client.RLockContacts()
+	defer local.client.RUnlockContacts()
+	return newContact(c), added, nil
+}
+
+// RemoveContact removes the contact with fingerprint
+func (local *Local) RemoveContact(fingerprint string) (contact *Contact, err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	c, err := local.client.FindContact(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	local.client.RLockContacts()
+	pkHash, contact := string(c.PubKeyHash), newContact(c)
+	local.client.RUnlockContacts()
+	local.client.RemoveContact(pkHash)
+	if err = local.client.WriteContactsFile(); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// SendFile sends fileName to the contact with fingerprint. mutex is held only while connecting,
+// so other operations are not blocked by the transfer.
+func (local *Local) SendFile(fingerprint string, fileName string) (err error) {
+	contact, err := local.client.FindContact(fingerprint)
+	if err != nil {
+		return err
+	}
+	local.mutex.Lock()
+	err = local.connect()
+	local.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	local.client.RLockContacts()
+	pkHash := string(contact.PubKeyHash)
+	local.client.RUnlockContacts()
+	return local.client.DoSendFile(pkHash, fileName)
+}
+
+// GetAddCode returns a new Add Code
+func (local *Local) GetAddCode() (addCode string, err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	if err = local.connect(); err != nil {
+		return "", err
+	}
+	if err = local.client.DoGetAddCode(); err != nil {
+		return "", err
+	}
+	return local.client.AddCode(), nil
+}
+
+// RemoveAddCode removes addCode
+func (local *Local) RemoveAddCode(addCode string) (err error) {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+	if err = local.connect(); err != nil {
+		return err
+	}
+	return local.client.DoRemoveAddCodeStr(addCode)
+}
+
+// Receive waits up to timeout for files received after the file with ID after.
+// Files are received only while connected to the relay server.
+func (local *Local) Receive(after uint64, timeout time.Duration) (files []*ReceivedFile, err error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		local.receivedMutex.Lock()
+		for _, file := range local.received {
+			if file.ID > after {
+				files = append(files, file)
+			}
+		}
+		notify := local.notify
+		local.receivedMutex.Unlock()
+		if len(files) != 0 {
+			return files, nil
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return make([]*ReceivedFile, 0), nil
+		}
+	}
+}
+
+// History returns up to limit recorded transfers, newest first. The history has its own lock,
+// so it can be read while a file is sent.
+func (local *Local) History(limit int) (transfers []*Transfer, err error) {
+	transfers = make([]*Transfer, 0)
+	for _, transfer := range local.client.History() {
+		if limit > 0 && len(transfers) == limit {
+			break
+		}
+		transfers = append(transfers, newTransfer(transfer))
+	}
+	return transfers, nil
+}
+
+// Resend sends the file of the sent transfer with id to its receiver again. See SendFile.
+func (local *Local) Resend(id uint64) (err error) {
+	// Errors other than connection errors are reported before connecting
+	if _, err = local.client.FindTransfer(id); err != nil {
+		return err
+	}
+	local.mutex.Lock()
+	err = local.connect()
+	local.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return local.client.DoResend(id)
+}
+
+// Close disconnects the client
+func (local *Local) Close() (err error) {
+	return local.Disconnect()
+}
@@ -0,0 +1,258 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// serviceName is the name of the JSON-RPC service
+const serviceName = "Coconut"
+
+// maxReceiveTimeout limits the time a single Receive call waits, so that callers notice
+// a daemon that stopped
+const maxReceiveTimeout = 30 * time.Second
+
+// DaemonRunningError is returned by Listen when another daemon is using the socket
+var DaemonRunningError = errors.New("daemon is already running")
+
+// Server serves API to local processes over a Unix domain socket with JSON-RPC. Only the user
+// that started the daemon can access the socket.
+type Server struct {
+	local    *Local
+	rpc      *rpc.Server
+	listener net.Listener
+	// wg tracks connections being served
+	wg sync.WaitGroup
+	// mutex protects conns
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Listen creates a Unix domain socket at socketPath that is accessible only to the current user.
+// A stale socket left by a daemon that exited is replaced.
+// Returns DaemonRunningError if another daemon is listening on socketPath.
+func Listen(socketPath string) (listener net.Listener, err error) {
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		_ = conn.Close()
+		return nil, DaemonRunningError
+	}
+	if err = os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating socket directory")
+		return nil, err
+	}
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket == 0 {
+		log.Error(socketPath, " exists and is not a socket")
+		return nil, os.ErrExist
+	}
+	if err = os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		log.Debug(err)
+		log.Error("Error while removing stale socket")
+		return nil, err
+	}
+
+	listener, err = listenPrivate(socketPath)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while creating socket")
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		log.Debug(err)
+		log.Error("Error while setting socket permission")
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// NewServer returns Server for local. Status of local reports that it is served by a daemon.
+func NewServer(local *Local) (server *Server, err error) {
+	local.daemon = true
+	server = &Server{
+		local:    local,
+		rpc:      rpc.NewServer(),
+		listener: nil,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if err = server.rpc.RegisterName(serviceName, &Service{local: local}); err != nil {
+		log.Debug(err)
+		log.Error("Error while registering service")
+		return nil, err
+	}
+	return server, nil
+}
+
+// Serve accepts connections on listener until Close is called
+func (server *Server) Serve(listener net.Listener) (err error) {
+	server.mutex.Lock()
+	server.listener = listener
+	server.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			closed := server.listener == nil
+			server.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			log.Debug(err)
+			log.Error("Error while accepting connection")
+			return err
+		}
+
+		server.mutex.Lock()
+		server.conns[conn] = struct{}{}
+		server.mutex.Unlock()
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			server.rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+			server.mutex.Lock()
+			delete(server.conns, conn)
+			server.mutex.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, closes open connections and removes the socket
+func (server *Server) Close() (err error) {
+	server.mutex.Lock()
+	listener := server.listener
+	server.listener = nil
+	for conn := range server.conns {
+		_ = conn.Close()
+	}
+	server.mutex.Unlock()
+
+	if listener != nil {
+		// Closing Unix listener removes the socket file
+		err = listener.Close()
+	}
+	server.wg.Wait()
+	return err
+}
+
+// Empty is used for methods without arguments or replies
+type Empty struct{}
+
+// AddContactArgs are arguments of Service.AddContact
+type AddContactArgs struct {
+	AddCode   string
+	FirstName string
+	LastName  string
+}
+
+// AddContactReply is the reply of Service.AddContact
+type AddContactReply struct {
+	Contact *Contact
+	Added   bool
+}
+
+// SendFileArgs are arguments of Service.SendFile
+type SendFileArgs struct {
+	Fingerprint string
+	// FileName must be an absolute path, as the daemon may run in another directory
+	FileName string
+}
+
+// ReceiveArgs are arguments of Service.Receive
+type ReceiveArgs struct {
+	After   uint64
+	Timeout time.Duration
+}
+
+// Service exposes Local as JSON-RPC methods
+type Service struct {
+	local *Local
+}
+
+// Status returns the status of the client
+func (service *Service) Status(_ *Empty, reply *Status) (err error) {
+	status, err := service.local.Status()
+	if err != nil {
+		return err
+	}
+	*reply = *status
+	return nil
+}
+
+// Connect connects to the relay server
+func (service *Service) Connect(_ *Empty, _ *Empty) (err error) {
+	return service.local.Connect()
+}
+
+// Disconnect disconnects from the relay server
+func (service *Service) Disconnect(_ *Empty, _ *Empty) (err error) {
+	return service.local.Disconnect()
+}
+
+// Contacts returns every contact sorted by name
+func (service *Service) Contacts(_ *Empty, reply *[]*Contact) (err error) {
+	*reply, err = service.local.Contacts()
+	return err
+}
+
+// AddContact adds the client with Add Code as a contact
+func (service *Service) AddContact(args *AddContactArgs, reply *AddContactReply) (err error) {
+	reply.Contact, reply.Added, err = service.local.AddContact(args.AddCode, args.FirstName, args.LastName)
+	return err
+}
+
+// RemoveContact removes the contact with fingerprint
+func (service *Service) RemoveContact(fingerprint *string, reply *Contact) (err error) {
+	contact, err := service.local.RemoveContact(*fingerprint)
+	if err != nil {
+		return err
+	}
+	*reply = *contact
+	return nil
+}
+
+// SendFile sends a file to a contact
+func (service *Service) SendFile(args *SendFileArgs, _ *Empty) (err error) {
+	if !filepath.IsAbs(args.FileName) {
+		return errors.New("file name must be an absolute path")
+	}
+	return service.local.SendFile(args.Fingerprint, args.FileName)
+}
+
+// GetAddCode returns a new Add Code
+func (service *Service) GetAddCode(_ *Empty, reply *string) (err error) {
+	*reply, err = service.local.GetAddCode()
+	return err
+}
+
+// RemoveAddCode removes Add Code
+func (service *Service) RemoveAddCode(addCode *string, _ *Empty) (err error) {
+	return service.local.RemoveAddCode(*addCode)
+}
+
+// Receive waits for received files. Timeout is limited to maxReceiveTimeout.
+func (service *Service) Receive(args *ReceiveArgs, reply *[]*ReceivedFile) (err error) {
+	timeout := args.Timeout
+	if timeout <= 0 || timeout > maxReceiveTimeout {
+		timeout = maxReceiveTimeout
+	}
+	*reply, err = service.local.Receive(args.After, timeout)
+	return err
+}
+
+// History returns up to limit recorded transfers, newest first
+func (service *Service) History(limit *int, reply *[]*Transfer) (err error) {
+	*reply, err = service.local.History(*limit)
+	return err
+}
+
+// Resend sends the file of a sent transfer again
+func (service *Service) Resend(id *uint64, _ *Empty) (err error) {
+	return service.local.Resend(*id)
+}
@@ -1,16 +1,20 @@
-package client
+//go:build !nogui
+// +build !nogui
+
+package gui
 
 import (
 	"errors"
 	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
-	"github.com/jaeha-choi/Proj_Coconut_Utility/cryptography"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/app"
+	"github.com/jaeha-choi/Proj_Coconut_Desktop/internal/daemon"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
 	"os"
 	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
 )
 
 const (
@@ -33,46 +37,75 @@ const (
 	keyFingerprint
 )
 
+// History tree view index
+const (
+	historyTimeIdx = iota
+	historyDirectionIdx
+	historyPeerIdx
+	historyFileNameIdx
+	historySizeWithUnitIdx
+	historyResultIdx
+	historyDetailsIdx
+	historyIdIdx
+	historySizeInBytesIdx
+)
+
+// Notebook page index
+const (
+	filePage = iota
+	contactPage
+	historyPage
+)
+
 // AssertFailed is returned when the type assertion fails.
 var AssertFailed = errors.New("type assertion failed")
 
+// UIStatus is the GTK implementation of app.View. User events are forwarded to controller
+// outside of the GTK main loop, and View methods update widgets in the main loop.
 type UIStatus struct {
-	builder        *gtk.Builder
-	isFileTab      bool
-	onlineStatus   bool
-	fileListOrder  []int
-	keyListOrder   []int
-	totalFileSize  int64
-	totalFileCount int
-	fileMap        map[string]struct{}
-	client         *Client
-}
-
-func init() {
-	log.Init(os.Stdout, log.DEBUG)
+	builder     *gtk.Builder
+	application *gtk.Application
+	// page is the index of the current notebook page
+	page          uint
+	onlineStatus  bool
+	fileListOrder []int
+	keyListOrder  []int
+	// historyListOrder is the order of history list columns
+	historyListOrder []int
+	controller       *app.Controller
+	// settingProfiles is true while SetProfiles changes the profile switcher
+	settingProfiles bool
 }
 
 // initUIStatus returns default UIStatus settings
 func initUIStatus() (stat *UIStatus) {
 	return &UIStatus{
-		builder:        nil,
-		isFileTab:      true,
-		onlineStatus:   false,
-		fileListOrder:  []int{fileNameIdx, fileSizeWithUnitIdx, fileStatusIdx, fileFullPath, fileSizeInBytes},
-		keyListOrder:   []int{keyName, keyDate, keyFingerprint},
-		totalFileSize:  0,
-		totalFileCount: 0,
-		fileMap:        map[string]struct{}{},
-		client:         nil,
+		builder:       nil,
+		application:   nil,
+		page:          filePage,
+		onlineStatus:  false,
+		fileListOrder: []int{fileNameIdx, fileSizeWithUnitIdx, fileStatusIdx, fileFullPath, fileSizeInBytes},
+		keyListOrder:  []int{keyName, keyDate, keyFingerprint},
+		historyListOrder: []int{historyTimeIdx, historyDirectionIdx, historyPeerIdx, historyFileNameIdx,
+			historySizeWithUnitIdx, historyResultIdx, historyDetailsIdx, historyIdIdx, historySizeInBytesIdx},
+		controller:      nil,
+		settingProfiles: false,
 	}
 }
 
-// Start initializes all configurations and starts main UI
-func Start(uiGladePath string, client *Client) {
+// Start initializes all configurations and starts main UI. api is the API of the current profile
+// in profiles, and is closed when the application shuts down.
+func Start(uiGladePath string, api daemon.API, profiles app.Profiles) {
 	var stat *UIStatus
 
+	// Each profile is a separate application, so that profiles can run at the same time.
+	// Elements of application IDs cannot start with a digit or contain "-".
+	id := appId
+	if profiles.Current != "" && profiles.Current != "default" {
+		id += ".profile_" + strings.ReplaceAll(profiles.Current, "-", "_")
+	}
 	// Create a new application.
-	application, err := gtk.ApplicationNew(appId, glib.APPLICATION_FLAGS_NONE)
+	application, err := gtk.ApplicationNew(id, glib.APPLICATION_FLAGS_NONE)
 	if err != nil {
 		log.Debug(err)
 		log.Error("Error while creating application")
@@ -84,25 +117,13 @@ func Start(uiGladePath string, client *Client) {
 		log.Debug("Application starting up...")
 
 		stat = initUIStatus()
-		stat.client = client
+		stat.application = application
+		stat.controller = app.NewController(api, stat, profiles)
 	})
 
 	// Connect function to application activate event
 	application.Connect("activate", func() {
 		var err error
-		// Open RSA Keys
-		pubBlock, privBlock, err := cryptography.OpenKeys(client.KeyPath)
-		if err != nil {
-			log.Fatal(err)
-			os.Exit(1)
-		}
-		stat.client.pubKeyBlock = pubBlock
-		stat.client.privKey, err = cryptography.PemToKeys(privBlock)
-		if err != nil {
-			log.Fatal(err)
-			os.Exit(1)
-		}
-
 		// Get the GtkBuilder ui definition in the glade file.
 		stat.builder, err = gtk.BuilderNewFromFile(uiGladePath)
 		//stat.builder, err = gtk.BuilderNewFromString(uiString)
@@ -115,13 +136,16 @@ func Start(uiGladePath string, client *Client) {
 		// Map the handlers to callback functions, and connect the signals
 		// to the Builder.
 		signals := map[string]interface{}{
-			"switchPage":         stat.handleSwitchPage,
-			"addButtonClick":     stat.handleAddButtonClick,
-			"keyPressFileList":   stat.handleKeyPressFileList,
-			"statusClick":        stat.handleStatusClick,
-			"addCodeDone":        stat.handleAddCodeDone,
-			"clickEmptySpotFile": stat.handleClickEmptySpotFile,
-			"activateExpander":   stat.handleActivateExpander,
+			"switchPage":          stat.handleSwitchPage,
+			"addButtonClick":      stat.handleAddButtonClick,
+			"sendButtonClick":     stat.handleSendButtonClick,
+			"keyPressFileList":    stat.handleKeyPressFileList,
+			"statusClick":         stat.handleStatusClick,
+			"addCodeDone":         stat.handleAddCodeDone,
+			"clickEmptySpotFile":  stat.handleClickEmptySpotFile,
+			"activateExpander":    stat.handleActivateExpander,
+			"profileChanged":      stat.handleProfileChanged,
+			"historyRowActivated": stat.handleHistoryRowActivated,
 		}
 		stat.builder.ConnectSignals(signals)
 
@@ -135,18 +159,19 @@ func Start(uiGladePath string, client *Client) {
 		win.Show()
 
 		application.AddWindow(win)
+
+		// Show the status of the daemon, which may be connected already
+		go stat.controller.Start()
 	})
 
 	// Connect function to application shutdown event
 	application.Connect("shutdown", func() {
 		log.Debug("Application shutdown...")
-		// Close connection if not already
-		if stat.client.conn != nil {
-			if err = stat.client.Disconnect(); err != nil {
-				log.Debug(err)
-				log.Error("Error while closing connection")
-				return
-			}
+		// Disconnects if the client is in this process. The daemon stays connected.
+		if err = api.Close(); err != nil {
+			log.Debug(err)
+			log.Error("Error while closing connection")
+			return
 		}
 	})
 
@@ -154,20 +179,272 @@ func Start(uiGladePath string, client *Client) {
 	os.Exit(application.Run(nil))
 }
 
-func (ui *UIStatus) handleSwitchPage() {
-	//log.Debug("handleSwitchPage called")
-	ui.isFileTab = !ui.isFileTab
+// SetStatus shows the connection status in the status label, and enables the Add Code expander
+// only while online
+func (ui *UIStatus) SetStatus(status app.ConnStatus) {
+	_ = glib.IdleAdd(func() {
+		label, err := ui.getLabelWithId("connStatusLabel")
+		if err != nil {
+			return
+		}
+		listBoxRow, err := ui.getListBoxRowWithId("statusBoxRow")
+		if err != nil {
+			return
+		}
+		addCodeExpander, err := ui.getExpanderWithId("addCodeExpander")
+		if err != nil {
+			return
+		}
+		addCodeExpanderLabel, err := ui.getLabelWithId("expanderLabel")
+		if err != nil {
+			return
+		}
+
+		color := "red"
+		switch status {
+		case app.Connecting, app.Disconnecting:
+			color = "orange"
+		case app.Online:
+			color = "green"
+		}
+		label.SetMarkup("<span foreground=\"" + color + "\">" + status.String() + "</span>")
+		// Status label is un-clickable while the status is changing
+		listBoxRow.SetSensitive(status != app.Connecting && status != app.Disconnecting)
+
+		switch status {
+		case app.Online:
+			ui.onlineStatus = true
+			addCodeExpanderLabel.SetLabel("Activate Add Code")
+			addCodeExpander.SetSensitive(true)
+		case app.Offline:
+			ui.onlineStatus = false
+			addCodeExpanderLabel.SetLabel("Switch online to get Add Code")
+			addCodeExpander.SetSensitive(false)
+		}
+	})
+}
+
+// SetAddCode shows each Add Code digit in the Add Code grid, or "-" if addCode is empty.
+// The expander is expanded while the Add Code is shown.
+func (ui *UIStatus) SetAddCode(addCode string, err error) {
+	_ = glib.IdleAdd(func() {
+		addCodeExpander, e := ui.getExpanderWithId("addCodeExpander")
+		if e != nil {
+			return
+		}
+		addCodeGrid, e := ui.getGridWithId("addCodeGrid")
+		if e != nil {
+			return
+		}
+		addCodeExpanderLabel, e := ui.getLabelWithId("expanderLabel")
+		if e != nil {
+			return
+		}
+
+		// Add Code digit index (GetChildren returns labels from the right side,
+		// and Add Codes are always 6 digit long; so start from the last index)
+		idx := 5
+		children := addCodeGrid.GetChildren()
+		children.Foreach(func(item interface{}) {
+			label, _ := gtk.WidgetToLabel(item.(*gtk.Widget))
+			digit := "-"
+			if 0 <= idx && idx < len(addCode) {
+				digit = string(addCode[idx])
+			}
+			label.SetLabel("<span size=\"xx-large\" weight=\"bold\">" + digit + "</span>")
+			idx--
+		})
+
+		labelText := "Click to activate Add Code"
+		if addCode != "" {
+			labelText = "Click to deactivate Add Code"
+		}
+		addCodeExpander.SetExpanded(addCode != "")
+		addCodeExpander.SetSensitive(ui.onlineStatus)
+		if err == nil {
+			addCodeExpanderLabel.SetLabel(labelText)
+			return
+		}
+		addCodeExpanderLabel.SetLabel("Error. Try again in a bit")
+		_ = glib.TimeoutAdd(5000, func() bool {
+			addCodeExpanderLabel.SetLabel(labelText)
+			return false
+		})
+	})
+}
+
+// SetFiles replaces rows of the file list with files, and updates the InfoBox
+// (total file count, total file size)
+func (ui *UIStatus) SetFiles(files []app.File) {
+	_ = glib.IdleAdd(func() {
+		fileList, err := ui.getListStoreWithId("fileList")
+		if err != nil {
+			return
+		}
+		fileList.Clear()
+		var totalFileSize int64
+		for _, file := range files {
+			// Get file name (without path)
+			_, fName := filepath.Split(file.Name)
+
+			// Only the first three values are visible;
+			// 4th value is full file path that is used to keep track of files and provide a tooltip
+			// 5th value is a full size used for InfoBox size to calculate correct values
+			row := []interface{}{fName, sizeAddUnit(file.Size), file.Status.String(), file.Name, file.Size}
+
+			// Add new row to the list
+			iter := fileList.Append()
+			if err = fileList.Set(iter, ui.fileListOrder, row); err != nil {
+				log.Debug("Error while adding ", file.Name)
+				continue
+			}
+			totalFileSize += file.Size
+		}
+		ui.updateInfoBox(len(files), totalFileSize)
+	})
+}
+
+// SetContacts replaces rows of the contact list with contacts
+func (ui *UIStatus) SetContacts(contacts []*daemon.Contact) {
+	_ = glib.IdleAdd(func() {
+		contactList, err := ui.getListStoreWithId("contactList")
+		if err != nil {
+			return
+		}
+		contactList.Clear()
+		for _, contact := range contacts {
+			name := strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+			row := []interface{}{name, "", contact.Fingerprint}
+			iter := contactList.Append()
+			if err = contactList.Set(iter, ui.keyListOrder, row); err != nil {
+				log.Debug("Error while adding ", contact.Fingerprint)
+				continue
+			}
+		}
+	})
+}
+
+// SetHistory replaces rows of the history list with transfers
+func (ui *UIStatus) SetHistory(transfers []*daemon.Transfer) {
+	_ = glib.IdleAdd(func() {
+		historyList, err := ui.getListStoreWithId("historyList")
+		if err != nil {
+			return
+		}
+		historyList.Clear()
+		for _, transfer := range transfers {
+			_, fName := filepath.Split(transfer.FileName)
+			peer := transfer.PeerName
+			if peer == "" {
+				peer = transfer.Peer
+			}
+			// Details are shown as a tooltip
+			details := transfer.FileName + "\nSHA256: " + transfer.Hash + "\nPeer: " + transfer.Peer +
+				"\nDuration: " + transfer.Duration.String()
+			if transfer.Error != "" {
+				details += "\nError: " + transfer.Error
+			}
+			row := []interface{}{transfer.Time.Format("2006-01-02 15:04"), transfer.Direction, peer, fName,
+				sizeAddUnit(transfer.Size), transfer.Result, details, transfer.ID, transfer.Size}
+			iter := historyList.Append()
+			if err = historyList.Set(iter, ui.historyListOrder, row); err != nil {
+				log.Debug("Error while adding transfer ", transfer.ID)
+				continue
+			}
+		}
+	})
+}
+
+// handleHistoryRowActivated sends the file of the activated transfer again. Received files
+// cannot be sent again.
+func (ui *UIStatus) handleHistoryRowActivated(_ *gtk.TreeView, path *gtk.TreePath) {
+	historyList, err := ui.getListStoreWithId("historyList")
+	if err != nil {
+		return
+	}
+	iter, err := historyList.GetIter(path)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting iterator of the activated row")
+		return
+	}
+	value, err := historyList.GetValue(iter, historyIdIdx)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting transfer ID from iterator")
+		return
+	}
+	goValue, err := value.GoValue()
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	id, ok := goValue.(uint64)
+	if !ok {
+		log.Debug(AssertFailed)
+		return
+	}
+	go func() {
+		if err := ui.controller.Resend(id); err != nil {
+			log.Debug(err)
+			log.Error("Error while sending file again")
+		}
+	}()
+}
+
+// SetProfiles replaces profiles in the profile switcher and selects current
+func (ui *UIStatus) SetProfiles(current string, names []string) {
+	_ = glib.IdleAdd(func() {
+		comboBox, err := ui.getComboBoxTextWithId("profileComboBox")
+		if err != nil {
+			return
+		}
+		// Changes made here are not user events
+		ui.settingProfiles = true
+		defer func() { ui.settingProfiles = false }()
+		comboBox.RemoveAll()
+		for _, name := range names {
+			comboBox.Append(name, name)
+		}
+		comboBox.SetActiveID(current)
+		// Switcher is only useful with more than one profile
+		comboBox.SetVisible(len(names) > 1)
+	})
+}
+
+// handleProfileChanged restarts the program with the profile selected in the profile switcher
+func (ui *UIStatus) handleProfileChanged(comboBox *gtk.ComboBoxText) {
+	if ui.settingProfiles {
+		return
+	}
+	name := comboBox.GetActiveID()
+	go func() {
+		if switched, err := ui.controller.SwitchProfile(name); err == nil && switched {
+			_ = glib.IdleAdd(ui.application.Quit)
+		}
+	}()
+}
+
+// handleSwitchPage records the selected page. History is refreshed when "History" tab is shown,
+// so that files received since the last refresh are listed.
+func (ui *UIStatus) handleSwitchPage(_ *gtk.Notebook, _ interface{}, pageNum uint) {
+	ui.page = pageNum
+	if pageNum == historyPage {
+		go ui.controller.RefreshHistory()
+	}
 }
 
 // handleAddButtonClick handles event when "+" button is clicked.
 // Behavior depends on current viewing tab ("Files"/"Contacts")
 // If "Files" tab is activated, this will show a file chooser
 // If "Contacts" tab is activated, this will prompt for receiver's Add Code
+// If "History" tab is activated, this does nothing
 func (ui *UIStatus) handleAddButtonClick() {
 	//log.Debug("handleAddButtonClick called")
 
 	// Behavior depends on current tab
-	if ui.isFileTab {
+	switch ui.page {
+	case filePage:
 		// Add files
 
 		// Get main window
@@ -200,9 +477,9 @@ func (ui *UIStatus) handleAddButtonClick() {
 				log.Error("Error while getting filenames")
 				return
 			}
-			ui.addFilesToListStore(filenames)
+			go ui.controller.AddFiles(filenames)
 		}
-	} else {
+	case contactPage:
 		// Add contacts
 		popover, err := ui.getPopoverWithId("addCodeEntry")
 		if err != nil {
@@ -212,102 +489,57 @@ func (ui *UIStatus) handleAddButtonClick() {
 	}
 }
 
-// handleActivateExpander handles event when the expander button on "Contacts" tab is clicked.
-// Behavior depends on the current online/offline status, and current expander status.
-// If current status is offline, do nothing. Enable grayed out expander, otherwise.
-// If expander is opened, register device and get Add Code then display it.
-// If expander is closed, remove device from the Add Code list from the server.
-func (ui *UIStatus) handleActivateExpander(expander *gtk.Expander) {
-	//log.Debug("handleActivateExpander called")
-
-	// If the current user is offline, do nothing
-	if !ui.onlineStatus {
-		expander.SetExpanded(true)
+// handleSendButtonClick handles event when "Send" button is clicked.
+// Files in the list are sent to the contact selected in the "Contacts" tab.
+func (ui *UIStatus) handleSendButtonClick() {
+	contactTreeView, err := ui.getTreeViewWithId("contactListView")
+	if err != nil {
 		return
 	}
-
-	// Get grid containing labels for Add Code digits
-	addCodeGrid, err := ui.getGridWithId("addCodeGrid")
+	contactList, err := ui.getListStoreWithId("contactList")
 	if err != nil {
 		return
 	}
-
-	// Get expander label
-	addCodeExpanderLabel, err := ui.getLabelWithId("expanderLabel")
+	selection, err := contactTreeView.GetSelection()
 	if err != nil {
+		log.Debug(err)
+		log.Error("Error while getting selected contact")
 		return
 	}
 
-	// When the process is ongoing, "gray out" expander
-	expander.SetSensitive(false)
+	fingerprint := ""
+	if _, iter, ok := selection.GetSelected(); ok {
+		value, err := contactList.GetValue(iter, keyFingerprint)
+		if err != nil {
+			log.Debug(err)
+			log.Error("Error while getting fingerprint from iterator")
+			return
+		}
+		if fingerprint, err = value.GetString(); err != nil {
+			log.Debug(err)
+			log.Error("Error while getting string from *glib.Value")
+			return
+		}
+	}
 
-	if expander.GetExpanded() {
-		// If expander was expanded, remove current device from the Add Code list
-		//log.Debug("Expander no longer revealed")
-		go func() {
-			log.Debugf("Removing Add Code: %s", ui.client.addCode)
-			if err = ui.client.DoRemoveAddCode(); err != nil {
-				log.Debug(err)
-				log.Error("Error while removing Add Code from the server")
-				_ = glib.IdleAdd(func() {
-					expander.SetExpanded(false)
-					addCodeExpanderLabel.SetLabel("Error. Try again in a bit")
-					time.Sleep(5 * time.Second)
-					addCodeExpanderLabel.SetLabel("Click to activate Add Code")
-					expander.SetSensitive(true)
-				})
-				return
-			}
-			time.Sleep(1 * time.Second)
-			// Replace each Add Code character to "-"
-			_ = glib.IdleAdd(func() {
-				children := addCodeGrid.GetChildren()
-				children.Foreach(func(item interface{}) {
-					label, _ := gtk.WidgetToLabel(item.(*gtk.Widget))
-					label.SetLabel("<span size=\"xx-large\" weight=\"bold\">-</span>")
-				})
-
-				addCodeExpanderLabel.SetLabel("Click to activate Add Code")
-				expander.SetSensitive(true)
-			})
-		}()
-	} else {
-		// If expander was not expanded, add current device to the Add Code list
-		//log.Debug("Expander revealed")
-		go func() {
-			if err = ui.client.DoGetAddCode(); err != nil {
-				log.Debug(err)
-				log.Error("Error while getting Add Code from the server")
-				_ = glib.IdleAdd(func() {
-					expander.SetExpanded(true)
-					addCodeExpanderLabel.SetLabel("Error. Try again in a bit")
-					time.Sleep(5 * time.Second)
-					addCodeExpanderLabel.SetLabel("Click to deactivate Add Code")
-					expander.SetSensitive(true)
-				})
-				return
-			}
-			log.Debugf("Received Add Code: %s", ui.client.addCode)
-			time.Sleep(1 * time.Second)
+	go func() {
+		if err := ui.controller.SendFiles(fingerprint); err != nil {
+			log.Debug(err)
+			log.Error("Error while sending files")
+		}
+	}()
+}
 
-			// Replace each Add Code character to corresponding digit
-			_ = glib.IdleAdd(func() {
-				children := addCodeGrid.GetChildren()
-				// Add Code digit index (GetChildren returns labels from the right side,
-				// and Add Codes are always 6 digit long; so start from the last index)
-				idx := 5
-				//children = children.Reverse()
-				children.Foreach(func(item interface{}) {
-					label, _ := gtk.WidgetToLabel(item.(*gtk.Widget))
-					label.SetLabel("<span size=\"xx-large\" weight=\"bold\">" + string(ui.client.addCode[idx]) + "</span>")
-					idx--
-				})
+// handleActivateExpander handles event when the expander button on "Contacts" tab is clicked.
+// If expander is opened, register device and get Add Code then display it.
+// If expander is closed, remove device from the Add Code list from the server.
+// Expander is disabled while offline.
+func (ui *UIStatus) handleActivateExpander(expander *gtk.Expander) {
+	//log.Debug("handleActivateExpander called")
 
-				addCodeExpanderLabel.SetLabel("Click to deactivate Add Code")
-				expander.SetSensitive(true)
-			})
-		}()
-	}
+	// When the process is ongoing, "gray out" expander. SetAddCode enables it again.
+	expander.SetSensitive(false)
+	go ui.controller.ToggleAddCode()
 }
 
 // handleStatusClick handles event when the status button ("Online"/"Offline") is clicked.
@@ -319,83 +551,14 @@ func (ui *UIStatus) handleStatusClick(_ *gtk.EventBox, event *gdk.Event) {
 	eventButton := gdk.EventButtonNewFromEvent(event)
 	// If user right-clicks the status label
 	if eventButton.Button() == gdk.BUTTON_PRIMARY {
-		label, err := ui.getLabelWithId("connStatusLabel")
-		if err != nil {
-			return
-		}
 		listBoxRow, err := ui.getListBoxRowWithId("statusBoxRow")
 		if err != nil {
 			return
 		}
-		addCodeExpander, err := ui.getExpanderWithId("addCodeExpander")
-		if err != nil {
-			return
-		}
-		addCodeExpanderLabel, err := ui.getLabelWithId("expanderLabel")
-		if err != nil {
-			return
-		}
 
-		// Make status label un-clickable
+		// Make status label un-clickable. SetStatus makes it clickable again.
 		listBoxRow.SetSensitive(false)
-
-		var markAsError = func() {
-			label.SetMarkup("<span foreground=\"red\">ERROR</span>")
-			listBoxRow.SetSensitive(true)
-		}
-
-		// If currently online
-		if ui.onlineStatus {
-			label.SetMarkup("<span foreground=\"orange\">Disconnecting...</span>")
-			go func() {
-				if err = ui.client.Disconnect(); err != nil {
-					log.Debug(err)
-					log.Error("Error while connecting to the server")
-					_ = glib.IdleAdd(markAsError)
-					return
-				}
-				_ = glib.IdleAdd(func() {
-					label.SetMarkup("<span foreground=\"red\">Offline</span>")
-					ui.onlineStatus = false
-
-					if addCodeExpander.GetExpanded() {
-						// Get grid containing labels for Add Code digits
-						addCodeGrid, err := ui.getGridWithId("addCodeGrid")
-						if err != nil {
-							return
-						}
-						children := addCodeGrid.GetChildren()
-						children.Foreach(func(item interface{}) {
-							label, _ := gtk.WidgetToLabel(item.(*gtk.Widget))
-							label.SetLabel("<span size=\"xx-large\" weight=\"bold\">-</span>")
-						})
-						addCodeExpander.SetExpanded(false)
-					}
-
-					addCodeExpanderLabel.SetLabel("Switch online to get Add Code")
-					addCodeExpander.SetSensitive(false)
-					listBoxRow.SetSensitive(true)
-				})
-			}()
-
-		} else {
-			label.SetMarkup("<span foreground=\"orange\">Connecting...</span>")
-			go func() {
-				if err = ui.client.Connect(); err != nil {
-					log.Debug(err)
-					log.Error("Error while connecting to the server")
-					_ = glib.IdleAdd(markAsError)
-					return
-				}
-				_ = glib.IdleAdd(func() {
-					label.SetMarkup("<span foreground=\"green\">Online</span>")
-					ui.onlineStatus = true
-					addCodeExpanderLabel.SetLabel("Activate Add Code")
-					addCodeExpander.SetSensitive(true)
-					listBoxRow.SetSensitive(true)
-				})
-			}()
-		}
+		go ui.controller.ToggleOnline()
 	}
 }
 
@@ -468,7 +631,6 @@ func (ui *UIStatus) unselectAll(treeView *gtk.TreeView) {
 }
 
 // removeSelectedFiles removes selected files from the list
-// This function also affects the InfoBox (total file count, total file size)
 func (ui *UIStatus) removeSelectedFiles(fileTreeView *gtk.TreeView) (err error) {
 	listStore, err := ui.getListStoreWithId("fileList")
 	if err != nil {
@@ -480,11 +642,9 @@ func (ui *UIStatus) removeSelectedFiles(fileTreeView *gtk.TreeView) (err error)
 		log.Error("Error while getting selected files")
 		return err
 	}
+	var fileNames []string
 	rows := selected.GetSelectedRows(listStore)
-	// Reverse is called to preserve the head of the linked list for iter.
-	// Without Reserve, not all nodes will be deleted properly.
-	reversed := rows.Reverse()
-	reversed.Foreach(func(item interface{}) {
+	rows.Foreach(func(item interface{}) {
 		// Convert interface to *gtk.TreePath
 		path, err := isTreePath(item)
 		if err != nil {
@@ -502,7 +662,7 @@ func (ui *UIStatus) removeSelectedFiles(fileTreeView *gtk.TreeView) (err error)
 			log.Error("Error while getting full path from iterator")
 			return
 		}
-		// Get full path as a string (full path works as a unique key for map)
+		// Get full path as a string (full path works as a unique key)
 		fullPath, err := value.GetString()
 		if err != nil {
 			log.Debug(err)
@@ -510,42 +670,16 @@ func (ui *UIStatus) removeSelectedFiles(fileTreeView *gtk.TreeView) (err error)
 			return
 		}
 		log.Debug("Full path: ", fullPath)
-		value, err = listStore.GetValue(iter, fileSizeInBytes)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while getting value from GetValue")
-			return
-		}
-		goValue, err := value.GoValue()
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while getting value from GoValue")
-			return
-		}
-		// Get file size in bytes
-		size, ok := goValue.(int64)
-		if !ok {
-			log.Debug(AssertFailed)
-			log.Error("Returned value is not int64")
-			return
-		}
-		// Delete the file from the map
-		delete(ui.fileMap, fullPath)
-		// Delete the file from the UI list
-		_ = listStore.Remove(iter)
-
-		// Update total file info
-		ui.totalFileSize -= size
-		ui.totalFileCount -= 1
+		fileNames = append(fileNames, fullPath)
 	})
 
-	// Update InfoBox with new file count/size values
-	ui.updateInfoBox()
+	// Rows are removed when the controller calls SetFiles
+	go ui.controller.RemoveFiles(fileNames)
 	return nil
 }
 
 // updateInfoBox updates total file count and size
-func (ui *UIStatus) updateInfoBox() {
+func (ui *UIStatus) updateInfoBox(totalFileCount int, totalFileSize int64) {
 	fileCountLabel, err := ui.getLabelWithId("infoFileCount")
 	if err != nil {
 		return
@@ -554,61 +688,8 @@ func (ui *UIStatus) updateInfoBox() {
 	if err != nil {
 		return
 	}
-	fileCountLabel.SetLabel(strconv.Itoa(ui.totalFileCount))
-	fileSizeLabel.SetLabel(sizeAddUnit(ui.totalFileSize))
-}
-
-// addFilesToListStore adds files in fileNames to the fileList
-// This function also affects the InfoBox (total file count, total file size)
-func (ui *UIStatus) addFilesToListStore(fileNames []string) {
-	fileList, err := ui.getListStoreWithId("fileList")
-	if err != nil {
-		return
-	}
-	// For each files
-	for _, fileName := range fileNames {
-		// Check if file already exist
-		if _, exist := ui.fileMap[fileName]; exist {
-			log.Debug("File is already added; Skipping...")
-			continue
-		}
-
-		// Add to set
-		ui.fileMap[fileName] = struct{}{}
-
-		// Get file name (without path)
-		_, fName := filepath.Split(fileName)
-
-		// Get file stat to get file size
-		s, err := os.Stat(fileName)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while getting stats; Skipping...")
-			continue
-		}
-
-		// Get file size in bytes
-		size := s.Size()
-
-		// Define new row
-		// Only the first three values are visible;
-		// 4th value is full file path that is used to keep track of files and provide a tooltip
-		// 5th value is a full size used for InfoBox size to calculate correct values
-		row := []interface{}{fName, sizeAddUnit(size), "Pending", fileName, size}
-
-		// Add new row to the list
-		iter := fileList.Append()
-		if err = fileList.Set(iter, ui.fileListOrder, row); err != nil {
-			log.Debug("Error while adding ", fileName)
-			continue
-		}
-
-		// Update total file info
-		ui.totalFileSize += size
-		ui.totalFileCount += 1
-	}
-	// Update total file labels
-	ui.updateInfoBox()
+	fileCountLabel.SetLabel(strconv.Itoa(totalFileCount))
+	fileSizeLabel.SetLabel(sizeAddUnit(totalFileSize))
 }
 
 // sizeAddUnit converts size in bytes to size with appropriate file unit
@@ -694,6 +775,23 @@ func (ui *UIStatus) getButtonWithId(buttonId string) (button *gtk.Button, err er
 	return nil, AssertFailed
 }
 
+// getComboBoxTextWithId returns ComboBoxText with a provided id. If found, err != nil.
+func (ui *UIStatus) getComboBoxTextWithId(comboBoxId string) (comboBox *gtk.ComboBoxText, err error) {
+	object, err := ui.builder.GetObject(comboBoxId)
+	if err != nil {
+		log.Debug(err)
+		log.Errorf("Error while getting comboBox with comboBox id: %s", comboBoxId)
+		return nil, err
+	}
+	comboBox, ok := object.(*gtk.ComboBoxText)
+	if ok {
+		return comboBox, nil
+	}
+	log.Debug(AssertFailed)
+	log.Error("object is not a comboBoxText")
+	return nil, AssertFailed
+}
+
 // getTreeViewWithId returns TreeView with a provided id. If found, err != nil.
 func (ui *UIStatus) getTreeViewWithId(treeViewId string) (treeView *gtk.TreeView, err error) {
 	object, err := ui.builder.GetObject(treeViewId)
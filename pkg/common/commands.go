@@ -19,6 +19,8 @@ var CommandCodes = [256]*Command{
 	HolePunchPING,
 	HolePunchPONG,
 	File,
+	KeyHandover,
+	Version,
 }
 
 var Init = &Command{
@@ -83,3 +85,15 @@ var File = &Command{
 	String: "FILE",
 	Code:   12,
 }
+
+// KeyHandover command is used when announcing a rotated public key to contacts
+var KeyHandover = &Command{
+	String: "KHOV",
+	Code:   13,
+}
+
+// Version command is used to negotiate protocol version and features before INIT
+var Version = &Command{
+	String: "VERS",
+	Code:   14,
+}
@@ -34,6 +34,7 @@ var ErrorCodes = [256]*Error{
 	NoAvailableAddCodeError,
 	ExistingConnError,
 	PeerUnavailableError,
+	IncompatibleVersionError,
 }
 
 var UnknownCodeError = &Error{
@@ -95,3 +96,9 @@ var PeerUnavailableError = &Error{
 	Err:     errors.New("able to establish connection with peer"),
 	ErrCode: 12,
 }
+
+// IncompatibleVersionError is returned when peers do not share any protocol version
+var IncompatibleVersionError = &Error{
+	Err:     errors.New("incompatible protocol version"),
+	ErrCode: 13,
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	// LegacyProtocolVersion is the protocol version of peers that do not support Version command.
+	// These peers only know INIT, relay and P2P commands.
+	LegacyProtocolVersion uint16 = 1
+	// ProtocolVersion is the protocol version implemented by this package
+	ProtocolVersion uint16 = 2
+	// MinProtocolVersion is the oldest protocol version this package can talk to
+	MinProtocolVersion = LegacyProtocolVersion
+	// helloMaxAppVersion is the maximum length of Hello.AppVersion
+	helloMaxAppVersion = 255
+)
+
+// Feature is a set of optional protocol features
+type Feature uint32
+
+const (
+	// FeatureRelay indicates support for relaying files through the server
+	FeatureRelay Feature = 1 << iota
+	// FeatureP2P indicates support for hole punching and direct peer to peer connections
+	FeatureP2P
+	// FeatureResume indicates support for resuming interrupted transfers
+	FeatureResume
+	// FeatureCompression indicates support for compressed payloads
+	FeatureCompression
+	// FeatureMux indicates support for util.MuxSession. If negotiated, both sides start a session
+	// right after the reply to Version, with the client as the initiator. Commands are sent on the
+	// control stream, and each relay is sent on its own stream.
+	FeatureMux
+)
+
+// LegacyFeatures are features assumed for peers using LegacyProtocolVersion
+const LegacyFeatures = FeatureRelay | FeatureP2P
+
+// featureNames is used by Feature.String
+var featureNames = []string{"relay", "p2p", "resume", "compression", "mux"}
+
+// InvalidHello occurs when Hello cannot be decoded
+var InvalidHello = errors.New("invalid hello message")
+
+// Hello is exchanged with Version command before INIT to negotiate the protocol.
+//
+// Encoding:
+//
+//	2 bytes: Version (uint16)
+//	2 bytes: MinVersion (uint16)
+//	4 bytes: Features (uint32)
+//	1 byte:  length of AppVersion, followed by AppVersion
+//
+// Decoders must ignore any trailing bytes, which are reserved for future versions.
+type Hello struct {
+	// Version is the highest protocol version supported by the sender
+	Version uint16
+	// MinVersion is the oldest protocol version supported by the sender
+	MinVersion uint16
+	// Features is the set of optional features supported by the sender
+	Features Feature
+	// AppVersion describes the application of the sender, e.g. "coconut-desktop/0.1.0"
+	AppVersion string
+}
+
+// NewHello returns Hello for this package with features and appVersion
+func NewHello(features Feature, appVersion string) *Hello {
+	return &Hello{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   features,
+		AppVersion: appVersion,
+	}
+}
+
+// LegacyHello returns Hello assumed for peers that do not support Version command
+func LegacyHello() *Hello {
+	return &Hello{
+		Version:    LegacyProtocolVersion,
+		MinVersion: LegacyProtocolVersion,
+		Features:   LegacyFeatures,
+		AppVersion: "",
+	}
+}
+
+// MarshalBinary encodes hello. AppVersion longer than 255 bytes is truncated.
+func (hello *Hello) MarshalBinary() (data []byte, err error) {
+	appVersion := hello.AppVersion
+	if len(appVersion) > helloMaxAppVersion {
+		appVersion = appVersion[:helloMaxAppVersion]
+	}
+	data = make([]byte, 9, 9+len(appVersion))
+	binary.BigEndian.PutUint16(data[0:2], hello.Version)
+	binary.BigEndian.PutUint16(data[2:4], hello.MinVersion)
+	binary.BigEndian.PutUint32(data[4:8], uint32(hello.Features))
+	data[8] = uint8(len(appVersion))
+	return append(data, appVersion...), nil
+}
+
+// UnmarshalBinary decodes data created by MarshalBinary.
+// Returns InvalidHello if data is too short or versions are inconsistent.
+func (hello *Hello) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 9 || len(data) < 9+int(data[8]) {
+		return InvalidHello
+	}
+	hello.Version = binary.BigEndian.Uint16(data[0:2])
+	hello.MinVersion = binary.BigEndian.Uint16(data[2:4])
+	hello.Features = Feature(binary.BigEndian.Uint32(data[4:8]))
+	hello.AppVersion = string(data[9 : 9+int(data[8])])
+	if hello.MinVersion == 0 || hello.MinVersion > hello.Version {
+		return InvalidHello
+	}
+	return nil
+}
+
+// Negotiate returns the highest protocol version supported by both local and remote, and
+// features supported by both.
+// Returns IncompatibleVersionError if version ranges of local and remote do not overlap.
+func Negotiate(local *Hello, remote *Hello) (version uint16, features Feature, err error) {
+	version = local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if version < local.MinVersion || version < remote.MinVersion {
+		return 0, 0, IncompatibleVersionError
+	}
+	return version, local.Features & remote.Features, nil
+}
+
+// Has returns true if every feature in other is in f
+func (f Feature) Has(other Feature) bool {
+	return f&other == other
+}
+
+// String returns names of features separated by commas
+func (f Feature) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f.Has(1 << uint(i)) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
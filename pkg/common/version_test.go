@@ -0,0 +1,93 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHelloMarshal(t *testing.T) {
+	hello := NewHello(FeatureRelay|FeatureMux, "coconut-test/1.0")
+	data, err := hello.MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// Trailing bytes are reserved for future versions
+	data = append(data, 1, 2, 3)
+	decoded := &Hello{}
+	if err = decoded.UnmarshalBinary(data); err != nil {
+		t.Error(err)
+		return
+	}
+	if *decoded != *hello {
+		t.Error("Expected ", hello, ", got ", decoded)
+	}
+
+	long := NewHello(0, strings.Repeat("a", 300))
+	if data, err = long.MarshalBinary(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = decoded.UnmarshalBinary(data); err != nil || len(decoded.AppVersion) != helloMaxAppVersion {
+		t.Error("Expected truncated app version, got: ", len(decoded.AppVersion), err)
+	}
+}
+
+func TestHelloInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte{0, 2, 0, 1}},
+		{"truncated app version", []byte{0, 2, 0, 1, 0, 0, 0, 0, 5, 'a'}},
+		{"zero min version", []byte{0, 2, 0, 0, 0, 0, 0, 0, 0}},
+		{"min version above version", []byte{0, 2, 0, 3, 0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		if err := (&Hello{}).UnmarshalBinary(test.data); err != InvalidHello {
+			t.Errorf("%s: expected InvalidHello, got %v", test.name, err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := NewHello(FeatureRelay|FeatureP2P|FeatureMux, "")
+	tests := []struct {
+		name     string
+		remote   *Hello
+		version  uint16
+		features Feature
+		err      error
+	}{
+		{"same", NewHello(FeatureRelay|FeatureResume|FeatureMux, ""), ProtocolVersion,
+			FeatureRelay | FeatureMux, nil},
+		{"legacy", LegacyHello(), LegacyProtocolVersion, LegacyFeatures, nil},
+		{"newer", &Hello{Version: ProtocolVersion + 5, MinVersion: ProtocolVersion, Features: FeatureP2P},
+			ProtocolVersion, FeatureP2P, nil},
+		{"too new", &Hello{Version: ProtocolVersion + 5, MinVersion: ProtocolVersion + 1}, 0, 0,
+			IncompatibleVersionError},
+	}
+	for _, test := range tests {
+		version, features, err := Negotiate(local, test.remote)
+		if !errors.Is(err, test.err) || version != test.version || features != test.features {
+			t.Errorf("%s: expected %v %v %v, got %v %v %v", test.name,
+				test.version, test.features, test.err, version, features, err)
+		}
+	}
+
+	old := &Hello{Version: LegacyProtocolVersion, MinVersion: LegacyProtocolVersion}
+	if _, _, err := Negotiate(&Hello{Version: 3, MinVersion: 2}, old); err != IncompatibleVersionError {
+		t.Error("Expected IncompatibleVersionError, got: ", err)
+	}
+}
+
+func TestFeatureString(t *testing.T) {
+	if s := (FeatureRelay | FeatureCompression | FeatureMux).String(); s != "relay,compression,mux" {
+		t.Error("Unexpected feature string: ", s)
+	}
+	if s := Feature(0).String(); s != "" {
+		t.Error("Unexpected feature string: ", s)
+	}
+}
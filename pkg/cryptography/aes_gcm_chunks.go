@@ -5,7 +5,11 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
 	"io"
@@ -13,6 +17,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -28,15 +33,57 @@ const (
 	// may depend on the IV, file system, OS, etc.
 	//MaxFileSize = ChunkSize * 65535
 	//gcmOverhead = 16
+
+	// streamVersion is the first byte of the stream header
+	streamVersion = 1
+	// noncePrefixSize is the size of random nonce prefix generated for each stream.
+	// Nonce for each chunk consists of nonce prefix, chunk number (uint32), and a flag byte.
+	noncePrefixSize = IvSize - 5
+	// streamHeaderSize is the size of the stream header:
+	// version (1 byte), nonce prefix, chunk count (uint16), file size (uint64)
+	streamHeaderSize = 1 + noncePrefixSize + 2 + 8
 )
 
-// ChunkIncorrectOrder occurs when encrypted file chunks are received in incorrect order.
-var ChunkIncorrectOrder = errors.New("encrypted chunk incorrect order")
+// Flags are the last byte of the nonce, which separates the file name from the chunks,
+// and the last chunk from other chunks.
+const (
+	chunkFlag byte = iota
+	lastChunkFlag
+	fileNameFlag
+)
 
 // IncompleteFile occurs when written chunk size != total chunk size.
 var IncompleteFile = errors.New("incomplete file")
 
+// InvalidSymKey occurs when the decrypted symmetric encryption key has invalid size.
+var InvalidSymKey = errors.New("invalid symmetric encryption key")
+
+// InvalidStreamHeader occurs when the stream header is malformed or does not match the encrypted key.
+var InvalidStreamHeader = errors.New("invalid stream header")
+
+// InvalidChunk occurs when an encrypted chunk fails authentication. This happens if the chunk was
+// modified, reordered, truncated or taken from other stream.
+var InvalidChunk = errors.New("encrypted chunk authentication failed")
+
+// InvalidFileName occurs when the received file name cannot be used as a file name.
+var InvalidFileName = errors.New("invalid file name")
+
+// FileTooLarge occurs when the file requires more chunks than the stream can represent.
+var FileTooLarge = errors.New("file too large")
+
+// FileNameTaken occurs when no unused name is found for the decrypted file.
+var FileNameTaken = errors.New("no unused file name")
+
+// maxFileNameTries is the number of names tried before FileNameTaken is returned
+const maxFileNameTries = 1000
+
 // AesGcmChunk stores data for encrypting or decrypting chunks, but it cannot be both.
+//
+// Payload is encrypted with the STREAM construction. Each stream uses a random nonce prefix,
+// and each chunk is sealed with the nonce containing the chunk number and a flag indicating
+// whether the chunk is the last chunk. The hash of the stream header and the encrypted file name
+// is used as the additional data for every chunk, so chunks cannot be reordered, dropped,
+// or spliced from other streams, even if they were encrypted with the same key.
 type AesGcmChunk struct {
 	key           []byte
 	file          *os.File
@@ -47,6 +94,11 @@ type AesGcmChunk struct {
 	writeChunkNum uint16
 	fileSize      uint64
 	chunkCount    uint16
+	chunkSize     uint64
+	noncePrefix   []byte
+	headerHash    []byte
+	aead          cipher.AEAD
+	accept        func(fileName string, fileSize uint64) error
 }
 
 // EncryptSetup opens file, determine number of chunks, then return *AesGcmChunk
@@ -66,18 +118,31 @@ func EncryptSetup(fileN string) (ag *AesGcmChunk, err error) {
 		return nil, err
 	}
 	// Get size of the src file
-	fileStat, err := os.Stat(fileN)
+	fileStat, err := srcFile.Stat()
 	if err != nil {
 		log.Debug(err)
 		log.Error("Error while getting stats")
+		if err := srcFile.Close(); err != nil {
+			log.Debug(err)
+		}
 		return nil, err
 	}
 	// Split path from file name so dst file can use this file name
 	_, fileName := filepath.Split(fileN)
 	// Get file size
 	fileSize := fileStat.Size()
-	// Get number of chunks
+	// Get number of chunks. Empty files are sent as a single empty chunk,
+	// so that the end of the stream is always authenticated.
 	chunkNum := math.Ceil(float64(fileSize) / ChunkSize)
+	if chunkNum == 0 {
+		chunkNum = 1
+	} else if chunkNum > math.MaxUint16 {
+		log.Error("File requires more than ", math.MaxUint16, " chunks")
+		if err := srcFile.Close(); err != nil {
+			log.Debug(err)
+		}
+		return nil, FileTooLarge
+	}
 	return &AesGcmChunk{
 		key:           symKey,
 		file:          srcFile,
@@ -88,19 +153,29 @@ func EncryptSetup(fileN string) (ag *AesGcmChunk, err error) {
 		writeChunkNum: 0,
 		fileSize:      uint64(fileSize),
 		chunkCount:    uint16(chunkNum),
+		chunkSize:     ChunkSize,
+		noncePrefix:   nil,
+		headerHash:    nil,
+		aead:          nil,
+		accept:        nil,
 	}, nil
 }
 
 // DecryptSetup creates temporary file, make directory if it doesn't exist then return *AesGcmChunk
 func DecryptSetup() (ag *AesGcmChunk, err error) {
+	return DecryptSetupDir(util.DownloadPath)
+}
+
+// DecryptSetupDir is DecryptSetup with downloadPath for decrypted files instead of util.DownloadPath
+func DecryptSetupDir(downloadPath string) (ag *AesGcmChunk, err error) {
 	// Create directory if it doesn't exist
-	if err = os.MkdirAll(util.DownloadPath, os.ModePerm); err != nil {
+	if err = os.MkdirAll(downloadPath, os.ModePerm); err != nil {
 		log.Debug(err)
 		log.Error("Error while creating download directory")
 		return nil, err
 	}
 	// Create file for decrypted data
-	tmpFile, err := ioutil.TempFile(util.DownloadPath, ".tmp_decrypted_")
+	tmpFile, err := ioutil.TempFile(downloadPath, ".tmp_decrypted_")
 	if err != nil {
 		log.Debug(err)
 		log.Error("Temp file could not be created")
@@ -116,6 +191,11 @@ func DecryptSetup() (ag *AesGcmChunk, err error) {
 		writeChunkNum: 0,
 		fileSize:      0,
 		chunkCount:    0,
+		chunkSize:     0,
+		noncePrefix:   nil,
+		headerHash:    nil,
+		aead:          nil,
+		accept:        nil,
 	}, nil
 }
 
@@ -124,7 +204,22 @@ func DecryptSetup() (ag *AesGcmChunk, err error) {
 // Sender's private key is required for signing the encrypted key.
 // err == nil indicates successful execution.
 func (ag *AesGcmChunk) Encrypt(writer io.Writer, receiverPubKey *rsa.PublicKey, senderPrivKey *rsa.PrivateKey) (err error) {
-	keyChNum := append(ag.key, util.Uint16ToByte(ag.chunkCount)...)
+	if err = ag.EncryptKey(writer, receiverPubKey, senderPrivKey); err != nil {
+		if err := ag.file.Close(); err != nil {
+			log.Debug(err)
+		}
+		return err
+	}
+	return ag.EncryptPayload(writer)
+}
+
+// EncryptKey encrypts symmetric encryption key for receiverPubKey, sign it with senderPrivKey
+// and write it to writer. Output of EncryptKey followed by the output of EncryptPayload
+// is identical to the output of Encrypt, which allows the payload to be encrypted only once
+// when sending the same file to multiple receivers.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) EncryptKey(writer io.Writer, receiverPubKey *rsa.PublicKey, senderPrivKey *rsa.PrivateKey) (err error) {
+	keyChNum := append(append([]byte{}, ag.key...), util.Uint16ToByte(ag.chunkCount)...)
 	// Encrypt and sign symmetric encryption key
 	dataEncrypted, dataSignature, err := EncryptSignMsg(keyChNum, receiverPubKey, senderPrivKey)
 	if err != nil {
@@ -134,138 +229,168 @@ func (ag *AesGcmChunk) Encrypt(writer io.Writer, receiverPubKey *rsa.PublicKey,
 	}
 
 	// Send encrypted symmetric key
-	if _, err = util.WriteBytes(writer, dataEncrypted); err != nil {
+	if _, err = util.WriteMessage(writer, dataEncrypted, nil, common.File); err != nil {
 		log.Debug(err)
-		log.Error("Error in WriteBytes while sending dataEncrypted")
+		log.Error("Error in WriteMessage while sending dataEncrypted")
 		return err
 	}
 
 	// Send encrypted symmetric key signature
-	if _, err = util.WriteBytes(writer, dataSignature); err != nil {
+	if _, err = util.WriteMessage(writer, dataSignature, nil, common.File); err != nil {
 		log.Debug(err)
-		log.Error("Error in WriteBytes while sending dataSignature")
+		log.Error("Error in WriteMessage while sending dataSignature")
 		return err
 	}
+	return nil
+}
 
-	// Encrypt file name
-	encryptedFileName, fileNameIv, err := ag.encryptBytes([]byte(ag.fileName))
-	if err != nil {
+// EncryptPayload encrypts file name and file, then write them to writer.
+// File is closed when done, so EncryptPayload can be called only once.
+//
+// Payload format:
+//
+//	stream header: version, nonce prefix, chunk count, file size
+//	encrypted file name (stream header as additional data)
+//	encrypted chunks (hash of stream header and encrypted file name as additional data)
+//
+// Each part is written as a util.Message with common.File command. The input file is closed
+// when EncryptPayload returns.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) EncryptPayload(writer io.Writer) (err error) {
+	// Close input file when done reading, or on error
+	defer func() {
+		if e := ag.file.Close(); e != nil {
+			log.Debug(e)
+			if err == nil {
+				err = e
+			}
+		}
+	}()
+	if err = ag.initAead(); err != nil {
+		return err
+	}
+	// Generate random nonce prefix for this stream
+	ag.noncePrefix = make([]byte, noncePrefixSize)
+	if _, err = io.ReadFull(rand.Reader, ag.noncePrefix); err != nil {
 		log.Debug(err)
-		log.Error("Error in encryptBytes while encrypting file name")
+		log.Error("Error while creating nonce prefix")
 		return err
 	}
-	// Send IV (Nonce)
-	if _, err = util.WriteBytes(writer, fileNameIv); err != nil {
+
+	// Send stream header
+	header := ag.streamHeader()
+	if _, err = util.WriteMessage(writer, header, nil, common.File); err != nil {
 		log.Debug(err)
-		log.Error("Error in WriteBytes while writing fileNameIv")
+		log.Error("Error in WriteMessage while writing stream header")
 		return err
 	}
+
+	// Encrypt file name; stream header is authenticated with the file name
+	encryptedFileName := ag.aead.Seal(nil, ag.nonce(0, fileNameFlag), []byte(ag.fileName), header)
 	// Send encrypted file name
-	if _, err = util.WriteBytes(writer, encryptedFileName); err != nil {
+	if _, err = util.WriteMessage(writer, encryptedFileName, nil, common.File); err != nil {
 		log.Debug(err)
-		log.Error("Error in WriteBytes while writing encrypted file name")
+		log.Error("Error in WriteMessage while writing encrypted file name")
 		return err
 	}
+	ag.headerHash = hashHeader(header, encryptedFileName)
 
 	// Send encrypted file
-	var encryptedFileChunk, iv []byte
-	// Loop until every byte is sent
+	var encryptedFileChunk []byte
+	// Loop until every chunk is sent
 	// ag.readOffset and ag.readChunkNum are updated in encryptChunk
-	for ag.readOffset < ag.fileSize {
-		if ag.readOffset+ChunkSize >= ag.fileSize {
+	for ag.readChunkNum < ag.chunkCount {
+		if ag.readOffset+ag.chunkSize >= ag.fileSize {
 			// Send last chunk
-			encryptedFileChunk, iv, err = ag.encryptChunk(ag.fileSize - ag.readOffset)
+			encryptedFileChunk, err = ag.encryptChunk(ag.fileSize - ag.readOffset)
 		} else {
 			// Send chunk
-			encryptedFileChunk, iv, err = ag.encryptChunk(ChunkSize)
+			encryptedFileChunk, err = ag.encryptChunk(ag.chunkSize)
 		}
 		if err != nil {
 			log.Debug(err)
 			log.Error("Error in encryptChunk. Read Offset: ", int(ag.readOffset))
 			return err
 		}
-		// Send IV in plain text
-		if _, err = util.WriteBytes(writer, iv); err != nil {
-			log.Debug(err)
-			log.Error("Error in WriteBytes while sending iv")
-			return err
-		}
-		// Send encrypted file chunk + current chunk number (first two bytes)
-		if _, err = util.WriteBytes(writer, encryptedFileChunk); err != nil {
+		// Send encrypted file chunk
+		if _, err = util.WriteMessage(writer, encryptedFileChunk, nil, common.File); err != nil {
 			log.Debug(err)
-			log.Error("Error in WriteBytes while sending encryptedFileChunk")
+			log.Error("Error in WriteMessage while sending encryptedFileChunk")
 			return err
 		}
 	}
-
-	// Close input file when done reading
-	if err := ag.file.Close(); err != nil {
-		log.Debug(err)
-		return err
-	}
-
 	return nil
 }
 
-// encryptChunk encrypts portion of the file and return it as []byte with current chunk number
-// appended in the beginning (first two bytes). IV is also returned in plain text.
+// encryptChunk encrypts portion of the file and return it as []byte.
+// Current chunk number and whether the chunk is the last chunk is included in the nonce.
 // err == nil indicates successful execution.
-func (ag *AesGcmChunk) encryptChunk(chunkSize uint64) (encryptedData []byte, iv []byte, err error) {
+func (ag *AesGcmChunk) encryptChunk(chunkSize uint64) (encryptedData []byte, err error) {
 	// Read chunk of file to encrypt
 	plain := make([]byte, int(chunkSize))
-	//plain := make([]byte, int(chunkSize)-gcmOverhead-len(currChunkNum))
 	if _, err := io.ReadFull(ag.file, plain); err != nil {
 		log.Debug(err)
 		log.Error("Error while reading src file")
-		return nil, nil, err
+		return nil, err
 	}
 
-	// Get current chunk number
-	currChunkNum := util.Uint16ToByte(ag.readChunkNum)
-	// Plain data is combined with current chunk number to be sent
-	plain = append(currChunkNum, plain...)
-
-	// Encrypt chunk of file and return encrypted output, IV, and error, if any.
-	if encryptedData, iv, err = ag.encryptBytes(plain); err != nil {
-		log.Debug(err)
-		log.Error("Error in encryptBytes")
-		return nil, nil, err
+	flag := chunkFlag
+	if ag.readChunkNum == ag.chunkCount-1 {
+		flag = lastChunkFlag
 	}
+	encryptedData = ag.aead.Seal(nil, ag.nonce(ag.readChunkNum, flag), plain, ag.headerHash)
 
-	// Update variables for loop in Encrypt
+	// Update variables for loop in EncryptPayload
 	ag.readChunkNum += 1
-	ag.readOffset += uint64(len(plain) - len(currChunkNum))
+	ag.readOffset += uint64(len(plain))
 
-	return encryptedData, iv, err
+	return encryptedData, nil
 }
 
-// encryptBytes encrypts plain and return encrypted data, IV that was used, and error, if any.
-// err == nil indicates successful execution.
-func (ag *AesGcmChunk) encryptBytes(plain []byte) (encryptedData []byte, iv []byte, err error) {
+// initAead creates AES-GCM cipher with ag.key
+func (ag *AesGcmChunk) initAead() (err error) {
 	block, err := aes.NewCipher(ag.key)
 	if err != nil {
 		log.Debug(err)
 		log.Error("Error while creating new cipher block")
-		return nil, nil, err
+		return err
 	}
-	// Generate random IV.
-	// To save some bandwidth, some portion of the IV can be static (e.g. 32 bits)
-	// while the rest (e.g. 64 bits) remains dynamic.
-	iv = make([]byte, IvSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		log.Debug(err)
-		log.Error("Error while creating iv")
-		return nil, nil, err
-	}
-	aesGcm, err := cipher.NewGCM(block)
-	if err != nil {
+	if ag.aead, err = cipher.NewGCM(block); err != nil {
 		log.Debug(err)
 		log.Error("Error in NewGCM")
-		return nil, iv, err
+		return err
 	}
-	// Get encrypted data
-	encryptedData = aesGcm.Seal(nil, iv, plain, nil)
-	return encryptedData, iv, nil
+	return nil
+}
+
+// streamHeader returns stream header: version, nonce prefix, chunk count, file size
+func (ag *AesGcmChunk) streamHeader() (header []byte) {
+	header = make([]byte, 0, streamHeaderSize)
+	header = append(header, streamVersion)
+	header = append(header, ag.noncePrefix...)
+	header = append(header, util.Uint16ToByte(ag.chunkCount)...)
+	fileSize := make([]byte, 8)
+	binary.BigEndian.PutUint64(fileSize, ag.fileSize)
+	return append(header, fileSize...)
+}
+
+// nonce returns nonce for chunkNum: nonce prefix, chunk number (uint32), and flag
+func (ag *AesGcmChunk) nonce(chunkNum uint16, flag byte) []byte {
+	nonce := make([]byte, IvSize)
+	copy(nonce, ag.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(chunkNum))
+	nonce[IvSize-1] = flag
+	return nonce
+}
+
+// hashHeader returns SHA256 hash of stream header and encrypted file name,
+// which is used as the additional data for each chunk
+func hashHeader(header []byte, encryptedFileName []byte) []byte {
+	h := sha256.New()
+	h.Write(util.Uint32ToByte(uint32(len(header))))
+	h.Write(header)
+	h.Write(encryptedFileName)
+	return h.Sum(nil)
 }
 
 // Decrypt reads encrypted data from reader and decrypts the file and return error, if raised.
@@ -273,20 +398,38 @@ func (ag *AesGcmChunk) encryptBytes(plain []byte) (encryptedData []byte, iv []by
 // Receiver's private key is required for decrypting symmetric encryption key.
 // err == nil indicates successful execution.
 func (ag *AesGcmChunk) Decrypt(reader io.Reader, senderPubKey *rsa.PublicKey, receiverPrivKey *rsa.PrivateKey) (err error) {
+	if err = ag.readDecryptKey(reader, senderPubKey, receiverPrivKey); err != nil {
+		ag.removeTempFile()
+		return err
+	}
+	return ag.decryptPayload(reader)
+}
+
+// readDecryptKey reads encrypted symmetric encryption key and its signature from reader, then decrypts it.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) readDecryptKey(reader io.Reader, senderPubKey *rsa.PublicKey, receiverPrivKey *rsa.PrivateKey) (err error) {
 	// Reads encrypted symmetric encryption key
-	dataEncrypted, err := util.ReadBytes(reader)
+	dataEncrypted, err := util.ReadMessageData(reader, common.File)
 	if err != nil {
 		log.Debug(err)
-		log.Error("Error in ReadBytes while getting dataEncrypted")
+		log.Error("Error in ReadMessageData while getting dataEncrypted")
 		return err
 	}
 	// Reads signature for encrypted symmetric encryption key
-	dataSignature, err := util.ReadBytes(reader)
+	dataSignature, err := util.ReadMessageData(reader, common.File)
 	if err != nil {
 		log.Debug(err)
-		log.Error("Error in ReadBytes while getting dataEncrypted")
+		log.Error("Error in ReadMessageData while getting dataEncrypted")
 		return err
 	}
+	return ag.decryptKey(dataEncrypted, dataSignature, senderPubKey, receiverPrivKey)
+}
+
+// decryptKey verifies and decrypts symmetric encryption key and total chunk count.
+// Returns InvalidSymKey if the decrypted data is not a key followed by chunk count.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) decryptKey(dataEncrypted []byte, dataSignature []byte, senderPubKey *rsa.PublicKey,
+	receiverPrivKey *rsa.PrivateKey) (err error) {
 	// Verify and decrypts symmetric encryption key
 	dataPlain, err := DecryptVerifyMsg(dataEncrypted, dataSignature, senderPubKey, receiverPrivKey)
 	if err != nil {
@@ -294,57 +437,90 @@ func (ag *AesGcmChunk) Decrypt(reader io.Reader, senderPubKey *rsa.PublicKey, re
 		log.Error("Error in DecryptVerifyMsg")
 		return err
 	}
+	if len(dataPlain) != SymKeySize+2 {
+		log.Error("Decrypted symmetric encryption key has invalid size")
+		return InvalidSymKey
+	}
 
 	ag.key = dataPlain[:SymKeySize]
 	// Total chunk count is appended to symmetric encryption key
 	ag.chunkCount = util.ByteToUint16(dataPlain[SymKeySize:])
+	return nil
+}
 
-	// Get IV for decrypting file name
-	ivFileName, err := util.ReadBytes(reader)
+// decryptPayload reads encrypted file name and file from reader, then decrypts them.
+// Symmetric encryption key must be set with decryptKey before calling decryptPayload.
+// Temp file is removed if the file was not fully decrypted.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) decryptPayload(reader io.Reader) (err error) {
+	var isDecryptComplete = false
+	// If error encountered while writing a file, close then delete tmp file.
+	defer func() {
+		if !isDecryptComplete {
+			ag.removeTempFile()
+		}
+	}()
+
+	if err = ag.initAead(); err != nil {
+		return err
+	}
+
+	// Get stream header
+	header, err := util.ReadMessageData(reader, common.File)
 	if err != nil {
 		log.Debug(err)
-		log.Error("Error while reading iv for file name")
+		log.Error("Error while reading stream header")
+		return err
+	}
+	if err = ag.parseStreamHeader(header); err != nil {
 		return err
 	}
 
 	// Get encrypted file name
-	encryptedFileName, err := util.ReadBytes(reader)
+	encryptedFileName, err := util.ReadMessageData(reader, common.File)
 	if err != nil {
 		log.Debug(err)
 		log.Error("Error while reading encrypted file name")
 		return err
 	}
 
-	// Decrypt file name with encrypted data and IV
-	decryptedFileName, err := ag.decryptBytes(encryptedFileName, ivFileName)
+	// Decrypt file name and authenticate stream header
+	decryptedFileName, err := ag.aead.Open(nil, ag.nonce(0, fileNameFlag), encryptedFileName, header)
 	if err != nil {
 		log.Debug(err)
 		log.Error("Error while decrypting file name")
-		return err
+		return InvalidStreamHeader
 	}
+	ag.headerHash = hashHeader(header, encryptedFileName)
 
-	// Update file name
-	ag.fileName = string(decryptedFileName)
+	// Update file name. Only the base name is used, so that the file is always saved in the download directory.
+	ag.fileName = filepath.Base(string(decryptedFileName))
+	if ag.fileName == "." || ag.fileName == ".." || ag.fileName == string(filepath.Separator) {
+		log.Error("Invalid file name: ", string(decryptedFileName))
+		return InvalidFileName
+	}
+
+	// File name and size are authenticated, so the file can be refused before any chunk is written
+	if ag.accept != nil {
+		if err = ag.accept(ag.fileName, ag.fileSize); err != nil {
+			log.Debug(err)
+			return err
+		}
+	}
 
 	// Receive file and decrypt
-	var encryptedFileChunk, iv []byte
+	var encryptedFileChunk []byte
 	// Loop until every chunk is received
 	// ag.writeOffset and ag.writeChunkNum are updated in decryptChunk
 	for ag.writeChunkNum < ag.chunkCount {
-		// Read IV in plain text
-		if iv, err = util.ReadBytes(reader); err != nil {
+		// Read encrypted file chunk
+		if encryptedFileChunk, err = util.ReadMessageData(reader, common.File); err != nil {
 			log.Debug(err)
-			log.Error("Error in ReadBytes while reading iv")
-			return err
-		}
-		// Read encrypted file chunk + current chunk number (first two bytes)
-		if encryptedFileChunk, err = util.ReadBytes(reader); err != nil {
-			log.Debug(err)
-			log.Error("Error in ReadBytes while reading encryptedFileChunk")
-			return err
+			log.Error("Error in ReadMessageData while reading encryptedFileChunk")
+			return IncompleteFile
 		}
-		// Decrypt file chunk + current chunk number (first two bytes)
-		decryptedFileChunk, _, err := ag.decryptChunk(encryptedFileChunk, iv)
+		// Decrypt file chunk
+		decryptedFileChunk, err := ag.decryptChunk(encryptedFileChunk)
 		if err != nil {
 			log.Debug(err)
 			log.Error("Error in decryptChunk")
@@ -358,98 +534,144 @@ func (ag *AesGcmChunk) Decrypt(reader io.Reader, senderPubKey *rsa.PublicKey, re
 		}
 	}
 
+	// File size is authenticated with the stream header
+	if ag.writeOffset != ag.fileSize {
+		log.Error("Not all chunks were received")
+		return IncompleteFile
+	}
+
 	// Close output file when done writing
-	if err := ag.file.Close(); err != nil {
+	if err = ag.file.Close(); err != nil {
+		log.Debug(err)
+		return err
+	}
+	isDecryptComplete = true
+
+	// Move temporary file. Temp file is in the download path.
+	if ag.fileName, err = renameNoReplace(ag.file.Name(), ag.fileName); err != nil {
 		log.Debug(err)
+		log.Debug("Tmp file name: ", ag.file.Name())
+		log.Error("Error moving the temp file to download path")
 		// If rename was unsuccessful, remove temp file
 		if err := os.Remove(ag.file.Name()); err != nil {
 			log.Debug(err)
 			log.Error("Error while removing temp file. Temp file at: ", ag.file.Name())
-			return err
 		}
 		return err
 	}
 
-	// If file was fully processed, rename temp file to actual name
-	if ag.writeChunkNum == ag.chunkCount {
-		// Rename temporary file
-		if err := os.Rename(ag.file.Name(), filepath.Join(util.DownloadPath, ag.fileName)); err != nil {
-			log.Debug(err)
-			log.Debug("Tmp file name: ", ag.file.Name())
-			log.Debug("File name: ", ag.fileName)
-			log.Error("Error moving the temp file to download path")
-			// If rename was unsuccessful, remove temp file
-			if err := os.Remove(ag.file.Name()); err != nil {
+	return nil
+}
+
+// renameNoReplace moves tmpName to fileName in the same directory without replacing existing files.
+// If fileName is taken, a number is added to the name, e.g. "file (1).txt".
+// Returns the base name of the moved file.
+func renameNoReplace(tmpName string, fileName string) (name string, err error) {
+	dir := filepath.Dir(tmpName)
+	ext := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	if base == "" {
+		base, ext = fileName, ""
+	}
+	for i := 0; i < maxFileNameTries; i++ {
+		name = fileName
+		if i > 0 {
+			name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		target := filepath.Join(dir, name)
+		// Link fails if target exists, unlike Rename
+		if err = os.Link(tmpName, target); err == nil {
+			if err := os.Remove(tmpName); err != nil {
 				log.Debug(err)
-				log.Error("Error while removing temp file. Temp file at: ", ag.file.Name())
-				return err
 			}
-			return err
+			return name, nil
 		}
-	} else {
-		log.Error("Not all chunks were received")
-		// If file was not fully processed, delete file
-		if err := os.Remove(ag.file.Name()); err != nil {
-			log.Debug(err)
-			log.Error("Error while removing temp file. Temp file at: ", ag.file.Name())
-			return err
+		if os.IsExist(err) {
+			continue
 		}
-		return IncompleteFile
+		// Hard links are not supported on every file system
+		if _, err = os.Lstat(target); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		if err = os.Rename(tmpName, target); err != nil {
+			return "", err
+		}
+		return name, nil
 	}
+	return "", FileNameTaken
+}
 
-	return nil
+// FileName returns the name of the file. When decrypting, the name is available after the
+// file is decrypted, and differs from the name sent if a file with that name already existed.
+func (ag *AesGcmChunk) FileName() string {
+	return ag.fileName
 }
 
-// decryptChunk decrypts encryptedData with IV and current chunk number.
-// Decrypted data and current chunk number is returned with error, if any.
-// err == nil indicates successful execution.
-func (ag *AesGcmChunk) decryptChunk(encryptedData []byte, iv []byte) (decryptedData []byte, currChunkNum uint16, err error) {
-	// Decrypt data
-	decryptedData, err = ag.decryptBytes(encryptedData, iv)
-	if err != nil {
+// SetAccept sets a function called with the authenticated file name and size before any chunk
+// is decrypted. If accept returns an error, the file is not written and Decrypt returns the error.
+func (ag *AesGcmChunk) SetAccept(accept func(fileName string, fileSize uint64) error) {
+	ag.accept = accept
+}
+
+// removeTempFile closes and removes the temp file created in DecryptSetup.
+// Should be called only if the file was not decrypted successfully.
+func (ag *AesGcmChunk) removeTempFile() {
+	if err := ag.file.Close(); err != nil {
 		log.Debug(err)
-		log.Error("Error in decryptBytes")
-		return nil, 0, err
 	}
-
-	// Convert chunk number bytes to uint16 (first two bytes)
-	currChunkNum = util.ByteToUint16(decryptedData[:2])
-	decryptedFileChunk := decryptedData[2:]
-
-	// If chunk was received in incorrect order, raise error
-	if ag.writeChunkNum != currChunkNum {
-		log.Error("Encrypted chunk was received in an incorrect order")
-		return decryptedFileChunk, currChunkNum, ChunkIncorrectOrder
+	if err := os.Remove(ag.file.Name()); err != nil {
+		log.Debug(err)
+		log.Error("Error while removing temp file. Temp file at: ", ag.file.Name())
 	}
+}
 
-	// Update variables for loop in Decrypt
-	ag.writeChunkNum += 1
-	ag.writeOffset += uint64(len(decryptedFileChunk))
-
-	return decryptedFileChunk, currChunkNum, nil
+// parseStreamHeader parses stream header and updates nonce prefix, chunk count and file size.
+// If the chunk count was sent with the encrypted key, chunk count in the header should match it.
+func (ag *AesGcmChunk) parseStreamHeader(header []byte) (err error) {
+	if len(header) != streamHeaderSize || header[0] != streamVersion {
+		log.Error("Unsupported stream header")
+		return InvalidStreamHeader
+	}
+	header = header[1:]
+	ag.noncePrefix = header[:noncePrefixSize]
+	header = header[noncePrefixSize:]
+	chunkCount := util.ByteToUint16(header[:2])
+	if chunkCount == 0 || (ag.chunkCount != 0 && chunkCount != ag.chunkCount) {
+		log.Error("Chunk count does not match encrypted key")
+		return InvalidStreamHeader
+	}
+	ag.chunkCount = chunkCount
+	ag.fileSize = binary.BigEndian.Uint64(header[2:])
+	return nil
 }
 
-// decryptBytes decrypts encryptedData with IV. Decrypted data and error is returned, if any.
+// decryptChunk decrypts encryptedData with the nonce for the current chunk number.
+// Decrypted data is returned with error, if any.
 // err == nil indicates successful execution.
-func (ag *AesGcmChunk) decryptBytes(encryptedData []byte, iv []byte) (decryptedData []byte, err error) {
-	block, err := aes.NewCipher(ag.key)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while creating new cipher block")
-		return nil, err
-	}
-	aesGcm, err := cipher.NewGCM(block)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error in NewGCM")
-		return nil, err
+func (ag *AesGcmChunk) decryptChunk(encryptedData []byte) (decryptedData []byte, err error) {
+	flag := chunkFlag
+	if ag.writeChunkNum == ag.chunkCount-1 {
+		flag = lastChunkFlag
 	}
-	// Decrypt the encryptedData
-	if decryptedData, err = aesGcm.Open(nil, iv, encryptedData, nil); err != nil {
+	// Decrypt data
+	if decryptedData, err = ag.aead.Open(nil, ag.nonce(ag.writeChunkNum, flag), encryptedData, ag.headerHash); err != nil {
 		log.Debug(err)
 		log.Error("Error in Open in decryptChunk")
-		return nil, err
+		return nil, InvalidChunk
+	}
+
+	// File size in the stream header is the upper bound of the decrypted data
+	if ag.writeOffset+uint64(len(decryptedData)) > ag.fileSize {
+		log.Error("Decrypted data exceeds the file size")
+		return nil, InvalidChunk
 	}
+
+	// Update variables for loop in Decrypt
+	ag.writeChunkNum += 1
+	ag.writeOffset += uint64(len(decryptedData))
+
 	return decryptedData, nil
 }
 
@@ -1,11 +1,16 @@
 package cryptography
 
 import (
+	"bytes"
+	"crypto/rsa"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -239,3 +244,447 @@ func ChecksumMatch(t *testing.T, expected io.Reader, result io.Reader) bool {
 	}
 	return true
 }
+
+func TestEncryptPayloadOnce(t *testing.T) {
+	defer func() {
+		if err := os.RemoveAll(util.DownloadPath); err != nil {
+			log.Debug(err)
+			log.Error("Existing directory not deleted, perhaps it does not exist?")
+		}
+	}()
+	testFileN := "../testdata/checksum.txt"
+
+	// Sender
+	_, privPem1, err := OpenKeys("../testdata/keypair1")
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in OpenKeys")
+		return
+	}
+	privKey1, err := PemToKeys(privPem1)
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in PemToKeys")
+		return
+	}
+
+	// Receivers
+	var receivers []*rsa.PrivateKey
+	for _, keyPath := range []string{"../testdata/keypair2", "../testdata/keypair3"} {
+		_, privPem, err := OpenKeys(keyPath)
+		if err != nil {
+			log.Debug(err)
+			t.Error("Error in OpenKeys")
+			return
+		}
+		privKey, err := PemToKeys(privPem)
+		if err != nil {
+			log.Debug(err)
+			t.Error("Error in PemToKeys")
+			return
+		}
+		receivers = append(receivers, privKey)
+	}
+
+	// Encrypt payload only once
+	streamEncrypt, err := EncryptSetup(testFileN)
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in EncryptSetup")
+		return
+	}
+	var payload bytes.Buffer
+	if err = streamEncrypt.EncryptPayload(&payload); err != nil {
+		log.Debug(err)
+		t.Error("Error in EncryptPayload")
+		return
+	}
+
+	for _, receiver := range receivers {
+		// Wrap the key for each receiver
+		var stream bytes.Buffer
+		if err = streamEncrypt.EncryptKey(&stream, &receiver.PublicKey, privKey1); err != nil {
+			log.Debug(err)
+			t.Error("Error in EncryptKey")
+			return
+		}
+		stream.Write(payload.Bytes())
+
+		streamDecrypt, err := DecryptSetup()
+		if err != nil {
+			log.Debug(err)
+			t.Error("Error in DecryptSetup")
+			return
+		}
+		if err = streamDecrypt.Decrypt(&stream, &privKey1.PublicKey, receiver); err != nil {
+			log.Debug(err)
+			t.Error("Error in Decrypt")
+			return
+		}
+
+		srcFile, err := os.Open(testFileN)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		dstFile, err := os.Open(filepath.Join(util.DownloadPath, "checksum.txt"))
+		if err != nil {
+			_ = srcFile.Close()
+			t.Error(err)
+			return
+		}
+		if !ChecksumMatch(t, srcFile, dstFile) {
+			t.Error("Checksum does not match")
+		}
+		_ = srcFile.Close()
+		_ = dstFile.Close()
+	}
+}
+
+// Indexes of each part in the stream created by Encrypt
+const (
+	streamKeyIdx = iota
+	streamSignatureIdx
+	streamHeaderIdx
+	streamFileNameIdx
+	streamFirstChunkIdx
+)
+
+// encryptStreamHelper encrypts fileN with chunkSize and key, then returns each part of the stream.
+// If key is nil, random key is used.
+func encryptStreamHelper(t testing.TB, fileN string, chunkSize uint64, key []byte, privKey *rsa.PrivateKey) [][]byte {
+	t.Helper()
+	ag, err := EncryptSetup(fileN)
+	if err != nil {
+		t.Fatal("Error in EncryptSetup: ", err)
+	}
+	if key != nil {
+		ag.key = key
+	}
+	ag.chunkSize = chunkSize
+	ag.chunkCount = uint16((ag.fileSize + chunkSize - 1) / chunkSize)
+	if ag.chunkCount == 0 {
+		ag.chunkCount = 1
+	}
+
+	var stream bytes.Buffer
+	if err = ag.Encrypt(&stream, &privKey.PublicKey, privKey); err != nil {
+		t.Fatal("Error in Encrypt: ", err)
+	}
+
+	// Split stream into messages
+	var parts [][]byte
+	for stream.Len() > 0 {
+		part, err := util.ReadMessageData(&stream, common.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// decryptStreamHelper joins parts and decrypts them. Downloaded file is compared with expectedFileN.
+func decryptStreamHelper(t *testing.T, parts [][]byte, privKey *rsa.PrivateKey, expectedFileN string) error {
+	t.Helper()
+	var stream bytes.Buffer
+	for _, part := range parts {
+		if _, err := util.WriteMessage(&stream, part, nil, common.File); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ag, err := DecryptSetup()
+	if err != nil {
+		t.Fatal("Error in DecryptSetup: ", err)
+	}
+	if err = ag.Decrypt(&stream, &privKey.PublicKey, privKey); err != nil {
+		return err
+	}
+
+	expected, err := ioutil.ReadFile(expectedFileN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadFile(filepath.Join(util.DownloadPath, ag.FileName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, received) {
+		t.Error("Decrypted file mismatch")
+	}
+	return nil
+}
+
+// countTempFilesHelper returns the number of temp files left in the download directory
+func countTempFilesHelper(t *testing.T) int {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(util.DownloadPath, ".tmp_decrypted_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestStreamMultipleChunks(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+
+	for _, chunkSize := range []uint64{1000, 4096, 1 << 20} {
+		parts := encryptStreamHelper(t, testFileN, chunkSize, nil, privKey)
+		if err := decryptStreamHelper(t, parts, privKey, testFileN); err != nil {
+			t.Error("Error in Decrypt: ", err)
+			return
+		}
+	}
+}
+
+func TestStreamEmptyFile(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := filepath.Join(t.TempDir(), "empty.txt")
+	if err := ioutil.WriteFile(testFileN, nil, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+
+	parts := encryptStreamHelper(t, testFileN, ChunkSize, nil, privKey)
+	if len(parts) != streamFirstChunkIdx+1 {
+		t.Error("Empty file should be sent as a single chunk")
+		return
+	}
+	if err := decryptStreamHelper(t, parts, privKey, testFileN); err != nil {
+		t.Error("Error in Decrypt: ", err)
+		return
+	}
+	// Last chunk cannot be dropped even for empty files
+	if err := decryptStreamHelper(t, parts[:streamFirstChunkIdx], privKey, testFileN); err != IncompleteFile {
+		t.Error("Expected IncompleteFile, got: ", err)
+	}
+}
+
+func TestStreamTamper(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	parts := encryptStreamHelper(t, testFileN, 4096, nil, privKey)
+
+	tests := []struct {
+		name   string
+		idx    int
+		offset int
+		err    error
+	}{
+		{"header version", streamHeaderIdx, 0, InvalidStreamHeader},
+		{"header nonce prefix", streamHeaderIdx, 1, InvalidStreamHeader},
+		{"header file size", streamHeaderIdx, streamHeaderSize - 1, InvalidStreamHeader},
+		{"file name", streamFileNameIdx, 0, InvalidStreamHeader},
+		{"first chunk", streamFirstChunkIdx, 10, InvalidChunk},
+		{"last chunk", len(parts) - 1, 0, InvalidChunk},
+	}
+	for _, test := range tests {
+		tampered := make([][]byte, len(parts))
+		copy(tampered, parts)
+		tampered[test.idx] = append([]byte{}, parts[test.idx]...)
+		tampered[test.idx][test.offset] ^= 0x01
+		if err := decryptStreamHelper(t, tampered, privKey, testFileN); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+	if n := countTempFilesHelper(t); n != 0 {
+		t.Errorf("%d temp files were not removed", n)
+	}
+}
+
+func TestStreamReorder(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	parts := encryptStreamHelper(t, testFileN, 4096, nil, privKey)
+
+	reordered := make([][]byte, len(parts))
+	copy(reordered, parts)
+	reordered[streamFirstChunkIdx], reordered[streamFirstChunkIdx+1] = reordered[streamFirstChunkIdx+1], reordered[streamFirstChunkIdx]
+	if err := decryptStreamHelper(t, reordered, privKey, testFileN); err != InvalidChunk {
+		t.Error("Expected InvalidChunk, got: ", err)
+	}
+
+	// Duplicate chunk in place of another chunk
+	duplicated := make([][]byte, len(parts))
+	copy(duplicated, parts)
+	duplicated[streamFirstChunkIdx+1] = duplicated[streamFirstChunkIdx]
+	if err := decryptStreamHelper(t, duplicated, privKey, testFileN); err != InvalidChunk {
+		t.Error("Expected InvalidChunk, got: ", err)
+	}
+}
+
+func TestStreamTruncate(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	parts := encryptStreamHelper(t, testFileN, 4096, nil, privKey)
+
+	// Drop last chunk
+	if err := decryptStreamHelper(t, parts[:len(parts)-1], privKey, testFileN); err != IncompleteFile {
+		t.Error("Expected IncompleteFile, got: ", err)
+	}
+
+	// Drop a chunk in the middle, so that the stream has one less chunk
+	dropped := append(append([][]byte{}, parts[:streamFirstChunkIdx+1]...), parts[streamFirstChunkIdx+2:]...)
+	if err := decryptStreamHelper(t, dropped, privKey, testFileN); err != InvalidChunk {
+		t.Error("Expected InvalidChunk, got: ", err)
+	}
+
+	// Chunks from a stream with fewer chunks cannot replace the original chunks
+	shortParts := encryptStreamHelper(t, testFileN, 1<<20, nil, privKey)
+	spliced := append(append([][]byte{}, parts[:streamFirstChunkIdx]...), shortParts[streamFirstChunkIdx:]...)
+	if err := decryptStreamHelper(t, spliced, privKey, testFileN); err != InvalidChunk {
+		t.Error("Expected InvalidChunk, got: ", err)
+	}
+	if n := countTempFilesHelper(t); n != 0 {
+		t.Errorf("%d temp files were not removed", n)
+	}
+}
+
+func TestStreamSplice(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+
+	// Both streams are encrypted with the same key
+	key, err := genSymKey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	parts1 := encryptStreamHelper(t, testFileN, 4096, key, privKey)
+	parts2 := encryptStreamHelper(t, testFileN, 4096, key, privKey)
+
+	// Replace a chunk with the chunk from other stream
+	spliced := make([][]byte, len(parts1))
+	copy(spliced, parts1)
+	spliced[streamFirstChunkIdx+1] = parts2[streamFirstChunkIdx+1]
+	if err = decryptStreamHelper(t, spliced, privKey, testFileN); err != InvalidChunk {
+		t.Error("Expected InvalidChunk, got: ", err)
+	}
+
+	// Replace the header with the header from other stream
+	copy(spliced, parts1)
+	spliced[streamHeaderIdx] = parts2[streamHeaderIdx]
+	if err = decryptStreamHelper(t, spliced, privKey, testFileN); err != InvalidStreamHeader {
+		t.Error("Expected InvalidStreamHeader, got: ", err)
+	}
+
+	// Replace the header and the file name with ones from other stream
+	copy(spliced, parts1)
+	spliced[streamHeaderIdx] = parts2[streamHeaderIdx]
+	spliced[streamFileNameIdx] = parts2[streamFileNameIdx]
+	if err = decryptStreamHelper(t, spliced, privKey, testFileN); err != InvalidChunk {
+		t.Error("Expected InvalidChunk, got: ", err)
+	}
+}
+
+// CleanupHelper removes DownloadPath after testing
+func CleanupHelper(t testing.TB) {
+	t.Helper()
+	if err := os.RemoveAll(util.DownloadPath); err != nil {
+		log.Debug(err)
+		log.Error("Existing directory not deleted, perhaps it does not exist?")
+	}
+}
+
+func TestStreamAccept(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	stat, err := os.Stat(testFileN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reject := errors.New("rejected")
+
+	for _, tc := range []struct {
+		accept error
+		files  int
+	}{{reject, 0}, {nil, 1}} {
+		var stream bytes.Buffer
+		for _, part := range encryptStreamHelper(t, testFileN, 4096, nil, privKey) {
+			if _, err := util.WriteMessage(&stream, part, nil, common.File); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ag, err := DecryptSetup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var name string
+		var size uint64
+		ag.SetAccept(func(fileName string, fileSize uint64) error {
+			name, size = fileName, fileSize
+			return tc.accept
+		})
+		if err = ag.Decrypt(&stream, &privKey.PublicKey, privKey); err != tc.accept {
+			t.Error("Expected ", tc.accept, ", got: ", err)
+		}
+		if name != "cat.jpg" || size != uint64(stat.Size()) {
+			t.Error("Unexpected file name or size: ", name, size)
+		}
+		files, err := filepath.Glob(filepath.Join(util.DownloadPath, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != tc.files || countTempFilesHelper(t) != 0 {
+			t.Error("Unexpected files in the download directory: ", files)
+		}
+	}
+}
+
+func TestStreamNoReplace(t *testing.T) {
+	defer CleanupHelper(t)
+	testFileN := "../testdata/cat.jpg"
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	if err := os.MkdirAll(util.DownloadPath, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(util.DownloadPath, "cat.jpg")
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := encryptStreamHelper(t, testFileN, 4096, nil, privKey)
+	if err := decryptStreamHelper(t, parts, privKey, testFileN); err != nil {
+		t.Error("Error in Decrypt: ", err)
+	}
+	if err := decryptStreamHelper(t, parts, privKey, testFileN); err != nil {
+		t.Error("Error in Decrypt: ", err)
+	}
+	if b, err := ioutil.ReadFile(existing); err != nil || string(b) != "existing" {
+		t.Error("Existing file was replaced: ", err)
+	}
+	for _, name := range []string{"cat (1).jpg", "cat (2).jpg"} {
+		if _, err := os.Stat(filepath.Join(util.DownloadPath, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		fileName string
+		expected string
+	}{{".bashrc", ".bashrc"}, {".bashrc", ".bashrc (1)"}, {"archive.tar.gz", "archive.tar.gz"},
+		{"archive.tar.gz", "archive.tar (1).gz"}} {
+		tmpName := filepath.Join(dir, ".tmp")
+		if err := ioutil.WriteFile(tmpName, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		name, err := renameNoReplace(tmpName, tc.fileName)
+		if err != nil || name != tc.expected {
+			t.Error("Expected ", tc.expected, ", got: ", name, err)
+		}
+		if _, err = os.Stat(tmpName); !os.IsNotExist(err) {
+			t.Error("Temp file was not removed: ", err)
+		}
+	}
+}
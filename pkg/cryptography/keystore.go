@@ -0,0 +1,232 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	// pubKeyFileName and privKeyFileName are the names of key files in the key path
+	pubKeyFileName  = "key.pub"
+	privKeyFileName = "key.priv"
+)
+
+// KeyMissing occurs when the key file does not exist.
+var KeyMissing = errors.New("key file not found")
+
+// KeyCorrupt occurs when the key file does not contain a valid key.
+var KeyCorrupt = errors.New("key file is corrupt")
+
+// KeyMismatch occurs when the public key does not belong to the private key.
+var KeyMismatch = errors.New("public key does not match private key")
+
+// KeyPermission occurs when the private key file is accessible by other users.
+var KeyPermission = errors.New("private key file is accessible by other users")
+
+// KeyError records an error and the key file that caused it.
+// Err is one of KeyMissing, KeyCorrupt, KeyMismatch, KeyPermission or an error from the os package.
+type KeyError struct {
+	// FileName is the key file, or the location of the key in KeyStorage
+	FileName string
+	Err      error
+}
+
+func (e *KeyError) Error() string {
+	return e.FileName + ": " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// KeyStore stores RSA key pair of this client. Public key is stored in a directory,
+// and private key is stored in KeyStorage.
+type KeyStore struct {
+	// pubFileN is the path to the public key file
+	pubFileN string
+	// storage stores the private key
+	storage KeyStorage
+	// bitSize is the size of newly created keys
+	bitSize int
+}
+
+// NewKeyStore returns KeyStore for keys in keyPath. Files are not accessed until the keys are used.
+func NewKeyStore(keyPath string) *KeyStore {
+	return NewKeyStoreWithStorage(keyPath, NewFileStorage(keyPath))
+}
+
+// NewKeyStoreWithStorage returns KeyStore for public key in keyPath and private key in storage.
+func NewKeyStoreWithStorage(keyPath string, storage KeyStorage) *KeyStore {
+	return &KeyStore{
+		pubFileN: filepath.Join(keyPath, pubKeyFileName),
+		storage:  storage,
+		bitSize:  rsaKeyBitSize,
+	}
+}
+
+// Open opens existing keys. If keys are not found, new keys will be created.
+// If only the public key is missing, it is regenerated from the private key.
+// If only the private key is missing, *KeyError wrapping KeyMissing is returned,
+// since the identity of this client cannot be recovered.
+func (ks *KeyStore) Open() (pubBlock *pem.Block, privBlock *pem.Block, err error) {
+	pubBlock, privBlock, err = ks.Load()
+
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) || keyErr.Err != KeyMissing {
+		return pubBlock, privBlock, err
+	}
+	if keyErr.FileName == ks.storage.Location(privKeyFileName) {
+		if _, statErr := os.Stat(ks.pubFileN); !os.IsNotExist(statErr) {
+			log.Error("Private key not found")
+			return nil, nil, err
+		}
+		log.Info("Keys not found, creating new keys")
+		return ks.Create()
+	}
+	log.Warning("Public key not found, regenerating from private key")
+	if _, err = ks.RegeneratePubKey(); err != nil {
+		return nil, nil, err
+	}
+	return ks.Load()
+}
+
+// Load reads and validates the key pair.
+// Returns *KeyError wrapping KeyMissing if either key does not exist, KeyCorrupt if either key
+// cannot be parsed, KeyPermission if the private key file is accessible by other users, or
+// KeyMismatch if the public key does not belong to the private key.
+func (ks *KeyStore) Load() (pubBlock *pem.Block, privBlock *pem.Block, err error) {
+	privBlock, privKey, err := ks.loadPrivKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pubBlock, err = readPemFile(ks.pubFileN, "RSA PUBLIC KEY")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = x509.ParsePKCS1PublicKey(pubBlock.Bytes); err != nil {
+		log.Debug(err)
+		log.Error("Error while parsing public key")
+		return nil, nil, &KeyError{FileName: ks.pubFileN, Err: KeyCorrupt}
+	}
+	if !bytes.Equal(pubBlock.Bytes, x509.MarshalPKCS1PublicKey(&privKey.PublicKey)) {
+		log.Error("Public key does not match private key")
+		return nil, nil, &KeyError{FileName: ks.pubFileN, Err: KeyMismatch}
+	}
+	return pubBlock, privBlock, nil
+}
+
+// Create creates a new key pair. The private key is stored first, so that the public key
+// can always be regenerated if the public key could not be written.
+// Returns *KeyError wrapping os.ErrExist if either key already exists.
+func (ks *KeyStore) Create() (pubBlock *pem.Block, privBlock *pem.Block, err error) {
+	if _, err = os.Stat(ks.pubFileN); err == nil {
+		log.Error("Public key file already exists")
+		return nil, nil, &KeyError{FileName: ks.pubFileN, Err: os.ErrExist}
+	}
+	// Create directory if it doesn't exist
+	if err = os.MkdirAll(filepath.Dir(ks.pubFileN), 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating key directory")
+		return nil, nil, err
+	}
+
+	key, err := createRSAKey(ks.bitSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	privBlock = &pem.Block{
+		Type:    "RSA PRIVATE KEY",
+		Headers: nil,
+		Bytes:   x509.MarshalPKCS1PrivateKey(key),
+	}
+	if err = ks.storage.Store(privKeyFileName, privBlock); err != nil {
+		return nil, nil, err
+	}
+	if pubBlock, err = ks.writePubKey(key); err != nil {
+		return nil, nil, err
+	}
+	return pubBlock, privBlock, nil
+}
+
+// RegeneratePubKey recreates the public key file from the private key.
+// Existing public key file is replaced.
+func (ks *KeyStore) RegeneratePubKey() (pubBlock *pem.Block, err error) {
+	_, privKey, err := ks.loadPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	return ks.writePubKey(privKey)
+}
+
+// loadPrivKey loads and parses the private key
+func (ks *KeyStore) loadPrivKey() (privBlock *pem.Block, privKey *rsa.PrivateKey, err error) {
+	if privBlock, err = ks.storage.Load(privKeyFileName); err != nil {
+		return nil, nil, err
+	}
+	if privBlock.Type != "RSA PRIVATE KEY" {
+		log.Error("Unexpected private key type")
+		return nil, nil, &KeyError{FileName: ks.storage.Location(privKeyFileName), Err: KeyCorrupt}
+	}
+	if privKey, err = x509.ParsePKCS1PrivateKey(privBlock.Bytes); err != nil {
+		log.Debug(err)
+		log.Error("Error while parsing private key")
+		return nil, nil, &KeyError{FileName: ks.storage.Location(privKeyFileName), Err: KeyCorrupt}
+	}
+	return privBlock, privKey, nil
+}
+
+// writePubKey writes public key of privKey to the public key file
+func (ks *KeyStore) writePubKey(privKey *rsa.PrivateKey) (pubBlock *pem.Block, err error) {
+	pubBlock = &pem.Block{
+		Type:    "RSA PUBLIC KEY",
+		Headers: nil,
+		Bytes:   x509.MarshalPKCS1PublicKey(&privKey.PublicKey),
+	}
+	if err = ioutil.WriteFile(ks.pubFileN, pem.EncodeToMemory(pubBlock), 0644); err != nil {
+		log.Debug(err)
+		log.Error("Error while writing public key")
+		return nil, &KeyError{FileName: ks.pubFileN, Err: err}
+	}
+	return pubBlock, nil
+}
+
+// readPemFile reads fileName and decodes a single PEM block with blockType
+func readPemFile(fileName string, blockType string) (block *pem.Block, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, &KeyError{FileName: fileName, Err: KeyMissing}
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading key file")
+		return nil, &KeyError{FileName: fileName, Err: err}
+	}
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != blockType || len(bytes.TrimSpace(rest)) != 0 {
+		log.Error("Error while decoding key file")
+		return nil, &KeyError{FileName: fileName, Err: KeyCorrupt}
+	}
+	return block, nil
+}
+
+// checkPrivKeyPermission returns KeyPermission if the private key file is accessible by group or others.
+// File permissions are not checked on Windows.
+func checkPrivKeyPermission(fileName string) (err error) {
+	info, err := os.Stat(fileName)
+	if os.IsNotExist(err) {
+		return &KeyError{FileName: fileName, Err: KeyMissing}
+	} else if err != nil {
+		return &KeyError{FileName: fileName, Err: err}
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		log.Error("Private key file should only be accessible by the owner (chmod 600)")
+		return &KeyError{FileName: fileName, Err: KeyPermission}
+	}
+	return nil
+}
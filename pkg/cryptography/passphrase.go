@@ -0,0 +1,131 @@
+package cryptography
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+)
+
+const (
+	// passphraseVersion is the first byte of data encrypted with EncryptWithPassphrase
+	passphraseVersion = 1
+	// passphraseIterations is the number of PBKDF2-HMAC-SHA256 iterations for new data
+	passphraseIterations = 600000
+	// passphraseSaltSize is the size of random salt
+	passphraseSaltSize = 16
+	// passphraseHeaderSize is the size of version, iterations, salt and nonce
+	passphraseHeaderSize = 1 + 4 + passphraseSaltSize + IvSize
+)
+
+// InvalidPassphrase occurs when the data cannot be decrypted with the passphrase. Since the
+// data is authenticated, this error is also returned if the data was modified.
+var InvalidPassphrase = errors.New("invalid passphrase or corrupt data")
+
+// EmptyPassphrase occurs when the passphrase is empty.
+var EmptyPassphrase = errors.New("passphrase is empty")
+
+// EncryptWithPassphrase encrypts plain with a key derived from passphrase (PBKDF2-HMAC-SHA256)
+// using AES-256-GCM.
+//
+// Format:
+//
+//	1 byte:   version
+//	4 bytes:  number of PBKDF2 iterations (uint32)
+//	16 bytes: salt
+//	12 bytes: nonce
+//	rest:     encrypted data with GCM tag. Preceding header is used as additional data.
+func EncryptWithPassphrase(plain []byte, passphrase []byte) (data []byte, err error) {
+	return encryptWithPassphrase(plain, passphrase, passphraseIterations)
+}
+
+// encryptWithPassphrase encrypts plain with a key derived from passphrase with iterations.
+func encryptWithPassphrase(plain []byte, passphrase []byte, iterations uint32) (data []byte, err error) {
+	if len(passphrase) == 0 {
+		return nil, EmptyPassphrase
+	}
+	header := make([]byte, passphraseHeaderSize)
+	header[0] = passphraseVersion
+	binary.BigEndian.PutUint32(header[1:5], iterations)
+	if _, err = rand.Read(header[5:]); err != nil {
+		log.Debug(err)
+		log.Error("Error while generating salt and nonce")
+		return nil, err
+	}
+	salt := header[5 : 5+passphraseSaltSize]
+	nonce := header[5+passphraseSaltSize:]
+
+	aead, err := passphraseAead(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, plain, header), nil
+}
+
+// DecryptWithPassphrase decrypts data created by EncryptWithPassphrase.
+// Returns InvalidPassphrase if the passphrase is wrong or data was modified.
+func DecryptWithPassphrase(data []byte, passphrase []byte) (plain []byte, err error) {
+	if len(passphrase) == 0 {
+		return nil, EmptyPassphrase
+	}
+	if len(data) < passphraseHeaderSize || data[0] != passphraseVersion {
+		log.Error("Unsupported passphrase encrypted data")
+		return nil, InvalidPassphrase
+	}
+	header := data[:passphraseHeaderSize]
+	iterations := binary.BigEndian.Uint32(header[1:5])
+	if iterations == 0 || iterations > 10*passphraseIterations {
+		log.Error("Invalid number of iterations")
+		return nil, InvalidPassphrase
+	}
+	salt := header[5 : 5+passphraseSaltSize]
+	nonce := header[5+passphraseSaltSize:]
+
+	aead, err := passphraseAead(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if plain, err = aead.Open(nil, nonce, data[passphraseHeaderSize:], header); err != nil {
+		log.Debug(err)
+		return nil, InvalidPassphrase
+	}
+	return plain, nil
+}
+
+// passphraseAead derives AES-256-GCM key from passphrase
+func passphraseAead(passphrase []byte, salt []byte, iterations uint32) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(pbkdf2Sha256(passphrase, salt, iterations, SymKeySize))
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while creating AES cipher")
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2Sha256 derives a key with PBKDF2 (RFC 8018) using HMAC-SHA256.
+func pbkdf2Sha256(password []byte, salt []byte, iterations uint32, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for blockNum := uint32(1); len(key) < length; blockNum++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(blockNum >> 24), byte(blockNum >> 16), byte(blockNum >> 8), byte(blockNum)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := uint32(1); i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
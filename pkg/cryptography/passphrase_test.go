@@ -0,0 +1,56 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPbkdf2Sha256(t *testing.T) {
+	// RFC 7914 section 11 test vectors for PBKDF2-HMAC-SHA256
+	tests := []struct {
+		password   string
+		salt       string
+		iterations uint32
+		expected   string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for i, test := range tests {
+		key := pbkdf2Sha256([]byte(test.password), []byte(test.salt), test.iterations, 64)
+		if hex.EncodeToString(key) != test.expected {
+			t.Errorf("Test %d: unexpected key %x", i, key)
+		}
+	}
+}
+
+func TestEncryptDecryptWithPassphrase(t *testing.T) {
+	plain := []byte("identity backup")
+	data, err := encryptWithPassphrase(plain, []byte("correct horse"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptWithPassphrase(data, []byte("correct horse"))
+	if err != nil || !bytes.Equal(plain, decrypted) {
+		t.Error("Error in DecryptWithPassphrase: ", err)
+	}
+
+	if _, err = DecryptWithPassphrase(data, []byte("wrong horse")); err != InvalidPassphrase {
+		t.Error("Expected InvalidPassphrase, got: ", err)
+	}
+	// Every byte, including the header, is authenticated
+	for _, i := range []int{0, 4, 10, passphraseHeaderSize - 1, passphraseHeaderSize, len(data) - 1} {
+		modified := append([]byte(nil), data...)
+		modified[i] ^= 1
+		if _, err = DecryptWithPassphrase(modified, []byte("correct horse")); err != InvalidPassphrase {
+			t.Errorf("Byte %d: expected InvalidPassphrase, got: %v", i, err)
+		}
+	}
+	if _, err = DecryptWithPassphrase(data[:passphraseHeaderSize], []byte("correct horse")); err != InvalidPassphrase {
+		t.Error("Expected InvalidPassphrase, got: ", err)
+	}
+	if _, err = EncryptWithPassphrase(plain, nil); err != EmptyPassphrase {
+		t.Error("Expected EmptyPassphrase, got: ", err)
+	}
+}
@@ -0,0 +1,99 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io/ioutil"
+)
+
+// InvalidPubKey occurs when the data does not contain a supported RSA public key.
+var InvalidPubKey = errors.New("invalid public key")
+
+// ImportPubKey parses RSA public key in any of the following formats:
+//
+//	PEM "RSA PUBLIC KEY" block (PKCS #1)
+//	PEM "PUBLIC KEY" block (PKIX, SubjectPublicKeyInfo)
+//	DER encoded PKCS #1
+//	DER encoded PKIX
+//
+// Returns the parsed key and its fingerprint. The fingerprint is the SHA256 hash of
+// PKCS #1 encoded key (see PubKeyToSha256), regardless of the input format.
+// Returns InvalidPubKey if data does not contain a supported RSA public key, or the key is
+// larger than 16384 bits.
+func ImportPubKey(data []byte) (pubKey *rsa.PublicKey, fingerprint []byte, err error) {
+	der := data
+	if block, rest := pem.Decode(data); block != nil {
+		if len(bytes.TrimSpace(rest)) != 0 {
+			log.Error("Public key contains more than one PEM block")
+			return nil, nil, InvalidPubKey
+		}
+		if block.Type != "RSA PUBLIC KEY" && block.Type != "PUBLIC KEY" {
+			log.Error("Unsupported PEM block type: ", block.Type)
+			return nil, nil, InvalidPubKey
+		}
+		der = block.Bytes
+	}
+
+	if pubKey, err = x509.ParsePKCS1PublicKey(der); err != nil {
+		key, pkixErr := x509.ParsePKIXPublicKey(der)
+		if pkixErr != nil {
+			log.Debug(err)
+			log.Debug(pkixErr)
+			log.Error("Public key could not be parsed")
+			return nil, nil, InvalidPubKey
+		}
+		var ok bool
+		if pubKey, ok = key.(*rsa.PublicKey); !ok {
+			log.Error("Public key is not an RSA key")
+			return nil, nil, InvalidPubKey
+		}
+	}
+	if err = checkPubKeySize(pubKey); err != nil {
+		return nil, nil, err
+	}
+	return pubKey, PubKeyToSha256(pubKey), nil
+}
+
+// checkPubKeySize returns InvalidPubKey if pubKey is larger than rsaMaxKeyBitSize
+func checkPubKeySize(pubKey *rsa.PublicKey) (err error) {
+	if pubKey.N.BitLen() > rsaMaxKeyBitSize {
+		log.Error("Public key size ", pubKey.N.BitLen(), " exceeds ", rsaMaxKeyBitSize)
+		return InvalidPubKey
+	}
+	return nil
+}
+
+// PubKeyToPem returns pubKey as PEM block ("RSA PUBLIC KEY", PKCS #1), which is the canonical
+// format for public keys in this package.
+func PubKeyToPem(pubKey *rsa.PublicKey) *pem.Block {
+	return &pem.Block{
+		Type:    "RSA PUBLIC KEY",
+		Headers: nil,
+		Bytes:   x509.MarshalPKCS1PublicKey(pubKey),
+	}
+}
+
+// ReadPubKeyFile reads RSA public key in any format supported by ImportPubKey from fileName.
+func ReadPubKeyFile(fileName string) (pubKey *rsa.PublicKey, fingerprint []byte, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while reading public key file")
+		return nil, nil, err
+	}
+	return ImportPubKey(data)
+}
+
+// WritePubKeyFile writes pubKey to fileName in canonical PEM format with 0644 permission.
+func WritePubKeyFile(pubKey *rsa.PublicKey, fileName string) (err error) {
+	if err = ioutil.WriteFile(fileName, pem.EncodeToMemory(PubKeyToPem(pubKey)), 0644); err != nil {
+		log.Debug(err)
+		log.Error("Error while writing public key file")
+		return err
+	}
+	return nil
+}
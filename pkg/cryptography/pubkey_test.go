@@ -0,0 +1,103 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportPubKey(t *testing.T) {
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	pkcs1 := x509.MarshalPKCS1PublicKey(&privKey.PublicKey)
+	pkix, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PemToSha256(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pkcs1})
+
+	inputs := map[string][]byte{
+		"PEM PKCS #1": pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pkcs1}),
+		"PEM PKIX":    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}),
+		"DER PKCS #1": pkcs1,
+		"DER PKIX":    pkix,
+	}
+	for name, data := range inputs {
+		pubKey, fingerprint, err := ImportPubKey(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !pubKey.Equal(&privKey.PublicKey) || !bytes.Equal(fingerprint, expected) {
+			t.Errorf("%s: unexpected key or fingerprint", name)
+		}
+	}
+}
+
+func TestImportPubKeyInvalid(t *testing.T) {
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privKey.PublicKey)})
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPkix, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+
+	inputs := map[string][]byte{
+		"empty":            nil,
+		"garbage":          []byte("not a key"),
+		"private key":      pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privKey)}),
+		"multiple blocks":  append(append([]byte(nil), pkcs1...), pkcs1...),
+		"non-RSA key":      ecPkix,
+		"truncated":        pkcs1[:len(pkcs1)/2],
+		"wrong block type": bytes.Replace(pkcs1, []byte("RSA PUBLIC KEY"), []byte("CERTIFICATE"), 2),
+	}
+	for name, data := range inputs {
+		if _, _, err := ImportPubKey(data); err != InvalidPubKey {
+			t.Errorf("%s: expected InvalidPubKey, got %v", name, err)
+		}
+	}
+}
+
+func TestPubKeyFileRoundTrip(t *testing.T) {
+	privKey := openKeysHelper(t, "../testdata/keypair1")
+	pkix, _ := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	fileName := filepath.Join(t.TempDir(), "contact.pub")
+
+	// Key received from the server is DER encoded
+	if err := BytesToPemFile(pkix, fileName); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil || info.Mode().Perm() != 0644 {
+		t.Error("Unexpected public key file permissions")
+	}
+	data, _ := ioutil.ReadFile(fileName)
+	if block, _ := pem.Decode(data); block == nil || block.Type != "RSA PUBLIC KEY" {
+		t.Error("Public key file is not in canonical PEM format")
+	}
+
+	pubKey, fingerprint, err := ReadPubKeyFile(fileName)
+	if err != nil || !pubKey.Equal(&privKey.PublicKey) || !bytes.Equal(fingerprint, PubKeyToSha256(&privKey.PublicKey)) {
+		t.Error("Public key file could not be read back: ", err)
+	}
+
+	// Written file is identical to key.pub created by OpenKeys
+	pubPem, _, err := OpenKeys("../testdata/keypair1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, pem.EncodeToMemory(pubPem)) {
+		t.Error("Public key file differs from key.pub")
+	}
+
+	if err = BytesToPemFile([]byte("not a key"), fileName); err != InvalidPubKey {
+		t.Error("Expected InvalidPubKey, got: ", err)
+	}
+}
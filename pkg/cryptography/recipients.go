@@ -0,0 +1,143 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io"
+)
+
+// MaxRecipients is the maximum number of receivers in a single multi-recipient stream
+const MaxRecipients = 65535
+
+// NoRecipients occurs when EncryptMulti is called without receivers or with too many receivers.
+var NoRecipients = errors.New("invalid number of recipients")
+
+// RecipientNotFound occurs when the multi-recipient stream does not contain an entry for the receiver.
+var RecipientNotFound = errors.New("recipient not found in stream")
+
+// InvalidRecipientsBlock occurs when the recipients block is malformed.
+var InvalidRecipientsBlock = errors.New("invalid recipients block")
+
+// PubKeyToSha256 generates bytes containing sha256sum of PKCS #1 encoded pubKey.
+// The result is identical to PemToSha256 of the "RSA PUBLIC KEY" PEM block for pubKey.
+func PubKeyToSha256(pubKey *rsa.PublicKey) []byte {
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey(pubKey))
+	return hash[:]
+}
+
+// EncryptMulti encrypts file for multiple receivers and write to writer. File is encrypted
+// and read only once, and the symmetric encryption key is wrapped for each receiver.
+//
+// Stream format:
+//
+//	recipients block:
+//	    number of recipients (uint16)
+//	    for each recipient:
+//	        SHA256 hash of recipient's public key (see PubKeyToSha256)
+//	        symmetric encryption key encrypted with recipient's public key
+//	        signature of symmetric encryption key
+//	payload (see EncryptPayload)
+//
+// Sender's private key is required for signing the encrypted key.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) EncryptMulti(writer io.Writer, receiverPubKeys []*rsa.PublicKey, senderPrivKey *rsa.PrivateKey) (err error) {
+	if len(receiverPubKeys) == 0 || len(receiverPubKeys) > MaxRecipients {
+		log.Error("Number of recipients should be between 1 and ", MaxRecipients)
+		return NoRecipients
+	}
+
+	// Send number of recipients
+	if _, err = util.WriteMessage(writer, util.Uint16ToByte(uint16(len(receiverPubKeys))), nil, common.File); err != nil {
+		log.Debug(err)
+		log.Error("Error in WriteMessage while sending number of recipients")
+		return err
+	}
+
+	for _, receiverPubKey := range receiverPubKeys {
+		// Send recipient identifier
+		if _, err = util.WriteMessage(writer, PubKeyToSha256(receiverPubKey), nil, common.File); err != nil {
+			log.Debug(err)
+			log.Error("Error in WriteMessage while sending recipient key hash")
+			return err
+		}
+		// Send encrypted symmetric key and signature for this recipient
+		if err = ag.EncryptKey(writer, receiverPubKey, senderPrivKey); err != nil {
+			log.Debug(err)
+			log.Error("Error in EncryptKey")
+			return err
+		}
+	}
+
+	return ag.EncryptPayload(writer)
+}
+
+// DecryptMulti reads multi-recipient stream created by EncryptMulti from reader, finds the entry
+// for receiverPrivKey, then decrypts the file. Entries for other recipients are skipped.
+// Sender's public key is required for verifying signature.
+// Returns RecipientNotFound if the stream was not encrypted for receiverPrivKey.
+// err == nil indicates successful execution.
+func (ag *AesGcmChunk) DecryptMulti(reader io.Reader, senderPubKey *rsa.PublicKey, receiverPrivKey *rsa.PrivateKey) (err error) {
+	dataEncrypted, dataSignature, err := readRecipients(reader, PubKeyToSha256(&receiverPrivKey.PublicKey))
+	if err == nil {
+		err = ag.decryptKey(dataEncrypted, dataSignature, senderPubKey, receiverPrivKey)
+	}
+	if err != nil {
+		ag.removeTempFile()
+		return err
+	}
+	return ag.decryptPayload(reader)
+}
+
+// readRecipients reads recipients block from reader and returns the encrypted key and
+// signature for the recipient with keyHash.
+// Returns RecipientNotFound if the recipients block does not contain keyHash.
+func readRecipients(reader io.Reader, keyHash []byte) (dataEncrypted []byte, dataSignature []byte, err error) {
+	// Read number of recipients
+	countBytes, err := util.ReadMessageData(reader, common.File)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error in ReadMessageData while reading number of recipients")
+		return nil, nil, err
+	}
+	if len(countBytes) != 2 {
+		log.Error("Number of recipients should be 2 bytes long")
+		return nil, nil, InvalidRecipientsBlock
+	}
+	count := util.ByteToUint16(countBytes)
+
+	// Every entry has to be read, even after the entry is found
+	for i := uint16(0); i < count; i++ {
+		recipientHash, err := util.ReadMessageData(reader, common.File)
+		if err != nil {
+			log.Debug(err)
+			log.Error("Error in ReadMessageData while reading recipient key hash")
+			return nil, nil, err
+		}
+		encrypted, err := util.ReadMessageData(reader, common.File)
+		if err != nil {
+			log.Debug(err)
+			log.Error("Error in ReadMessageData while reading dataEncrypted")
+			return nil, nil, err
+		}
+		signature, err := util.ReadMessageData(reader, common.File)
+		if err != nil {
+			log.Debug(err)
+			log.Error("Error in ReadMessageData while reading dataSignature")
+			return nil, nil, err
+		}
+		if dataEncrypted == nil && bytes.Equal(recipientHash, keyHash) {
+			dataEncrypted, dataSignature = encrypted, signature
+		}
+	}
+	if dataEncrypted == nil {
+		log.Error("Stream does not contain entry for this recipient")
+		return nil, nil, RecipientNotFound
+	}
+	return dataEncrypted, dataSignature, nil
+}
@@ -0,0 +1,127 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openKeysHelper opens key pair in keyPath and returns private key
+func openKeysHelper(t testing.TB, keyPath string) *rsa.PrivateKey {
+	t.Helper()
+	_, privPem, err := OpenKeys(keyPath)
+	if err != nil {
+		log.Debug(err)
+		t.Fatal("Error in OpenKeys")
+	}
+	privKey, err := PemToKeys(privPem)
+	if err != nil {
+		log.Debug(err)
+		t.Fatal("Error in PemToKeys")
+	}
+	return privKey
+}
+
+func TestEncryptDecryptMulti(t *testing.T) {
+	defer func() {
+		if err := os.RemoveAll(util.DownloadPath); err != nil {
+			log.Debug(err)
+			log.Error("Existing directory not deleted, perhaps it does not exist?")
+		}
+	}()
+	testFileN := "../testdata/cat.jpg"
+	sender := openKeysHelper(t, "../testdata/keypair1")
+	receiver1 := openKeysHelper(t, "../testdata/keypair2")
+	receiver2 := openKeysHelper(t, "../testdata/keypair3")
+
+	streamEncrypt, err := EncryptSetup(testFileN)
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in EncryptSetup")
+		return
+	}
+	var stream bytes.Buffer
+	if err = streamEncrypt.EncryptMulti(&stream, []*rsa.PublicKey{&receiver1.PublicKey, &receiver2.PublicKey}, sender); err != nil {
+		log.Debug(err)
+		t.Error("Error in EncryptMulti")
+		return
+	}
+
+	expected, err := ioutil.ReadFile(testFileN)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, receiver := range []*rsa.PrivateKey{receiver1, receiver2} {
+		streamDecrypt, err := DecryptSetup()
+		if err != nil {
+			log.Debug(err)
+			t.Error("Error in DecryptSetup")
+			return
+		}
+		if err = streamDecrypt.DecryptMulti(bytes.NewReader(stream.Bytes()), &sender.PublicKey, receiver); err != nil {
+			log.Debug(err)
+			t.Error("Error in DecryptMulti")
+			return
+		}
+		received, err := ioutil.ReadFile(filepath.Join(util.DownloadPath, "cat.jpg"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(expected, received) {
+			t.Error("Decrypted file mismatch")
+			return
+		}
+	}
+
+	// Sender is not one of the recipients
+	streamDecrypt, err := DecryptSetup()
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in DecryptSetup")
+		return
+	}
+	if err = streamDecrypt.DecryptMulti(bytes.NewReader(stream.Bytes()), &sender.PublicKey, sender); err != RecipientNotFound {
+		t.Error("Expected RecipientNotFound, got: ", err)
+		return
+	}
+}
+
+func TestEncryptMultiNoRecipients(t *testing.T) {
+	sender := openKeysHelper(t, "../testdata/keypair1")
+	streamEncrypt, err := EncryptSetup("../testdata/checksum.txt")
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in EncryptSetup")
+		return
+	}
+	var stream bytes.Buffer
+	if err = streamEncrypt.EncryptMulti(&stream, nil, sender); err != NoRecipients {
+		t.Error("Expected NoRecipients, got: ", err)
+		return
+	}
+}
+
+func TestPubKeyToSha256(t *testing.T) {
+	pubPem, privPem, err := OpenKeys("../testdata/keypair1")
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in OpenKeys")
+		return
+	}
+	privKey, err := PemToKeys(privPem)
+	if err != nil {
+		log.Debug(err)
+		t.Error("Error in PemToKeys")
+		return
+	}
+	if !bytes.Equal(PubKeyToSha256(&privKey.PublicKey), PemToSha256(pubPem)) {
+		t.Error("PubKeyToSha256 does not match PemToSha256")
+	}
+}
@@ -0,0 +1,234 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// handoverVersion is the first byte of encoded KeyHandover
+	handoverVersion = 1
+	// handoverContext is prepended to the signed handover message
+	handoverContext = "coconut key handover"
+	// archiveDir is a directory under the key path where rotated keys are stored
+	archiveDir = "archive"
+)
+
+// InvalidHandover occurs when the encoded key handover is malformed.
+var InvalidHandover = errors.New("invalid key handover")
+
+// InvalidHandoverSignature occurs when the new public key was not signed by the old private key.
+var InvalidHandoverSignature = errors.New("invalid key handover signature")
+
+// KeyHandover announces the successor of a rotated key pair. The new public key is
+// signed with the old private key, so that contacts who trust the old key can
+// accept the new key without verifying the fingerprint again.
+type KeyHandover struct {
+	// OldPubKey is the PKCS #1 DER encoded public key being replaced
+	OldPubKey []byte
+	// NewPubKey is the PKCS #1 DER encoded successor public key
+	NewPubKey []byte
+	// Signature is the RSA-PSS signature of OldPubKey and NewPubKey, created with the old private key
+	Signature []byte
+}
+
+// SignHandover creates KeyHandover for newPubKey signed with oldPrivKey.
+func SignHandover(oldPrivKey *rsa.PrivateKey, newPubKey *rsa.PublicKey) (handover *KeyHandover, err error) {
+	handover = &KeyHandover{
+		OldPubKey: x509.MarshalPKCS1PublicKey(&oldPrivKey.PublicKey),
+		NewPubKey: x509.MarshalPKCS1PublicKey(newPubKey),
+		Signature: nil,
+	}
+	hashed := handover.hash()
+	if handover.Signature, err = rsa.SignPSS(rand.Reader, oldPrivKey, crypto.SHA256, hashed[:], nil); err != nil {
+		log.Debug(err)
+		log.Error("Error while signing key handover")
+		return nil, err
+	}
+	return handover, nil
+}
+
+// hash returns SHA256 hash of the signed handover message
+func (handover *KeyHandover) hash() [sha256.Size]byte {
+	return sha256.Sum256(handoverMessage(handoverContext, handover.OldPubKey, handover.NewPubKey))
+}
+
+// handoverMessage returns context followed by length-prefixed parts
+func handoverMessage(context string, parts ...[]byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(context)
+	for _, part := range parts {
+		buffer.Write(util.Uint16ToByte(uint16(len(part))))
+		buffer.Write(part)
+	}
+	return buffer.Bytes()
+}
+
+// Verify verifies that the new public key was signed by the old key,
+// then returns both keys.
+// Returns InvalidHandover if either key cannot be parsed, InvalidHandoverSignature if
+// the signature is invalid.
+func (handover *KeyHandover) Verify() (oldPubKey *rsa.PublicKey, newPubKey *rsa.PublicKey, err error) {
+	if oldPubKey, err = x509.ParsePKCS1PublicKey(handover.OldPubKey); err != nil {
+		log.Debug(err)
+		return nil, nil, InvalidHandover
+	}
+	if newPubKey, err = x509.ParsePKCS1PublicKey(handover.NewPubKey); err != nil {
+		log.Debug(err)
+		return nil, nil, InvalidHandover
+	}
+	if checkPubKeySize(oldPubKey) != nil || checkPubKeySize(newPubKey) != nil {
+		return nil, nil, InvalidHandover
+	}
+	if bytes.Equal(handover.OldPubKey, handover.NewPubKey) {
+		log.Error("Key handover does not change the key")
+		return nil, nil, InvalidHandover
+	}
+	hashed := handover.hash()
+	if err = rsa.VerifyPSS(oldPubKey, crypto.SHA256, hashed[:], handover.Signature, nil); err != nil {
+		log.Debug(err)
+		log.Error("Invalid key handover signature")
+		return nil, nil, InvalidHandoverSignature
+	}
+	return oldPubKey, newPubKey, nil
+}
+
+// MarshalBinary encodes handover.
+//
+// Format:
+//
+//	1 byte:  version
+//	for old public key, new public key and signature:
+//	    2 bytes: length (uint16)
+//	    data
+func (handover *KeyHandover) MarshalBinary() (data []byte, err error) {
+	return append([]byte{handoverVersion}, handoverMessage("", handover.OldPubKey, handover.NewPubKey, handover.Signature)...), nil
+}
+
+// UnmarshalBinary decodes data created by MarshalBinary into handover.
+// Signature is not verified; call Verify before trusting the new key.
+func (handover *KeyHandover) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 1 || data[0] != handoverVersion {
+		return InvalidHandover
+	}
+	data = data[1:]
+	fields := make([][]byte, 3)
+	for i := range fields {
+		if len(data) < 2 || len(data) < 2+int(util.ByteToUint16(data)) {
+			return InvalidHandover
+		}
+		size := 2 + int(util.ByteToUint16(data))
+		fields[i] = append([]byte(nil), data[2:size]...)
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		return InvalidHandover
+	}
+	handover.OldPubKey, handover.NewPubKey, handover.Signature = fields[0], fields[1], fields[2]
+	return nil
+}
+
+// RotateKeys replaces existing keys in keyPath with a new key pair. See KeyStore.Rotate.
+func RotateKeys(keyPath string) (handover *KeyHandover, pubBlock *pem.Block, privBlock *pem.Block, err error) {
+	return NewKeyStore(keyPath).Rotate()
+}
+
+// Rotate replaces existing keys with a new key pair. Old keys are archived (see Replace).
+// Returns KeyHandover that announces the new public key, and new keys as *pem.Block.
+func (ks *KeyStore) Rotate() (handover *KeyHandover, pubBlock *pem.Block, privBlock *pem.Block, err error) {
+	// Existing keys are required for signing the handover
+	_, oldPrivBlock, err := ks.Load()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	oldPrivKey, err := PemToKeys(oldPrivBlock)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := createRSAKey(ks.bitSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if handover, err = SignHandover(oldPrivKey, &key.PublicKey); err != nil {
+		return nil, nil, nil, err
+	}
+
+	pubBlock = &pem.Block{
+		Type:    "RSA PUBLIC KEY",
+		Headers: nil,
+		Bytes:   x509.MarshalPKCS1PublicKey(&key.PublicKey),
+	}
+	privBlock = &pem.Block{
+		Type:    "RSA PRIVATE KEY",
+		Headers: nil,
+		Bytes:   x509.MarshalPKCS1PrivateKey(key),
+	}
+	if err = ks.Replace(pubBlock, privBlock); err != nil {
+		return nil, nil, nil, err
+	}
+	return handover, pubBlock, privBlock, nil
+}
+
+// Replace replaces existing keys with pubBlock and privBlock. Existing keys are archived under
+// the archive directory, named after the fingerprint of the old public key. The old private key
+// is archived in the same KeyStorage as the current private key.
+// Returns *KeyError wrapping KeyMismatch if pubBlock does not belong to privBlock.
+func (ks *KeyStore) Replace(pubBlock *pem.Block, privBlock *pem.Block) (err error) {
+	privKey, err := PemToKeys(privBlock)
+	if err != nil {
+		return &KeyError{FileName: ks.storage.Location(privKeyFileName), Err: KeyCorrupt}
+	}
+	if !bytes.Equal(pubBlock.Bytes, x509.MarshalPKCS1PublicKey(&privKey.PublicKey)) {
+		log.Error("Public key does not match private key")
+		return &KeyError{FileName: ks.pubFileN, Err: KeyMismatch}
+	}
+
+	oldPubBlock, oldPrivBlock, err := ks.Load()
+	if err == nil {
+		if err = ks.archive(oldPubBlock, oldPrivBlock); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, KeyMissing) {
+		return err
+	}
+
+	if err = ks.storage.Store(privKeyFileName, privBlock); err != nil {
+		return err
+	}
+	_, err = ks.writePubKey(privKey)
+	return err
+}
+
+// archive moves existing keys to the archive directory
+func (ks *KeyStore) archive(pubBlock *pem.Block, privBlock *pem.Block) (err error) {
+	archiveName := archiveDir + "/" + hex.EncodeToString(PemToSha256(pubBlock))
+	if err = ks.storage.Store(archiveName+".priv", privBlock); err != nil && !errors.Is(err, os.ErrExist) {
+		log.Debug(err)
+		log.Error("Error while archiving private key")
+		return err
+	}
+	archivePubFileN := filepath.Join(filepath.Dir(ks.pubFileN), filepath.FromSlash(archiveName)+".pub")
+	if err = os.MkdirAll(filepath.Dir(archivePubFileN), 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating key archive directory")
+		return err
+	}
+	if err = os.Rename(ks.pubFileN, archivePubFileN); err != nil {
+		log.Debug(err)
+		log.Error("Error while archiving public key")
+		return err
+	}
+	return ks.storage.Delete(privKeyFileName)
+}
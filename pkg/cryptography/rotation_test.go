@@ -0,0 +1,145 @@
+package cryptography
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyKeysHelper copies key pair in keyPath to a temporary directory
+func copyKeysHelper(t *testing.T, keyPath string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"key.pub", "key.priv"} {
+		data, err := ioutil.ReadFile(filepath.Join(keyPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRotateKeys(t *testing.T) {
+	keyPath := copyKeysHelper(t, "../testdata/keypair1")
+	oldPubBlock, _, err := OpenKeys(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := NewKeyStore(keyPath)
+	ks.bitSize = 1024
+	handover, pubBlock, privBlock, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(handover.OldPubKey, oldPubBlock.Bytes) || !bytes.Equal(handover.NewPubKey, pubBlock.Bytes) {
+		t.Error("Handover does not contain old and new public keys")
+	}
+	if _, _, err = handover.Verify(); err != nil {
+		t.Error("Expected valid handover, got: ", err)
+	}
+
+	// New keys are used by OpenKeys
+	newPubBlock, newPrivBlock, err := OpenKeys(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newPubBlock.Bytes, pubBlock.Bytes) || !bytes.Equal(newPrivBlock.Bytes, privBlock.Bytes) {
+		t.Error("OpenKeys did not return rotated keys")
+	}
+	if info, err := os.Stat(filepath.Join(keyPath, "key.priv")); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Unexpected private key permissions")
+	}
+
+	// Old keys are archived
+	name := filepath.Join(keyPath, archiveDir, hex.EncodeToString(PemToSha256(oldPubBlock)))
+	for _, ext := range []string{".pub", ".priv"} {
+		if _, err = os.Stat(name + ext); err != nil {
+			t.Error("Old key was not archived: ", err)
+		}
+	}
+}
+
+func TestRotateKeysMissing(t *testing.T) {
+	keyPath := t.TempDir()
+	if _, _, _, err := RotateKeys(keyPath); !errors.Is(err, KeyMissing) {
+		t.Error("Expected KeyMissing, got: ", err)
+	}
+	if _, err := os.Stat(filepath.Join(keyPath, "key.pub")); !os.IsNotExist(err) {
+		t.Error("Keys should not be created")
+	}
+}
+
+func TestKeyHandoverMarshal(t *testing.T) {
+	oldKey := openKeysHelper(t, "../testdata/keypair1")
+	newKey := openKeysHelper(t, "../testdata/keypair2")
+	handover, err := SignHandover(oldKey, &newKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := handover.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded KeyHandover
+	if err = decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	_, newPubKey, err := decoded.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x509.MarshalPKCS1PublicKey(newPubKey), x509.MarshalPKCS1PublicKey(&newKey.PublicKey)) {
+		t.Error("Decoded handover contains different key")
+	}
+
+	// Truncated or extended data
+	for _, invalid := range [][]byte{nil, data[:1], data[:len(data)-1], append(data, 0), append([]byte{2}, data[1:]...)} {
+		if err = decoded.UnmarshalBinary(invalid); err != InvalidHandover {
+			t.Error("Expected InvalidHandover, got: ", err)
+		}
+	}
+}
+
+func TestKeyHandoverForged(t *testing.T) {
+	oldKey := openKeysHelper(t, "../testdata/keypair1")
+	newKey := openKeysHelper(t, "../testdata/keypair2")
+	attackerKey := openKeysHelper(t, "../testdata/keypair3")
+
+	// Handover signed by someone other than the owner of the old key
+	forged, err := SignHandover(attackerKey, &attackerKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.OldPubKey = x509.MarshalPKCS1PublicKey(&oldKey.PublicKey)
+	if _, _, err = forged.Verify(); err != InvalidHandoverSignature {
+		t.Error("Expected InvalidHandoverSignature, got: ", err)
+	}
+
+	// Valid handover with replaced successor
+	handover, err := SignHandover(oldKey, &newKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handover.NewPubKey = x509.MarshalPKCS1PublicKey(&attackerKey.PublicKey)
+	if _, _, err = handover.Verify(); err != InvalidHandoverSignature {
+		t.Error("Expected InvalidHandoverSignature, got: ", err)
+	}
+
+	// Successor identical to the old key
+	handover, err = SignHandover(oldKey, &oldKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = handover.Verify(); err != InvalidHandover {
+		t.Error("Expected InvalidHandover, got: ", err)
+	}
+}
@@ -9,13 +9,16 @@ import (
 	"encoding/pem"
 	"errors"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 )
 
 const (
 	rsaKeyBitSize = 4096
+	// rsaMaxKeyBitSize is the largest RSA key accepted from other peers. Operations on larger
+	// keys are slow enough to be abused for denial of service.
+	rsaMaxKeyBitSize = 16384
+	// rsaMaxPrivKeySize is the largest DER encoded private key parsed by PemToKeys, which is
+	// large enough for a private key of rsaMaxKeyBitSize bits.
+	rsaMaxPrivKeySize = rsaMaxKeyBitSize / 8 * 5
 )
 
 var NoPemBlock = errors.New("[]byte does not contain public pem block")
@@ -31,136 +34,21 @@ func createRSAKey(bitSize int) (privKey *rsa.PrivateKey, err error) {
 	return privKey, nil
 }
 
-// OpenKeys open existing keys and return them as *pem.Block.
-// If keys are not found, new keys will be created.
+// OpenKeys open existing keys in keyPath and return them as *pem.Block.
+// If keys are not found, new keys will be created. See KeyStore.Open.
 func OpenKeys(keyPath string) (pubBlock *pem.Block, privBlock *pem.Block, err error) {
-	pubFileN := filepath.Join(keyPath, "key.pub")
-	privFileN := filepath.Join(keyPath, "key.priv")
-
-	// Check if keys already exist
-	if _, err := os.Stat(pubFileN); !os.IsNotExist(err) {
-
-		// Read existing pubkey file
-		pubFileBytes, err := ioutil.ReadFile(pubFileN)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while opening RSA pubkey in OpenKeys")
-			return nil, nil, err
-		}
-		// Decode file and create block
-		pubBlock, _ = pem.Decode(pubFileBytes)
-		if pubBlock == nil {
-			log.Error("Error while decoding pubkey file")
-			return nil, nil, err
-		}
-
-		// Read existing privkey file
-		privFileBytes, err := ioutil.ReadFile(privFileN)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while opening RSA privfile in OpenKeys")
-			return nil, nil, err
-		}
-		// Decode file and create block
-		privBlock, _ = pem.Decode(privFileBytes)
-		if privBlock == nil {
-			log.Error("Error while decoding priv file")
-			return nil, nil, err
-		}
-	} else if os.IsNotExist(err) {
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(keyPath, os.ModePerm); err != nil {
-			log.Debug(err)
-			log.Error("Error while creating key directory")
-			return nil, nil, err
-		}
-		// Create new RSA key pair
-		key, err := createRSAKey(rsaKeyBitSize)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while creating RSA key in OpenKeys")
-			return nil, nil, err
-		}
-		// Open pubkey file
-		pubOut, err := os.Create(pubFileN)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while creating pubkey file")
-			return nil, nil, err
-		}
-		// Close pubkey file when done
-		defer func() {
-			if errDef := pubOut.Close(); errDef != nil {
-				log.Error(err)
-				log.Error("Error while closing pubkey file")
-				err = errDef
-				return
-			}
-			if errDef := os.Chmod(pubFileN, 0644); errDef != nil {
-				log.Debug(errDef)
-				log.Error("Error while updating pubkey file permissions")
-				err = errDef
-				return
-			}
-		}()
-		// Create PEM block
-		pubBlock = &pem.Block{
-			Type:    "RSA PUBLIC KEY",
-			Headers: nil,
-			Bytes:   x509.MarshalPKCS1PublicKey(&key.PublicKey),
-		}
-		// Write PEM block to pubkey file
-		if err := pem.Encode(pubOut, pubBlock); err != nil {
-			log.Debug(err)
-			log.Error("Error while writing to pubkey file")
-			return nil, nil, err
-		}
-
-		// Create privkey file
-		privOut, err := os.OpenFile(privFileN, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-		if err != nil {
-			log.Debug(err)
-			log.Error("Error while creating private key in OpenKeys")
-			return nil, nil, err
-		}
-		// Close privkey file when done
-		defer func() {
-			if errDef := privOut.Close(); errDef != nil {
-				log.Debug(errDef)
-				log.Error("Error while closing private key file")
-				err = errDef
-				return
-			}
-			if errDef := os.Chmod(privFileN, 0600); errDef != nil {
-				log.Debug(errDef)
-				log.Error("Error while updating permissions")
-				err = errDef
-				return
-			}
-		}()
-		// Create PEM block
-		privBlock = &pem.Block{
-			Type:    "RSA PRIVATE KEY",
-			Headers: nil,
-			Bytes:   x509.MarshalPKCS1PrivateKey(key),
-		}
-		// Write PEM block to privkey file
-		if err := pem.Encode(privOut, privBlock); err != nil {
-			log.Debug(err)
-			log.Error("Error while encoding private key")
-			return nil, nil, err
-		}
-	} else {
-		log.Debug(err)
-		log.Error("Error while checking stat of the file")
-	}
-	return pubBlock, privBlock, err
+	return NewKeyStore(keyPath).Open()
 }
 
 // PemToKeys convert private PEM block to rsa.PrivateKey struct.
 // *rsa.PrivateKey contains public key as well, so access public key
 // with key.PublicKey
+// Returns KeyCorrupt if privBlock is nil or too large.
 func PemToKeys(privBlock *pem.Block) (privKey *rsa.PrivateKey, err error) {
+	if privBlock == nil || len(privBlock.Bytes) > rsaMaxPrivKeySize {
+		log.Error("Private key PEM block is empty or too large")
+		return nil, KeyCorrupt
+	}
 	if privKey, err = x509.ParsePKCS1PrivateKey(privBlock.Bytes); err != nil {
 		log.Debug(err)
 		log.Error("Error while converting PEM block to keys")
@@ -176,16 +64,15 @@ func PemToSha256(pubBlock *pem.Block) []byte {
 	return hash[:]
 }
 
-// BytesToPemFile writes pemBytes to fileName in PEM block format.
+// BytesToPemFile writes RSA public key in pemBytes to fileName in canonical PEM format.
+// pemBytes can be in any format supported by ImportPubKey.
+// Returns InvalidPubKey if pemBytes does not contain a supported RSA public key.
 func BytesToPemFile(pemBytes []byte, fileName string) (err error) {
-	block, _ := pem.Decode(pemBytes)
-	if block == nil || block.Type != "RSA PUBLIC KEY" {
-		return NoPemBlock
-	}
-	if err = os.WriteFile(fileName, block.Bytes, 0x600); err != nil {
+	pubKey, _, err := ImportPubKey(pemBytes)
+	if err != nil {
 		return err
 	}
-	return nil
+	return WritePubKeyFile(pubKey, fileName)
 }
 
 // EncryptSignMsg encrypts key for symmetric encryption with receiver's pubic key,
@@ -7,14 +7,9 @@ import (
 	"fmt"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
 	"github.com/jaeha-choi/Proj_Coconut_Utility/util"
-	"os"
 	"testing"
 )
 
-func init() {
-	log.Init(os.Stdout, log.DEBUG)
-}
-
 func TestCreateRSAKey(t *testing.T) {
 	//t.Cleanup(func() {
 	//	pubFileN := "key.pub"
@@ -0,0 +1,272 @@
+package cryptography
+
+import (
+	"encoding/pem"
+	"errors"
+	"github.com/godbus/dbus/v5"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+)
+
+const (
+	// secretServiceName is the D-Bus name of the freedesktop Secret Service
+	secretServiceName = "org.freedesktop.secrets"
+	// secretServicePath is the object path of the Secret Service
+	secretServicePath = dbus.ObjectPath("/org/freedesktop/secrets")
+	// secretDefaultCollection is the object path of the default collection (usually "login" keyring)
+	secretDefaultCollection = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+	// secretApplication is stored as "application" attribute of every item created by this package
+	secretApplication = "coconut"
+)
+
+// SecretServiceUnavailable occurs when the Secret Service cannot be reached through D-Bus.
+var SecretServiceUnavailable = errors.New("secret service is not available")
+
+// SecretServiceDismissed occurs when the user dismissed the prompt for unlocking the keyring.
+var SecretServiceDismissed = errors.New("secret service prompt was dismissed")
+
+// secretServiceSecret is the Secret structure defined in the Secret Service API
+type secretServiceSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// SecretServiceStorage stores private keys in the freedesktop Secret Service
+// (e.g. GNOME Keyring, KWallet) through the D-Bus session bus.
+// Items are identified by "application", "id" and "name" attributes.
+type SecretServiceStorage struct {
+	// id distinguishes keys of different clients on the same desktop session (e.g. key path)
+	id string
+}
+
+// NewSecretServiceStorage returns SecretServiceStorage for keys of the client with id.
+func NewSecretServiceStorage(id string) *SecretServiceStorage {
+	return &SecretServiceStorage{id: id}
+}
+
+// secretServiceSession is an open connection and Secret Service session
+type secretServiceSession struct {
+	conn    *dbus.Conn
+	service dbus.BusObject
+	path    dbus.ObjectPath
+}
+
+// open connects to the session bus and opens Secret Service session.
+// Secrets are transferred without encryption ("plain" algorithm), since the session bus
+// is only accessible by the current user.
+func (ss *SecretServiceStorage) open() (session *secretServiceSession, err error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while connecting to D-Bus session bus")
+		return nil, SecretServiceUnavailable
+	}
+	session = &secretServiceSession{conn: conn, service: conn.Object(secretServiceName, secretServicePath)}
+
+	var output dbus.Variant
+	err = session.service.Call("org.freedesktop.Secret.Service.OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&output, &session.path)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while opening Secret Service session")
+		_ = conn.Close()
+		return nil, SecretServiceUnavailable
+	}
+	return session, nil
+}
+
+// close closes the session and the connection
+func (session *secretServiceSession) close() {
+	if err := session.conn.Object(secretServiceName, session.path).
+		Call("org.freedesktop.Secret.Session.Close", 0).Err; err != nil {
+		log.Debug(err)
+	}
+	if err := session.conn.Close(); err != nil {
+		log.Debug(err)
+	}
+}
+
+// attributes returns lookup attributes for the key with name
+func (ss *SecretServiceStorage) attributes(name string) map[string]string {
+	return map[string]string{
+		"application": secretApplication,
+		"id":          ss.id,
+		"name":        name,
+	}
+}
+
+// search returns the unlocked item for the key with name. Locked items are unlocked first.
+// Returns empty path if the item does not exist.
+func (ss *SecretServiceStorage) search(session *secretServiceSession, name string) (item dbus.ObjectPath, err error) {
+	var unlocked, locked []dbus.ObjectPath
+	err = session.service.Call("org.freedesktop.Secret.Service.SearchItems", 0, ss.attributes(name)).
+		Store(&unlocked, &locked)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while searching Secret Service items")
+		return "", err
+	}
+	if len(unlocked) > 0 {
+		return unlocked[0], nil
+	}
+	if len(locked) == 0 {
+		return "", nil
+	}
+	if err = session.unlock(locked[0]); err != nil {
+		return "", err
+	}
+	return locked[0], nil
+}
+
+// unlock unlocks object, prompting the user if required
+func (session *secretServiceSession) unlock(object dbus.ObjectPath) (err error) {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err = session.service.Call("org.freedesktop.Secret.Service.Unlock", 0, []dbus.ObjectPath{object}).
+		Store(&unlocked, &prompt)
+	if err != nil {
+		log.Debug(err)
+		log.Error("Error while unlocking Secret Service item")
+		return err
+	}
+	return session.prompt(prompt)
+}
+
+// prompt shows prompt to the user and waits until it is completed. No-op if prompt is "/".
+func (session *secretServiceSession) prompt(prompt dbus.ObjectPath) (err error) {
+	if prompt == "/" || prompt == "" {
+		return nil
+	}
+	if err = session.conn.AddMatchSignal(dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface("org.freedesktop.Secret.Prompt")); err != nil {
+		log.Debug(err)
+		return err
+	}
+	signals := make(chan *dbus.Signal, 1)
+	session.conn.Signal(signals)
+	defer session.conn.RemoveSignal(signals)
+
+	if err = session.conn.Object(secretServiceName, prompt).
+		Call("org.freedesktop.Secret.Prompt.Prompt", 0, "").Err; err != nil {
+		log.Debug(err)
+		return err
+	}
+	for signal := range signals {
+		if signal.Path != prompt || signal.Name != "org.freedesktop.Secret.Prompt.Completed" {
+			continue
+		}
+		if len(signal.Body) > 0 {
+			if dismissed, ok := signal.Body[0].(bool); ok && dismissed {
+				return SecretServiceDismissed
+			}
+		}
+		return nil
+	}
+	return SecretServiceUnavailable
+}
+
+// Load returns the key with name
+func (ss *SecretServiceStorage) Load(name string) (block *pem.Block, err error) {
+	session, err := ss.open()
+	if err != nil {
+		return nil, &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	defer session.close()
+
+	item, err := ss.search(session, name)
+	if err != nil {
+		return nil, &KeyError{FileName: ss.Location(name), Err: err}
+	} else if item == "" {
+		return nil, &KeyError{FileName: ss.Location(name), Err: KeyMissing}
+	}
+
+	var secret secretServiceSecret
+	if err = session.conn.Object(secretServiceName, item).
+		Call("org.freedesktop.Secret.Item.GetSecret", 0, session.path).Store(&secret); err != nil {
+		log.Debug(err)
+		log.Error("Error while reading secret")
+		return nil, &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	block, rest := pem.Decode(secret.Value)
+	if block == nil || len(rest) != 0 {
+		log.Error("Error while decoding secret")
+		return nil, &KeyError{FileName: ss.Location(name), Err: KeyCorrupt}
+	}
+	return block, nil
+}
+
+// Store saves block as a new item in the default collection
+func (ss *SecretServiceStorage) Store(name string, block *pem.Block) (err error) {
+	session, err := ss.open()
+	if err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	defer session.close()
+
+	item, err := ss.search(session, name)
+	if err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	} else if item != "" {
+		return &KeyError{FileName: ss.Location(name), Err: os.ErrExist}
+	}
+	if err = session.unlock(secretDefaultCollection); err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+
+	properties := map[string]dbus.Variant{
+		"org.freedesktop.Secret.Item.Label":      dbus.MakeVariant("Coconut private key (" + name + ")"),
+		"org.freedesktop.Secret.Item.Attributes": dbus.MakeVariant(ss.attributes(name)),
+	}
+	secret := secretServiceSecret{
+		Session:     session.path,
+		Parameters:  []byte{},
+		Value:       pem.EncodeToMemory(block),
+		ContentType: "application/x-pem-file",
+	}
+	var prompt dbus.ObjectPath
+	if err = session.conn.Object(secretServiceName, secretDefaultCollection).
+		Call("org.freedesktop.Secret.Collection.CreateItem", 0, properties, secret, false).
+		Store(&item, &prompt); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating secret")
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	if err = session.prompt(prompt); err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	return nil
+}
+
+// Delete removes the item for the key with name
+func (ss *SecretServiceStorage) Delete(name string) (err error) {
+	session, err := ss.open()
+	if err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	defer session.close()
+
+	item, err := ss.search(session, name)
+	if err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	} else if item == "" {
+		return &KeyError{FileName: ss.Location(name), Err: KeyMissing}
+	}
+	var prompt dbus.ObjectPath
+	if err = session.conn.Object(secretServiceName, item).
+		Call("org.freedesktop.Secret.Item.Delete", 0).Store(&prompt); err != nil {
+		log.Debug(err)
+		log.Error("Error while deleting secret")
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	if err = session.prompt(prompt); err != nil {
+		return &KeyError{FileName: ss.Location(name), Err: err}
+	}
+	return nil
+}
+
+// Location returns "secret-service:" followed by id and name
+func (ss *SecretServiceStorage) Location(name string) string {
+	return "secret-service:" + ss.id + "/" + name
+}
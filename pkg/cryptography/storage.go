@@ -0,0 +1,114 @@
+package cryptography
+
+import (
+	"encoding/pem"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"os"
+	"path/filepath"
+)
+
+// KeyStorage stores private keys. Keys are identified by name, such as "key.priv".
+// Names may contain slashes, which are used for archived keys (e.g. "archive/<fingerprint>.priv").
+type KeyStorage interface {
+	// Load returns the key with name. Returns *KeyError wrapping KeyMissing if the key does not exist.
+	Load(name string) (block *pem.Block, err error)
+	// Store saves block as name. Returns *KeyError wrapping os.ErrExist if the key already exists.
+	Store(name string, block *pem.Block) (err error)
+	// Delete removes the key with name. Returns *KeyError wrapping KeyMissing if the key does not exist.
+	Delete(name string) (err error)
+	// Location returns a human readable location of the key with name, used in errors.
+	Location(name string) string
+}
+
+// FileStorage stores private keys as PEM files in a directory, only readable by the owner.
+type FileStorage struct {
+	keyPath string
+}
+
+// NewFileStorage returns FileStorage for keys in keyPath
+func NewFileStorage(keyPath string) *FileStorage {
+	return &FileStorage{keyPath: keyPath}
+}
+
+// Load reads the key file. Returns *KeyError wrapping KeyPermission if the file is accessible by other users.
+func (fs *FileStorage) Load(name string) (block *pem.Block, err error) {
+	if err = checkPrivKeyPermission(fs.Location(name)); err != nil {
+		return nil, err
+	}
+	return readPemFile(fs.Location(name), "RSA PRIVATE KEY")
+}
+
+// Store writes block to the key file with 0600 permission
+func (fs *FileStorage) Store(name string, block *pem.Block) (err error) {
+	fileN := fs.Location(name)
+	if err = os.MkdirAll(filepath.Dir(fileN), 0700); err != nil {
+		log.Debug(err)
+		log.Error("Error while creating key directory")
+		return &KeyError{FileName: fileN, Err: err}
+	}
+	if err = writeNewFile(fileN, pem.EncodeToMemory(block), 0600); err != nil {
+		log.Debug(err)
+		log.Error("Error while writing private key")
+		return &KeyError{FileName: fileN, Err: err}
+	}
+	return nil
+}
+
+// writeNewFile writes data to fileName with perm. Returns error if fileName already exists.
+func writeNewFile(fileName string, data []byte, perm os.FileMode) (err error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Delete removes the key file
+func (fs *FileStorage) Delete(name string) (err error) {
+	if err = os.Remove(fs.Location(name)); os.IsNotExist(err) {
+		return &KeyError{FileName: fs.Location(name), Err: KeyMissing}
+	} else if err != nil {
+		log.Debug(err)
+		log.Error("Error while removing private key")
+		return &KeyError{FileName: fs.Location(name), Err: err}
+	}
+	return nil
+}
+
+// Location returns the path to the key file
+func (fs *FileStorage) Location(name string) string {
+	return filepath.Join(fs.keyPath, filepath.FromSlash(name))
+}
+
+// MigrateKey moves the key with name from src to dst. The key is removed from src
+// only after it was read back from dst.
+// Returns *KeyError wrapping KeyMissing if src does not contain the key, or os.ErrExist if
+// dst already contains the key.
+func MigrateKey(src KeyStorage, dst KeyStorage, name string) (err error) {
+	block, err := src.Load(name)
+	if err != nil {
+		return err
+	}
+	if err = dst.Store(name, block); err != nil {
+		return err
+	}
+	stored, err := dst.Load(name)
+	if err != nil {
+		return err
+	}
+	if string(stored.Bytes) != string(block.Bytes) {
+		log.Error("Migrated key does not match the original key")
+		return &KeyError{FileName: dst.Location(name), Err: KeyCorrupt}
+	}
+	log.Info("Moved private key from ", src.Location(name), " to ", dst.Location(name))
+	return src.Delete(name)
+}
+
+// MigratePrivKey moves the private key of this client from src to dst. See MigrateKey.
+func MigratePrivKey(src KeyStorage, dst KeyStorage) (err error) {
+	return MigrateKey(src, dst, privKeyFileName)
+}
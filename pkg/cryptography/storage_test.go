@@ -0,0 +1,138 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestKeyStoreMemoryStorage(t *testing.T) {
+	keyPath := t.TempDir()
+	storage := newMemoryStorage()
+	ks := NewKeyStoreWithStorage(keyPath, storage)
+	ks.bitSize = 1024
+
+	pubBlock, privBlock, err := ks.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Private key should not be written to the key path
+	if _, err = os.Stat(filepath.Join(keyPath, "key.priv")); !os.IsNotExist(err) {
+		t.Error("Private key was written to a file")
+	}
+	stored, err := storage.Load("key.priv")
+	if err != nil || !bytes.Equal(stored.Bytes, privBlock.Bytes) {
+		t.Error("Private key was not stored: ", err)
+	}
+
+	// Rotation archives the old private key in the same storage
+	if _, _, _, err = ks.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	archived, err := storage.Load("archive/" + hex.EncodeToString(PemToSha256(pubBlock)) + ".priv")
+	if err != nil || !bytes.Equal(archived.Bytes, privBlock.Bytes) {
+		t.Error("Old private key was not archived: ", err)
+	}
+	if _, _, err = ks.Load(); err != nil {
+		t.Error("Rotated keys could not be loaded: ", err)
+	}
+}
+
+func TestMigrateKey(t *testing.T) {
+	keyPath := t.TempDir()
+	ks := NewKeyStore(keyPath)
+	ks.bitSize = 1024
+	_, privBlock, err := ks.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewFileStorage(keyPath)
+	dst := newMemoryStorage()
+	if err = MigrateKey(src, dst, "key.priv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(keyPath, "key.priv")); !os.IsNotExist(err) {
+		t.Error("Private key file was not removed")
+	}
+	if _, _, err = NewKeyStoreWithStorage(keyPath, dst).Load(); err != nil {
+		t.Error("Migrated keys could not be loaded: ", err)
+	}
+
+	// Nothing left to migrate
+	if err = MigrateKey(src, dst, "key.priv"); !errors.Is(err, KeyMissing) {
+		t.Error("Expected KeyMissing, got: ", err)
+	}
+	// Existing key in destination is never overwritten
+	if err = src.Store("key.priv", privBlock); err != nil {
+		t.Fatal(err)
+	}
+	if err = MigrateKey(src, dst, "key.priv"); !errors.Is(err, os.ErrExist) {
+		t.Error("Expected os.ErrExist, got: ", err)
+	}
+	if _, err = src.Load("key.priv"); err != nil {
+		t.Error("Source key should be kept if migration fails")
+	}
+}
+
+func TestSecretServiceUnavailable(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "missing"))
+	storage := NewSecretServiceStorage("test")
+	if _, err := storage.Load("key.priv"); !errors.Is(err, SecretServiceUnavailable) {
+		t.Error("Expected SecretServiceUnavailable, got: ", err)
+	}
+}
+
+// memoryStorage stores private keys in memory for tests
+type memoryStorage struct {
+	mutex sync.Mutex
+	keys  map[string]*pem.Block
+}
+
+// newMemoryStorage returns an empty memoryStorage
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{keys: make(map[string]*pem.Block)}
+}
+
+// Load returns the key with name
+func (ms *memoryStorage) Load(name string) (block *pem.Block, err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	block, ok := ms.keys[name]
+	if !ok {
+		return nil, &KeyError{FileName: ms.Location(name), Err: KeyMissing}
+	}
+	return block, nil
+}
+
+// Store saves block as name
+func (ms *memoryStorage) Store(name string, block *pem.Block) (err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.keys[name]; ok {
+		return &KeyError{FileName: ms.Location(name), Err: os.ErrExist}
+	}
+	ms.keys[name] = block
+	return nil
+}
+
+// Delete removes the key with name
+func (ms *memoryStorage) Delete(name string) (err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.keys[name]; !ok {
+		return &KeyError{FileName: ms.Location(name), Err: KeyMissing}
+	}
+	delete(ms.keys, name)
+	return nil
+}
+
+// Location returns "memory:" followed by name
+func (ms *memoryStorage) Location(name string) string {
+	return "memory:" + name
+}
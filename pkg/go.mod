@@ -1,5 +1,8 @@
 module github.com/jaeha-choi/Proj_Coconut_Utility
 
-go 1.16
+go 1.21
 
-require gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+require (
+	github.com/godbus/dbus/v5 v5.1.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+)
@@ -0,0 +1,268 @@
+package log
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handler sends records to the handler set by Init, filtering them by the logging mode of
+// their subsystem. The sink can be replaced while loggers using handler exist.
+type handler struct {
+	// subsystem is the value of SubsystemKey added by WithAttrs
+	subsystem string
+	// ops add attributes and groups of WithAttrs and WithGroup to the sink, in order
+	ops []func(h slog.Handler) slog.Handler
+	// grouped is true if WithGroup was called
+	grouped bool
+}
+
+// Enabled returns true if level is enabled for the subsystem of h
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	m, ok := subsystemModes[h.subsystem]
+	if !ok {
+		m = mode
+	}
+	return level >= m.Level()
+}
+
+// Handle adds attributes stored in ctx by NewContext to r, and sends r to the sink
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	mutex.RLock()
+	s := sink
+	mutex.RUnlock()
+	for _, op := range h.ops {
+		s = op(s)
+	}
+	if attrs := contextAttrs(ctx); len(attrs) != 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return s.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler that adds attrs to every record
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := h.with(func(s slog.Handler) slog.Handler { return s.WithAttrs(attrs) })
+	if !h.grouped {
+		for _, attr := range attrs {
+			if attr.Key == SubsystemKey {
+				clone.subsystem = attr.Value.String()
+			}
+		}
+	}
+	return clone
+}
+
+// WithGroup returns a handler that adds attributes to the group with name
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := h.with(func(s slog.Handler) slog.Handler { return s.WithGroup(name) })
+	clone.grouped = true
+	return clone
+}
+
+// with returns a copy of h with op added
+func (h *handler) with(op func(h slog.Handler) slog.Handler) *handler {
+	ops := make([]func(h slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{subsystem: h.subsystem, ops: append(ops, op), grouped: h.grouped}
+}
+
+// TextHandler writes records in the format of earlier versions ("LEVEL:\tmessage"),
+// followed by attributes as key=value pairs
+type TextHandler struct {
+	w io.Writer
+	// mutex serializes writes to w, and is shared by handlers returned by WithAttrs and WithGroup
+	mutex *sync.Mutex
+	// prefix is written at the beginning of every line
+	prefix string
+	// timestamp and source decide whether time and file name with line number are written
+	timestamp bool
+	source    bool
+	// attrs are formatted attributes added by WithAttrs
+	attrs string
+	// group is the prefix of attribute keys added by WithGroup
+	group string
+}
+
+// NewTextHandler returns TextHandler that writes records with time and source to w
+func NewTextHandler(w io.Writer) *TextHandler {
+	return &TextHandler{w: w, mutex: &sync.Mutex{}, prefix: "", timestamp: true, source: true}
+}
+
+// Enabled always returns true, as records are filtered by logging modes
+func (h *TextHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle writes r as a single line
+func (h *TextHandler) Handle(_ context.Context, r slog.Record) error {
+	buf := []byte(h.prefix)
+	if h.timestamp && !r.Time.IsZero() {
+		buf = r.Time.AppendFormat(buf, "2006/01/02 15:04:05 ")
+	}
+	if h.source && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		buf = append(buf, filepath.Base(frame.File)...)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, int64(frame.Line), 10)
+		buf = append(buf, ": "...)
+	}
+	buf = append(buf, levelName(r.Level)...)
+	buf = append(buf, ":\t"...)
+	buf = append(buf, r.Message...)
+	buf = append(buf, h.attrs...)
+	r.Attrs(func(attr slog.Attr) bool {
+		buf = appendAttr(buf, h.group, attr)
+		return true
+	})
+	buf = append(buf, '\n')
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+// WithAttrs returns a handler that writes attrs in every record
+func (h *TextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	buf := []byte(h.attrs)
+	for _, attr := range attrs {
+		buf = appendAttr(buf, h.group, attr)
+	}
+	clone.attrs = string(buf)
+	return &clone
+}
+
+// WithGroup returns a handler that qualifies keys of later attributes with name
+func (h *TextHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.group = h.group + name + "."
+	return &clone
+}
+
+// appendAttr appends attr as " key=value" to buf. Keys are qualified with group, and
+// members of groups are appended as separate attributes.
+func appendAttr(buf []byte, group string, attr slog.Attr) []byte {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return buf
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			group += attr.Key + "."
+		}
+		for _, member := range attr.Value.Group() {
+			buf = appendAttr(buf, group, member)
+		}
+		return buf
+	}
+	buf = append(buf, ' ')
+	buf = append(buf, group...)
+	buf = append(buf, attr.Key...)
+	buf = append(buf, '=')
+	value := attr.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=") || !strconv.CanBackquote(value) {
+		return strconv.AppendQuote(buf, value)
+	}
+	return append(buf, value...)
+}
+
+// NewJSONHandler returns a handler that writes records with source to w as JSON objects,
+// with level names of this package
+func NewJSONHandler(w io.Writer) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if level, ok := attr.Value.Any().(slog.Level); ok && attr.Key == slog.LevelKey && len(groups) == 0 {
+				return slog.String(slog.LevelKey, levelName(level))
+			}
+			return attr
+		},
+	})
+}
+
+// multiHandler sends records to every handler
+type multiHandler []slog.Handler
+
+// NewMultiHandler returns a handler that sends records to each of handlers, such as a handler
+// for stderr and a handler for a log file
+func NewMultiHandler(handlers ...slog.Handler) slog.Handler {
+	return multiHandler(handlers)
+}
+
+// Enabled returns true if level is enabled for any handler
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle sends r to every handler where the level of r is enabled, and returns the first error
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) (err error) {
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if e := h.Handle(ctx, r.Clone()); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WithAttrs returns a handler that adds attrs in every handler
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, 0, len(m))
+	for _, h := range m {
+		handlers = append(handlers, h.WithAttrs(attrs))
+	}
+	return handlers
+}
+
+// WithGroup returns a handler that adds attributes to the group with name in every handler
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, 0, len(m))
+	for _, h := range m {
+		handlers = append(handlers, h.WithGroup(name))
+	}
+	return handlers
+}
+
+// contextKey is the key of attributes stored in contexts
+type contextKey struct{}
+
+// NewContext returns a copy of ctx with args added to attributes of ctx. Args are key-value
+// pairs or slog.Attr as in slog.Logger.With. The attributes are added to records logged with
+// the returned context, such as by slog.Logger.InfoContext.
+func NewContext(ctx context.Context, args ...interface{}) context.Context {
+	attrs := append(contextAttrs(ctx), slog.Group("", args...).Value.Group()...)
+	return context.WithValue(ctx, contextKey{}, attrs[:len(attrs):len(attrs)])
+}
+
+// contextAttrs returns attributes stored in ctx by NewContext
+func contextAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	return attrs
+}
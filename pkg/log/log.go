@@ -1,14 +1,16 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"time"
 )
 
-var logger *log.Logger
-var mode LoggingMode
-
 type LoggingMode int
 
 const (
@@ -19,80 +21,156 @@ const (
 	FATAL
 )
 
-// Init initializes the logger
+// LevelFatal is the slog level of FATAL
+const LevelFatal = slog.Level(12)
+
+// SubsystemKey is the attribute key of subsystem names (see Subsystem)
+const SubsystemKey = "subsystem"
+
+var (
+	// mutex protects sink, mode and subsystemModes
+	mutex sync.RWMutex
+	// sink formats and writes every record
+	sink = NewRedactHandler(NewTextHandler(os.Stderr), Redaction{})
+	// mode is the logging mode of subsystems without their own mode
+	mode LoggingMode = WARNING
+	// subsystemModes maps subsystem names to their logging modes
+	subsystemModes = map[string]LoggingMode{}
+)
+
+// Level returns the slog level of mode
+func (mode LoggingMode) Level() slog.Level {
+	switch mode {
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case WARNING:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	default:
+		return LevelFatal
+	}
+}
+
+// levelName returns the name of level used in log output
+func levelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < slog.LevelWarn:
+		return "INFO"
+	case level < slog.LevelError:
+		return "WARNING"
+	case level < LevelFatal:
+		return "ERROR"
+	default:
+		return "FATAL"
+	}
+}
+
+// Init initializes the logger to write text to outTo, with Add Codes and key material masked.
+// Logging modes of subsystems are kept.
 func Init(outTo io.Writer, logMode LoggingMode) {
+	InitHandler(NewRedactHandler(NewTextHandler(outTo), Redaction{}), logMode)
+}
+
+// InitHandler initializes the logger to send records to h, such as a handler returned by
+// NewTextHandler or NewJSONHandler. Logging modes of subsystems are kept.
+func InitHandler(h slog.Handler, logMode LoggingMode) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	sink = h
 	mode = logMode
-	logger = log.New(outTo, "", log.LstdFlags|log.Lshortfile)
 }
 
 // initTesting is similar to Init but without timestamp to make the testing easier
 func initTesting(outTo io.Writer, logMode LoggingMode) {
-	mode = logMode
-	logger = log.New(outTo, "Test: ", 0)
+	InitHandler(&TextHandler{w: outTo, mutex: &sync.Mutex{}, prefix: "Test: "}, logMode)
+}
+
+// SetSubsystemModes replaces logging modes of subsystems. Subsystems not in modes use the
+// logging mode of Init.
+func SetSubsystemModes(modes map[string]LoggingMode) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	subsystemModes = make(map[string]LoggingMode, len(modes))
+	for name, m := range modes {
+		subsystemModes[name] = m
+	}
+}
+
+// Default returns a structured logger without subsystem
+func Default() *slog.Logger {
+	return slog.New(&handler{})
+}
+
+// Subsystem returns a structured logger for the subsystem with name. Records are filtered
+// by the logging mode of the subsystem (see SetSubsystemModes).
+func Subsystem(name string) *slog.Logger {
+	return Default().With(SubsystemKey, name)
+}
+
+// output logs msg at level for the caller of the function that called output
+func output(level slog.Level, msg string) {
+	h := &handler{}
+	ctx := context.Background()
+	if !h.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	// Skip runtime.Callers, output and the logging function
+	runtime.Callers(3, pcs[:])
+	_ = h.Handle(ctx, slog.NewRecord(time.Now(), level, msg, pcs[0]))
 }
 
 // Debug logs only if LoggingMode is set to DEBUG
 func Debug(msg ...interface{}) {
-	if mode <= DEBUG {
-		_ = logger.Output(2, "DEBUG:\t"+fmt.Sprint(msg...))
-	}
+	output(slog.LevelDebug, fmt.Sprint(msg...))
 }
 
 // Debugf logs if LoggingMode is set to DEBUG or lower
 func Debugf(format string, msg ...interface{}) {
-	if mode <= DEBUG {
-		_ = logger.Output(2, "DEBUG:\t"+fmt.Sprintf(format, msg...))
-	}
+	output(slog.LevelDebug, fmt.Sprintf(format, msg...))
 }
 
 // Info logs if LoggingMode is set to INFO or lower
 func Info(msg ...interface{}) {
-	if mode <= INFO {
-		_ = logger.Output(2, "INFO:\t"+fmt.Sprint(msg...))
-	}
+	output(slog.LevelInfo, fmt.Sprint(msg...))
 }
 
 // Infof logs if LoggingMode is set to INFO or lower
 func Infof(format string, msg ...interface{}) {
-	if mode <= INFO {
-		_ = logger.Output(2, "INFO:\t"+fmt.Sprintf(format, msg...))
-	}
+	output(slog.LevelInfo, fmt.Sprintf(format, msg...))
 }
 
 // Warning logs if LoggingMode is set to WARNING or lower
 func Warning(msg ...interface{}) {
-	if mode <= WARNING {
-		_ = logger.Output(2, "WARNING:\t"+fmt.Sprint(msg...))
-	}
+	output(slog.LevelWarn, fmt.Sprint(msg...))
 }
 
 // Warningf logs if LoggingMode is set to WARNING or lower
 func Warningf(format string, msg ...interface{}) {
-	if mode <= WARNING {
-		_ = logger.Output(2, "WARNING:\t"+fmt.Sprintf(format, msg...))
-	}
+	output(slog.LevelWarn, fmt.Sprintf(format, msg...))
 }
 
 // Error logs if LoggingMode is set to ERROR or lower
 func Error(msg ...interface{}) {
-	if mode <= ERROR {
-		_ = logger.Output(2, "ERROR:\t"+fmt.Sprint(msg...))
-	}
+	output(slog.LevelError, fmt.Sprint(msg...))
 }
 
 // Errorf logs if LoggingMode is set to ERROR or lower
 func Errorf(format string, msg ...interface{}) {
-	if mode <= ERROR {
-		_ = logger.Output(2, "Error:\t"+fmt.Sprintf(format, msg...))
-	}
+	output(slog.LevelError, fmt.Sprintf(format, msg...))
 }
 
 // Fatal always logs when used
 func Fatal(msg ...interface{}) {
-	_ = logger.Output(2, "FATAL:\t"+fmt.Sprint(msg...))
+	output(LevelFatal, fmt.Sprint(msg...))
 }
 
 // Fatalf always logs when used
 func Fatalf(format string, msg ...interface{}) {
-	_ = logger.Output(2, "FATAL:\t"+fmt.Sprintf(format, msg...))
+	output(LevelFatal, fmt.Sprintf(format, msg...))
 }
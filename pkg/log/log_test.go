@@ -2,7 +2,10 @@ package log
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -87,3 +90,75 @@ func TestError(t *testing.T) {
 		t.Error("Output mismatch")
 	}
 }
+
+func TestErrorf(t *testing.T) {
+	var buffer bytes.Buffer
+	initTesting(&buffer, ERROR)
+	Errorf("test %s", "error")
+	if "Test: ERROR:\ttest error\n" != buffer.String() {
+		t.Error("Output mismatch: ", buffer.String())
+	}
+}
+
+func TestSubsystem(t *testing.T) {
+	var buffer bytes.Buffer
+	initTesting(&buffer, WARNING)
+	SetSubsystemModes(map[string]LoggingMode{"client": DEBUG})
+	defer SetSubsystemModes(nil)
+
+	Subsystem("daemon").Info("test info")
+	if "" != buffer.String() {
+		t.Error("Output mismatch: ", buffer.String())
+	}
+	Subsystem("client").With("peer", "ab cd").Debug("test debug", "size", 10)
+	if "Test: DEBUG:\ttest debug subsystem=client peer=\"ab cd\" size=10\n" != buffer.String() {
+		t.Error("Output mismatch: ", buffer.String())
+	}
+	buffer.Reset()
+	// Logging mode of subsystems is kept by Init
+	initTesting(&buffer, ERROR)
+	Subsystem("client").WithGroup("transfer").Debug("test debug", "id", 1)
+	if "Test: DEBUG:\ttest debug subsystem=client transfer.id=1\n" != buffer.String() {
+		t.Error("Output mismatch: ", buffer.String())
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	var buffer bytes.Buffer
+	initTesting(&buffer, INFO)
+	ctx := NewContext(context.Background(), "transfer", 1)
+	first := NewContext(ctx, "peer", "a")
+	second := NewContext(ctx, "peer", "b")
+	Default().InfoContext(first, "test info")
+	Default().InfoContext(second, "test info")
+	if "Test: INFO:\ttest info transfer=1 peer=a\nTest: INFO:\ttest info transfer=1 peer=b\n" != buffer.String() {
+		t.Error("Output mismatch: ", buffer.String())
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buffer bytes.Buffer
+	InitHandler(NewJSONHandler(&buffer), DEBUG)
+	defer initTesting(os.Stdout, DEBUG)
+	Warning("test warning")
+	Subsystem("client").Debug("test debug", "peer", "a")
+
+	var records []map[string]interface{}
+	decoder := json.NewDecoder(&buffer)
+	for decoder.More() {
+		var record map[string]interface{}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0]["level"] != "WARNING" || records[0]["msg"] != "test warning" ||
+		records[0]["source"] == nil || records[1]["level"] != "DEBUG" || records[1]["peer"] != "a" ||
+		records[1][SubsystemKey] != "client" {
+		t.Error("Unexpected records: ", records)
+	}
+	source, _ := records[0]["source"].(map[string]interface{})
+	if file, _ := source["file"].(string); !strings.HasSuffix(file, "log_test.go") {
+		t.Error("Source should be the caller of Warning, got: ", source)
+	}
+}
@@ -0,0 +1,156 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Masks that replace redacted information
+const (
+	AddCodeMask = "[add code]"
+	KeyMask     = "[key]"
+	AddressMask = "[address]"
+	FileMask    = "[file]"
+)
+
+// Redaction selects information masked in addition to Add Codes and key material, which are
+// always masked by redacting handlers
+type Redaction struct {
+	// FileNames masks file paths, and values of attributes such as "file"
+	FileNames bool
+	// Addresses masks IPv4 and IPv6 addresses
+	Addresses bool
+}
+
+var (
+	// addCodePattern matches Add Codes mentioned in text, such as "Add Code: 123456"
+	addCodePattern = regexp.MustCompile(`(?i)(add[ _-]?codes?\b[^0-9\n]{0,16})[0-9]{6}\b`)
+	// pemPattern matches PEM encoded keys
+	pemPattern = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----[\s\S]*?(-----END [A-Z0-9 ]+-----|$)`)
+	// base64Pattern matches long base64 strings. Hex fingerprints are shorter.
+	base64Pattern = regexp.MustCompile(`[A-Za-z0-9+/]{80,}={0,2}`)
+	// bytesPattern matches byte slices of 32 or more bytes formatted with fmt
+	bytesPattern = regexp.MustCompile(`\[(?:[0-9]{1,3} ){31,}[0-9]{1,3}\]`)
+	// addressPattern matches candidates of IP addresses, which are checked with net.ParseIP
+	addressPattern = regexp.MustCompile(`[0-9]{1,3}(?:\.[0-9]{1,3}){3}|[0-9A-Fa-f]*(?::[0-9A-Fa-f]*){2,7}(?:[0-9]{1,3}(?:\.[0-9]{1,3}){3})?`)
+	// pathPattern matches absolute paths after the beginning of text, spaces, quotes or '='.
+	// Punctuation at the end, such as ':' in "open /a/b: no such file", is not a part of paths.
+	pathPattern = regexp.MustCompile(`(^|[\s"'=(])((?:/|~/|[A-Za-z]:\\)[^\s"')]*[^\s"'):,;.])`)
+)
+
+// fileKeys are attribute keys of file names
+var fileKeys = map[string]bool{"file": true, "file_name": true, "filename": true, "path": true}
+
+// addCodeKeys are attribute keys of Add Codes
+var addCodeKeys = map[string]bool{"add_code": true, "addcode": true}
+
+// Redact returns text with Add Codes, key material and information selected by redaction masked
+func (redaction Redaction) Redact(text string) string {
+	text = pemPattern.ReplaceAllString(text, KeyMask)
+	text = bytesPattern.ReplaceAllString(text, KeyMask)
+	text = base64Pattern.ReplaceAllString(text, KeyMask)
+	text = addCodePattern.ReplaceAllString(text, "${1}"+AddCodeMask)
+	if redaction.FileNames {
+		text = pathPattern.ReplaceAllString(text, "${1}"+FileMask)
+	}
+	if redaction.Addresses {
+		text = redactAddresses(text)
+	}
+	return text
+}
+
+// redactAddresses returns text with IP addresses masked. Candidates that are a part of a word,
+// such as "::Connect", are not addresses.
+func redactAddresses(text string) string {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range addressPattern.FindAllStringIndex(text, -1) {
+		candidate := text[loc[0]:loc[1]]
+		// "::" is a valid address, but more likely punctuation
+		if isWordChar(text, loc[0]-1) || isWordChar(text, loc[1]) || strings.Trim(candidate, ":") == "" ||
+			net.ParseIP(candidate) == nil {
+			continue
+		}
+		builder.WriteString(text[last:loc[0]])
+		builder.WriteString(AddressMask)
+		last = loc[1]
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+// isWordChar returns true if the byte of text at i is a letter, a digit or '_'
+func isWordChar(text string, i int) bool {
+	if i < 0 || i >= len(text) {
+		return false
+	}
+	c := text[i]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// redactHandler masks information in records before sending them to next
+type redactHandler struct {
+	next      slog.Handler
+	redaction Redaction
+}
+
+// NewRedactHandler returns a handler that masks Add Codes, key material and information
+// selected by redaction in messages and attributes, then sends records to h
+func NewRedactHandler(h slog.Handler, redaction Redaction) slog.Handler {
+	return &redactHandler{next: h, redaction: redaction}
+}
+
+// Enabled returns true if level is enabled for next
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle sends a redacted copy of r to next
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, h.redaction.Redact(r.Message), r.PC)
+	r.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+// WithAttrs returns a handler that adds redacted attrs to every record
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, h.redactAttr(attr))
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), redaction: h.redaction}
+}
+
+// WithGroup returns a handler that adds attributes to the group with name
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), redaction: h.redaction}
+}
+
+// redactAttr returns attr with its value redacted. Values other than numbers, booleans,
+// durations and times are converted to strings.
+func (h *redactHandler) redactAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	key := strings.ToLower(attr.Key)
+	switch {
+	case attr.Value.Kind() == slog.KindGroup:
+		members := attr.Value.Group()
+		redacted := make([]slog.Attr, 0, len(members))
+		for _, member := range members {
+			redacted = append(redacted, h.redactAttr(member))
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+	case addCodeKeys[key]:
+		return slog.String(attr.Key, AddCodeMask)
+	case h.redaction.FileNames && fileKeys[key]:
+		return slog.String(attr.Key, FileMask)
+	case attr.Value.Kind() == slog.KindString || attr.Value.Kind() == slog.KindAny:
+		return slog.String(attr.Key, h.redaction.Redact(attr.Value.String()))
+	}
+	return attr
+}
@@ -0,0 +1,150 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file that is rotated when it would grow larger than its maximum size.
+// Rotated files are renamed to "<name>.1", "<name>.2" and so on, newest first. Rotated files
+// older than the maximum age and files beyond the maximum number of backups are removed.
+// The file in use is only rotated by size, so it may contain records older than the maximum age.
+type RotatingFile struct {
+	// mutex serializes writes and rotation
+	mutex      sync.Mutex
+	fileName   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	// file is nil if it was closed by Close, or could not be reopened after rotation
+	file *os.File
+	// size is the size of file
+	size int64
+	// closed is true after Close is called
+	closed bool
+}
+
+// OpenRotatingFile opens fileName for appending, creating it and its directory if needed.
+// maxSize is the maximum size of the file in bytes. Rotated files are kept for maxAge, or
+// forever if maxAge is 0, and at most maxBackups of them are kept.
+func OpenRotatingFile(fileName string, maxSize int64, maxAge time.Duration, maxBackups int) (
+	rf *RotatingFile, err error) {
+	rf = &RotatingFile{fileName: fileName, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return nil, err
+	}
+	if err = rf.open(); err != nil {
+		return nil, err
+	}
+	rf.removeBackups()
+	return rf, nil
+}
+
+// open opens fileName for appending
+func (rf *RotatingFile) open() (err error) {
+	file, err := os.OpenFile(rf.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if it would grow larger than the maximum size.
+// Lines larger than the maximum size are written to an empty file.
+func (rf *RotatingFile) Write(p []byte) (n int, err error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	// File that could not be reopened after rotation is opened again
+	if rf.file == nil {
+		if err = rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		// If rotation fails, records are written to the current file, and rotation is tried again
+		// on the next write
+		if err = rf.rotate(); err != nil && rf.file == nil {
+			return 0, err
+		}
+	}
+	n, err = rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// backupName returns the name of the nth rotated file
+func (rf *RotatingFile) backupName(n int) string {
+	return rf.fileName + "." + strconv.Itoa(n)
+}
+
+// rotate renames the file to the first backup, shifting other backups, and opens a new file.
+// If the file cannot be renamed, the current file is reopened. rf.file is nil only if no file
+// could be opened.
+func (rf *RotatingFile) rotate() (err error) {
+	if err = rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+	renameErr := rf.renameFiles()
+	if err = rf.open(); err != nil {
+		return err
+	}
+	rf.removeBackups()
+	return renameErr
+}
+
+// renameFiles renames the file to the first backup and shifts other backups, or removes the
+// file if no backup is kept
+func (rf *RotatingFile) renameFiles() (err error) {
+	if rf.maxBackups <= 0 {
+		return os.Remove(rf.fileName)
+	}
+	for n := rf.maxBackups - 1; n > 0; n-- {
+		if err = os.Rename(rf.backupName(n), rf.backupName(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(rf.fileName, rf.backupName(1))
+}
+
+// removeBackups removes rotated files older than the maximum age. As rotated files are only
+// renamed, their modification time is the time of the last record.
+func (rf *RotatingFile) removeBackups() {
+	if rf.maxAge <= 0 {
+		return
+	}
+	for n := 1; n <= rf.maxBackups; n++ {
+		if info, err := os.Stat(rf.backupName(n)); err == nil && time.Since(info.ModTime()) > rf.maxAge {
+			_ = os.Remove(rf.backupName(n))
+		}
+	}
+}
+
+// Close closes the file
+func (rf *RotatingFile) Close() (err error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.closed {
+		return os.ErrClosed
+	}
+	rf.closed = true
+	if rf.file == nil {
+		return nil
+	}
+	err = rf.file.Close()
+	rf.file = nil
+	return err
+}
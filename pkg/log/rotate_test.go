@@ -0,0 +1,90 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "logs", "coconut.log")
+	rf, err := OpenRotatingFile(fileName, 10, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n", "larger than limit\n"} {
+		if _, err = rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Oldest file is removed
+	for name, expected := range map[string]string{fileName: "larger than limit\n", fileName + ".1": "fourth\n",
+		fileName + ".2": "third\n"} {
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != expected {
+			t.Errorf("Unexpected content of %s: %q %v", name, data, err)
+		}
+	}
+	if _, err = os.Stat(fileName + ".3"); !os.IsNotExist(err) {
+		t.Error("Only two rotated files should be kept")
+	}
+	if info, _ := os.Stat(fileName); info.Mode().Perm() != 0600 {
+		t.Error("Log file should only be readable by the owner, got: ", info.Mode())
+	}
+
+	// Old rotated files are removed, and the file is appended
+	old := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(fileName+".2", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = OpenRotatingFile(fileName, 100, time.Hour, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if _, err = os.Stat(fileName + ".2"); !os.IsNotExist(err) {
+		t.Error("Rotated file older than max age should be removed")
+	}
+	if _, err = rf.Write([]byte("appended\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != "larger than limit\nappended\n" {
+		t.Errorf("Unexpected content: %q", data)
+	}
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "coconut.log")
+	// Backup cannot be created where a directory exists
+	if err := os.MkdirAll(filepath.Join(fileName+".1", "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := OpenRotatingFile(fileName, 10, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rf.Close() }()
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err = rf.Write([]byte(line)); err != nil {
+			t.Fatal("Write failed after failed rotation: ", err)
+		}
+	}
+	if data, err := ioutil.ReadFile(fileName); err != nil || string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("Unexpected content: %q %v", data, err)
+	}
+
+	// Rotation is tried again when the backup can be created
+	if err = os.RemoveAll(fileName + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rf.Write([]byte("fourth\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(fileName); err != nil || string(data) != "fourth\n" {
+		t.Errorf("Unexpected content after rotation: %q %v", data, err)
+	}
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"bytes"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// fuzzConn is a connection that reads from a fixed input and discards writes
+type fuzzConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (c *fuzzConn) Close() error { return nil }
+
+func FuzzReadMessageToWriter(f *testing.F) {
+	var buffer bytes.Buffer
+	_, _ = WriteMessage(&buffer, []byte("data"), nil, common.File)
+	f.Add(buffer.Bytes(), false)
+	f.Add(buffer.Bytes(), true)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, common.File.Code}, false)
+	f.Add([]byte{0, 0, 0, 8, 0, common.Init.Code, 1}, true)
+	f.Fuzz(func(t *testing.T, data []byte, writeHeader bool) {
+		var written bytes.Buffer
+		n, err := ReadMessageToWriter(bytes.NewReader(data), &written, writeHeader)
+		if err != nil {
+			return
+		}
+		if writeHeader {
+			if n != written.Len()-HeaderSize {
+				t.Fatal("Written size does not match: ", n, written.Len())
+			}
+			if !bytes.HasPrefix(data, written.Bytes()) {
+				t.Fatal("Written data does not match input")
+			}
+			return
+		}
+		if msg, err := ReadMessage(bytes.NewReader(data)); err != nil || n != len(msg.Data) ||
+			!bytes.Equal(msg.Data, written.Bytes()) {
+			t.Fatal("Written data does not match message: ", err)
+		}
+	})
+}
+
+func FuzzMuxSession(f *testing.F) {
+	data := append(muxHeaderHelper(ControlStreamID, muxData, 4), "ping"...)
+	data = append(data, muxHeaderHelper(1, muxOpen, 0)...)
+	data = append(data, muxHeaderHelper(1, muxData, 2)...)
+	data = append(data, "hi"...)
+	data = append(data, muxHeaderHelper(1, muxClose, 0)...)
+	f.Add(data)
+	f.Add(muxHeaderHelper(ControlStreamID, muxWindowUpdate, 1))
+	f.Add(muxHeaderHelper(ControlStreamID, muxData, MuxMaxFrameSize+1))
+	f.Add(append(muxHeaderHelper(1, muxOpen, 0), muxHeaderHelper(1, muxReset, 0)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		session := NewMuxSession(&fuzzConn{bytes.NewReader(data), ioutil.Discard}, false)
+		// Session is closed once the input is consumed or a protocol error is found
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				break
+			}
+			if stream.ID()%2 != 1 {
+				t.Fatal("Accepted stream with invalid ID: ", stream.ID())
+			}
+		}
+		received, err := ioutil.ReadAll(session.Control())
+		if err != nil && err != MuxClosedError && err != MuxProtocolError {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if len(received) > MuxWindowSize {
+			t.Fatal("Received data exceeds the window")
+		}
+	})
+}
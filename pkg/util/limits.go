@@ -0,0 +1,77 @@
+package util
+
+import (
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DefaultMaxMessageSize is the maximum data size of messages for commands without
+	// a specific limit
+	DefaultMaxMessageSize = 64 * 1024
+	// FileMaxMessageSize is the maximum data size of common.File messages. Encrypted chunks
+	// are the largest messages, which are cryptography.ChunkSize bytes and GCM tag.
+	FileMaxMessageSize = 16*1024*1024 + 1024
+)
+
+// MessageTooLarge is wrapped by *MessageSizeError
+var MessageTooLarge = errors.New("message too large")
+
+// MessageSizeError is returned when the size of a message exceeds the maximum size for its command.
+// After this error, the reader is positioned at the data of the rejected message, so the
+// connection should be closed.
+type MessageSizeError struct {
+	// CommandCode is the command of the message
+	CommandCode uint8
+	// Size is the data size of the message
+	Size uint32
+	// MaxSize is the maximum data size for the command
+	MaxSize uint32
+}
+
+func (e *MessageSizeError) Error() string {
+	return "message too large: command " + strconv.Itoa(int(e.CommandCode)) + ", size " +
+		strconv.FormatUint(uint64(e.Size), 10) + " exceeds " + strconv.FormatUint(uint64(e.MaxSize), 10)
+}
+
+func (e *MessageSizeError) Unwrap() error { return MessageTooLarge }
+
+// maxSizes stores the maximum data size for each command code
+var maxSizes = struct {
+	sync.RWMutex
+	sizes [256]uint32
+}{}
+
+func init() {
+	for i := range maxSizes.sizes {
+		maxSizes.sizes[i] = DefaultMaxMessageSize
+	}
+	maxSizes.sizes[common.File.Code] = FileMaxMessageSize
+}
+
+// MaxMessageSize returns the maximum data size of messages with commandCode
+func MaxMessageSize(commandCode uint8) uint32 {
+	maxSizes.RLock()
+	defer maxSizes.RUnlock()
+	return maxSizes.sizes[commandCode]
+}
+
+// SetMaxMessageSize sets the maximum data size of messages with command, and returns the
+// previous value. Applies to both ReadMessage and WriteMessage.
+func SetMaxMessageSize(command *common.Command, size uint32) (previous uint32) {
+	maxSizes.Lock()
+	defer maxSizes.Unlock()
+	previous = maxSizes.sizes[command.Code]
+	maxSizes.sizes[command.Code] = size
+	return previous
+}
+
+// checkMessageSize returns *MessageSizeError if size exceeds the maximum size for commandCode
+func checkMessageSize(commandCode uint8, size uint32) (err error) {
+	if maxSize := MaxMessageSize(commandCode); size > maxSize {
+		return &MessageSizeError{CommandCode: commandCode, Size: size, MaxSize: maxSize}
+	}
+	return nil
+}
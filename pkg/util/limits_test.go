@@ -0,0 +1,160 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadMessageTooLarge(t *testing.T) {
+	// 4 GiB message must be rejected before any data is read
+	reader := bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0, common.Init.Code})
+	msg, err := ReadMessage(reader)
+	var sizeErr *MessageSizeError
+	if !errors.As(err, &sizeErr) || !errors.Is(err, MessageTooLarge) || msg != nil {
+		t.Error("Expected MessageSizeError, got: ", msg, err)
+		return
+	}
+	if sizeErr.CommandCode != common.Init.Code || sizeErr.Size != Uint32Max || sizeErr.MaxSize != DefaultMaxMessageSize {
+		t.Error("Unexpected error fields: ", sizeErr)
+	}
+
+	if _, err = ReadMessageToWriter(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0, common.File.Code}),
+		ioutil.Discard, false); !errors.Is(err, MessageTooLarge) {
+		t.Error("Expected MessageTooLarge, got: ", err)
+	}
+}
+
+func TestReadMessageLargeShortReader(t *testing.T) {
+	// Size is within the limit, but the reader ends early
+	reader := bytes.NewReader(append([]byte{0, 0x10, 0, 0, 0, common.File.Code}, "short"...))
+	if _, err := ReadMessage(reader); err != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF, got: ", err)
+	}
+}
+
+func TestReadMessageLarge(t *testing.T) {
+	var buffer bytes.Buffer
+	data := bytes.Repeat([]byte("large"), BufferSize)
+	if _, err := WriteMessage(&buffer, data, nil, common.File); err != nil {
+		t.Error(err)
+		return
+	}
+	if msg, err := ReadMessage(&buffer); err != nil || !bytes.Equal(msg.Data, data) {
+		t.Error("Result mismatch: ", err)
+	}
+}
+
+func TestSetMaxMessageSize(t *testing.T) {
+	previous := SetMaxMessageSize(common.Init, 8)
+	defer SetMaxMessageSize(common.Init, previous)
+	if previous != DefaultMaxMessageSize || MaxMessageSize(common.Init.Code) != 8 {
+		t.Error("Unexpected max size: ", previous, MaxMessageSize(common.Init.Code))
+	}
+
+	var buffer bytes.Buffer
+	if _, err := WriteMessage(&buffer, make([]byte, 9), nil, common.Init); !errors.Is(err, MessageTooLarge) {
+		t.Error("Expected MessageTooLarge, got: ", err)
+	}
+	if buffer.Len() != 0 {
+		t.Error("Rejected message was written")
+	}
+	if _, err := WriteMessage(&buffer, make([]byte, 8), nil, common.Init); err != nil {
+		t.Error(err)
+	}
+
+	// Other commands are not affected
+	if _, err := WriteMessage(&buffer, make([]byte, 9), nil, common.Quit); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadMessageStream(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := WriteMessage(&buffer, []byte("streamed data"), common.ReceiverNotFound, common.File); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := WriteMessage(&buffer, []byte("next"), nil, common.Quit); err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg, data, size, err := ReadMessageStream(&buffer, 100)
+	if err != nil || size != 13 || msg.Data != nil || msg.ErrorCode != common.ReceiverNotFound.ErrCode ||
+		msg.CommandCode != common.File.Code {
+		t.Error("Unexpected message: ", msg, size, err)
+		return
+	}
+	if b, err := ioutil.ReadAll(data); err != nil || string(b) != "streamed data" {
+		t.Error("Unexpected data: ", string(b), err)
+	}
+	// Next message is not consumed by the data reader
+	if msg, err = ReadMessage(&buffer); err != nil || string(msg.Data) != "next" {
+		t.Error("Unexpected next message: ", msg, err)
+	}
+
+	if _, err = WriteMessage(&buffer, []byte("too long"), nil, common.File); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, _, _, err = ReadMessageStream(&buffer, 7); !errors.Is(err, MessageTooLarge) {
+		t.Error("Expected MessageTooLarge, got: ", err)
+	}
+
+	_, data, _, err = ReadMessageStream(bytes.NewReader([]byte{0, 0, 0, 8, 0, common.File.Code, 'a'}), 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = ioutil.ReadAll(data); err != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF, got: ", err)
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	var buffer bytes.Buffer
+	_, _ = WriteMessage(&buffer, []byte("data"), nil, common.File)
+	f.Add(buffer.Bytes())
+	f.Add([]byte{0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, common.Init.Code})
+	f.Add([]byte{0, 0x10, 0, 0, 3, common.File.Code, 1, 2, 3})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if uint32(len(msg.Data)) > MaxMessageSize(msg.CommandCode) {
+			t.Fatal("Message exceeds the maximum size")
+		}
+		// Message must be encoded exactly as it was read
+		var encoded bytes.Buffer
+		if _, err = WriteMessage(&encoded, msg.Data, common.ErrorCodes[msg.ErrorCode],
+			&common.Command{Code: msg.CommandCode}); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ErrorCode != 0 && common.ErrorCodes[msg.ErrorCode] == nil {
+			return
+		}
+		if !bytes.HasPrefix(data, encoded.Bytes()) {
+			t.Fatal("Encoded message does not match input")
+		}
+	})
+}
+
+func FuzzReadMessageData(f *testing.F) {
+	var buffer bytes.Buffer
+	_, _ = WriteMessage(&buffer, []byte("data"), nil, common.File)
+	f.Add(buffer.Bytes())
+	f.Add([]byte{0, 0, 0, 1, 200, common.File.Code, 0})
+	f.Add([]byte{0, 0, 0, 0, 0, common.Init.Code})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := ReadMessageData(bytes.NewReader(data), common.File)
+		if err == nil && uint32(len(b)) > FileMaxMessageSize {
+			t.Fatal("Message exceeds the maximum size")
+		}
+	})
+}
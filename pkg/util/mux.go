@@ -0,0 +1,504 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// muxHeaderSize is the size of the frame header:
+	// 4 bytes of stream ID, 1 byte of frame type and 4 bytes of length
+	muxHeaderSize = 9
+	// MuxMaxFrameSize is the maximum size of data in a single frame. Writes larger than
+	// this value are split, so that streams take turns on the connection.
+	MuxMaxFrameSize = 16 * 1024
+	// MuxWindowSize is the number of bytes a stream can receive before the reader consumes them
+	MuxWindowSize = 256 * 1024
+	// muxAcceptBacklog is the number of opened streams waiting for Accept.
+	// Streams opened when the backlog is full are reset.
+	muxAcceptBacklog = 16
+	// MuxMaxStreams is the maximum number of open streams in a session, except the control stream.
+	// Open returns MuxTooManyStreamsError at the limit, and streams opened by the peer are reset.
+	MuxMaxStreams = 256
+	// ControlStreamID is the ID of the control stream, which is open for the lifetime of the session
+	ControlStreamID uint32 = 0
+)
+
+// Frame types
+const (
+	// muxOpen opens a new stream
+	muxOpen uint8 = iota
+	// muxData carries stream data. Length is the size of data following the header.
+	muxData
+	// muxWindowUpdate allows the peer to send length more bytes
+	muxWindowUpdate
+	// muxClose indicates the sender will not write to the stream anymore
+	muxClose
+	// muxReset aborts the stream in both directions
+	muxReset
+)
+
+// MuxClosedError is returned when the session or its connection is closed
+var MuxClosedError = errors.New("mux session closed")
+
+// MuxStreamClosedError is returned when writing to a stream closed by Close
+var MuxStreamClosedError = errors.New("mux stream closed")
+
+// MuxStreamResetError is returned when the stream was reset by the peer
+var MuxStreamResetError = errors.New("mux stream reset by peer")
+
+// MuxProtocolError is returned when the peer violated the framing or flow control
+var MuxProtocolError = errors.New("mux protocol error")
+
+// MuxTooManyStreamsError is returned by Open when MuxMaxStreams streams are open
+var MuxTooManyStreamsError = errors.New("too many mux streams")
+
+// MuxStreamIDsExhaustedError is returned by Open when every stream ID of this side was used.
+// A new session is required to open more streams.
+var MuxStreamIDsExhaustedError = errors.New("mux stream IDs exhausted")
+
+// MuxSession multiplexes streams over a single connection. Each stream has its own flow control
+// window, so a slow reader on one stream does not block other streams. Stream 0 is the control
+// stream and is always open on both sides.
+//
+// Frame format:
+//
+//	4 bytes: stream ID (uint32)
+//	1 byte:  frame type
+//	4 bytes: length (uint32), size of data for muxData or window increment for muxWindowUpdate
+//	rest:    data, only for muxData
+type MuxSession struct {
+	// conn is the underlying connection
+	conn io.ReadWriteCloser
+	// writeMutex serializes frames written to conn
+	writeMutex sync.Mutex
+	// mutex protects streams, nextID and err
+	mutex   sync.Mutex
+	streams map[uint32]*MuxStream
+	// nextID is the ID of the next stream opened by this side. Initiator uses odd IDs,
+	// responder uses even IDs. IDs are never reused, so nextID is larger than uint32 once
+	// every ID was used.
+	nextID uint64
+	// control is the control stream, which is available even after the session is closed
+	control *MuxStream
+	// acceptChan stores streams opened by the peer until Accept is called
+	acceptChan chan *MuxStream
+	// closed is closed when the session is closed
+	closed chan struct{}
+	// err is the reason the session was closed
+	err error
+}
+
+// MuxStream is a single stream in MuxSession. MuxStream is safe for one concurrent reader and
+// one concurrent writer.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+	// mutex protects every field below. cond is signaled when any of them changes.
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// recvBuf stores received data until it is read
+	recvBuf bytes.Buffer
+	// recvWindow is the number of bytes the peer is allowed to send
+	recvWindow uint32
+	// consumed is the number of bytes read since the last window update
+	consumed uint32
+	// sendWindow is the number of bytes this side is allowed to send
+	sendWindow uint32
+	// localClosed is true if Close was called
+	localClosed bool
+	// remoteClosed is true if the peer closed the stream
+	remoteClosed bool
+	// err is set if the stream was reset or the session was closed
+	err error
+}
+
+// NewMuxSession starts a session over conn. initiator must be true on exactly one side of the
+// connection, usually the side that dialed.
+func NewMuxSession(conn io.ReadWriteCloser, initiator bool) *MuxSession {
+	session := &MuxSession{
+		conn:       conn,
+		streams:    make(map[uint32]*MuxStream),
+		nextID:     2,
+		acceptChan: make(chan *MuxStream, muxAcceptBacklog),
+		closed:     make(chan struct{}),
+		err:        nil,
+	}
+	if initiator {
+		session.nextID = 1
+	}
+	session.control = session.newStream(ControlStreamID)
+	session.streams[ControlStreamID] = session.control
+	go session.readLoop()
+	return session
+}
+
+// newStream creates stream with id. Does not register the stream.
+func (session *MuxSession) newStream(id uint32) *MuxStream {
+	stream := &MuxStream{
+		id:         id,
+		session:    session,
+		recvWindow: MuxWindowSize,
+		sendWindow: MuxWindowSize,
+	}
+	stream.cond = sync.NewCond(&stream.mutex)
+	return stream
+}
+
+// Control returns the control stream
+func (session *MuxSession) Control() *MuxStream {
+	return session.control
+}
+
+// Open opens a new stream. The peer receives the stream from Accept.
+// Returns MuxTooManyStreamsError if MuxMaxStreams streams are open, and
+// MuxStreamIDsExhaustedError if no stream ID is left.
+func (session *MuxSession) Open() (stream *MuxStream, err error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return nil, session.err
+	}
+	if session.streamCount() >= MuxMaxStreams {
+		session.mutex.Unlock()
+		return nil, MuxTooManyStreamsError
+	}
+	if session.nextID > math.MaxUint32 {
+		session.mutex.Unlock()
+		return nil, MuxStreamIDsExhaustedError
+	}
+	stream = session.newStream(uint32(session.nextID))
+	session.streams[stream.id] = stream
+	session.nextID += 2
+	session.mutex.Unlock()
+
+	if err = session.writeFrame(stream.id, muxOpen, 0, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// streamCount returns the number of open streams, except the control stream.
+// Must be called with mutex locked.
+func (session *MuxSession) streamCount() int {
+	if _, ok := session.streams[ControlStreamID]; ok {
+		return len(session.streams) - 1
+	}
+	return len(session.streams)
+}
+
+// Accept waits for a stream opened by the peer.
+// Returns MuxClosedError if the session is closed.
+func (session *MuxSession) Accept() (stream *MuxStream, err error) {
+	select {
+	case stream = <-session.acceptChan:
+		return stream, nil
+	case <-session.closed:
+		return nil, session.err
+	}
+}
+
+// Close closes the session and the underlying connection. Pending and future operations on
+// every stream return MuxClosedError.
+func (session *MuxSession) Close() (err error) {
+	err = session.conn.Close()
+	session.closeWithError(MuxClosedError)
+	return err
+}
+
+// closeWithError closes the session once, and wakes every stream with err
+func (session *MuxSession) closeWithError(err error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return
+	}
+	session.err = err
+	streams := session.streams
+	session.streams = make(map[uint32]*MuxStream)
+	close(session.closed)
+	session.mutex.Unlock()
+
+	_ = session.conn.Close()
+	for _, stream := range streams {
+		stream.setError(err)
+	}
+}
+
+// writeFrame writes a frame to the connection
+func (session *MuxSession) writeFrame(id uint32, frameType uint8, length uint32, data []byte) (err error) {
+	header := make([]byte, muxHeaderSize, muxHeaderSize+len(data))
+	binary.BigEndian.PutUint32(header[0:4], id)
+	header[4] = frameType
+	binary.BigEndian.PutUint32(header[5:9], length)
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+	if _, err = session.conn.Write(append(header, data...)); err != nil {
+		log.Debug(err)
+		session.closeWithError(MuxClosedError)
+		return MuxClosedError
+	}
+	return nil
+}
+
+// readLoop reads frames from the connection and dispatches them to streams until the
+// connection is closed.
+func (session *MuxSession) readLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(session.conn, header); err != nil {
+			session.closeWithError(MuxClosedError)
+			return
+		}
+		id := binary.BigEndian.Uint32(header[0:4])
+		frameType := header[4]
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		var data []byte
+		if frameType == muxData {
+			if length > MuxMaxFrameSize {
+				log.Error("Mux frame size ", length, " exceeds ", MuxMaxFrameSize)
+				session.closeWithError(MuxProtocolError)
+				return
+			}
+			var err error
+			if data, err = readNBytes(session.conn, length); err != nil {
+				session.closeWithError(MuxClosedError)
+				return
+			}
+		}
+		if err := session.handleFrame(id, frameType, length, data); err != nil {
+			session.closeWithError(err)
+			return
+		}
+	}
+}
+
+// handleFrame applies a single frame to its stream.
+// Returns MuxProtocolError if the frame is not valid.
+func (session *MuxSession) handleFrame(id uint32, frameType uint8, length uint32, data []byte) (err error) {
+	session.mutex.Lock()
+	stream, ok := session.streams[id]
+	if frameType == muxOpen {
+		// Peer must use IDs of the other parity
+		if ok || id == ControlStreamID || uint64(id)%2 == session.nextID%2 {
+			session.mutex.Unlock()
+			log.Error("Peer opened invalid stream ", id)
+			return MuxProtocolError
+		}
+		if session.streamCount() >= MuxMaxStreams {
+			session.mutex.Unlock()
+			log.Warning("Too many streams; resetting stream ", id)
+			go func() { _ = session.writeFrame(id, muxReset, 0, nil) }()
+			return nil
+		}
+		stream = session.newStream(id)
+		session.streams[id] = stream
+	}
+	session.mutex.Unlock()
+
+	if !ok && frameType != muxOpen {
+		// Frames for streams that were already removed are ignored
+		return nil
+	}
+
+	switch frameType {
+	case muxOpen:
+		select {
+		case session.acceptChan <- stream:
+		default:
+			log.Warning("Too many streams waiting for Accept; resetting stream ", id)
+			session.removeStream(id)
+			go func() { _ = session.writeFrame(id, muxReset, 0, nil) }()
+		}
+	case muxData:
+		return stream.receive(data)
+	case muxWindowUpdate:
+		stream.mutex.Lock()
+		if uint64(stream.sendWindow)+uint64(length) > MuxWindowSize {
+			stream.mutex.Unlock()
+			log.Error("Peer sent invalid window update for stream ", id)
+			return MuxProtocolError
+		}
+		stream.sendWindow += length
+		stream.cond.Broadcast()
+		stream.mutex.Unlock()
+	case muxClose:
+		stream.mutex.Lock()
+		stream.remoteClosed = true
+		remove := stream.localClosed
+		stream.cond.Broadcast()
+		stream.mutex.Unlock()
+		if remove {
+			session.removeStream(id)
+		}
+	case muxReset:
+		if id == ControlStreamID {
+			log.Error("Peer reset the control stream")
+			return MuxProtocolError
+		}
+		session.removeStream(id)
+		stream.setError(MuxStreamResetError)
+	default:
+		log.Error("Unknown mux frame type ", frameType)
+		return MuxProtocolError
+	}
+	return nil
+}
+
+// removeStream unregisters the stream with id
+func (session *MuxSession) removeStream(id uint32) {
+	if id == ControlStreamID {
+		return
+	}
+	session.mutex.Lock()
+	delete(session.streams, id)
+	session.mutex.Unlock()
+}
+
+// ID returns the stream ID
+func (stream *MuxStream) ID() uint32 {
+	return stream.id
+}
+
+// receive appends data to the receive buffer.
+// Returns MuxProtocolError if the peer sent more than the window allows.
+func (stream *MuxStream) receive(data []byte) (err error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if uint32(len(data)) > stream.recvWindow {
+		log.Error("Peer exceeded the window of stream ", stream.id)
+		return MuxProtocolError
+	}
+	if stream.remoteClosed {
+		log.Error("Peer sent data after closing stream ", stream.id)
+		return MuxProtocolError
+	}
+	stream.recvWindow -= uint32(len(data))
+	stream.recvBuf.Write(data)
+	stream.cond.Broadcast()
+	return nil
+}
+
+// setError wakes pending operations with err, unless the stream already has an error
+func (stream *MuxStream) setError(err error) {
+	stream.mutex.Lock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+}
+
+// Read reads data received on the stream. Returns io.EOF after the peer closed the stream and
+// every received byte was read.
+func (stream *MuxStream) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	stream.mutex.Lock()
+	for stream.recvBuf.Len() == 0 && !stream.remoteClosed && stream.err == nil {
+		stream.cond.Wait()
+	}
+	if stream.recvBuf.Len() == 0 {
+		err = stream.err
+		if err == nil {
+			err = io.EOF
+		}
+		stream.mutex.Unlock()
+		return 0, err
+	}
+	n, _ = stream.recvBuf.Read(b)
+
+	// Return consumed bytes to the peer in batches to reduce the number of window updates
+	stream.consumed += uint32(n)
+	var increment uint32
+	if stream.consumed >= MuxWindowSize/2 && !stream.remoteClosed {
+		increment = stream.consumed
+		stream.recvWindow += increment
+		stream.consumed = 0
+	}
+	stream.mutex.Unlock()
+
+	if increment > 0 {
+		if err = stream.session.writeFrame(stream.id, muxWindowUpdate, increment, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write writes b to the stream. Blocks while the peer's window is full. Large writes are split
+// into frames of at most MuxMaxFrameSize bytes.
+// Returns MuxStreamClosedError if the stream was closed by Close.
+func (stream *MuxStream) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		stream.mutex.Lock()
+		for stream.sendWindow == 0 && stream.err == nil && !stream.localClosed {
+			stream.cond.Wait()
+		}
+		if stream.err != nil {
+			err = stream.err
+			stream.mutex.Unlock()
+			return n, err
+		}
+		if stream.localClosed {
+			stream.mutex.Unlock()
+			return n, MuxStreamClosedError
+		}
+		size := uint32(len(b) - n)
+		if size > stream.sendWindow {
+			size = stream.sendWindow
+		}
+		if size > MuxMaxFrameSize {
+			size = MuxMaxFrameSize
+		}
+		stream.sendWindow -= size
+		stream.mutex.Unlock()
+
+		if err = stream.session.writeFrame(stream.id, muxData, size, b[n:n+int(size)]); err != nil {
+			return n, err
+		}
+		n += int(size)
+	}
+	return n, nil
+}
+
+// Close closes the stream for writing. The peer reads io.EOF after reading every byte
+// written before Close. The control stream cannot be closed; close the session instead.
+func (stream *MuxStream) Close() (err error) {
+	if stream.id == ControlStreamID {
+		return nil
+	}
+	stream.mutex.Lock()
+	if stream.localClosed || stream.err != nil {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	remove := stream.remoteClosed
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	if remove {
+		stream.session.removeStream(stream.id)
+	}
+	return stream.session.writeFrame(stream.id, muxClose, 0, nil)
+}
+
+// Reset aborts the stream in both directions. Pending and future operations on both sides
+// return an error.
+func (stream *MuxStream) Reset() (err error) {
+	if stream.id == ControlStreamID {
+		return nil
+	}
+	stream.session.removeStream(stream.id)
+	stream.setError(MuxStreamClosedError)
+	return stream.session.writeFrame(stream.id, muxReset, 0, nil)
+}
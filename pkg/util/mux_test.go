@@ -0,0 +1,324 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/jaeha-choi/Proj_Coconut_Utility/common"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// muxPairHelper returns two sessions connected with net.Pipe
+func muxPairHelper(t *testing.T) (initiator *MuxSession, responder *MuxSession) {
+	conn1, conn2 := net.Pipe()
+	initiator = NewMuxSession(conn1, true)
+	responder = NewMuxSession(conn2, false)
+	t.Cleanup(func() {
+		_ = initiator.Close()
+		_ = responder.Close()
+	})
+	return initiator, responder
+}
+
+func TestMuxStreams(t *testing.T) {
+	initiator, responder := muxPairHelper(t)
+	const streamCount = 3
+	payloads := make([][]byte, streamCount)
+	for i := range payloads {
+		// Larger than the window, so flow control is exercised
+		payloads[i] = make([]byte, MuxWindowSize*2+i)
+		if _, err := rand.Read(payloads[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, streamCount*2+1)
+	for i := 0; i < streamCount; i++ {
+		wg.Add(1)
+		go func(payload []byte) {
+			defer wg.Done()
+			stream, err := initiator.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err = stream.Write(payload); err != nil {
+				errs <- err
+				return
+			}
+			errs <- stream.Close()
+		}(payloads[i])
+	}
+
+	// Control messages are exchanged while the streams are busy
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if _, err := WriteMessage(initiator.Control(), []byte("ping"), nil, common.HolePunchPING); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		msg, err := ReadMessage(responder.Control())
+		if err != nil || string(msg.Data) != "ping" || msg.CommandCode != common.HolePunchPING.Code {
+			t.Fatal("Unexpected control message: ", msg, err)
+		}
+	}
+
+	received := make(map[int]bool)
+	for i := 0; i < streamCount; i++ {
+		stream, err := responder.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.ID()%2 != 1 {
+			t.Error("Expected odd stream ID from initiator, got: ", stream.ID())
+		}
+		data, err := ioutil.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := len(data) - MuxWindowSize*2
+		if size < 0 || size >= streamCount || received[size] || !bytes.Equal(data, payloads[size]) {
+			t.Error("Received data does not match any payload")
+			continue
+		}
+		received[size] = true
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	initiator, responder := muxPairHelper(t)
+	slow, err := initiator.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := initiator.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the slow stream, so the writer blocks once the window is full
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := slow.Write(make([]byte, MuxWindowSize+1))
+		slowDone <- err
+	}()
+
+	slowAccepted, err := responder.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastAccepted, err := responder.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = fast.Write([]byte("not blocked")) }()
+	buffer := make([]byte, 11)
+	if _, err = io.ReadFull(fastAccepted, buffer); err != nil || string(buffer) != "not blocked" {
+		t.Fatal("Fast stream was blocked: ", err)
+	}
+
+	select {
+	case err = <-slowDone:
+		t.Fatal("Write should block until the window is updated: ", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = io.ReadFull(slowAccepted, make([]byte, MuxWindowSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-slowDone; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	initiator, responder := muxPairHelper(t)
+	stream, err := responder.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID()%2 != 0 || stream.ID() == ControlStreamID {
+		t.Error("Expected even stream ID from responder, got: ", stream.ID())
+	}
+	if _, err = stream.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write([]byte("more")); err != MuxStreamClosedError {
+		t.Error("Expected MuxStreamClosedError, got: ", err)
+	}
+
+	accepted, err := initiator.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(accepted); err != nil || string(data) != "bye" {
+		t.Error("Unexpected data: ", string(data), err)
+	}
+	// Half closed stream can still be written by the other side
+	go func() {
+		_, _ = accepted.Write([]byte("reply"))
+		_ = accepted.Close()
+	}()
+	if data, err := ioutil.ReadAll(stream); err != nil || string(data) != "reply" {
+		t.Error("Unexpected reply: ", string(data), err)
+	}
+
+	if err = initiator.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = initiator.Accept(); err != MuxClosedError {
+		t.Error("Expected MuxClosedError, got: ", err)
+	}
+	if _, err = responder.Control().Read(make([]byte, 1)); err != MuxClosedError {
+		t.Error("Expected MuxClosedError from the peer, got: ", err)
+	}
+	if _, err = responder.Open(); err != MuxClosedError {
+		t.Error("Expected MuxClosedError, got: ", err)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	initiator, responder := muxPairHelper(t)
+	stream, err := initiator.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := responder.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = accepted.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accepted.Read(make([]byte, 1)); err != MuxStreamClosedError {
+		t.Error("Expected MuxStreamClosedError, got: ", err)
+	}
+	if _, err = stream.Read(make([]byte, 1)); err != MuxStreamResetError {
+		t.Error("Expected MuxStreamResetError, got: ", err)
+	}
+}
+
+func TestMuxProtocolError(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"frame too large", muxHeaderHelper(ControlStreamID, muxData, MuxMaxFrameSize+1)},
+		{"window exceeded", muxHeaderHelper(ControlStreamID, muxWindowUpdate, 1)},
+		{"open with own parity", muxHeaderHelper(2, muxOpen, 0)},
+		{"open control stream", muxHeaderHelper(ControlStreamID, muxOpen, 0)},
+		{"reset control stream", muxHeaderHelper(ControlStreamID, muxReset, 0)},
+		{"unknown frame type", muxHeaderHelper(ControlStreamID, 100, 0)},
+	}
+	for _, test := range tests {
+		conn1, conn2 := net.Pipe()
+		session := NewMuxSession(conn1, false)
+		go func() { _, _ = conn2.Write(test.header) }()
+		if _, err := session.Accept(); err != MuxProtocolError {
+			t.Errorf("%s: expected MuxProtocolError, got %v", test.name, err)
+		}
+		_ = conn2.Close()
+	}
+}
+
+func TestMuxStreamLimit(t *testing.T) {
+	initiator, responder := muxPairHelper(t)
+	go func() {
+		for {
+			if _, err := responder.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < MuxMaxStreams; i++ {
+		if _, err := initiator.Open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := initiator.Open(); err != MuxTooManyStreamsError {
+		t.Error("Expected MuxTooManyStreamsError, got: ", err)
+	}
+
+	// Streams opened by the peer beyond the limit are reset
+	conn1, conn2 := net.Pipe()
+	session := NewMuxSession(conn1, false)
+	t.Cleanup(func() {
+		_ = session.Close()
+		_ = conn2.Close()
+	})
+	go func() {
+		for {
+			if _, err := session.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	const lastID = 2*MuxMaxStreams + 1
+	go func() {
+		for id := uint32(1); id <= lastID; id += 2 {
+			if _, err := conn2.Write(muxHeaderHelper(id, muxOpen, 0)); err != nil {
+				return
+			}
+		}
+	}()
+	_ = conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(conn2, header); err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint32(header[0:4]); id != lastID || header[4] != muxReset {
+		t.Error("Expected reset of stream ", lastID, ", got frame ", header[4], " of stream ", id)
+	}
+}
+
+func TestMuxStreamIDsExhausted(t *testing.T) {
+	initiator, responder := muxPairHelper(t)
+	initiator.mutex.Lock()
+	initiator.nextID = math.MaxUint32
+	initiator.mutex.Unlock()
+
+	stream, err := initiator.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted, err := responder.Accept(); err != nil || accepted.ID() != math.MaxUint32 {
+		t.Error("Unexpected stream: ", err)
+	}
+	if _, err = initiator.Open(); err != MuxStreamIDsExhaustedError {
+		t.Error("Expected MuxStreamIDsExhaustedError, got: ", err)
+	}
+	// Existing streams are not affected
+	if _, err = stream.Write([]byte("data")); err != nil {
+		t.Error(err)
+	}
+}
+
+// muxHeaderHelper returns a frame header
+func muxHeaderHelper(id uint32, frameType uint8, length uint32) []byte {
+	header := make([]byte, muxHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], id)
+	header[4] = frameType
+	binary.BigEndian.PutUint32(header[5:9], length)
+	return header
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -8,10 +9,8 @@ import (
 	"github.com/jaeha-choi/Proj_Coconut_Utility/log"
 	"gopkg.in/yaml.v3"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
-	"path/filepath"
 	"sync"
 )
 
@@ -28,7 +27,8 @@ type Message struct {
 	CommandCode uint8
 }
 
-var EmptyFileName = errors.New("empty filename")
+// UnexpectedCommandError is returned when the command of the message read does not match the expected command
+var UnexpectedCommandError = errors.New("unexpected command")
 
 var bufPool = sync.Pool{
 	New: func() interface{} {
@@ -38,46 +38,91 @@ var bufPool = sync.Pool{
 }
 
 // ReadMessage reads message from reader.
+// Returns *MessageSizeError if the data size exceeds MaxMessageSize of the command. Data is
+// read incrementally, so memory is only allocated as the data arrives.
 func ReadMessage(reader io.Reader) (msg *Message, err error) {
-	// Read packet size
-	size, err := readSize(reader)
+	msg, size, err := readHeader(reader)
 	if err != nil {
 		return nil, err
 	}
-
-	// Read Error Code
-	header, err := readNBytes(reader, 2)
-	if err != nil {
+	if err = checkMessageSize(msg.CommandCode, size); err != nil {
+		log.Debug(err)
 		return nil, err
 	}
 
-	// Create new Message
-	msg = &Message{
-		Data:        nil,
-		ErrorCode:   header[0],
-		CommandCode: header[1],
-	}
-
 	// Read data
 	msg.Data, err = readNBytes(reader, size)
 	return msg, err
 }
 
+// ReadMessageStream reads message header from reader and returns a reader for its data, which
+// must be fully read before reading the next message. Use this for payloads that should not be
+// buffered in memory. msg.Data is always nil.
+// Returns *MessageSizeError if the data size exceeds maxSize.
+func ReadMessageStream(reader io.Reader, maxSize uint32) (msg *Message, data io.Reader, size uint32, err error) {
+	msg, size, err = readHeader(reader)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if size > maxSize {
+		err = &MessageSizeError{CommandCode: msg.CommandCode, Size: size, MaxSize: maxSize}
+		log.Debug(err)
+		return nil, nil, 0, err
+	}
+	return msg, &exactReader{reader: reader, remaining: size}, size, nil
+}
+
+// readHeader reads message header from reader. Returns message without data and its data size.
+func readHeader(reader io.Reader) (msg *Message, size uint32, err error) {
+	header, err := readNBytes(reader, HeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Message{
+		Data:        nil,
+		ErrorCode:   header[4],
+		CommandCode: header[5],
+	}, binary.BigEndian.Uint32(header[:4]), nil
+}
+
+// exactReader reads remaining bytes from reader. Unlike io.LimitedReader, it returns
+// io.ErrUnexpectedEOF if reader ends early.
+type exactReader struct {
+	reader    io.Reader
+	remaining uint32
+}
+
+func (r *exactReader) Read(b []byte) (n int, err error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint32(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err = r.reader.Read(b)
+	r.remaining -= uint32(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
 // WriteMessage write msg to writer. commandToWrite should not be nil
 // Returns int indicating the number of bytes written, and error, if any.
+// Returns *MessageSizeError if b exceeds MaxMessageSize of the command, since the peer would reject it.
 // err == nil only if length of sent bytes = length of msg
 func WriteMessage(writer io.Writer, b []byte, errorToWrite *common.Error, commandToWrite *common.Command) (n int, err error) {
-	//// Return error if b is too big
-	//if len(b) > BufferSize {
-	//	log.Error("Byte should contain less than ", BufferSize)
-	//	return 0, SizeError
-	//}
-
 	// Check b len
 	size, err := IntToUint32(len(b))
 	if err != nil {
 		return 0, err
 	}
+	if err = checkMessageSize(commandToWrite.Code, size); err != nil {
+		log.Debug(err)
+		return 0, err
+	}
 
 	// Get error errCode
 	var errCode uint8 = 0
@@ -101,14 +146,25 @@ func WriteMessage(writer io.Writer, b []byte, errorToWrite *common.Error, comman
 	return writtenSize, err
 }
 
-// readSize reads first 4 bytes from the reader and convert them into a uint32 value
-func readSize(reader io.Reader) (uint32, error) {
-	// Read first 4 bytes for the size
-	b, err := readNBytes(reader, 4)
+// ReadMessageData reads message from reader and returns its data.
+// Returns UnexpectedCommandError if the command of the message is not command, or the error
+// in common.ErrorCodes if the message contains an error code.
+func ReadMessageData(reader io.Reader, command *common.Command) (b []byte, err error) {
+	msg, err := ReadMessage(reader)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if msg.CommandCode != command.Code {
+		log.Error("Expected command ", command.String, ", received command code ", msg.CommandCode)
+		return nil, UnexpectedCommandError
+	}
+	if msg.ErrorCode != 0 {
+		if errCode := common.ErrorCodes[msg.ErrorCode]; errCode != nil {
+			return msg.Data, errCode
+		}
+		return msg.Data, common.UnknownCodeError
 	}
-	return binary.BigEndian.Uint32(b), nil
+	return msg.Data, nil
 }
 
 // Uint32ToByte converts uint32 value to byte slices
@@ -137,52 +193,23 @@ func ByteToUint16(b []byte) uint16 {
 	return binary.BigEndian.Uint16(b)
 }
 
-// writeSize converts packet size to byte and write to writer
-// Take a look at encoding/gob package or protocol buffers for a better performance.
-func writeSize(writer io.Writer, size uint32) (err error) {
-	// consider using array over slice for a better performance i.e: arr := [4]byte{}
-	if _, err = writer.Write(Uint32ToByte(size)); err != nil {
-		return err
-	}
-	return nil
-}
-
-func writeErrorCode(writer io.Writer, errorToWrite *common.Error) (err error) {
-	var code uint8 = 0
-	if errorToWrite != nil {
-		code = errorToWrite.ErrCode
-	}
-	// Write 1 byte of error code
-	if _, err = writer.Write([]byte{code}); err != nil {
-		return err
-	}
-	return nil
-}
-
-// readNString reads up to nth character. Maximum length should not exceed BufferSize.
-func readNString(reader io.Reader, n uint32) (string, error) {
-	if n > BufferSize {
-		log.Error("n should be smaller than ", BufferSize)
-		return "", errors.New("parameter value error")
-	}
-	buffer, err := readNBytes(reader, n)
-	return string(buffer), err
-}
-
-// readNBytes reads up to nth byte
+// readNBytes reads up to nth byte. Buffers larger than BufferSize grow as data is read,
+// so a large n does not allocate memory before the data arrives.
 func readNBytes(reader io.Reader, n uint32) ([]byte, error) {
 	if n == 0 {
 		return nil, nil
 	}
-	buffer := make([]byte, n)
-	_, err := io.ReadFull(reader, buffer)
-	return buffer, err
-}
-
-// readNBytes reads up to nth byte
-func readNBytesPointer(reader io.Reader, buffer *[]byte) error {
-	_, err := io.ReadFull(reader, *buffer)
-	return err
+	if n <= BufferSize {
+		buffer := make([]byte, n)
+		_, err := io.ReadFull(reader, buffer)
+		return buffer, err
+	}
+	var buffer bytes.Buffer
+	read, err := buffer.ReadFrom(io.LimitReader(reader, int64(n)))
+	if err == nil && read != int64(n) {
+		err = io.ErrUnexpectedEOF
+	}
+	return buffer.Bytes(), err
 }
 
 // Int64ToUint32 converts int64 value to uint32.
@@ -243,34 +270,32 @@ func BytesToBase64(data []byte) []byte {
 	return encoded
 }
 
-// ReadBytesToWriter reads message from reader and write it to writer.
-// First four bytes of reader should be uint32 size of the message,
-// represented in big endian.
+// ReadMessageToWriter reads message from reader and write its data to writer without
+// buffering the whole message in memory. If writeHeader is true, the message header is written
+// before the data, so that writer receives the message as it was read.
 // Common usage for this function is to read from net.Conn, and write to temp file.
-func ReadBytesToWriter(reader io.Reader, writer io.Writer, writeWithSize bool) (n int, err error) {
-	// Read message size
-	size, err := readSize(reader)
+// Returns the number of data bytes written, and error, if any.
+// Returns *MessageSizeError if the data size exceeds MaxMessageSize of the command.
+func ReadMessageToWriter(reader io.Reader, writer io.Writer, writeHeader bool) (n int, err error) {
+	// Read header
+	header, err := readNBytes(reader, HeaderSize)
 	if err != nil {
 		return 0, err
 	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if err = checkMessageSize(header[5], size); err != nil {
+		log.Debug(err)
+		return 0, err
+	}
 
-	if writeWithSize {
-		err := writeSize(writer, size)
-		if err != nil {
+	if writeHeader {
+		if _, err = writer.Write(header); err != nil {
 			log.Debug(err)
 			return 0, err
 		}
 	}
 
-	if err = writeErrorCode(writer, nil); err != nil {
-		return 0, err
-	}
-
-	totalReceived, err := readWrite(reader, writer, size+2)
-	if err != nil {
-		return totalReceived, err
-	}
-	return totalReceived, err
+	return readWrite(reader, writer, size)
 }
 
 // readWrite is a helper function to read exactly size bytes from reader and write it to writer.
@@ -281,6 +306,7 @@ func readWrite(reader io.Reader, writer io.Writer, size uint32) (int, error) {
 	intSize := int(size)
 	readSize := BufferSize
 	buffer := bufPool.Get().([]byte)
+	defer bufPool.Put(buffer)
 	for totalReceived < intSize {
 		if totalReceived+BufferSize > intSize {
 			readSize = intSize - totalReceived
@@ -295,312 +321,5 @@ func readWrite(reader io.Reader, writer io.Writer, size uint32) (int, error) {
 			return totalReceived, err
 		}
 	}
-	bufPool.Put(buffer)
 	return totalReceived, nil
 }
-
-// Deprecated: readNBinary reads up to nth bytes and save it as fileN in DownloadPath.
-// Maximum buffer size does not exceed BufferSize.
-// Returns error == nil only if file is fully downloaded, renamed and moved to DownloadPath.
-//goland:noinspection GoDeprecation
-func readNBinary(reader io.Reader, n uint32, fileN string) error {
-	var isDownloadComplete = false
-
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(DownloadPath, os.ModePerm); err != nil {
-		log.Debug(err)
-		log.Error("Error while creating download directory")
-		return err
-	}
-
-	// Create temporary file for downloading
-	tmpFile, err := ioutil.TempFile(DownloadPath, ".tmp_download_")
-	if err != nil {
-		log.Debug(err)
-		log.Error("Temp file could not be opened")
-		return err
-	}
-
-	// If error encountered while writing a file, close then delete tmp file.
-	defer func(name string) {
-		if !isDownloadComplete {
-			if err := tmpFile.Close(); err != nil {
-				log.Debug(err)
-				log.Error("Error while closing the file.")
-			}
-			// Delete file if not renamed
-			if err := os.Remove(name); err != nil {
-				log.Debug(err)
-				log.Error("Error while removing temp file. Temp file at: ", name)
-			}
-		}
-	}(tmpFile.Name())
-
-	if writtenSize, err := readWrite(reader, tmpFile, n); writtenSize != int(n) || err != nil {
-		log.Debug(err)
-		log.Error("Error while reading from reader and writing to temp file")
-		return err
-	}
-	isDownloadComplete = true
-
-	// Close I/O operation for temporary file
-	if err := tmpFile.Close(); err != nil {
-		log.Debug(err)
-		log.Error("Error while closing temp file.")
-		return err
-	}
-
-	// Move temporary file to download directory (DownloadPath)
-	if err := os.Rename(tmpFile.Name(), filepath.Join(DownloadPath, fileN)); err != nil {
-		log.Debug(err)
-		log.Error("Error moving the temp file to download path")
-		if err := os.Remove(tmpFile.Name()); err != nil {
-			log.Debug(err)
-			log.Error("Error while removing temp file. Temp file at: ", tmpFile.Name())
-		}
-		return err
-	}
-	return nil
-}
-
-// Deprecated: readErrorCode
-//goland:noinspection GoDeprecation
-func readErrorCode(reader io.Reader) (readError *common.Error, err error) {
-	// Read 1 byte for the error code
-	b, err := readNBytes(reader, 1)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while reading packet size")
-		return nil, err
-	}
-	if b[0] != 0 {
-		readError = common.ErrorCodes[b[0]]
-		if readError == nil {
-			return common.UnknownCodeError, nil
-		}
-		return readError, nil
-	}
-	return nil, nil
-}
-
-// Deprecated: ReadString reads string from reader
-//goland:noinspection GoDeprecation
-func ReadString(reader io.Reader) (str string, err error) {
-	bytes, err := ReadBytes(reader)
-	return string(bytes), err
-}
-
-// Deprecated: ReadBytes reads bytes from reader
-//goland:noinspection GoDeprecation
-func ReadBytes(reader io.Reader) (b []byte, err error) {
-	b, errCode, err := ReadBytesErr(reader)
-	if err != nil {
-		return b, err
-	}
-	// Next four lines CANNOT be replaced with "return b, errCode"
-	// This is because errCode nil and nil are different types.
-	if errCode != nil {
-		return b, errCode
-	}
-	return b, nil
-}
-
-// Deprecated: ReadBytesErr reads b from reader.
-//goland:noinspection GoDeprecation
-func ReadBytesErr(reader io.Reader) (b []byte, errorCode *common.Error, err error) {
-	// Read packet size
-	size, err := readSize(reader)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while reading packet size")
-		return nil, nil, err
-	}
-
-	//// ReadBytes always expect the size to be <= BufferSize
-	//if size > BufferSize {
-	//	log.Error("Size cannot be greater than ", BufferSize, ". Received size: ", size)
-	//	return nil, SizeError
-	//}
-
-	// Read Error Code
-	readError, err := readErrorCode(reader)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while reading error code")
-		return nil, nil, err
-	}
-
-	// Read bytes from reader
-	if b, err = readNBytes(reader, size); err != nil {
-		log.Debug(err)
-		log.Error("Error raised by readNBytes")
-		return nil, readError, err
-	}
-	return b, readError, nil
-}
-
-// Deprecated: ReadBinary reads file name and file content from a connection and save it.
-//goland:noinspection GoDeprecation
-func ReadBinary(reader io.Reader) (errorCode *common.Error, err error) {
-	// Read file name
-	fileN, err := ReadString(reader)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while reading file name")
-		return nil, err
-	}
-	if fileN == "" {
-		log.Error("File name cannot be empty")
-		return nil, EmptyFileName
-	}
-
-	// Read file size
-	size, err := readSize(reader)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while reading file size")
-		return nil, err
-	}
-
-	errCode, err := readErrorCode(reader)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while getting status code")
-		return errCode, err
-	}
-
-	// Read file and save
-	if err := readNBinary(reader, size, fileN); err != nil {
-		log.Debug(err)
-		log.Error("Error while reading/saving binary file")
-		return errCode, err
-	}
-	return errCode, nil
-}
-
-// Deprecated: WriteString writes msg to writer
-// length of msg cannot exceed BufferSize
-// Returns total bytes sent and error, if any.
-// err == nil only if length of sent bytes = length of msg
-//goland:noinspection GoDeprecation
-func WriteString(writer io.Writer, msg string) (int, error) {
-	return WriteBytes(writer, []byte(msg))
-}
-
-// Deprecated: WriteBytes
-//goland:noinspection GoDeprecation
-func WriteBytes(writer io.Writer, b []byte) (int, error) {
-	return WriteBytesErr(writer, b, nil)
-}
-
-// Deprecated: WriteBytesErr write b to writer.
-// Returns int indicating the number of bytes written, and error, if any.
-//goland:noinspection GoDeprecation
-func WriteBytesErr(writer io.Writer, b []byte, errorToWrite *common.Error) (n int, err error) {
-	//// Return error if b is too big
-	//if len(b) > BufferSize {
-	//	log.Error("Byte should contain less than ", BufferSize)
-	//	return 0, SizeError
-	//}
-
-	// Check b len
-	size, err := IntToUint32(len(b))
-	if err != nil {
-		log.Debug(err)
-		return 0, err
-	}
-
-	// Get error code
-	var code uint8 = 0
-	if errorToWrite != nil {
-		code = errorToWrite.ErrCode
-	}
-
-	// Write size (first 4 bytes) and error code (last 1 byte)
-	if _, err = writer.Write(append(Uint32ToByte(size), code)); err != nil {
-		log.Debug(err)
-		log.Error("Error while writing packet size")
-		return 0, err
-	}
-
-	// Write b to writer
-	writtenSize, err := writer.Write(b)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while writing bytes")
-		return writtenSize, err
-	}
-	return writtenSize, err
-}
-
-// Deprecated: WriteBinary opens file and writes byte data to writer.
-// Returns total length of bytes sent, and error. err == nil only if
-// total bytes sent = file size.
-// writer is likely to be net.Conn. File size cannot exceed max value of uint32
-// as of now. We can split files or change the data type to uint64 if time allows.
-//goland:noinspection GoDeprecation
-func WriteBinary(writer io.Writer, filePath string) (int, error) {
-	// Open source file to send
-	srcFile, err := os.Open(filePath)
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while opening source file")
-		return 0, err
-	}
-	// Close src file when done
-	defer func() {
-		if err := srcFile.Close(); err != nil {
-			log.Debug(err)
-			log.Error("Error while closing file")
-		}
-	}()
-
-	// Get stat of the file
-	srcFileStat, err := srcFile.Stat()
-	if err != nil {
-		log.Debug(err)
-		log.Error("Error while fetching stats for source file")
-		return 0, err
-	}
-
-	// If file is too big to send, return error.
-	srcFileSize, err := Int64ToUint32(srcFileStat.Size())
-	if err != nil {
-		log.Debug(err)
-		log.Error("File exceeds size limit")
-		return 0, err
-	}
-
-	// Only preserve file name instead of passing directory + file name
-	_, fileN := filepath.Split(filePath)
-
-	// Send file name
-	if _, err := WriteString(writer, fileN); err != nil {
-		log.Debug(err)
-		log.Error("Error while sending file name")
-		return 0, err
-	}
-
-	// Write size of the file size to writer
-	if err := writeSize(writer, srcFileSize); err != nil {
-		log.Debug(err)
-		log.Error("Error while writing string size")
-		return 0, err
-	}
-
-	// Write ErrorCode
-	if err := writeErrorCode(writer, nil); err != nil {
-		log.Debug(err)
-		log.Error("Error while writing error code")
-		return 0, err
-	}
-
-	// Write file to writer
-	writtenSize, err := readWrite(srcFile, writer, srcFileSize)
-	if err != nil || writtenSize != int(srcFileSize) {
-		log.Debug(err)
-		log.Error("Error while writing binary file")
-		return writtenSize, err
-	}
-	return writtenSize, nil
-}